@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const ANNOTATION_DEPLOY = "deploy"
+const ANNOTATION_UPDATE = "update"
+const ANNOTATION_DELETE = "delete"
+
+type AnnotatorInterface interface {
+	Annotate(query DownsamplingObject, action string) error
+}
+
+func NewAnnotator(config *Config, metrics *Metrics) AnnotatorInterface {
+	if config.Grafana == nil || config.Grafana.Url == "" {
+		log.Println("No shared Grafana configured, lifecycle annotations are disabled.")
+		return &NoopAnnotator{}
+	}
+
+	client := NewGrafanaClient(config.Grafana.User, config.Grafana.Password)
+	if config.Grafana.ApiKey != "" {
+		client = NewGrafanaApiKeyClient(config.Grafana.ApiKey)
+	}
+	// no up check here, an annotation is not worth holding up a job for
+	grafana := &Grafana{grafanaBaseURL: config.Grafana.Url, grafanaClient: client}
+	return &GrafanaAnnotator{grafana, config.Environment, metrics}
+}
+
+type NoopAnnotator struct {
+}
+
+func (a *NoopAnnotator) Annotate(query DownsamplingObject, action string) error {
+	return nil
+}
+
+// GrafanaAnnotator adds organization wide annotations, dashboards show them through an annotation query on the tags.
+type GrafanaAnnotator struct {
+	grafana     GrafanaInterface
+	environment string
+	metrics     *Metrics
+}
+
+func (a *GrafanaAnnotator) Annotate(query DownsamplingObject, action string) error {
+	text := fmt.Sprintf("Downsampling %s %s: %s.%s to %s.%s (%s)", action, query.QueryId, query.Rp, query.Measurement, query.TargetRp, query.TargetMeasurement, a.environment)
+	tags := []string{"downsampling", "db:" + query.Db, "measurement:" + query.Measurement, "queryId:" + query.QueryId, "action:" + action}
+	err := a.grafana.CreateAnnotation(text, tags)
+	if err != nil {
+		a.metrics.IncrementAnnotationErrors()
+	}
+	return err
+}
+
+// annotateLifecycle never fails the calling job, a lost annotation is only logged and counted.
+func annotateLifecycle(annotator AnnotatorInterface, query DownsamplingObject, action string) {
+	log.Printf("Annotating %s of query %s...", action, query.QueryId)
+	if err := annotator.Annotate(query, action); err != nil {
+		log.Printf("Could not annotate: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"testing"
+)
+
+type FakeAnnotator struct {
+	actions []string
+	err     error
+}
+
+func (a *FakeAnnotator) Annotate(query DownsamplingObject, action string) error {
+	a.actions = append(a.actions, action+" "+query.QueryId)
+	return a.err
+}
+
+func Test_GrafanaAnnotator_Annotate(t *testing.T) {
+	grafana := &FakeGrafana{}
+	sut := &GrafanaAnnotator{grafana, "test", &Metrics{AnnotationErrors: metrics.NewCounter()}}
+
+	err := sut.Annotate(getQueryForValidation(), ANNOTATION_DEPLOY)
+	if err != nil || fmt.Sprint(grafana.calls) != "[annotation [downsampling db:sca measurement:request_count queryId:query1 action:deploy]]" {
+		t.Error(fmt.Sprintf("Annotation was expected with db, measurement, queryId and action tags, found %v (%v)", grafana.calls, err))
+	}
+	if sut.metrics.AnnotationErrors.Count() != 0 {
+		t.Error(fmt.Sprintf("No annotation error was expected to be counted, found %d", sut.metrics.AnnotationErrors.Count()))
+	}
+}
+
+func Test_GrafanaAnnotator_Annotate_Error(t *testing.T) {
+	sut := &GrafanaAnnotator{&FakeGrafana{err: errors.New("unauthorized")}, "test", &Metrics{AnnotationErrors: metrics.NewCounter()}}
+
+	annotateLifecycle(sut, getQueryForValidation(), ANNOTATION_DELETE)
+	if sut.metrics.AnnotationErrors.Count() != 1 {
+		t.Error(fmt.Sprintf("The annotation error was expected to be counted, found %d", sut.metrics.AnnotationErrors.Count()))
+	}
+}
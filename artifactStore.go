@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const ARTIFACT_STORE_LOCAL = "local"
+const ARTIFACT_STORE_S3 = "s3"
+
+// ArtifactStoreInterface keeps files under keys like queryId/name, Location tells users where to find a key.
+type ArtifactStoreInterface interface {
+	Put(key string, data []byte, contentType string) error
+	Location(key string) string
+}
+
+func NewArtifactStore(config *ArtifactConfig) (ArtifactStoreInterface, error) {
+	switch config.Store {
+	case ARTIFACT_STORE_LOCAL:
+		return &LocalArtifactStore{config.Dir}, nil
+	case ARTIFACT_STORE_S3:
+		return NewS3ArtifactStore(config)
+	}
+	return nil, errors.New("unknown artifact store " + config.Store + ", must be " + ARTIFACT_STORE_LOCAL + " or " + ARTIFACT_STORE_S3)
+}
+
+type LocalArtifactStore struct {
+	dir string
+}
+
+func (s *LocalArtifactStore) Put(key string, data []byte, contentType string) error {
+	file := filepath.Join(s.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func (s *LocalArtifactStore) Location(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+type S3ArtifactStore struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewS3ArtifactStore uses path style addressing with a custom endpoint, which S3 compatible stores expect.
+func NewS3ArtifactStore(config *ArtifactConfig) (*S3ArtifactStore, error) {
+	if config.S3Bucket == "" {
+		return nil, errors.New("ARTIFACT_S3_BUCKET is required for the s3 artifact store")
+	}
+
+	awsConfig := &aws.Config{Region: aws.String(config.S3Region)}
+	if config.S3Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.S3Endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	session, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3ArtifactStore{s3.New(session), config.S3Bucket, config.S3Prefix}, nil
+}
+
+func (s *S3ArtifactStore) Put(key string, data []byte, contentType string) error {
+	_, err := s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(path.Join(s.prefix, key)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3ArtifactStore) Location(key string) string {
+	return "s3://" + s.bucket + "/" + path.Join(s.prefix, key)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type FakeArtifactStore struct {
+	files map[string]string
+}
+
+func (s *FakeArtifactStore) Put(key string, data []byte, contentType string) error {
+	if s.files == nil {
+		s.files = make(map[string]string)
+	}
+	s.files[key] = string(data)
+	return nil
+}
+
+func (s *FakeArtifactStore) Location(key string) string {
+	return "fake://" + key
+}
+
+type FakeS3 struct {
+	s3iface.S3API
+	puts []*s3.PutObjectInput
+}
+
+func (s *FakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	s.puts = append(s.puts, input)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func Test_LocalArtifactStore_Put(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sut, _ := NewArtifactStore(&ArtifactConfig{Store: ARTIFACT_STORE_LOCAL, Dir: dir})
+
+	err = sut.Put("query1/dashboard.json", []byte("{}"), "application/json")
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "query1", "dashboard.json"))
+	if err != nil || string(data) != "{}" {
+		t.Error(fmt.Sprintf("Artifact was expected to be written under the query directory, found %s (%v)", data, err))
+	}
+	if location := sut.Location("query1"); location != filepath.Join(dir, "query1") {
+		t.Error(fmt.Sprintf("Location was expected to be the query directory, found %s", location))
+	}
+}
+
+func Test_S3ArtifactStore_Put(t *testing.T) {
+	client := &FakeS3{}
+	sut := &S3ArtifactStore{client, "previews", "downsamplr"}
+
+	err := sut.Put("query1/request_count_1m.csv", []byte("time"), "text/csv")
+	if err != nil || len(client.puts) != 1 || aws.StringValue(client.puts[0].Bucket) != "previews" || aws.StringValue(client.puts[0].Key) != "downsamplr/query1/request_count_1m.csv" || aws.StringValue(client.puts[0].ContentType) != "text/csv" {
+		t.Error(fmt.Sprintf("Artifact was expected to be put under the prefix, found %v (%v)", client.puts, err))
+	}
+	if location := sut.Location("query1"); location != "s3://previews/downsamplr/query1" {
+		t.Error(fmt.Sprintf("Location was expected to be an s3 url, found %s", location))
+	}
+}
+
+func Test_NewArtifactStore_Invalid(t *testing.T) {
+	for _, config := range []*ArtifactConfig{{Store: "ftp"}, {Store: ARTIFACT_STORE_S3}} {
+		_, err := NewArtifactStore(config)
+		if err == nil {
+			t.Error(fmt.Sprintf("Error was expected for %v but not received", config))
+		}
+	}
+}
@@ -1,21 +1,44 @@
 package main
 
 import (
+	"bytes"
 	"os"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
+const DEFAULT_SOURCE_TOPIC_TEMPLATE = "{{ .Db | lower }}-influx-metrics"
+const DEFAULT_SINK_TOPIC_TEMPLATE = "{{ .Db | lower }}-downsampling-influx-metrics"
+
 type Config struct {
-	Environment       string
-	Namespace         string
-	DbTablePrefix     string
-	ExpireAfterMinute float64
-	Mode              string //local/in-cluster
-	DeploymentConfig  *DeploymentConfig
-	MetricsConfig     *MetricsConfig
-	KafkaConfig       *KafkaConfig
-	FlinkConfig       *FlinkConfig
+	Environment        string
+	Namespace          string
+	DbTablePrefix      string
+	DbBackend          string //dynamodb/crd
+	ExpireAfterMinute  float64
+	ReportAfterMinute  float64
+	PreviewMaxMinute   float64
+	ReadyTimeoutMinute float64
+	JobRetentionMinute float64
+	Mode               string //local/in-cluster
+	DeploymentConfig   *DeploymentConfig
+	MetricsConfig      *MetricsConfig
+	KafkaConfig        *KafkaConfig
+	FlinkConfig        *FlinkConfig
+	SourceInfluxdb     *InfluxdbConfig
+	TargetInfluxdb     *InfluxdbConfig
+	TargetInfluxdbV2   *InfluxdbV2Config
+	TargetRetention    *RetentionConfig
+	EngineConfig       *EngineConfig
+	PreviewSeed        *PreviewSeedConfig
+	Grafana            *GrafanaConfig
+	Artifacts          *ArtifactConfig
+	PreviewIngress     *IngressConfig
+	PreviewLimits      *PreviewLimitConfig
+	PreviewResources   *PreviewResourceConfig
+	JobName            string //the controller job running this, if any
 }
 type DeploymentConfig struct {
 	AwsRole string
@@ -30,8 +53,95 @@ type MetricsConfig struct {
 }
 
 type KafkaConfig struct {
-	Source string
-	Sink   string
+	Source              string
+	Sink                string
+	SourceTopicTemplate string
+	SinkTopicTemplate   string
+	AuditCluster        string
+	AuditTopic          string
+}
+
+// KafkaTopicFiller is the data the topic templates are executed against,
+// so a template can refer to {{ .Environment }} as well as any query field.
+type KafkaTopicFiller struct {
+	Environment string
+	DownsamplingObject
+}
+
+type InfluxdbConfig struct {
+	Url      string
+	Username string
+	Password string
+}
+
+// InfluxdbV2Config is used for the databases listed in Databases, every other database is on InfluxDB 1.x.
+type InfluxdbV2Config struct {
+	Url       string
+	Token     string
+	Org       string
+	Databases []string
+}
+
+type RetentionConfig struct {
+	Duration      string
+	ShardDuration string
+	PurgeOnDelete bool
+}
+
+// EngineConfig picks the downsampling engine of queries that do not set one,
+// queries with at most ContinuousQueryMaxSeries series use continuous queries, 0 disables the rule.
+type EngineConfig struct {
+	Default                  string
+	ContinuousQueryMaxSeries int
+}
+
+// PreviewSeedConfig bounds the raw data copied from the source into a preview, Hours 0 disables seeding.
+type PreviewSeedConfig struct {
+	Hours        int
+	ChunkMinutes int
+	MaxPoints    int
+}
+
+// GrafanaConfig is the shared Grafana where deployed queries get a dashboard, in a folder per database.
+// ApiKey, an API key or service account token, is used instead of User and Password when set.
+type GrafanaConfig struct {
+	Url              string
+	User             string
+	Password         string
+	ApiKey           string
+	DatasourcePrefix string
+}
+
+// ArtifactConfig is where previews are exported to before they expire, Store is local, s3 or empty to not export.
+// S3Endpoint is only set for S3 compatible stores, MaxRows caps the rows of the exported CSV.
+// ExportTimeoutSecond bounds the export of a single preview, a preview that does not answer in time is not exported.
+type ArtifactConfig struct {
+	Store               string
+	Dir                 string
+	S3Bucket            string
+	S3Prefix            string
+	S3Region            string
+	S3Endpoint          string
+	MaxRows             int
+	ExportTimeoutSecond int
+}
+
+// IngressConfig is how previews are reached, each on its own hosts under Domain, see templates/simulation-ingress.json.
+// Class and TlsSecret are left out of the ingress when empty, Scheme defaults to https with a TlsSecret.
+type IngressConfig struct {
+	Domain    string
+	Scheme    string
+	Class     string
+	TlsSecret string
+}
+
+// Host is where a service of a preview stack is exposed, service being influx or grafana.
+func (c *IngressConfig) Host(stackName string, service string) string {
+	return stackName + "." + service + "." + c.Domain
+}
+
+func (c *IngressConfig) Url(host string) string {
+	return c.Scheme + "://" + host
 }
 
 type FlinkConfig struct {
@@ -40,17 +150,110 @@ type FlinkConfig struct {
 	FlinkJobDeleteUrl string
 }
 
+// PreviewLimitConfig caps the previews running at once, in all and for each Db, 0 is no limit.
+// The coordinator leaves the previews over the limits pending until others are gone.
+type PreviewLimitConfig struct {
+	MaxActive      int
+	MaxActivePerDb int
+}
+
+// Admits tells if one more preview fits next to active ones, activeOfDb of them of its Db.
+func (c *PreviewLimitConfig) Admits(active int, activeOfDb int) bool {
+	if c == nil {
+		return true
+	}
+	return (c.MaxActive <= 0 || active < c.MaxActive) && (c.MaxActivePerDb <= 0 || activeOfDb < c.MaxActivePerDb)
+}
+
+// PreviewResourceConfig sizes the containers of a preview, see templates/simulation-deployment.json.
+// InfluxDB keeps its data in a volume claim of StorageSize when set, otherwise in the container.
+type PreviewResourceConfig struct {
+	Influxdb     *ResourceProfile
+	Grafana      *ResourceProfile
+	StorageSize  string
+	StorageClass string
+}
+
+// ResourceProfile quantities are both the requests and the limits of a container, empty ones are left out.
+type ResourceProfile struct {
+	Cpu              string
+	Memory           string
+	EphemeralStorage string
+}
+
 func NewConfig(mode string) (*Config, error) {
 	ExpireAfterMinute, err := strconv.ParseFloat(os.Getenv("EXPIRE_AFTER_MINUTE"), 64)
 	if err != nil {
 		return nil, err
 	}
+	ReportAfterMinute, err := strconv.ParseFloat(getEnvString("REPORT_AFTER_MINUTE", "60"), 64)
+	if err != nil {
+		return nil, err
+	}
+	PreviewMaxMinute, err := strconv.ParseFloat(getEnvString("PREVIEW_MAX_MINUTE", "1440"), 64)
+	if err != nil {
+		return nil, err
+	}
+	ReadyTimeoutMinute, err := strconv.ParseFloat(getEnvString("READY_TIMEOUT_MINUTE", "3"), 64)
+	if err != nil {
+		return nil, err
+	}
+	JobRetentionMinute, err := strconv.ParseFloat(getEnvString("JOB_RETENTION_MINUTE", "60"), 64)
+	if err != nil {
+		return nil, err
+	}
+	PurgeTargetOnDelete, err := getEnvBool("PURGE_TARGET_ON_DELETE", false)
+	if err != nil {
+		return nil, err
+	}
+	ContinuousQueryMaxSeries, err := strconv.Atoi(getEnvString("CONTINUOUS_QUERY_MAX_SERIES", "0"))
+	if err != nil {
+		return nil, err
+	}
+	PreviewSeedHours, err := strconv.Atoi(getEnvString("PREVIEW_SEED_HOURS", "6"))
+	if err != nil {
+		return nil, err
+	}
+	PreviewSeedChunkMinutes, err := strconv.Atoi(getEnvString("PREVIEW_SEED_CHUNK_MINUTES", "30"))
+	if err != nil {
+		return nil, err
+	}
+	PreviewSeedMaxPoints, err := strconv.Atoi(getEnvString("PREVIEW_SEED_MAX_POINTS", "500000"))
+	if err != nil {
+		return nil, err
+	}
+	ArtifactMaxRows, err := strconv.Atoi(getEnvString("ARTIFACT_MAX_ROWS", "100000"))
+	if err != nil {
+		return nil, err
+	}
+	ArtifactExportTimeoutSecond, err := strconv.Atoi(getEnvString("ARTIFACT_EXPORT_TIMEOUT_SECOND", "60"))
+	if err != nil {
+		return nil, err
+	}
+	PreviewMaxActive, err := strconv.Atoi(getEnvString("PREVIEW_MAX_ACTIVE", "0"))
+	if err != nil {
+		return nil, err
+	}
+	PreviewMaxActivePerDb, err := strconv.Atoi(getEnvString("PREVIEW_MAX_ACTIVE_PER_DB", "0"))
+	if err != nil {
+		return nil, err
+	}
+	PreviewIngressTlsSecret := os.Getenv("PREVIEW_INGRESS_TLS_SECRET")
+	PreviewIngressScheme := "http"
+	if PreviewIngressTlsSecret != "" {
+		PreviewIngressScheme = "https"
+	}
 
 	c := &Config{
 		os.Getenv("ENVIRONMENT"),
 		os.Getenv("NAMESPACE"),
 		os.Getenv("DB_TABLE_PREFIX"),
+		getEnvString("DB_BACKEND", DB_BACKEND_DYNAMODB),
 		ExpireAfterMinute,
+		ReportAfterMinute,
+		PreviewMaxMinute,
+		ReadyTimeoutMinute,
+		JobRetentionMinute,
 		mode,
 		&DeploymentConfig{
 			os.Getenv("AWS_ROLE"),
@@ -63,23 +266,203 @@ func NewConfig(mode string) (*Config, error) {
 			Password: os.Getenv("METRICS_PASSWORD"),
 		},
 		&KafkaConfig{
-			Source: os.Getenv("SOURCE_CLUSTER"),
-			Sink:   os.Getenv("SINK_CLUSTER"),
+			Source:              os.Getenv("SOURCE_CLUSTER"),
+			Sink:                os.Getenv("SINK_CLUSTER"),
+			SourceTopicTemplate: os.Getenv("SOURCE_TOPIC_TEMPLATE"),
+			SinkTopicTemplate:   os.Getenv("SINK_TOPIC_TEMPLATE"),
+			AuditCluster:        os.Getenv("AUDIT_CLUSTER"),
+			AuditTopic:          os.Getenv("AUDIT_TOPIC"),
 		},
 		&FlinkConfig{
 			os.Getenv("FLINK_JARS_URL"),
 			os.Getenv("FLINK_JOBS_URL"),
 			os.Getenv("FLINK_JOB_DELETE_URL"),
 		},
+		&InfluxdbConfig{
+			Url:      os.Getenv("SOURCE_INFLUXDB_URL"),
+			Username: os.Getenv("SOURCE_INFLUXDB_USERNAME"),
+			Password: os.Getenv("SOURCE_INFLUXDB_PASSWORD"),
+		},
+		&InfluxdbConfig{
+			Url:      os.Getenv("TARGET_INFLUXDB_URL"),
+			Username: os.Getenv("TARGET_INFLUXDB_USERNAME"),
+			Password: os.Getenv("TARGET_INFLUXDB_PASSWORD"),
+		},
+		&InfluxdbV2Config{
+			Url:       os.Getenv("TARGET_INFLUXDB_V2_URL"),
+			Token:     os.Getenv("TARGET_INFLUXDB_V2_TOKEN"),
+			Org:       os.Getenv("TARGET_INFLUXDB_V2_ORG"),
+			Databases: getEnvList("INFLUXDB_V2_DATABASES"),
+		},
+		&RetentionConfig{
+			Duration:      getEnvString("TARGET_RP_DURATION", "INF"),
+			ShardDuration: os.Getenv("TARGET_RP_SHARD_DURATION"),
+			PurgeOnDelete: PurgeTargetOnDelete,
+		},
+		&EngineConfig{
+			Default:                  getEnvString("DEFAULT_ENGINE", ENGINE_FLINK),
+			ContinuousQueryMaxSeries: ContinuousQueryMaxSeries,
+		},
+		&PreviewSeedConfig{
+			Hours:        PreviewSeedHours,
+			ChunkMinutes: PreviewSeedChunkMinutes,
+			MaxPoints:    PreviewSeedMaxPoints,
+		},
+		&GrafanaConfig{
+			Url:              os.Getenv("GRAFANA_URL"),
+			User:             os.Getenv("GRAFANA_USER"),
+			Password:         os.Getenv("GRAFANA_PASSWORD"),
+			ApiKey:           os.Getenv("GRAFANA_API_KEY"),
+			DatasourcePrefix: getEnvString("GRAFANA_DATASOURCE_PREFIX", "downsampled-"),
+		},
+		&ArtifactConfig{
+			Store:               os.Getenv("ARTIFACT_STORE"),
+			Dir:                 getEnvString("ARTIFACT_DIR", "/var/lib/downsamplr/artifacts"),
+			S3Bucket:            os.Getenv("ARTIFACT_S3_BUCKET"),
+			S3Prefix:            os.Getenv("ARTIFACT_S3_PREFIX"),
+			S3Region:            getEnvString("ARTIFACT_S3_REGION", "us-west-2"),
+			S3Endpoint:          os.Getenv("ARTIFACT_S3_ENDPOINT"),
+			MaxRows:             ArtifactMaxRows,
+			ExportTimeoutSecond: ArtifactExportTimeoutSecond,
+		},
+		&IngressConfig{
+			Domain:    getEnvString("PREVIEW_INGRESS_DOMAIN", "platform.r53.arghanil.net"),
+			Scheme:    getEnvString("PREVIEW_INGRESS_SCHEME", PreviewIngressScheme),
+			Class:     os.Getenv("PREVIEW_INGRESS_CLASS"),
+			TlsSecret: PreviewIngressTlsSecret,
+		},
+		&PreviewLimitConfig{
+			MaxActive:      PreviewMaxActive,
+			MaxActivePerDb: PreviewMaxActivePerDb,
+		},
+		&PreviewResourceConfig{
+			Influxdb: &ResourceProfile{
+				Cpu:              os.Getenv("PREVIEW_INFLUXDB_CPU"),
+				Memory:           os.Getenv("PREVIEW_INFLUXDB_MEMORY"),
+				EphemeralStorage: os.Getenv("PREVIEW_INFLUXDB_EPHEMERAL_STORAGE"),
+			},
+			Grafana: &ResourceProfile{
+				Cpu:              os.Getenv("PREVIEW_GRAFANA_CPU"),
+				Memory:           os.Getenv("PREVIEW_GRAFANA_MEMORY"),
+				EphemeralStorage: os.Getenv("PREVIEW_GRAFANA_EPHEMERAL_STORAGE"),
+			},
+			StorageSize:  os.Getenv("PREVIEW_STORAGE_SIZE"),
+			StorageClass: os.Getenv("PREVIEW_STORAGE_CLASS"),
+		},
+		os.Getenv("JOB_NAME"),
+	}
+
+	// a typo in a quantity fails every preview otherwise
+	if err := c.PreviewResources.Validate(); err != nil {
+		return nil, err
 	}
 
 	return c, nil
 }
 
-func (c *Config) GetSourceKafkaTopic(query DownsamplingObject) string {
-	return strings.ToLower(query.Db) + "-influx-metrics"
+func getEnvString(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvBool(name string, defaultValue bool) (bool, error) {
+	if value := os.Getenv(name); value != "" {
+		return strconv.ParseBool(value)
+	}
+	return defaultValue, nil
+}
+
+func (c *Config) GetSourceKafkaTopic(query DownsamplingObject) (string, error) {
+	if query.SourceTopic != "" {
+		return query.SourceTopic, nil
+	}
+	text := DEFAULT_SOURCE_TOPIC_TEMPLATE
+	if c.KafkaConfig != nil && c.KafkaConfig.SourceTopicTemplate != "" {
+		text = c.KafkaConfig.SourceTopicTemplate
+	}
+	return c.renderKafkaTopic(text, query)
+}
+
+func (c *Config) GetSinkKafkaTopic(query DownsamplingObject) (string, error) {
+	if query.SinkTopic != "" {
+		return query.SinkTopic, nil
+	}
+	text := DEFAULT_SINK_TOPIC_TEMPLATE
+	if c.KafkaConfig != nil && c.KafkaConfig.SinkTopicTemplate != "" {
+		text = c.KafkaConfig.SinkTopicTemplate
+	}
+	return c.renderKafkaTopic(text, query)
 }
 
-func (c *Config) GetSinkKafkaTopic(query DownsamplingObject) string {
-	return strings.ToLower(query.Db) + "-downsampling-influx-metrics"
+func (c *Config) renderKafkaTopic(text string, query DownsamplingObject) (string, error) {
+	tmpl, err := template.New("topic").Funcs(template.FuncMap{
+		"lower":   strings.ToLower,
+		"upper":   strings.ToUpper,
+		"replace": func(old string, new string, s string) string { return strings.Replace(s, old, new, -1) },
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, &KafkaTopicFiller{c.Environment, query})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// DatabaseList gives Databases back in the INFLUXDB_V2_DATABASES form, the controller job template passes it on.
+func (c *InfluxdbV2Config) DatabaseList() string {
+	return strings.Join(c.Databases, ",")
+}
+
+// PreviewLifetimeMinute is the longest a preview may run with its extensions, never less than ExpireAfterMinute.
+func (c *Config) PreviewLifetimeMinute() float64 {
+	if c.PreviewMaxMinute < c.ExpireAfterMinute {
+		return c.ExpireAfterMinute
+	}
+	return c.PreviewMaxMinute
+}
+
+// ReadyTimeout bounds each wait of a preview, on the Deployment becoming Available and on InfluxDB and Grafana answering.
+func (c *Config) ReadyTimeout() time.Duration {
+	return time.Duration(c.ReadyTimeoutMinute * float64(time.Minute))
+}
+
+// ExportTimeout bounds the export of a single preview, see ArtifactConfig.
+func (c *ArtifactConfig) ExportTimeout() time.Duration {
+	return time.Duration(c.ExportTimeoutSecond) * time.Second
+}
+
+// JobDeadlineSeconds leaves room in a controller job for the three readiness waits of a preview on top of
+// the 240s the jobs have always had, so a timed out wait is reported before the Job itself is killed.
+func (c *Config) JobDeadlineSeconds() int {
+	return 240 + int(3*c.ReadyTimeout().Seconds())
+}
+
+// IsInfluxdbV2 tells if db has been migrated to InfluxDB 2.x.
+func (c *Config) IsInfluxdbV2(db string) bool {
+	if c == nil || c.TargetInfluxdbV2 == nil {
+		return false
+	}
+	for _, database := range c.TargetInfluxdbV2.Databases {
+		if database == db {
+			return true
+		}
+	}
+	return false
 }
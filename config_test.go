@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+type KafkaTopicTestSuite struct {
+	label               string
+	config              *Config
+	query               DownsamplingObject
+	expectedSourceTopic string
+	expectedSinkTopic   string
+}
+
+var KafkaTopicTestCases = []KafkaTopicTestSuite{
+	{
+		"Default templates",
+		&Config{Environment: "dev", KafkaConfig: &KafkaConfig{}},
+		DownsamplingObject{Db: "SCA", Measurement: "request_count"},
+		"sca-influx-metrics",
+		"sca-downsampling-influx-metrics",
+	},
+	{
+		"No kafka config",
+		&Config{Environment: "dev"},
+		DownsamplingObject{Db: "sca"},
+		"sca-influx-metrics",
+		"sca-downsampling-influx-metrics",
+	},
+	{
+		"Configured templates",
+		&Config{Environment: "dev", KafkaConfig: &KafkaConfig{SourceTopicTemplate: "{{ .Environment }}.{{ replace \"_\" \"-\" .Db }}.raw", SinkTopicTemplate: "{{ .Environment }}.{{ .Db | upper }}.{{ .Measurement }}"}},
+		DownsamplingObject{Db: "omni_db", Measurement: "request_count"},
+		"dev.omni-db.raw",
+		"dev.OMNI_DB.request_count",
+	},
+	{
+		"Explicit topics on the item",
+		&Config{Environment: "dev", KafkaConfig: &KafkaConfig{SourceTopicTemplate: "{{ .Db }}-ignored"}},
+		DownsamplingObject{Db: "sca", SourceTopic: "shared-metrics", SinkTopic: "shared-downsampled"},
+		"shared-metrics",
+		"shared-downsampled",
+	},
+}
+
+func Test_Config_GetKafkaTopics(t *testing.T) {
+	for _, testCase := range KafkaTopicTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			source, err := testCase.config.GetSourceKafkaTopic(testCase.query)
+			if err != nil || source != testCase.expectedSourceTopic {
+				t.Error(fmt.Sprintf("%s: source topic was expected %s found %s (%v)", testCase.label, testCase.expectedSourceTopic, source, err))
+			}
+			sink, err := testCase.config.GetSinkKafkaTopic(testCase.query)
+			if err != nil || sink != testCase.expectedSinkTopic {
+				t.Error(fmt.Sprintf("%s: sink topic was expected %s found %s (%v)", testCase.label, testCase.expectedSinkTopic, sink, err))
+			}
+		})
+	}
+}
+
+func Test_Config_GetKafkaTopics_Error(t *testing.T) {
+	config := &Config{KafkaConfig: &KafkaConfig{SourceTopicTemplate: "{{ .Db "}}
+	_, err := config.GetSourceKafkaTopic(DownsamplingObject{Db: "sca"})
+	if err == nil {
+		t.Error(fmt.Sprintf("Was expecting error but not received"))
+	}
+}
+
+func Test_Config_IsInfluxdbV2(t *testing.T) {
+	config := &Config{TargetInfluxdbV2: &InfluxdbV2Config{Databases: []string{"sca", "omni"}}}
+	if !config.IsInfluxdbV2("omni") || config.IsInfluxdbV2("metrics") {
+		t.Error(fmt.Sprintf("Only sca and omni were expected on InfluxDB 2.x"))
+	}
+	if (&Config{}).IsInfluxdbV2("sca") || config.TargetInfluxdbV2.DatabaseList() != "sca,omni" {
+		t.Error(fmt.Sprintf("Databases were expected on InfluxDB 1.x unless configured, found %s", config.TargetInfluxdbV2.DatabaseList()))
+	}
+}
+
+func Test_PreviewLimitConfig_Admits(t *testing.T) {
+	tests := map[string]struct {
+		limits     *PreviewLimitConfig
+		active     int
+		activeOfDb int
+		expected   bool
+	}{
+		"no config":        {nil, 10, 10, true},
+		"no limits":        {&PreviewLimitConfig{}, 10, 10, true},
+		"under global":     {&PreviewLimitConfig{MaxActive: 3}, 2, 2, true},
+		"at global":        {&PreviewLimitConfig{MaxActive: 3}, 3, 0, false},
+		"at db":            {&PreviewLimitConfig{MaxActive: 3, MaxActivePerDb: 1}, 1, 1, false},
+		"other db is free": {&PreviewLimitConfig{MaxActive: 3, MaxActivePerDb: 1}, 1, 0, true},
+	}
+	for name, test := range tests {
+		if admits := test.limits.Admits(test.active, test.activeOfDb); admits != test.expected {
+			t.Error(fmt.Sprintf("%s: %t was expected, found %t", name, test.expected, admits))
+		}
+	}
+}
+
+func Test_PreviewResourceConfig_Validate(t *testing.T) {
+	valid := &PreviewResourceConfig{Influxdb: &ResourceProfile{Cpu: "500m", Memory: "1Gi", EphemeralStorage: "2Gi"}, Grafana: &ResourceProfile{Memory: "256Mi"}, StorageSize: "10Gi"}
+	if err := valid.Validate(); err != nil {
+		t.Error(fmt.Sprintf("Error was not expected but received - %v", err))
+	}
+	for _, invalid := range []*PreviewResourceConfig{{Influxdb: &ResourceProfile{Cpu: "half"}}, {Grafana: &ResourceProfile{Memory: "1 GB"}}, {StorageSize: "lots"}} {
+		if err := invalid.Validate(); err == nil {
+			t.Error(fmt.Sprintf("Error was expected for %v but not received", invalid))
+		}
+	}
+}
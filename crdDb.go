@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	clientv1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"strconv"
+	"time"
+)
+
+// The finalizer keeps a deleted DownsamplingQuery until the delete job has taken its downsampling down.
+const DOWNSAMPLING_QUERY_FINALIZER = "downsamplr.io/cleanup"
+
+var DownsamplingQueryResource = schema.GroupVersionResource{Group: "downsamplr.io", Version: "v1alpha1", Resource: "downsamplingqueries"}
+
+// The fields of DownsamplingObject kept in the status of a DownsamplingQuery, the controller never writes the spec.
+// The query id is the name of the object and the creation time its creation timestamp.
+var downsamplingQueryStatusFields = []string{"queryState", "stateMessage", "updatedAt", "previewExpiresAt", "previewDeployedAt",
+	"previewInfluxdbUrl", "previewGrafanaUrl", "previewReport", "previewCredentials", "engine", "dashboardTemplate",
+	"artifactLocation", "flinkJobId", "lastJob"}
+
+// CrdDb keeps the downsampling queries as DownsamplingQuery objects, see chart/templates/downsamplingquery-crd.yaml.
+// The state of an object is derived the way the UI sets it in DynamoDB: a new or changed spec is PENDING, or
+// PREVIEW_PENDING when spec.preview is set, and an object being deleted is DELETED.
+type CrdDb struct {
+	client  dynamic.ResourceInterface
+	secrets clientv1core.SecretInterface
+	config  *Config
+}
+
+func NewCrdDb(k8client K8ClientInterface, config *Config) *CrdDb {
+	client := k8client.GetDynamicClient().Resource(DownsamplingQueryResource).Namespace(config.Namespace)
+	secrets := k8client.GetClientSet().CoreV1().Secrets(config.Namespace)
+	return &CrdDb{client, secrets, config}
+}
+
+func (d *CrdDb) GetAllToDoItems() ([]DownsamplingObject, error) {
+	return d.getDownsampleItems("PENDING", "PREVIEW_PENDING", "DELETED", "PREVIEW_CANCEL_PENDING", "PREVIEW_EXTEND_PENDING")
+}
+
+func (d *CrdDb) GetPendingDownsamplePreviewItems() ([]DownsamplingObject, error) {
+	return d.getDownsampleItems("PREVIEW_PENDING")
+}
+
+func (d *CrdDb) GetPendingDownsampleItems() ([]DownsamplingObject, error) {
+	return d.getDownsampleItems("PENDING")
+}
+
+func (d *CrdDb) GetDeployedDownsamplePreviewItems() ([]DownsamplingObject, error) {
+	return d.getDownsampleItems("PREVIEW_DEPLOYED")
+}
+
+func (d *CrdDb) GetDeletedDownsampleItems() ([]DownsamplingObject, error) {
+	return d.getDownsampleItems("DELETED")
+}
+
+func (d *CrdDb) getDownsampleItems(states ...string) ([]DownsamplingObject, error) {
+	var ds []DownsamplingObject
+	list, err := d.client.List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return ds, err
+	}
+
+	for i := range list.Items {
+		query, err := d.toDownsamplingObject(&list.Items[i])
+		if err != nil {
+			// one broken object must not hold up the others
+			log.Printf("Skipping DownsamplingQuery %s: %v", list.Items[i].GetName(), err)
+			continue
+		}
+		for _, state := range states {
+			if query.QueryState == state {
+				ds = append(ds, query)
+			}
+		}
+	}
+	return ds, nil
+}
+
+// GetDownsamplingItem returns an empty object when there is no DownsamplingQuery of that id, as DynamoDB does.
+func (d *CrdDb) GetDownsamplingItem(queryId string) (DownsamplingObject, error) {
+	var query DownsamplingObject
+	object, err := d.client.Get(context.TODO(), queryId, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return query, nil
+		}
+		return query, err
+	}
+
+	return d.toDownsamplingObject(object)
+}
+
+// UpdateDownsamplingItem writes the status of the DownsamplingQuery, which has to exist: queries are declared, not
+// created by the controller.
+func (d *CrdDb) UpdateDownsamplingItem(DownsampleObject DownsamplingObject) (string, error) {
+	object, err := d.client.Get(context.TODO(), DownsampleObject.QueryId, metav1.GetOptions{})
+	if err != nil {
+		return "Failure", err
+	}
+
+	if object.GetDeletionTimestamp() == nil && !hasFinalizer(object) {
+		object.SetFinalizers(append(object.GetFinalizers(), DOWNSAMPLING_QUERY_FINALIZER))
+		object, err = d.client.Update(context.TODO(), object, metav1.UpdateOptions{})
+		if err != nil {
+			return "Failure", err
+		}
+	}
+
+	status, err := toDownsamplingQueryStatus(DownsampleObject)
+	if err != nil {
+		return "Failure", err
+	}
+	// the spec may have changed since the item was read, that change is still to be observed
+	observedGeneration := DownsampleObject.Generation
+	if observedGeneration == 0 {
+		observedGeneration = object.GetGeneration()
+	}
+	status["observedGeneration"] = observedGeneration
+	err = unstructured.SetNestedField(object.Object, status, "status")
+	if err != nil {
+		return "Failure", err
+	}
+
+	_, err = d.client.UpdateStatus(context.TODO(), object, metav1.UpdateOptions{})
+	if err != nil {
+		return "Failure", err
+	}
+
+	return "Success", nil
+}
+
+// KeepsExpiredItems is true, an object is declared by its owner, possibly under GitOps that would only recreate it.
+func (d *CrdDb) KeepsExpiredItems() bool {
+	return true
+}
+
+// DeleteDownsamplingItem lets an object being deleted go, any other one is deleted.
+func (d *CrdDb) DeleteDownsamplingItem(queryId string) error {
+	object, err := d.client.Get(context.TODO(), queryId, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if object.GetDeletionTimestamp() == nil {
+		err = d.client.Delete(context.TODO(), queryId, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		object, err = d.client.Get(context.TODO(), queryId, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	var finalizers []string
+	for _, finalizer := range object.GetFinalizers() {
+		if finalizer != DOWNSAMPLING_QUERY_FINALIZER {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	object.SetFinalizers(finalizers)
+	_, err = d.client.Update(context.TODO(), object, metav1.UpdateOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *CrdDb) toDownsamplingObject(object *unstructured.Unstructured) (DownsamplingObject, error) {
+	var query DownsamplingObject
+	spec, _, err := unstructured.NestedMap(object.Object, "spec")
+	if err != nil {
+		return query, err
+	}
+	status, _, err := unstructured.NestedMap(object.Object, "status")
+	if err != nil {
+		return query, err
+	}
+
+	values := make(map[string]interface{})
+	for key, value := range spec {
+		values[key] = value
+	}
+	for _, key := range downsamplingQueryStatusFields {
+		if value, ok := status[key]; ok {
+			values[key] = value
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return query, err
+	}
+	err = json.Unmarshal(data, &query)
+	if err != nil {
+		return query, err
+	}
+
+	query.QueryId = object.GetName()
+	query.Generation = object.GetGeneration()
+	query.CreatedAt = object.GetCreationTimestamp().UTC().Format(time.RFC3339)
+	if query.QueryHash == "" {
+		query.QueryHash = strconv.FormatInt(object.GetGeneration(), 10)
+	}
+
+	observedGeneration, _, _ := unstructured.NestedInt64(object.Object, "status", "observedGeneration")
+	preview, _, _ := unstructured.NestedBool(object.Object, "spec", "preview")
+	previewCancel, _, _ := unstructured.NestedBool(object.Object, "spec", "previewCancel")
+	changed := observedGeneration != object.GetGeneration()
+	switch {
+	case object.GetDeletionTimestamp() != nil:
+		query.QueryState = "DELETED"
+	// a running preview is cancelled or extended rather than deployed again
+	case changed && query.QueryState == "PREVIEW_DEPLOYED" && previewCancel:
+		query.QueryState = "PREVIEW_CANCEL_PENDING"
+	case changed && query.QueryState == "PREVIEW_DEPLOYED" && query.PreviewExtendMinutes > 0:
+		query.QueryState = "PREVIEW_EXTEND_PENDING"
+	case query.QueryState == "" || changed:
+		query.QueryState = "PENDING"
+		if preview {
+			query.QueryState = "PREVIEW_PENDING"
+		}
+	}
+
+	if query.PreviewCredentials != nil {
+		d.readPreviewPasswords(query.PreviewCredentials)
+	}
+	return query, nil
+}
+
+// readPreviewPasswords fills the passwords left out of the status from the preview secret, as long as it exists.
+func (d *CrdDb) readPreviewPasswords(credentials *PreviewCredentials) {
+	secret, err := d.secrets.Get(context.TODO(), credentials.SecretName, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("Could not read preview secret %s: %v", credentials.SecretName, err)
+		return
+	}
+	credentials.InfluxdbPassword = string(secret.Data["influxdb-password"])
+	credentials.InfluxdbToken = string(secret.Data["influxdb-token"])
+	credentials.GrafanaPassword = string(secret.Data["grafana-password"])
+}
+
+// toDownsamplingQueryStatus keeps the passwords out, anyone allowed to read the queries could read the status.
+func toDownsamplingQueryStatus(query DownsamplingObject) (map[string]interface{}, error) {
+	if query.PreviewCredentials != nil {
+		credentials := *query.PreviewCredentials
+		credentials.InfluxdbPassword, credentials.InfluxdbToken, credentials.GrafanaPassword = "", "", ""
+		query.PreviewCredentials = &credentials
+	}
+
+	data, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(map[string]interface{})
+	for _, key := range downsamplingQueryStatusFields {
+		if value, ok := values[key]; ok && value != nil {
+			status[key] = value
+		}
+	}
+	return status, nil
+}
+
+func hasFinalizer(object *unstructured.Unstructured) bool {
+	for _, finalizer := range object.GetFinalizers() {
+		if finalizer == DOWNSAMPLING_QUERY_FINALIZER {
+			return true
+		}
+	}
+	return false
+}
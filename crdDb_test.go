@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"testing"
+)
+
+func NewDownsamplingQuery(name string, spec map[string]interface{}, status map[string]interface{}) *unstructured.Unstructured {
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "downsamplr.io/v1alpha1",
+		"kind":       "DownsamplingQuery",
+		"metadata": map[string]interface{}{
+			"name":       name,
+			"namespace":  "testns",
+			"generation": int64(1),
+		},
+		"spec": spec,
+	}}
+	if status != nil {
+		object.Object["status"] = status
+	}
+	return object
+}
+
+func NewCrdDbForTest(objects ...runtime.Object) *CrdDb {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...).Resource(DownsamplingQueryResource).Namespace("testns")
+	secret := &v1.Secret{Data: map[string][]byte{"influxdb-password": []byte("influxdbpw"), "grafana-password": []byte("grafanapw")}}
+	return &CrdDb{client, &FakeSecrets{existing: map[string]*v1.Secret{"downsamplr-preview-query1": secret, "downsamplr-preview-query2": secret}}, &Config{Namespace: "testns"}}
+}
+
+func NewCrdDbTestObjects() []runtime.Object {
+	spec := map[string]interface{}{"db": "sca", "rp": "autogen", "measurement": "request_count", "interval": int64(60),
+		"fields": []interface{}{map[string]interface{}{"alias": "sum_count", "field": "count", "func": "SUM"}}}
+	return []runtime.Object{
+		NewDownsamplingQuery("query1", spec, nil),
+		NewDownsamplingQuery("query2", map[string]interface{}{"db": "sca", "preview": true}, map[string]interface{}{"observedGeneration": int64(1), "queryState": "PREVIEW_DEPLOYED",
+			"previewCredentials": map[string]interface{}{"secretName": "downsamplr-preview-query2", "influxdbUser": "downsamplr", "grafanaUser": "downsamplr"}}),
+		NewDownsamplingQuery("query3", map[string]interface{}{"db": "sca", "preview": true}, nil),
+		NewDownsamplingQuery("query4", spec, map[string]interface{}{"observedGeneration": int64(0), "queryState": "DEPLOYED"}),
+	}
+}
+
+func Test_CrdDb_GetDownsamplingItem(t *testing.T) {
+	db := NewCrdDbForTest(NewCrdDbTestObjects()...)
+	query, err := db.GetDownsamplingItem("query1")
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if query.QueryId != "query1" || query.QueryState != "PENDING" || query.Db != "sca" || query.Interval != 60 || query.QueryHash != "1" {
+		t.Error(fmt.Sprintf("Unexpected query %+v", query))
+	}
+	if len(query.Fields) != 1 || query.Fields[0].Function != "SUM" {
+		t.Error(fmt.Sprintf("Unexpected fields %+v", query.Fields))
+	}
+
+	query, err = db.GetDownsamplingItem("missing")
+	if err != nil || query.QueryId != "" {
+		t.Error(fmt.Sprintf("An empty object was expected for a missing query, found %+v and %v", query, err))
+	}
+}
+
+func Test_CrdDb_GetDownsamplingItem_ReadsPasswordsFromSecret(t *testing.T) {
+	db := NewCrdDbForTest(NewCrdDbTestObjects()...)
+	query, _ := db.GetDownsamplingItem("query2")
+	if query.QueryState != "PREVIEW_DEPLOYED" || query.PreviewCredentials == nil {
+		t.Error(fmt.Sprintf("Unexpected query %+v", query))
+		return
+	}
+	if query.PreviewCredentials.InfluxdbPassword != "influxdbpw" || query.PreviewCredentials.GrafanaPassword != "grafanapw" {
+		t.Error(fmt.Sprintf("Passwords were expected from the secret, found %+v", query.PreviewCredentials))
+	}
+}
+
+func Test_CrdDb_States(t *testing.T) {
+	db := NewCrdDbForTest(NewCrdDbTestObjects()...)
+	for name, test := range map[string]struct {
+		list     func() ([]DownsamplingObject, error)
+		expected int
+	}{
+		// query4 changed since it was deployed
+		"PENDING":          {db.GetPendingDownsampleItems, 2},
+		"PREVIEW_PENDING":  {db.GetPendingDownsamplePreviewItems, 1},
+		"PREVIEW_DEPLOYED": {db.GetDeployedDownsamplePreviewItems, 1},
+		"DELETED":          {db.GetDeletedDownsampleItems, 0},
+		"TODO":             {db.GetAllToDoItems, 3},
+	} {
+		ds, err := test.list()
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected here but received - %v", name, err))
+		}
+		if len(ds) != test.expected {
+			t.Error(fmt.Sprintf("%s: %d items were expected, found %d", name, test.expected, len(ds)))
+		}
+	}
+}
+
+func Test_CrdDb_GetDeletedDownsampleItems(t *testing.T) {
+	object := NewDownsamplingQuery("query1", map[string]interface{}{"db": "sca"}, map[string]interface{}{"observedGeneration": int64(1), "queryState": "DEPLOYED"})
+	now := metav1.Now()
+	object.SetDeletionTimestamp(&now)
+	db := NewCrdDbForTest(object)
+	ds, err := db.GetDeletedDownsampleItems()
+	if err != nil || len(ds) != 1 || ds[0].QueryState != "DELETED" {
+		t.Error(fmt.Sprintf("A deleted item was expected, found %+v and %v", ds, err))
+	}
+}
+
+func Test_CrdDb_UpdateDownsamplingItem(t *testing.T) {
+	db := NewCrdDbForTest(NewCrdDbTestObjects()...)
+	query, _ := db.GetDownsamplingItem("query1")
+	query.QueryState = "PREVIEW_DEPLOYED"
+	query.FlinkJobId = "flinkjob1"
+	query.PreviewGrafanaUrl = "http://grafana"
+	query.PreviewCredentials = &PreviewCredentials{SecretName: "downsamplr-preview-query1", GrafanaUser: "downsamplr", GrafanaPassword: "secret"}
+	_, err := db.UpdateDownsamplingItem(query)
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+
+	object, _ := db.client.Get(context.TODO(), "query1", metav1.GetOptions{})
+	if !hasFinalizer(object) {
+		t.Error("The finalizer was expected to be added")
+	}
+	status, _, _ := unstructured.NestedMap(object.Object, "status")
+	if status["queryState"] != "PREVIEW_DEPLOYED" || status["flinkJobId"] != "flinkjob1" || status["previewGrafanaUrl"] != "http://grafana" || status["observedGeneration"] != int64(1) {
+		t.Error(fmt.Sprintf("Unexpected status %v", status))
+	}
+	if password, _, _ := unstructured.NestedString(object.Object, "status", "previewCredentials", "grafanaPassword"); password != "" {
+		t.Error("Passwords were not expected in the status")
+	}
+	if specDb, _, _ := unstructured.NestedString(object.Object, "spec", "db"); specDb != "sca" {
+		t.Error(fmt.Sprintf("The spec was expected unchanged, found db %s", specDb))
+	}
+
+	updated, _ := db.GetDownsamplingItem("query1")
+	if updated.QueryState != "PREVIEW_DEPLOYED" {
+		t.Error(fmt.Sprintf("The written state was expected, found %s", updated.QueryState))
+	}
+}
+
+func Test_CrdDb_UpdateDownsamplingItem_SpecChanged(t *testing.T) {
+	db := NewCrdDbForTest(NewCrdDbTestObjects()...)
+	query, _ := db.GetDownsamplingItem("query1")
+
+	// the spec is changed while the item is deployed
+	object, _ := db.client.Get(context.TODO(), "query1", metav1.GetOptions{})
+	object.SetGeneration(2)
+	db.client.Update(context.TODO(), object, metav1.UpdateOptions{})
+
+	query.QueryState = "DEPLOYED"
+	_, err := db.UpdateDownsamplingItem(query)
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	object, _ = db.client.Get(context.TODO(), "query1", metav1.GetOptions{})
+	if observed, _, _ := unstructured.NestedInt64(object.Object, "status", "observedGeneration"); observed != 1 {
+		t.Error(fmt.Sprintf("The generation that was read was expected to be observed, found %d", observed))
+	}
+	updated, _ := db.GetDownsamplingItem("query1")
+	if updated.QueryState != "PENDING" {
+		t.Error(fmt.Sprintf("The changed spec was expected to be PENDING, found %s", updated.QueryState))
+	}
+}
+
+func Test_CrdDb_UpdateDownsamplingItem_NotFound(t *testing.T) {
+	db := NewCrdDbForTest()
+	_, err := db.UpdateDownsamplingItem(DownsamplingObject{QueryId: "query1"})
+	if err == nil {
+		t.Error("Error was expected for a query that is not declared")
+	}
+}
+
+func Test_CrdDb_DeleteDownsamplingItem(t *testing.T) {
+	db := NewCrdDbForTest(NewCrdDbTestObjects()...)
+	err := db.DeleteDownsamplingItem("query1")
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	query, _ := db.GetDownsamplingItem("query1")
+	if query.QueryId != "" {
+		t.Error("The query was expected to be deleted")
+	}
+
+	err = db.DeleteDownsamplingItem("missing")
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected for a missing query but received - %v", err))
+	}
+}
+
+func Test_CrdDb_DeleteDownsamplingItem_Finalizer(t *testing.T) {
+	object := NewDownsamplingQuery("query1", map[string]interface{}{"db": "sca"}, map[string]interface{}{"observedGeneration": int64(1), "queryState": "DEPLOYED"})
+	object.SetFinalizers([]string{DOWNSAMPLING_QUERY_FINALIZER})
+	now := metav1.Now()
+	object.SetDeletionTimestamp(&now)
+	db := NewCrdDbForTest(object)
+	err := db.DeleteDownsamplingItem("query1")
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	deleted, err := db.client.Get(context.TODO(), "query1", metav1.GetOptions{})
+	if err == nil && hasFinalizer(deleted) {
+		t.Error("The finalizer was expected to be removed")
+	}
+}
+
+func Test_CrdDb_HandleExpiredSimulations(t *testing.T) {
+	db := NewCrdDbForTest(NewCrdDbTestObjects()...)
+	handler := &DownsamplingItemHandler{db: db, config: &Config{}}
+	deleted, kept, err := handler.HandleExpiredSimulations()
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if len(deleted) != 0 || len(kept) != 1 || kept[0].QueryId != "query2" {
+		t.Error(fmt.Sprintf("The expired preview query2 was expected to be kept, found deleted %v and kept %v", deleted, kept))
+	}
+	query, _ := db.GetDownsamplingItem("query2")
+	if query.QueryId != "query2" || query.QueryState != "PREVIEW_EXPIRED" {
+		t.Error(fmt.Sprintf("The declared query was expected to be kept as PREVIEW_EXPIRED, found %s in state %s", query.QueryId, query.QueryState))
+	}
+}
+
+func Test_CrdDb_PreviewCancelAndExtend(t *testing.T) {
+	deployed := map[string]interface{}{"observedGeneration": int64(1), "queryState": "PREVIEW_DEPLOYED"}
+	cancel := NewDownsamplingQuery("query1", map[string]interface{}{"db": "sca", "preview": true, "previewCancel": true}, deployed)
+	cancel.SetGeneration(2)
+	extend := NewDownsamplingQuery("query2", map[string]interface{}{"db": "sca", "preview": true, "previewExtendMinutes": int64(60)}, deployed)
+	extend.SetGeneration(2)
+	// already extended by that spec
+	extended := NewDownsamplingQuery("query3", map[string]interface{}{"db": "sca", "preview": true, "previewExtendMinutes": int64(60)}, deployed)
+	db := NewCrdDbForTest(cancel, extend, extended)
+
+	for queryId, state := range map[string]string{"query1": "PREVIEW_CANCEL_PENDING", "query2": "PREVIEW_EXTEND_PENDING", "query3": "PREVIEW_DEPLOYED"} {
+		query, err := db.GetDownsamplingItem(queryId)
+		if err != nil || query.QueryState != state {
+			t.Error(fmt.Sprintf("%s: state %s was expected, found %s (%v)", queryId, state, query.QueryState, err))
+		}
+	}
+	todo, _ := db.GetAllToDoItems()
+	if len(todo) != 2 {
+		t.Error(fmt.Sprintf("The cancel and the extension were expected to be done, found %d items", len(todo)))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+type DashboardProvisionerInterface interface {
+	ProvisionDashboard(query DownsamplingObject) (string, error)
+	RemoveDashboard(query DownsamplingObject) error
+}
+
+func NewDashboardProvisioner(config *Config) (DashboardProvisionerInterface, error) {
+	if config.Grafana == nil || config.Grafana.Url == "" {
+		log.Println("No shared Grafana configured, deployed queries will not get a dashboard.")
+		return &NoopDashboardProvisioner{}, nil
+	}
+
+	provisioner := &DashboardProvisioner{config: config}
+	if config.TargetInfluxdb != nil && config.TargetInfluxdb.Url != "" {
+		grafana, err := newSharedGrafana(config.TargetInfluxdb.Url, config.Grafana, config.ReadyTimeout())
+		if err != nil {
+			return nil, err
+		}
+		grafana.SetInfluxdbCredentials(config.TargetInfluxdb.Username, config.TargetInfluxdb.Password)
+		grafana.SetDatasourcePrefix(config.Grafana.DatasourcePrefix)
+		provisioner.grafana = grafana
+	}
+	if config.TargetInfluxdbV2 != nil && config.TargetInfluxdbV2.Url != "" {
+		grafana, err := newSharedGrafana(config.TargetInfluxdbV2.Url, config.Grafana, config.ReadyTimeout())
+		if err != nil {
+			return nil, err
+		}
+		// the v1 compatible API of InfluxDB 2.x takes the token as password
+		grafana.SetInfluxdbCredentials(config.TargetInfluxdbV2.Org, config.TargetInfluxdbV2.Token)
+		grafana.SetDatasourcePrefix(config.Grafana.DatasourcePrefix)
+		provisioner.grafanaV2 = grafana
+	}
+
+	return provisioner, nil
+}
+
+// newSharedGrafana prefers the API key over the user, a service account token can be scoped to the folders it manages.
+func newSharedGrafana(influxdbUrl string, config *GrafanaConfig, upTimeout time.Duration) (*Grafana, error) {
+	if config.ApiKey != "" {
+		return NewGrafanaApiKeyApiClient(influxdbUrl, config.Url, config.ApiKey, upTimeout)
+	}
+	return NewGrafanaApiClient(influxdbUrl, config.Url, config.User, config.Password, upTimeout)
+}
+
+type NoopDashboardProvisioner struct {
+}
+
+func (p *NoopDashboardProvisioner) ProvisionDashboard(query DownsamplingObject) (string, error) {
+	return "", nil
+}
+
+func (p *NoopDashboardProvisioner) RemoveDashboard(query DownsamplingObject) error {
+	return nil
+}
+
+// DashboardProvisioner keeps a dashboard per deployed query in the shared Grafana, reading from a datasource on the
+// target InfluxDB of the query's database.
+type DashboardProvisioner struct {
+	grafana   GrafanaInterface
+	grafanaV2 GrafanaInterface
+	config    *Config
+}
+
+// grafanaFor returns the Grafana client whose datasources point to the InfluxDB db lives on, nil when that version is not configured.
+func (p *DashboardProvisioner) grafanaFor(db string) GrafanaInterface {
+	if p.config.IsInfluxdbV2(db) {
+		return p.grafanaV2
+	}
+	return p.grafana
+}
+
+// ProvisionDashboard returns the name of the dashboard template used, empty when no dashboard was provisioned.
+func (p *DashboardProvisioner) ProvisionDashboard(query DownsamplingObject) (string, error) {
+	grafana := p.grafanaFor(query.Db)
+	if grafana == nil {
+		log.Printf("No target InfluxDB configured for %s, skipping the dashboard.", query.Db)
+		return "", nil
+	}
+
+	err := grafana.CreateDatasource(query)
+	if err != nil {
+		return "", err
+	}
+	err = grafana.CreateFolder(DashboardFolderUid(query), "Downsampled "+query.Db)
+	if err != nil {
+		return "", err
+	}
+	return grafana.SaveDashboard(query, DashboardUid(query), DashboardFolderUid(query))
+}
+
+func (p *DashboardProvisioner) RemoveDashboard(query DownsamplingObject) error {
+	grafana := p.grafanaFor(query.Db)
+	if grafana == nil {
+		return nil
+	}
+	return grafana.DeleteDashboard(DashboardUid(query))
+}
+
+func DashboardUid(query DownsamplingObject) string {
+	return truncate("ds-"+query.QueryId, GRAFANA_UID_LENGTH)
+}
+
+func DashboardFolderUid(query DownsamplingObject) string {
+	return GrafanaUid("downsampled-" + query.Db)
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length]
+	}
+	return s
+}
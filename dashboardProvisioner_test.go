@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type FakeGrafana struct {
+	calls []string
+	err   error
+}
+
+func (g *FakeGrafana) CreateDatasource(dsObject DownsamplingObject) error {
+	g.calls = append(g.calls, "datasource "+dsObject.Db)
+	return g.err
+}
+
+func (g *FakeGrafana) CreateDashboard(dsObject DownsamplingObject) (string, error) {
+	g.calls = append(g.calls, "dashboard "+dsObject.QueryId)
+	return "default", g.err
+}
+
+func (g *FakeGrafana) CreateFolder(uid string, title string) error {
+	g.calls = append(g.calls, "folder "+uid)
+	return g.err
+}
+
+func (g *FakeGrafana) SaveDashboard(dsObject DownsamplingObject, uid string, folderUid string) (string, error) {
+	g.calls = append(g.calls, fmt.Sprintf("save %s %s", uid, folderUid))
+	return "counter", g.err
+}
+
+func (g *FakeGrafana) GetDashboard(uid string) ([]byte, error) {
+	g.calls = append(g.calls, "get "+uid)
+	return []byte(`{"dashboard": {"uid": "` + uid + `"}}`), g.err
+}
+
+func (g *FakeGrafana) DeleteDashboard(uid string) error {
+	g.calls = append(g.calls, "delete "+uid)
+	return g.err
+}
+
+func (g *FakeGrafana) CreateAnnotation(text string, tags []string) error {
+	g.calls = append(g.calls, fmt.Sprintf("annotation %v", tags))
+	return g.err
+}
+
+func (g *FakeGrafana) DeleteDatasource(uid string) error {
+	g.calls = append(g.calls, "delete datasource "+uid)
+	return g.err
+}
+
+func Test_DashboardProvisioner_ProvisionAndRemove(t *testing.T) {
+	grafana := &FakeGrafana{}
+	sut := &DashboardProvisioner{grafana: grafana, config: &Config{}}
+	query := getQueryForValidation()
+
+	template, err := sut.ProvisionDashboard(query)
+	if err != nil || template != "counter" || fmt.Sprint(grafana.calls) != "[datasource sca folder downsampled-sca save ds-query1 downsampled-sca]" {
+		t.Error(fmt.Sprintf("Dashboard was expected to be saved in the folder of sca, found %v (%v)", grafana.calls, err))
+	}
+	err = sut.RemoveDashboard(query)
+	if err != nil || grafana.calls[len(grafana.calls)-1] != "delete ds-query1" {
+		t.Error(fmt.Sprintf("Dashboard was expected to be deleted, found %v (%v)", grafana.calls, err))
+	}
+}
+
+func Test_DashboardProvisioner_InfluxdbV2(t *testing.T) {
+	grafana, grafanaV2 := &FakeGrafana{}, &FakeGrafana{}
+	sut := &DashboardProvisioner{grafana: grafana, grafanaV2: grafanaV2, config: &Config{TargetInfluxdbV2: &InfluxdbV2Config{Databases: []string{"sca"}}}}
+
+	_, err := sut.ProvisionDashboard(getQueryForValidation())
+	if err != nil || len(grafana.calls) != 0 || len(grafanaV2.calls) != 3 {
+		t.Error(fmt.Sprintf("Dashboard was expected on the InfluxDB 2.x datasource, found %v %v (%v)", grafana.calls, grafanaV2.calls, err))
+	}
+}
+
+func Test_DashboardProvisioner_Error(t *testing.T) {
+	grafana := &FakeGrafana{err: errors.New("folder error")}
+	sut := &DashboardProvisioner{grafana: grafana, config: &Config{}}
+
+	_, err := sut.ProvisionDashboard(getQueryForValidation())
+	if err == nil || len(grafana.calls) != 1 {
+		t.Error(fmt.Sprintf("Provisioning was expected to stop at the first error, found %v (%v)", grafana.calls, err))
+	}
+}
+
+func Test_DashboardUid_Truncated(t *testing.T) {
+	query := DownsamplingObject{QueryId: "0123456789012345678901234567890123456789"}
+	if uid := DashboardUid(query); len(uid) != 40 {
+		t.Error(fmt.Sprintf("Uid was expected to be cut to 40 characters, found %s", uid))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const DASHBOARD_TEMPLATES_DIR = "templates/dashboards"
+
+// DashboardTemplate is an entry of the manifest of a dashboard template directory.
+// Db and Measurement are regular expressions matching the whole name, Functions lists the field functions the
+// template is meant for and matches when every field of the query uses one of them. An empty rule matches anything.
+type DashboardTemplate struct {
+	Name        string   `json:"name"`
+	File        string   `json:"file"`
+	Db          string   `json:"db"`
+	Measurement string   `json:"measurement"`
+	Functions   []string `json:"functions"`
+	Path        string   `json:"-"`
+	db          *regexp.Regexp
+	measurement *regexp.Regexp
+}
+
+type DashboardManifest struct {
+	Default   string               `json:"default"`
+	Templates []*DashboardTemplate `json:"templates"`
+}
+
+type DashboardRegistryInterface interface {
+	Select(query DownsamplingObject) *DashboardTemplate
+}
+
+// DashboardRegistry picks the first template of the manifest matching a query, the default one when none does.
+type DashboardRegistry struct {
+	templates       []*DashboardTemplate
+	defaultTemplate *DashboardTemplate
+}
+
+func NewDashboardRegistry(dir string) (*DashboardRegistry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var manifest DashboardManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := &DashboardRegistry{}
+	for _, template := range manifest.Templates {
+		err = template.compile()
+		if err != nil {
+			return nil, err
+		}
+		template.Path = filepath.Join(dir, template.File)
+		if _, err := os.Stat(template.Path); err != nil {
+			return nil, err
+		}
+		if template.Name == manifest.Default {
+			registry.defaultTemplate = template
+		}
+		registry.templates = append(registry.templates, template)
+	}
+	if registry.defaultTemplate == nil {
+		return nil, errors.New(fmt.Sprintf("default dashboard template %s not found in %s", manifest.Default, dir))
+	}
+
+	return registry, nil
+}
+
+func (r *DashboardRegistry) Select(query DownsamplingObject) *DashboardTemplate {
+	for _, template := range r.templates {
+		if template.Matches(query) {
+			return template
+		}
+	}
+	return r.defaultTemplate
+}
+
+func (t *DashboardTemplate) compile() error {
+	var err error
+	if t.Db != "" {
+		if t.db, err = regexp.Compile("^(?:" + t.Db + ")$"); err != nil {
+			return errors.New(fmt.Sprintf("dashboard template %s: %v", t.Name, err))
+		}
+	}
+	if t.Measurement != "" {
+		if t.measurement, err = regexp.Compile("^(?:" + t.Measurement + ")$"); err != nil {
+			return errors.New(fmt.Sprintf("dashboard template %s: %v", t.Name, err))
+		}
+	}
+	return nil
+}
+
+func (t *DashboardTemplate) Matches(query DownsamplingObject) bool {
+	if t.db != nil && !t.db.MatchString(query.Db) {
+		return false
+	}
+	if t.measurement != nil && !t.measurement.MatchString(query.Measurement) {
+		return false
+	}
+	if len(t.Functions) == 0 {
+		return true
+	}
+	for _, field := range query.Fields {
+		if !t.hasFunction(field.Function) {
+			return false
+		}
+	}
+	return len(query.Fields) > 0
+}
+
+func (t *DashboardTemplate) hasFunction(function string) bool {
+	for _, f := range t.Functions {
+		if strings.EqualFold(f, function) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func NewDashboardRegistryForTest() *DashboardRegistry {
+	registry, err := NewDashboardRegistry(DASHBOARD_TEMPLATES_DIR)
+	if err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+type DashboardRegistryTestSuite struct {
+	label            string
+	measurement      string
+	functions        []string
+	expectedTemplate string
+}
+
+var DashboardRegistryTestCases = []DashboardRegistryTestSuite{
+	{"Latency measurement", "http_latency", []string{"MEAN", "MAX"}, "latency"},
+	{"Latency measurement of counters", "Request_Duration", []string{"SUM"}, "latency"},
+	{"Counters", "request_count", []string{"SUM", "count"}, "counter"},
+	{"Gauges", "heap_usage", []string{"last", "MAX"}, "gauge"},
+	{"Counters and gauges", "request_count", []string{"SUM", "LAST"}, "default"},
+	{"Unknown function", "request_count", []string{"PERCENTILE"}, "default"},
+	{"No fields", "request_count", nil, "default"},
+}
+
+func Test_DashboardRegistry_Select(t *testing.T) {
+	registry := NewDashboardRegistryForTest()
+	for _, testCase := range DashboardRegistryTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			query := DownsamplingObject{QueryId: "query1", Db: "sca", Measurement: testCase.measurement}
+			for _, function := range testCase.functions {
+				query.Fields = append(query.Fields, struct {
+					Alias    string `json:"alias"`
+					Field    string `json:"field"`
+					Function string `json:"func"`
+				}{"alias", "field", function})
+			}
+			template := registry.Select(query)
+			if template.Name != testCase.expectedTemplate || template.Path != filepath.Join(DASHBOARD_TEMPLATES_DIR, template.Name+".json") {
+				t.Error(fmt.Sprintf("%s: template %s was expected, found %s at %s", testCase.label, testCase.expectedTemplate, template.Name, template.Path))
+			}
+		})
+	}
+}
+
+func Test_DashboardRegistry_Select_Db(t *testing.T) {
+	dir := NewDashboardDirForTest(t, `{"default": "default", "templates": [{"name": "sca", "file": "sca.json", "db": "sca|sca_.*"}, {"name": "default", "file": "default.json"}]}`, "sca.json", "default.json")
+	defer os.RemoveAll(dir)
+	registry, err := NewDashboardRegistry(dir)
+	if err != nil {
+		t.Error(fmt.Sprintf("Error wasn't expected but received. %v", err))
+		return
+	}
+
+	for db, expected := range map[string]string{"sca": "sca", "sca_eu": "sca", "scale": "default"} {
+		if template := registry.Select(DownsamplingObject{Db: db}); template.Name != expected {
+			t.Error(fmt.Sprintf("Template %s was expected for %s, found %s", expected, db, template.Name))
+		}
+	}
+}
+
+func Test_NewDashboardRegistry_Invalid(t *testing.T) {
+	manifests := map[string]string{
+		"No default":      `{"default": "missing", "templates": [{"name": "default", "file": "default.json"}]}`,
+		"Missing file":    `{"default": "default", "templates": [{"name": "default", "file": "other.json"}]}`,
+		"Invalid pattern": `{"default": "default", "templates": [{"name": "default", "file": "default.json", "measurement": "(latency"}]}`,
+	}
+	for label, manifest := range manifests {
+		dir := NewDashboardDirForTest(t, manifest, "default.json")
+		_, err := NewDashboardRegistry(dir)
+		if err == nil {
+			t.Error(fmt.Sprintf("%s: error was expected but not received", label))
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func NewDashboardDirForTest(t *testing.T, manifest string, files ...string) string {
+	dir, err := ioutil.TempDir("", "dashboards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "manifest.json"), []byte(manifest), 0644)
+	for _, file := range files {
+		ioutil.WriteFile(filepath.Join(dir, file), []byte("{}"), 0644)
+	}
+	return dir
+}
@@ -20,9 +20,28 @@ type DownsamplingObject struct {
 		Field    string `json:"field"`
 		Function string `json:"func"`
 	} `json:"fields"`
-	Tags                   []string `json:"tags"`
-	Interval               int      `json:"interval"`
-	IsHistoricDownsampling bool     `json:"isHistoricDownsampling"`
+	Tags                   []string            `json:"tags"`
+	Interval               int                 `json:"interval"`
+	IsHistoricDownsampling bool                `json:"isHistoricDownsampling"`
+	SourceTopic            string              `json:"sourceTopic"`
+	SinkTopic              string              `json:"sinkTopic"`
+	StateMessage           string              `json:"stateMessage"`
+	TargetRpDuration       string              `json:"targetRpDuration"`
+	TargetRpShardDuration  string              `json:"targetRpShardDuration"`
+	PurgeOnDelete          bool                `json:"purgeOnDelete"`
+	PreviewDeployedAt      string              `json:"previewDeployedAt"`
+	PreviewInfluxdbUrl     string              `json:"previewInfluxdbUrl"`
+	PreviewGrafanaUrl      string              `json:"previewGrafanaUrl"`
+	PreviewReport          *PreviewReport      `json:"previewReport,omitempty"`
+	PreviewCredentials     *PreviewCredentials `json:"previewCredentials,omitempty"`
+	Engine                 string              `json:"engine"`
+	DashboardTemplate      string              `json:"dashboardTemplate,omitempty"`
+	ArtifactLocation       string              `json:"artifactLocation,omitempty"`
+	FlinkJobId             string              `json:"flinkJobId,omitempty"`
+	PreviewExtendMinutes   int                 `json:"previewExtendMinutes,omitempty"`
+	LastJob                *JobOutcome         `json:"lastJob,omitempty"`
+	// Generation is the generation of the DownsamplingQuery the item was read from, it is only kept by CrdDb.
+	Generation int64 `json:"-"`
 }
 
 type DownsampleObjects []DownsamplingObject
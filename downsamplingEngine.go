@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const ENGINE_FLINK = "flink"
+const ENGINE_CONTINUOUS_QUERY = "continuous_query"
+const ENGINE_FLUX_TASK = "flux_task"
+
+// How far back the source is looked at to count the series of a query for the engine size rule.
+const ENGINE_SERIES_WINDOW = time.Hour
+
+// DownsamplingEngineInterface runs the actual downsampling of a query into its target retention policy.
+type DownsamplingEngineInterface interface {
+	Name() string
+	Deploy(query DownsamplingObject) error
+	Delete(query DownsamplingObject) error
+}
+
+// JobEngineInterface is implemented by the engines running a query as a job of their own, whose id is kept on the item.
+type JobEngineInterface interface {
+	JobId(query DownsamplingObject) (string, error)
+}
+
+type FlinkEngine struct {
+	flinkJobHandler   FlinkJobHandlerInterface
+	targetProvisioner TargetProvisionerInterface
+}
+
+func (e *FlinkEngine) Name() string {
+	return ENGINE_FLINK
+}
+
+func (e *FlinkEngine) Deploy(query DownsamplingObject) error {
+	log.Println("Provisioning target retention policy...")
+	err := e.targetProvisioner.ProvisionTarget(query)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Deploying Flink job...")
+	return e.flinkJobHandler.DeployFlinkJob(query)
+}
+
+func (e *FlinkEngine) JobId(query DownsamplingObject) (string, error) {
+	return e.flinkJobHandler.FindFlinkJobId(query.QueryId, FLINK_ACTUAL)
+}
+
+func (e *FlinkEngine) Delete(query DownsamplingObject) error {
+	log.Println("Cancelling Flink job...")
+	count, err := e.flinkJobHandler.CancelFlinkJob(query.QueryId, FLINK_ALL)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d jobs were cancel attempted.", count)
+
+	return e.targetProvisioner.PurgeTarget(query)
+}
+
+// ContinuousQueryEngine downsamples inside the source InfluxDB, so the target retention policy is provisioned there too.
+type ContinuousQueryEngine struct {
+	influx            InfluxdbInterface
+	targetProvisioner TargetProvisionerInterface
+}
+
+func (e *ContinuousQueryEngine) Name() string {
+	return ENGINE_CONTINUOUS_QUERY
+}
+
+func (e *ContinuousQueryEngine) Deploy(query DownsamplingObject) error {
+	log.Println("Provisioning target retention policy...")
+	err := e.targetProvisioner.ProvisionTarget(query)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating continuous query...")
+	return e.influx.CreateContinuousQuery(query.Db, DownsamplingTaskName(query), BuildContinuousQuerySelect(query))
+}
+
+func (e *ContinuousQueryEngine) Delete(query DownsamplingObject) error {
+	log.Println("Dropping continuous query...")
+	err := e.influx.DropContinuousQuery(query.Db, DownsamplingTaskName(query))
+	if err != nil {
+		return err
+	}
+
+	return e.targetProvisioner.PurgeTarget(query)
+}
+
+// DownsamplingTaskName names the continuous query or Flux task of a query.
+func DownsamplingTaskName(query DownsamplingObject) string {
+	return "ds_" + query.QueryId
+}
+
+// BuildContinuousQuerySelect writes each aggregated field under its alias into the target, keeping the query tags.
+func BuildContinuousQuerySelect(query DownsamplingObject) string {
+	var selectors []string
+	for _, field := range query.Fields {
+		selectors = append(selectors, fmt.Sprintf("%s(%s) AS %s", strings.ToUpper(field.Function), quoteIdentifier(field.Field), quoteIdentifier(field.Alias)))
+	}
+	groupBy := []string{fmt.Sprintf("time(%ds)", query.Interval)}
+	for _, tag := range query.Tags {
+		groupBy = append(groupBy, quoteIdentifier(tag))
+	}
+
+	return fmt.Sprintf("SELECT %s INTO %s.%s FROM %s.%s GROUP BY %s",
+		strings.Join(selectors, ", "),
+		quoteIdentifier(query.Db), qualifiedMeasurement(query.TargetRp, query.TargetMeasurement),
+		quoteIdentifier(query.Db), qualifiedMeasurement(query.Rp, query.Measurement),
+		strings.Join(groupBy, ", "))
+}
+
+// FluxTaskEngine downsamples databases migrated to InfluxDB 2.x with a Flux task reading the db/rp bucket.
+type FluxTaskEngine struct {
+	influx            InfluxdbV2Interface
+	targetProvisioner TargetProvisionerInterface
+	config            *Config
+}
+
+func (e *FluxTaskEngine) Name() string {
+	return ENGINE_FLUX_TASK
+}
+
+func (e *FluxTaskEngine) Deploy(query DownsamplingObject) error {
+	if !e.config.IsInfluxdbV2(query.Db) {
+		return errors.New("database " + query.Db + " is not on InfluxDB 2.x, Flux tasks cannot be used")
+	}
+
+	log.Println("Provisioning target bucket...")
+	err := e.targetProvisioner.ProvisionTarget(query)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating Flux task...")
+	name := DownsamplingTaskName(query)
+	return e.influx.CreateTask(name, BuildFluxTask(name, query))
+}
+
+func (e *FluxTaskEngine) Delete(query DownsamplingObject) error {
+	log.Println("Deleting Flux task...")
+	err := e.influx.DeleteTask(DownsamplingTaskName(query))
+	if err != nil {
+		return err
+	}
+
+	return e.targetProvisioner.PurgeTarget(query)
+}
+
+type EngineSelectorInterface interface {
+	SelectEngine(query DownsamplingObject) (DownsamplingEngineInterface, error)
+	GetEngine(name string) (DownsamplingEngineInterface, error)
+}
+
+type EngineSelector struct {
+	engines       map[string]DownsamplingEngineInterface
+	defaultEngine string
+	maxSeries     int
+	sourceInflux  InfluxdbInterface
+	config        *Config
+}
+
+func NewEngineSelector(config *Config, metrics *Metrics) (*EngineSelector, error) {
+	targetProvisioner, err := NewTargetProvisioner(config)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := &EngineSelector{
+		engines:       map[string]DownsamplingEngineInterface{ENGINE_FLINK: &FlinkEngine{NewFlinkJobHandler(config, metrics), targetProvisioner}},
+		defaultEngine: config.EngineConfig.Default,
+		maxSeries:     config.EngineConfig.ContinuousQueryMaxSeries,
+		config:        config,
+	}
+
+	if config.TargetInfluxdbV2 != nil && config.TargetInfluxdbV2.Url != "" {
+		influxV2, err := NewInfluxdbV2(config.TargetInfluxdbV2.Url, config.TargetInfluxdbV2.Token, config.TargetInfluxdbV2.Org, config.ReadyTimeout())
+		if err != nil {
+			return nil, err
+		}
+		selector.engines[ENGINE_FLUX_TASK] = &FluxTaskEngine{influxV2, &TargetProvisioner{influxV2: influxV2, retention: config.TargetRetention, config: config}, config}
+	}
+
+	if config.SourceInfluxdb == nil || config.SourceInfluxdb.Url == "" {
+		log.Println("No source InfluxDB configured, continuous queries are not available.")
+		return selector, nil
+	}
+	sourceInflux, err := NewInfluxdb(config.SourceInfluxdb.Url, config.SourceInfluxdb.Username, config.SourceInfluxdb.Password, config.ReadyTimeout())
+	if err != nil {
+		return nil, err
+	}
+	selector.sourceInflux = sourceInflux
+	selector.engines[ENGINE_CONTINUOUS_QUERY] = &ContinuousQueryEngine{sourceInflux, &TargetProvisioner{influx: sourceInflux, retention: config.TargetRetention}}
+	return selector, nil
+}
+
+// SelectEngine picks the engine set on the query, else a continuous query when the query has at most maxSeries series, else the default.
+// The size rule only applies to InfluxDB 1.x databases, continuous queries do not exist on 2.x.
+func (s *EngineSelector) SelectEngine(query DownsamplingObject) (DownsamplingEngineInterface, error) {
+	if query.Engine != "" {
+		return s.GetEngine(query.Engine)
+	}
+
+	if s.maxSeries > 0 && s.engines[ENGINE_CONTINUOUS_QUERY] != nil && !s.config.IsInfluxdbV2(query.Db) {
+		var fields []string
+		for _, field := range query.Fields {
+			fields = append(fields, field.Field)
+		}
+		now := time.Now()
+		series, err := s.sourceInflux.GetSeriesPoints(query.Db, query.Rp, query.Measurement, fields, now.Add(-ENGINE_SERIES_WINDOW), now)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Query %s has %d series, continuous queries are used up to %d.", query.QueryId, len(series), s.maxSeries)
+		if len(series) <= s.maxSeries {
+			return s.GetEngine(ENGINE_CONTINUOUS_QUERY)
+		}
+	}
+
+	return s.GetEngine(s.defaultEngine)
+}
+
+// GetEngine returns the engine by name, queries deployed before engines were recorded ran on Flink.
+func (s *EngineSelector) GetEngine(name string) (DownsamplingEngineInterface, error) {
+	if name == "" {
+		name = ENGINE_FLINK
+	}
+	engine, ok := s.engines[name]
+	if !ok {
+		return nil, errors.New("downsampling engine " + name + " is not available")
+	}
+	return engine, nil
+}
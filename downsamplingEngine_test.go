@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func NewFlinkEngineSelector(flinkJobHandler FlinkJobHandlerInterface) *EngineSelector {
+	return &EngineSelector{engines: map[string]DownsamplingEngineInterface{ENGINE_FLINK: &FlinkEngine{flinkJobHandler, &NoopTargetProvisioner{}}}, defaultEngine: ENGINE_FLINK}
+}
+
+type FakeSeriesInfluxdb struct {
+	*FakeSchemaInfluxdb
+	series int
+}
+
+func (i *FakeSeriesInfluxdb) GetSeriesPoints(db string, rp string, measurement string, fields []string, from time.Time, to time.Time) (map[string]int64, error) {
+	points := make(map[string]int64)
+	for s := 0; s < i.series; s++ {
+		points[fmt.Sprintf("app_name=%d", s)] = 1
+	}
+	return points, i.err
+}
+
+func NewEngineSelectorForTest(series int) *EngineSelector {
+	influx := &FakeSeriesInfluxdb{&FakeSchemaInfluxdb{}, series}
+	return &EngineSelector{
+		engines: map[string]DownsamplingEngineInterface{
+			ENGINE_FLINK:            &FlinkEngine{&FakeFlinkJobHandler{}, &NoopTargetProvisioner{}},
+			ENGINE_CONTINUOUS_QUERY: &ContinuousQueryEngine{influx, &NoopTargetProvisioner{}},
+		},
+		defaultEngine: ENGINE_FLINK,
+		maxSeries:     10,
+		sourceInflux:  influx,
+	}
+}
+
+type EngineSelectorTestSuite struct {
+	label          string
+	series         int
+	queryEngine    string
+	expectedEngine string
+}
+
+var EngineSelectorTestCases = []EngineSelectorTestSuite{
+	{"Few series", 3, "", ENGINE_CONTINUOUS_QUERY},
+	{"Many series", 50, "", ENGINE_FLINK},
+	{"Engine set on the query", 3, ENGINE_FLINK, ENGINE_FLINK},
+	{"Continuous query set on the query", 50, ENGINE_CONTINUOUS_QUERY, ENGINE_CONTINUOUS_QUERY},
+}
+
+func Test_EngineSelector_SelectEngine(t *testing.T) {
+	for _, testCase := range EngineSelectorTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			query := getQueryForValidation()
+			query.Engine = testCase.queryEngine
+			engine, err := NewEngineSelectorForTest(testCase.series).SelectEngine(query)
+			if err != nil || engine.Name() != testCase.expectedEngine {
+				t.Error(fmt.Sprintf("%s: engine was expected %s found %v (%v)", testCase.label, testCase.expectedEngine, engine, err))
+			}
+		})
+	}
+}
+
+func Test_EngineSelector_GetEngine(t *testing.T) {
+	selector := NewFlinkEngineSelector(&FakeFlinkJobHandler{})
+	engine, err := selector.GetEngine("")
+	if err != nil || engine.Name() != ENGINE_FLINK {
+		t.Error(fmt.Sprintf("Queries without engine were expected on Flink, found %v (%v)", engine, err))
+	}
+	_, err = selector.GetEngine(ENGINE_CONTINUOUS_QUERY)
+	if err == nil || !strings.Contains(err.Error(), "not available") {
+		t.Error(fmt.Sprintf("Was expecting error for an unavailable engine but received %v", err))
+	}
+}
+
+func Test_EngineSelector_SelectEngine_Error(t *testing.T) {
+	selector := NewEngineSelectorForTest(0)
+	selector.sourceInflux.(*FakeSeriesInfluxdb).err = errors.New("connection refused")
+	_, err := selector.SelectEngine(getQueryForValidation())
+	if err == nil {
+		t.Error(fmt.Sprintf("Was expecting error but not received"))
+	}
+}
+
+func Test_ContinuousQueryEngine_DeployAndDelete(t *testing.T) {
+	influx := &FakeSchemaInfluxdb{}
+	engine := &ContinuousQueryEngine{influx, &NoopTargetProvisioner{}}
+	query := getQueryForValidation()
+	query.QueryId, query.TargetRp, query.TargetMeasurement, query.Interval = "query1", "downsampled", "request_count_1m", 60
+
+	err := engine.Deploy(query)
+	expected := "sca.ds_query1 SELECT SUM(\"count\") AS \"sum_count\", LAST(\"status\") AS \"last_status\" INTO \"sca\".\"downsampled\".\"request_count_1m\" FROM \"sca\".\"autogen\".\"request_count\" GROUP BY time(60s), \"app_name\", \"scenario\""
+	if err != nil || len(influx.continuousQueries) != 1 || influx.continuousQueries[0] != expected {
+		t.Error(fmt.Sprintf("Continuous query was expected %s found %v (%v)", expected, influx.continuousQueries, err))
+	}
+
+	err = engine.Delete(query)
+	if err != nil || len(influx.droppedContinuousQueries) != 1 || influx.droppedContinuousQueries[0] != "sca.ds_query1" {
+		t.Error(fmt.Sprintf("Continuous query sca.ds_query1 was expected to be dropped, found %v (%v)", influx.droppedContinuousQueries, err))
+	}
+}
+
+type FakeInfluxdbV2 struct {
+	FakeSchemaInfluxdb
+	tasks        map[string]string
+	deletedTasks []string
+}
+
+func (i *FakeInfluxdbV2) EnsureBucket(db string, rp string, duration string, shardDuration string) (string, error) {
+	return "bucket1", i.EnsureRetentionPolicy(db, rp, duration, shardDuration)
+}
+
+func (i *FakeInfluxdbV2) CreateTask(name string, flux string) error {
+	if i.tasks == nil {
+		i.tasks = make(map[string]string)
+	}
+	i.tasks[name] = flux
+	return i.err
+}
+
+func (i *FakeInfluxdbV2) DeleteTask(name string) error {
+	i.deletedTasks = append(i.deletedTasks, name)
+	return i.err
+}
+
+func Test_FluxTaskEngine_DeployAndDelete(t *testing.T) {
+	config := &Config{TargetInfluxdbV2: &InfluxdbV2Config{Databases: []string{"sca"}}}
+	influx := &FakeInfluxdbV2{}
+	engine := &FluxTaskEngine{influx, &TargetProvisioner{influxV2: influx, config: config}, config}
+	query := getQueryForValidation()
+	query.TargetRp, query.TargetMeasurement, query.Interval = "downsampled", "request_count_1m", 60
+
+	err := engine.Deploy(query)
+	if err != nil || influx.tasks["ds_query1"] != BuildFluxTask("ds_query1", query) {
+		t.Error(fmt.Sprintf("Flux task ds_query1 was expected to be created, found %v (%v)", influx.tasks, err))
+	}
+	if fmt.Sprint(influx.retentionPolicies) != "[sca.downsampled INF ]" {
+		t.Error(fmt.Sprintf("Target bucket sca/downsampled was expected to be provisioned, found %v", influx.retentionPolicies))
+	}
+
+	err = engine.Delete(query)
+	if err != nil || len(influx.deletedTasks) != 1 || influx.deletedTasks[0] != "ds_query1" {
+		t.Error(fmt.Sprintf("Flux task ds_query1 was expected to be deleted, found %v (%v)", influx.deletedTasks, err))
+	}
+
+	query.Db = "omni"
+	err = engine.Deploy(query)
+	if err == nil || !strings.Contains(err.Error(), "not on InfluxDB 2.x") {
+		t.Error(fmt.Sprintf("Was expecting error for a database on InfluxDB 1.x but received %v", err))
+	}
+}
+
+func Test_EngineSelector_SelectEngine_InfluxdbV2(t *testing.T) {
+	selector := NewEngineSelectorForTest(3)
+	selector.config = &Config{TargetInfluxdbV2: &InfluxdbV2Config{Databases: []string{"sca"}}}
+	engine, err := selector.SelectEngine(getQueryForValidation())
+	if err != nil || engine.Name() != ENGINE_FLINK {
+		t.Error(fmt.Sprintf("Databases on InfluxDB 2.x were expected on the default engine, found %v (%v)", engine, err))
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -20,6 +21,30 @@ type DbInterface interface {
 	UpdateDownsamplingItem(DownsampleObject DownsamplingObject) (string, error)
 }
 
+// ExpiringDbInterface is implemented by the backends whose items are declared by their owner, an expired preview is
+// kept there as PREVIEW_EXPIRED rather than deleted from under the owner.
+type ExpiringDbInterface interface {
+	KeepsExpiredItems() bool
+}
+
+const DB_BACKEND_DYNAMODB = "dynamodb"
+const DB_BACKEND_CRD = "crd"
+
+// NewDb returns the store of the downsampling queries, a DynamoDB table or DownsamplingQuery objects of the namespace.
+func NewDb(config *Config) (DbInterface, error) {
+	switch config.DbBackend {
+	case DB_BACKEND_DYNAMODB:
+		return NewDynamodb(config)
+	case DB_BACKEND_CRD:
+		k8client, err := NewK8Client(config)
+		if err != nil {
+			return nil, err
+		}
+		return NewCrdDb(k8client, config), nil
+	}
+	return nil, errors.New("unknown db backend " + config.DbBackend + ", must be " + DB_BACKEND_DYNAMODB + " or " + DB_BACKEND_CRD)
+}
+
 func (d *Dynamodb) formTableName(table string) *string {
 	return aws.String(fmt.Sprintf("%s%s", d.Configs.DbTablePrefix, table))
 }
@@ -68,8 +93,14 @@ func (d *Dynamodb) GetAllToDoItems() ([]DownsamplingObject, error) {
 			":queryStateDeleted": {
 				S: aws.String("DELETED"),
 			},
+			":queryStatePreviewCancelPending": {
+				S: aws.String("PREVIEW_CANCEL_PENDING"),
+			},
+			":queryStatePreviewExtendPending": {
+				S: aws.String("PREVIEW_EXTEND_PENDING"),
+			},
 		},
-		FilterExpression: aws.String("queryState IN (:queryStatePending, :queryStatePreviewPending, :queryStateDeleted)"),
+		FilterExpression: aws.String("queryState IN (:queryStatePending, :queryStatePreviewPending, :queryStateDeleted, :queryStatePreviewCancelPending, :queryStatePreviewExtendPending)"),
 		TableName:        d.formTableName("metrics_downsample_queries"),
 	}
 	var ds []DownsamplingObject
@@ -31,6 +31,9 @@ var DynamodbTestCases = map[string]DynamodbTestCase{
 	"PENDING":          {DownsamplingObject{QueryState: "PENDING"}},
 	"PREVIEW_DEPLOYED": {DownsamplingObject{QueryState: "PREVIEW_DEPLOYED"}},
 	"DELETED":          {DownsamplingObject{QueryState: "DELETED"}},
+
+	"PREVIEW_CANCEL_PENDING": {DownsamplingObject{QueryState: "PREVIEW_CANCEL_PENDING"}},
+	"PREVIEW_EXTEND_PENDING": {DownsamplingObject{QueryState: "PREVIEW_EXTEND_PENDING"}},
 }
 
 func (m *mockDynamoDBClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
@@ -105,10 +108,11 @@ func Test_Dynamodb_GetDeletedDownsampleItems(t *testing.T) {
 func Test_Dynamodb_GetAllPendingItems(t *testing.T) {
 	tc := NewDynamodbTestSuite()
 	ds, _ := tc.Dynamodb.GetAllToDoItems()
-	if len(ds) != 3 {
-		t.Error(fmt.Sprintf("%s expected to be %d but found %d", "Length of query objects", 3, len(ds)))
+	if len(ds) != 5 {
+		t.Error(fmt.Sprintf("%s expected to be %d but found %d", "Length of query objects", 5, len(ds)))
 	}
-	var statuses = map[string]string{"PREVIEW_PENDING": "PREVIEW_PENDING", "PENDING": "PENDING", "DELETED": "DELETED"}
+	var statuses = map[string]string{"PREVIEW_PENDING": "PREVIEW_PENDING", "PENDING": "PENDING", "DELETED": "DELETED",
+		"PREVIEW_CANCEL_PENDING": "PREVIEW_CANCEL_PENDING", "PREVIEW_EXTEND_PENDING": "PREVIEW_EXTEND_PENDING"}
 	for _, item := range ds {
 		delete(statuses, item.QueryState)
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+)
+
+// The component the Kubernetes events of the controller come from.
+const EVENT_SOURCE_COMPONENT = "downsampling-controller"
+
+// Reasons of the Kubernetes events of the steps of a job, lifecycle events are recorded with lifecycleReasons.
+const REASON_PREVIEW_AVAILABLE = "PreviewAvailable"
+const REASON_GRAFANA_PROVISIONED = "GrafanaProvisioned"
+const REASON_FLINK_JOB_SUBMITTED = "FlinkJobSubmitted"
+const REASON_ENGINE_DEPLOYED = "EngineDeployed"
+
+var lifecycleReasons = map[string]string{
+	EVENT_PREVIEW_READY:     "PreviewReady",
+	EVENT_DEPLOYED:          "Deployed",
+	EVENT_DELETED:           "Deleted",
+	EVENT_FAILED:            "Failed",
+	EVENT_EXPIRED:           "Expired",
+	EVENT_PREVIEW_CANCELLED: "PreviewCancelled",
+	EVENT_PREVIEW_EXTENDED:  "PreviewExtended",
+}
+
+type EventRecorderInterface interface {
+	Eventf(stack *PreviewStack, eventType string, reason string, messageFmt string, args ...interface{})
+}
+
+// EventRecorder records Kubernetes events on the controller job it runs in and on the deployment of a preview stack,
+// so kubectl describe shows what the controller did. Jobs the coordinator did not spawn have no job to record on.
+type EventRecorder struct {
+	recorder  record.EventRecorder
+	clientset kubernetes.Interface
+	job       *corev1.ObjectReference
+	namespace string
+}
+
+func NewEventRecorder(k8client K8ClientInterface, config *Config) *EventRecorder {
+	clientset := k8client.GetClientSet()
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events(config.Namespace)})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: EVENT_SOURCE_COMPONENT})
+	return &EventRecorder{recorder, clientset, jobReference(clientset, config), config.Namespace}
+}
+
+// jobReference refers to the job by uid too, kubectl describe only shows the events with the uid of the object.
+func jobReference(clientset kubernetes.Interface, config *Config) *corev1.ObjectReference {
+	if config.JobName == "" {
+		return nil
+	}
+	reference := &corev1.ObjectReference{Kind: "Job", APIVersion: "batch/v1", Name: config.JobName, Namespace: config.Namespace}
+	job, err := clientset.BatchV1().Jobs(config.Namespace).Get(context.TODO(), config.JobName, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("Could not get job %s, its events will not show with kubectl describe: %v", config.JobName, err)
+		return reference
+	}
+	reference.UID = job.UID
+	return reference
+}
+
+// Eventf records the event on the job, and on the deployment of stack unless it is nil.
+func (e *EventRecorder) Eventf(stack *PreviewStack, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if e.job != nil {
+		e.recorder.Eventf(e.job, eventType, reason, messageFmt, args...)
+	}
+	if stack != nil {
+		e.recorder.Eventf(e.deploymentReference(stack), eventType, reason, messageFmt, args...)
+	}
+}
+
+// deploymentReference takes the uid from the owner of the stack, or from the deployment as long as it is served as apps/v1.
+func (e *EventRecorder) deploymentReference(stack *PreviewStack) *corev1.ObjectReference {
+	reference := &corev1.ObjectReference{Kind: "Deployment", APIVersion: DEPLOYMENT_API_APPS_V1, Name: stack.Name, Namespace: e.namespace}
+	if stack.Owner != nil {
+		reference.APIVersion, reference.UID = stack.Owner.APIVersion, stack.Owner.UID
+		return reference
+	}
+	if e.clientset != nil {
+		deployment, err := e.clientset.AppsV1().Deployments(e.namespace).Get(context.TODO(), stack.Name, metav1.GetOptions{})
+		if err == nil {
+			reference.UID = deployment.UID
+		}
+	}
+	return reference
+}
+
+// recordLifecycleEvent records a lifecycle event as a Kubernetes event, a warning for a failure.
+func recordLifecycleEvent(events EventRecorderInterface, event LifecycleEvent, stack *PreviewStack) {
+	eventType := corev1.EventTypeNormal
+	message := fmt.Sprintf("Query %s %s", event.QueryId, strings.Replace(event.Type, "_", " ", -1))
+	if event.Type == EVENT_FAILED {
+		eventType = corev1.EventTypeWarning
+		message += ": " + event.Message
+	} else if event.Message != "" {
+		message += ", " + event.Message
+	}
+	events.Eventf(stack, eventType, lifecycleReasons[event.Type], "%s", message)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"testing"
+)
+
+// NewTestEventRecorder records on a fake recorder as if it ran in a controller job, see recordedEvents.
+func NewTestEventRecorder() *EventRecorder {
+	return &EventRecorder{recorder: record.NewFakeRecorder(100), job: &corev1.ObjectReference{Kind: "Job", Name: "downsamplr-test-job"}, namespace: "testns"}
+}
+
+// recordedEvents returns the events recorded so far as "type reason message".
+func recordedEvents(events EventRecorderInterface) []string {
+	recorded := []string{}
+	channel := events.(*EventRecorder).recorder.(*record.FakeRecorder).Events
+	for {
+		select {
+		case event := <-channel:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
+func Test_EventRecorder_Eventf(t *testing.T) {
+	stack := &PreviewStack{Name: "downsamplr-preview-query1", Owner: &metav1.OwnerReference{APIVersion: DEPLOYMENT_API_APPS_V1, Kind: "Deployment", Name: "downsamplr-preview-query1", UID: "uid1"}}
+	testCases := map[string]struct {
+		events   *EventRecorder
+		stack    *PreviewStack
+		expected string
+	}{
+		"job and deployment": {NewTestEventRecorder(), stack, "[Normal PreviewAvailable stack is up Normal PreviewAvailable stack is up]"},
+		"job only":           {NewTestEventRecorder(), nil, "[Normal PreviewAvailable stack is up]"},
+		"not in a job":       {&EventRecorder{recorder: record.NewFakeRecorder(10)}, nil, "[]"},
+	}
+
+	for name, tc := range testCases {
+		tc.events.Eventf(tc.stack, corev1.EventTypeNormal, REASON_PREVIEW_AVAILABLE, "stack is %s", "up")
+		recorded := fmt.Sprint(recordedEvents(tc.events))
+		if recorded != tc.expected {
+			t.Error(fmt.Sprintf("%s: events %s were expected, found %s", name, tc.expected, recorded))
+		}
+	}
+}
+
+func Test_RecordLifecycleEvent(t *testing.T) {
+	query := DownsamplingObject{QueryId: "query1"}
+	extended := NewLifecycleEvent(EVENT_PREVIEW_EXTENDED, "test", query)
+	extended.Message = "extended by 30 minutes"
+	testCases := map[string]struct {
+		event    LifecycleEvent
+		expected string
+	}{
+		"deployed": {NewLifecycleEvent(EVENT_DEPLOYED, "test", query), "[Normal Deployed Query query1 deployed]"},
+		"extended": {extended, "[Normal PreviewExtended Query query1 preview extended, extended by 30 minutes]"},
+		"failed":   {NewFailedLifecycleEvent("test", query, fmt.Errorf("flink is down")), "[Warning Failed Query query1 failed: flink is down]"},
+	}
+
+	for name, tc := range testCases {
+		events := NewTestEventRecorder()
+		recordLifecycleEvent(events, tc.event, nil)
+		recorded := fmt.Sprint(recordedEvents(events))
+		if recorded != tc.expected {
+			t.Error(fmt.Sprintf("%s: events %s were expected, found %s", name, tc.expected, recorded))
+		}
+	}
+}
+
+func Test_EventRecorder_References(t *testing.T) {
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "downsamplr-test-job", Namespace: "testns", UID: "jobuid"}}
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "downsamplr-preview-query1", Namespace: "testns", UID: "deploymentuid"}}
+	clientset := fake.NewSimpleClientset(job, deployment)
+	config := &Config{Namespace: "testns", JobName: "downsamplr-test-job"}
+
+	reference := jobReference(clientset, config)
+	if reference == nil || reference.Name != "downsamplr-test-job" || reference.UID != "jobuid" {
+		t.Error(fmt.Sprintf("The job was expected to be referred by uid jobuid, found %v", reference))
+	}
+	if reference := jobReference(clientset, &Config{Namespace: "testns"}); reference != nil {
+		t.Error(fmt.Sprintf("No job was expected without a job name, found %v", reference))
+	}
+
+	events := &EventRecorder{record.NewFakeRecorder(10), clientset, reference, "testns"}
+	deploymentReference := events.deploymentReference(&PreviewStack{Name: "downsamplr-preview-query1"})
+	if deploymentReference.Kind != "Deployment" || deploymentReference.UID != "deploymentuid" {
+		t.Error(fmt.Sprintf("The deployment was expected to be referred by uid deploymentuid, found %v", deploymentReference))
+	}
+}
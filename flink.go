@@ -33,7 +33,8 @@ func (f *FlinkClient) MakeHttpCall(method string, url string) (int, []byte, erro
 		return http.StatusInternalServerError, nil, err
 	}
 
-	log.Printf("Request: %s %s", method, url)
+	// the query is left out, the program args of a job hold credentials
+	log.Printf("Request: %s %s://%s%s", method, req.URL.Scheme, req.URL.Host, req.URL.Path)
 	res, err := f.flinkClient.Do(req)
 	if err != nil {
 		return http.StatusInternalServerError, nil, err
@@ -94,10 +95,12 @@ func (f *FlinkFunctions) GetRunningFlinkJobs() (JobDetails, error) {
 	return jobDetails, err
 }
 
+// CreatelJob passes the program arguments as the program-args query parameter of the legacy REST API, the InfluxDB url
+// among them holds credentials and is redacted from the log.
 func (f *FlinkFunctions) CreatelJob(jarId string, param string) error {
 	flinkJarUrl := f.ProduceJobCreationUrl(jarId)
 
-	log.Printf("Sending to Flink – Endpoint: %s\nUrl Params: %s", flinkJarUrl, param)
+	log.Printf("Sending to Flink – Endpoint: %s\nUrl Params: %s", flinkJarUrl, redactProgramArgs(param))
 
 	data := url.Values{
 		"program-args": {param},
@@ -158,6 +161,19 @@ func (f *FlinkFunctions) GetLatestFlinkJarId() (string, error) {
 	return jarId, nil
 }
 
+// Program arguments whose value is not logged.
+var redactedProgramArgs = map[string]bool{"--influxdbUrl": true}
+
+func redactProgramArgs(param string) string {
+	args := strings.Fields(param)
+	for i := 1; i < len(args); i++ {
+		if redactedProgramArgs[args[i-1]] {
+			args[i] = REDACTED
+		}
+	}
+	return strings.Join(args, " ")
+}
+
 func (f *FlinkFunctions) ProduceJobCancelUrl(jobId string) string {
 	return fmt.Sprintf("%s/%s/%s", f.config.FlinkConfig.FlinkJobDeleteUrl, jobId, "cancel")
 }
@@ -42,6 +42,7 @@ type FlinkJobHandlerInterface interface {
 	DeployFlinkJob(query DownsamplingObject) error
 	DeployFlinkJobForSimulation(query DownsamplingObject, influxdbBaseUrl string, offsets KafkaPartitionOffsets) error
 	CancelFlinkJob(queryId string, mode string) (int, error)
+	FindFlinkJobId(queryId string, mode string) (string, error)
 	HandleOldFlinkJobs() (int, error)
 }
 
@@ -93,10 +94,19 @@ func (f *FlinkJobHandler) CreateSimulationJobConfig(query DownsamplingObject, in
 	}
 	offsetsStr := strings.Join(arr, ",")
 
-	influxDbUrl := influxdbBaseUrl + ":80/write?db=" + query.Db + "&rp=downsample&precision=us"
+	sourceTopic, err := f.config.GetSourceKafkaTopic(query)
+	if err != nil {
+		return "", err
+	}
+
+	influxDbUrl := influxdbBaseUrl + ":80/write?db=" + query.Db + "&rp=" + PREVIEW_RP + "&precision=us"
+	if query.PreviewCredentials != nil || f.config.IsInfluxdbV2(query.Db) {
+		user, password := PreviewInfluxdbCredentials(f.config, query)
+		influxDbUrl += "&u=" + user + "&p=" + password
+	}
 	flinkUrlParamStr := fmt.Sprintf("--jobConfig %s --sourceTopic %s --sourceCluster %s --consumerGroupId %s --influxdbUrl %s --previewMode true --jobName %s --topicOffsets %s",
 		base64.StdEncoding.EncodeToString([]byte(queryStr)),
-		f.config.GetSourceKafkaTopic(query),
+		sourceTopic,
 		f.config.KafkaConfig.Source,
 		"downsample-simulation-"+query.QueryId,
 		base64.StdEncoding.EncodeToString([]byte(influxDbUrl)),
@@ -138,13 +148,22 @@ func (f *FlinkJobHandler) CreateDownsampleJobConfig(query DownsamplingObject) (s
 		return "", err
 	}
 
+	sourceTopic, err := f.config.GetSourceKafkaTopic(query)
+	if err != nil {
+		return "", err
+	}
+	sinkTopic, err := f.config.GetSinkKafkaTopic(query)
+	if err != nil {
+		return "", err
+	}
+
 	flinkUrlParamStr := fmt.Sprintf("--jobConfig %s --sourceTopic %s --sourceCluster %s --consumerGroupId %s --sinkCluster %s --sinkTopic %s --jobName %s",
 		base64.StdEncoding.EncodeToString([]byte(queryStr)),
-		f.config.GetSourceKafkaTopic(query),
+		sourceTopic,
 		f.config.KafkaConfig.Source,
 		"downsample-"+query.QueryId,
 		f.config.KafkaConfig.Sink,
-		f.config.GetSinkKafkaTopic(query),
+		sinkTopic,
 		"downsample"+":"+query.QueryId+":"+query.Db+":"+query.Measurement+":"+fmt.Sprintf("%d", query.Interval),
 	)
 	return flinkUrlParamStr, nil
@@ -179,6 +198,12 @@ func (f *FlinkJobHandler) ModifyQueryObject(q DownsamplingObject) DownsamplingOb
 }
 
 func (f *FlinkJobHandler) CheckForExistingJob(queryId string, mode string) (bool, error) {
+	jobId, err := f.FindFlinkJobId(queryId, mode)
+	return jobId != "", err
+}
+
+// FindFlinkJobId returns the id of the running Flink job of the query, empty when there is none.
+func (f *FlinkJobHandler) FindFlinkJobId(queryId string, mode string) (string, error) {
 	log.Printf("Flink Job check mode: %s", mode)
 	prefix := ""
 	switch mode {
@@ -189,23 +214,23 @@ func (f *FlinkJobHandler) CheckForExistingJob(queryId string, mode string) (bool
 	case FLINKL_SIMULATION:
 		prefix = "simulate"
 	default:
-		return false, errors.New("Wrong mode, aborting...")
+		return "", errors.New("Wrong mode, aborting...")
 	}
 	log.Println("Getting running flink jobs...")
 	jobDetails, err := f.flink.GetRunningFlinkJobs()
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	log.Println("Checking if a Flink job is already running for the query id...")
 	for _, job := range jobDetails.Jobs {
 		if strings.HasPrefix(job.Name, prefix) && strings.Contains(job.Name, queryId) {
 			log.Printf("Found marching Flink job: %s", job.JobId)
-			return true, nil
+			return job.JobId, nil
 		}
 	}
 
-	return false, nil
+	return "", nil
 }
 
 func (f *FlinkJobHandler) CancelFlinkJob(queryId string, mode string) (int, error) {
@@ -254,7 +279,8 @@ func (f *FlinkJobHandler) HandleOldFlinkJobs() (int, error) {
 	for _, job := range jobDetails.Jobs {
 		ts := job.StartTs / 1000
 		now := time.Now().Unix()
-		if strings.HasPrefix(job.Name, "simulate:") && float64(now-ts) > f.config.ExpireAfterMinute*60 {
+		// expired previews cancel their own jobs, this only catches those left behind, extended ones included
+		if strings.HasPrefix(job.Name, "simulate:") && float64(now-ts) > f.config.PreviewLifetimeMinute()*60 {
 			err = f.flink.CancelJob(job.JobId)
 			if err != nil {
 				return count, err
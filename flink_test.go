@@ -364,6 +364,27 @@ func Test_FlinkFunctions_CreatelJob_Success(t *testing.T) {
 	}
 }
 
+func Test_FlinkFunctions_CreatelJob_ProgramArgs(t *testing.T) {
+	received := "not received"
+	flinkSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.URL.Path + " " + r.URL.Query().Get("program-args")
+		w.WriteHeader(200)
+	}))
+	defer flinkSpy.Close()
+	sut := &FlinkFunctions{config: &Config{FlinkConfig: &FlinkConfig{FlinkJarsUrl: flinkSpy.URL + "/jars/"}}, flinkClient: NewFlinkClient()}
+	err := sut.CreatelJob("jarid", "--influxdbUrl aHR0cDovL2luZmx1eD9wPXNlY3JldA== --jobName simulate:query1")
+	if err != nil || received != "/jars/jarid/run --influxdbUrl aHR0cDovL2luZmx1eD9wPXNlY3JldA== --jobName simulate:query1" {
+		t.Error(fmt.Sprintf("The program args were expected as program-args of the legacy run request, found %s (%v)", received, err))
+	}
+}
+
+func Test_RedactProgramArgs(t *testing.T) {
+	redacted := redactProgramArgs("--jobConfig e30= --influxdbUrl aHR0cDovL2luZmx1eD9wPXNlY3JldA== --jobName simulate:query1")
+	if redacted != "--jobConfig e30= --influxdbUrl <redacted> --jobName simulate:query1" {
+		t.Error(fmt.Sprintf("The InfluxDB url was expected to be redacted, found %s", redacted))
+	}
+}
+
 func Test_FlinkFunctions_CreatelJob_Failure_No_Error(t *testing.T) {
 	tc := NewFlinkFunctionsTestSuite(&Config{FlinkConfig: &FlinkConfig{FlinkJobDeleteUrl: ""}}, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
@@ -11,6 +12,9 @@ import (
 	"time"
 )
 
+// Grafana uids are at most 40 characters.
+const GRAFANA_UID_LENGTH = 40
+
 type GrafanaClientInterface interface {
 	MakeHttpCall(method string, path string, body interface{}, isJson bool) (int, []byte, error)
 }
@@ -19,6 +23,7 @@ type GrafanaClient struct {
 	grafanaClient http.Client
 	User          string
 	Password      string
+	ApiKey        string
 }
 
 func NewGrafanaClient(user string, password string) *GrafanaClient {
@@ -28,6 +33,14 @@ func NewGrafanaClient(user string, password string) *GrafanaClient {
 	return &GrafanaClient{grafanaClient: httpClient, User: user, Password: password}
 }
 
+// NewGrafanaApiKeyClient authenticates with an API key or a service account token instead of basic auth.
+func NewGrafanaApiKeyClient(apiKey string) *GrafanaClient {
+	httpClient := http.Client{
+		Timeout: time.Second * 30,
+	}
+	return &GrafanaClient{grafanaClient: httpClient, ApiKey: apiKey}
+}
+
 func (f *GrafanaClient) MakeHttpCall(method string, url string, body interface{}, isJson bool) (int, []byte, error) {
 	var data []byte
 	var err error
@@ -46,10 +59,14 @@ func (f *GrafanaClient) MakeHttpCall(method string, url string, body interface{}
 	if err != nil {
 		return http.StatusInternalServerError, nil, err
 	}
-	req.SetBasicAuth(f.User, f.Password)
+	if f.ApiKey != "" {
+		req.Header.Add("Authorization", "Bearer "+f.ApiKey)
+	} else {
+		req.SetBasicAuth(f.User, f.Password)
+	}
 	req.Header.Add("Content-Type", "application/json")
 
-	log.Printf("Request: %s %s %v", method, url, data)
+	log.Printf("Request: %s %s %s", method, url, redactPasswords(string(data)))
 	res, err := f.grafanaClient.Do(req)
 	if err != nil {
 		return http.StatusInternalServerError, nil, err
@@ -65,49 +82,153 @@ func (f *GrafanaClient) MakeHttpCall(method string, url string, body interface{}
 }
 
 type DataSource struct {
-	Name      string `json:"name"`
-	Type      string `json:"type"`
-	URL       string `json:"url"`
-	Access    string `json:"access"`
-	Database  string `json:"database,omitempty"`
-	IsDefault bool   `json:"isDefault"`
-	BasicAuth bool   `json:"basicAuth"`
+	Uid            string            `json:"uid,omitempty"`
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	URL            string            `json:"url"`
+	Access         string            `json:"access"`
+	Database       string            `json:"database,omitempty"`
+	IsDefault      bool              `json:"isDefault"`
+	BasicAuth      bool              `json:"basicAuth"`
+	User           string            `json:"user,omitempty"`
+	JsonData       map[string]string `json:"jsonData,omitempty"`
+	SecureJsonData map[string]string `json:"secureJsonData,omitempty"`
 }
 
+// DashboardTemplateFiller renders the templates of templates/dashboards with a panel per field and a variable per tag.
+// The templates are in the rows layout of schemaVersion 14, which Grafana migrates when it loads them, and refer to
+// their datasource by DatasourceUid so they do not depend on its name.
+// RawPolicy is empty when the preview holds no raw data to overlay.
+// An empty FolderUid saves the dashboard in the General folder, Message is kept as the version message.
 type DashboardTemplateFiller struct {
-	Database    string
-	Measurement string
-	Tag         string
-	Field       string
+	Database          string
+	Datasource        string
+	DatasourceUid     string
+	Title             string
+	Uid               string
+	FolderUid         string
+	Message           string
+	Overwrite         bool
+	Measurement       string
+	TargetMeasurement string
+	Policy            string
+	RawPolicy         string
+	Tags              []string
+	Fields            []DashboardField
+}
+
+type DashboardField struct {
+	PanelId  int
+	Alias    string
+	Field    string
+	Function string
+}
+
+func NewDashboardTemplateFiller(dsObject DownsamplingObject, datasource string, policy string, rawPolicy string) *DashboardTemplateFiller {
+	filler := &DashboardTemplateFiller{
+		Database:          dsObject.Db,
+		Datasource:        datasource,
+		DatasourceUid:     GrafanaUid(datasource),
+		Title:             "Downsample Preview",
+		Measurement:       dsObject.Measurement,
+		TargetMeasurement: dsObject.TargetMeasurement,
+		Policy:            policy,
+		RawPolicy:         rawPolicy,
+		Tags:              dsObject.Tags,
+	}
+	for i, field := range dsObject.Fields {
+		filler.Fields = append(filler.Fields, DashboardField{i + 1, field.Alias, field.Field, strings.ToLower(field.Function)})
+	}
+	return filler
 }
 
 type GrafanaInterface interface {
 	CreateDatasource(dsObject DownsamplingObject) error
-	CreateDashboard(dsObject DownsamplingObject) error
+	CreateDashboard(dsObject DownsamplingObject) (string, error)
+	CreateFolder(uid string, title string) error
+	SaveDashboard(dsObject DownsamplingObject, uid string, folderUid string) (string, error)
+	GetDashboard(uid string) ([]byte, error)
+	DeleteDashboard(uid string) error
+	DeleteDatasource(uid string) error
+	CreateAnnotation(text string, tags []string) error
 }
 
 type Grafana struct {
-	templateParser TemplateParserInterface
-	influxdbUrl    string
-	grafanaBaseURL string
-	grafanaClient  GrafanaClientInterface
+	templateParser    TemplateParserInterface
+	dashboards        DashboardRegistryInterface
+	influxdbUrl       string
+	grafanaBaseURL    string
+	grafanaClient     GrafanaClientInterface
+	influxdbUser      string
+	influxdbPassword  string
+	rawPolicy         string
+	datasourcePrefix  string
+	defaultDatasource bool
 }
 
-func NewGrafanaApiClient(influxdbUrl string, baseUrl string, user string, password string) (*Grafana, error) {
-	grafana := &Grafana{influxdbUrl: influxdbUrl, templateParser: NewTemplateParser(), grafanaBaseURL: baseUrl, grafanaClient: NewGrafanaClient(user, password)}
-	grafana.checkUpStatus()
+// NewGrafanaApiClient waits up to upTimeout for Grafana to answer.
+func NewGrafanaApiClient(influxdbUrl string, baseUrl string, user string, password string, upTimeout time.Duration) (*Grafana, error) {
+	dashboards, err := NewDashboardRegistry(DASHBOARD_TEMPLATES_DIR)
+	if err != nil {
+		return nil, err
+	}
+	grafana := &Grafana{influxdbUrl: influxdbUrl, templateParser: NewTemplateParser(), dashboards: dashboards, grafanaBaseURL: baseUrl, grafanaClient: NewGrafanaClient(user, password)}
+	if err := grafana.checkUpStatus(upTimeout); err != nil {
+		return nil, err
+	}
 	return grafana, nil
 }
 
+func NewGrafanaApiKeyApiClient(influxdbUrl string, baseUrl string, apiKey string, upTimeout time.Duration) (*Grafana, error) {
+	dashboards, err := NewDashboardRegistry(DASHBOARD_TEMPLATES_DIR)
+	if err != nil {
+		return nil, err
+	}
+	grafana := &Grafana{influxdbUrl: influxdbUrl, templateParser: NewTemplateParser(), dashboards: dashboards, grafanaBaseURL: baseUrl, grafanaClient: NewGrafanaApiKeyClient(apiKey)}
+	if err := grafana.checkUpStatus(upTimeout); err != nil {
+		return nil, err
+	}
+	return grafana, nil
+}
+
+// SetInfluxdbCredentials makes the datasources authenticate against InfluxDB.
+func (g *Grafana) SetInfluxdbCredentials(user string, password string) {
+	g.influxdbUser = user
+	g.influxdbPassword = password
+}
+
+// SetDatasourcePrefix names datasources prefix+db, so they do not clash with datasources of a shared Grafana.
+func (g *Grafana) SetDatasourcePrefix(prefix string) {
+	g.datasourcePrefix = prefix
+}
+
+// SetDefaultDatasource makes the datasources the default one, only for a Grafana of its own such as the one of a preview.
+func (g *Grafana) SetDefaultDatasource() {
+	g.defaultDatasource = true
+}
+
+// SetRawPolicy makes dashboards overlay the raw data kept in rp with the downsampled series.
+func (g *Grafana) SetRawPolicy(rp string) {
+	g.rawPolicy = rp
+}
+
+// CreateDatasource updates an existing datasource, so it follows the InfluxDB and the credentials it was given.
+// Its uid is GrafanaUid of the datasource name.
 func (g *Grafana) CreateDatasource(dsObject DownsamplingObject) error {
 	log.Println("Creating grafana datasource...")
-	ds := &DataSource{dsObject.Db, "influxdb", g.influxdbUrl, "proxy", dsObject.Db, true, false}
+	name := g.datasourcePrefix + dsObject.Db
+	// Grafana 8 and later read the database from jsonData, older ones from database
+	ds := &DataSource{GrafanaUid(name), name, "influxdb", g.influxdbUrl, "proxy", dsObject.Db, g.defaultDatasource, false, g.influxdbUser, map[string]string{"dbName": dsObject.Db}, nil}
+	if g.influxdbPassword != "" {
+		ds.SecureJsonData = map[string]string{"password": g.influxdbPassword}
+	}
 	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodPost, g.grafanaBaseURL+"/api/datasources", ds, true)
+	if err == nil && code == http.StatusConflict {
+		log.Println("Datasource already exists, updating...")
+		code, body, err = g.grafanaClient.MakeHttpCall(http.MethodPut, g.grafanaBaseURL+"/api/datasources/uid/"+ds.Uid, ds, true)
+	}
 	if err != nil || code != http.StatusOK || strings.Contains(string(body), "error") {
-		if code == http.StatusConflict {
-			log.Println("Datasource already exists, skipping...")
-			return nil
-		} else if err == nil {
+		if err == nil {
 			err = errors.New(string((body)))
 		}
 		return err
@@ -115,35 +236,143 @@ func (g *Grafana) CreateDatasource(dsObject DownsamplingObject) error {
 	return nil
 }
 
-func (g *Grafana) CreateDashboard(dsObject DownsamplingObject) error {
-	log.Println("Creating grafana dashboard...")
-	filler := &DashboardTemplateFiller{dsObject.Db, dsObject.TargetMeasurement, dsObject.Tags[0], dsObject.Fields[0].Alias}
-	str, err := g.templateParser.LoadTemplate("templates/dashboard.json", filler)
+// CreateDashboard replaces the preview dashboard of a retried preview, so it always matches the current template.
+// It returns the name of the template the dashboard was rendered from.
+func (g *Grafana) CreateDashboard(dsObject DownsamplingObject) (string, error) {
+	template := g.dashboards.Select(dsObject)
+	log.Printf("Creating grafana dashboard from template %s...", template.Name)
+	filler := NewDashboardTemplateFiller(dsObject, g.datasourcePrefix+dsObject.Db, PREVIEW_RP, g.rawPolicy)
+	filler.Uid, filler.Overwrite = PreviewDashboardUid(dsObject), true
+	filler.Message = fmt.Sprintf("Preview of %s (%s)", dsObject.QueryId, dsObject.QueryHash)
+	str, err := g.templateParser.LoadTemplate(template.Path, filler)
 	if err != nil {
-		return err
+		return template.Name, err
 	}
 	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodPost, g.grafanaBaseURL+"/api/dashboards/db", str, false)
 	if err != nil || code != http.StatusOK || strings.Contains(string(body), "error") {
-		if code == http.StatusPreconditionFailed && strings.Contains(string(body), "name-exists") {
-			log.Println("Dashboard already exists, skipping...")
-			return nil
-		} else if err == nil {
+		if err == nil {
 			err = errors.New(string((body)))
 		}
+		return template.Name, err
+	}
+	return template.Name, nil
+}
+
+// CreateFolder creates the folder with uid when missing.
+func (g *Grafana) CreateFolder(uid string, title string) error {
+	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodGet, g.grafanaBaseURL+"/api/folders/"+uid, nil, false)
+	if err != nil {
 		return err
 	}
+	if code == http.StatusNotFound {
+		log.Printf("Creating grafana folder %s...", uid)
+		code, body, err = g.grafanaClient.MakeHttpCall(http.MethodPost, g.grafanaBaseURL+"/api/folders", map[string]string{"uid": uid, "title": title}, true)
+		if err != nil {
+			return err
+		}
+	}
+	if code != http.StatusOK {
+		return errors.New(string(body))
+	}
 	return nil
 }
 
-func (g *Grafana) checkUpStatus() {
-	for {
-		log.Printf("Checking if Grafana is up at %s", g.grafanaBaseURL+"/api/admin/stats")
-		code, body, err := g.grafanaClient.MakeHttpCall(http.MethodGet, g.grafanaBaseURL+"/api/admin/stats", nil, false)
-		if err != nil || code != http.StatusOK || strings.Contains(string(body), "error") {
-			log.Printf("Got Response: %v, %v, %v\nRetrying after 5s...", code, body, err)
-			time.Sleep(5 * time.Second)
-		} else {
-			return
-		}
+// SaveDashboard creates or replaces the dashboard of the downsampled measurement, keeping the uid stable across updates.
+// It returns the name of the template the dashboard was rendered from.
+func (g *Grafana) SaveDashboard(dsObject DownsamplingObject, uid string, folderUid string) (string, error) {
+	template := g.dashboards.Select(dsObject)
+	log.Printf("Saving grafana dashboard %s from template %s...", uid, template.Name)
+	filler := NewDashboardTemplateFiller(dsObject, g.datasourcePrefix+dsObject.Db, dsObject.TargetRp, "")
+	filler.Uid, filler.FolderUid, filler.Overwrite = uid, folderUid, true
+	filler.Title = fmt.Sprintf("%s.%s (%s)", dsObject.TargetRp, dsObject.TargetMeasurement, dsObject.QueryId)
+	filler.Message = fmt.Sprintf("Deployed %s (%s)", dsObject.QueryId, dsObject.QueryHash)
+	str, err := g.templateParser.LoadTemplate(template.Path, filler)
+	if err != nil {
+		return template.Name, err
+	}
+	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodPost, g.grafanaBaseURL+"/api/dashboards/db", str, false)
+	if err != nil {
+		return template.Name, err
+	}
+	if code != http.StatusOK {
+		return template.Name, errors.New(string(body))
+	}
+	return template.Name, nil
+}
+
+// GetDashboard returns the dashboard with uid and its metadata as Grafana exports them.
+func (g *Grafana) GetDashboard(uid string) ([]byte, error) {
+	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodGet, g.grafanaBaseURL+"/api/dashboards/uid/"+uid, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, errors.New(string(body))
 	}
+	return body, nil
+}
+
+// DeleteDashboard ignores a missing dashboard so a failed delete can be retried.
+func (g *Grafana) DeleteDashboard(uid string) error {
+	log.Printf("Deleting grafana dashboard %s...", uid)
+	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodDelete, g.grafanaBaseURL+"/api/dashboards/uid/"+uid, nil, false)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusNotFound {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+// DeleteDatasource ignores a missing datasource so a failed delete can be retried.
+func (g *Grafana) DeleteDatasource(uid string) error {
+	log.Printf("Deleting grafana datasource %s...", uid)
+	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodDelete, g.grafanaBaseURL+"/api/datasources/uid/"+uid, nil, false)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK && code != http.StatusNotFound {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+// CreateAnnotation adds an annotation at the current time, not bound to any dashboard.
+func (g *Grafana) CreateAnnotation(text string, tags []string) error {
+	annotation := map[string]interface{}{"time": time.Now().UnixNano() / int64(time.Millisecond), "text": text, "tags": tags}
+	code, body, err := g.grafanaClient.MakeHttpCall(http.MethodPost, g.grafanaBaseURL+"/api/annotations", annotation, true)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+func PreviewDashboardUid(query DownsamplingObject) string {
+	return truncate("preview-"+query.QueryId, GRAFANA_UID_LENGTH)
+}
+
+// GrafanaUid turns name into a valid uid, uids only allow letters, digits, - and _.
+func GrafanaUid(name string) string {
+	uid := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, name)
+	return truncate(uid, GRAFANA_UID_LENGTH)
+}
+
+// checkUpStatus asks /api/health, /api/admin/stats is not open to API keys and service accounts.
+func (g *Grafana) checkUpStatus(timeout time.Duration) error {
+	return waitUntilUp("Grafana", g.grafanaBaseURL+"/api/health", timeout, func() error {
+		code, body, err := g.grafanaClient.MakeHttpCall(http.MethodGet, g.grafanaBaseURL+"/api/health", nil, false)
+		if err == nil && (code != http.StatusOK || strings.Contains(string(body), "error")) {
+			err = fmt.Errorf("%v %s", code, body)
+		}
+		return err
+	})
 }
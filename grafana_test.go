@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -105,14 +106,25 @@ var GrafanaTestsCasesDataSource = []GrafanaTestSuite{
 		"",
 	},
 	{
-		"Conflict - Should Return with no error",
+		"Conflict - Should Update with no error",
 		func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(409)
-			w.Write([]byte("error message1"))
+			if r.Method == http.MethodPost {
+				w.WriteHeader(409)
+				w.Write([]byte("error message1"))
+			}
 		},
 		false,
 		"",
 	},
+	{
+		"Conflict - Should Return with error when the update fails",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(409)
+			w.Write([]byte("error message1"))
+		},
+		true,
+		"error message1",
+	},
 	{
 		"Error - Should Return with no error",
 		func(w http.ResponseWriter, r *http.Request) {
@@ -134,13 +146,13 @@ var GrafanaTestsCasesDashboard = []GrafanaTestSuite{
 		"",
 	},
 	{
-		"Conflict - Should Return with no error",
+		"Conflict - Should Return with error",
 		func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(412)
 			w.Write([]byte("name-exists"))
 		},
-		false,
-		"",
+		true,
+		"name-exists",
 	},
 	{
 		"Error - Should Return with no error",
@@ -163,7 +175,7 @@ func NewGrafanaMockClient(f func(w http.ResponseWriter, r *http.Request)) *Grafa
 }
 
 func (f *GrafanaMockClient) MakeHttpCall(method string, url string, body interface{}, isJson bool) (int, []byte, error) {
-	return NewGrafanaClient("admin", "admin").MakeHttpCall(http.MethodPost, f.url, body, isJson)
+	return NewGrafanaClient("admin", "admin").MakeHttpCall(method, f.url, body, isJson)
 }
 
 func (suite *GrafanaTestSuite) AssertErrorNotExpected(err error, t *testing.T) {
@@ -248,10 +260,190 @@ func Test_Grafana_CreateDashboard(t *testing.T) {
 	}`), &ds)
 	for _, testCase := range GrafanaTestsCasesDashboard {
 		t.Run(testCase.label, func(t *testing.T) {
-			sut := &Grafana{grafanaClient: NewGrafanaMockClient(testCase.grafanaCallHandler), templateParser: NewTemplateParser()}
-			err := sut.CreateDashboard(ds)
+			sut := &Grafana{grafanaClient: NewGrafanaMockClient(testCase.grafanaCallHandler), templateParser: NewTemplateParser(), dashboards: NewDashboardRegistryForTest()}
+			_, err := sut.CreateDashboard(ds)
 			testCase.AssertErrorNotExpected(err, t)
 			testCase.AssertErrorExpected(err, t)
 		})
 	}
 }
+
+func Test_Grafana_CreateDashboard_NoTags(t *testing.T) {
+	var dashboard string
+	sut := &Grafana{grafanaClient: NewGrafanaMockClient(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		dashboard = string(body)
+		w.WriteHeader(200)
+	}), templateParser: NewTemplateParser(), dashboards: NewDashboardRegistryForTest()}
+	sut.SetRawPolicy(PREVIEW_RAW_RP)
+	query := getQueryForValidation()
+	query.Tags = nil
+
+	_, err := sut.CreateDashboard(query)
+	if err != nil || !strings.Contains(dashboard, "\"policy\": \"raw\"") || !strings.Contains(dashboard, "last_status") {
+		t.Error(fmt.Sprintf("Dashboard was expected for every field with raw data, found %s (%v)", dashboard, err))
+	}
+}
+
+func Test_GrafanaClient_MakeHttpCall_ApiKey(t *testing.T) {
+	grafanaSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, basicAuth := r.BasicAuth()
+		if basicAuth || r.Header.Get("Authorization") != "Bearer key1" {
+			w.WriteHeader(401)
+		}
+	}))
+	defer grafanaSpy.Close()
+	sut := NewGrafanaApiKeyClient("key1")
+	code, _, err := sut.MakeHttpCall(http.MethodGet, grafanaSpy.URL, nil, false)
+	if err != nil || code != 200 {
+		t.Error(fmt.Sprintf("Bearer auth was expected, received %d (%v)", code, err))
+	}
+}
+
+func Test_Grafana_CreateDashboard_Overwrite(t *testing.T) {
+	var dashboard map[string]interface{}
+	sut := &Grafana{grafanaClient: NewGrafanaMockClient(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&dashboard)
+		w.WriteHeader(200)
+	}), templateParser: NewTemplateParser(), dashboards: NewDashboardRegistryForTest()}
+
+	template, err := sut.CreateDashboard(getQueryForValidation())
+	if err != nil || template != "default" || dashboard["overwrite"] != true || dashboard["folderUid"] != "" || !strings.HasPrefix(dashboard["message"].(string), "Preview of query1") {
+		t.Error(fmt.Sprintf("Preview dashboard was expected to overwrite with a message, found %v (%v)", dashboard, err))
+	}
+	if uid := dashboard["dashboard"].(map[string]interface{})["uid"]; uid != "preview-query1" {
+		t.Error(fmt.Sprintf("Dashboard uid was expected to be preview-query1, found %v", uid))
+	}
+}
+
+func Test_Grafana_CreateDatasource_SecurePassword(t *testing.T) {
+	var ds DataSource
+	sut := &Grafana{grafanaClient: NewGrafanaMockClient(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&ds)
+		w.WriteHeader(200)
+	}), datasourcePrefix: "downsampled-"}
+	sut.SetInfluxdbCredentials("downsamplr", "secret")
+
+	err := sut.CreateDatasource(getQueryForValidation())
+	if err != nil || ds.Uid != "downsampled-sca" || ds.User != "downsamplr" || ds.JsonData["dbName"] != "sca" || ds.SecureJsonData["password"] != "secret" {
+		t.Error(fmt.Sprintf("Datasource was expected with a uid and a secure password, found %v (%v)", ds, err))
+	}
+}
+
+func Test_Grafana_CreateDatasource_UpdatesExisting(t *testing.T) {
+	var calls []string
+	var ds DataSource
+	grafanaSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/datasources":
+			w.WriteHeader(409)
+			w.Write([]byte(`{"message": "data source with the same name already exists"}`))
+		case r.Method == http.MethodPut && r.URL.Path == "/api/datasources/uid/downsampled-sca":
+			json.NewDecoder(r.Body).Decode(&ds)
+			w.Write([]byte(`{"message": "Datasource updated"}`))
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer grafanaSpy.Close()
+	sut := &Grafana{grafanaClient: NewGrafanaClient("admin", "admin"), grafanaBaseURL: grafanaSpy.URL, influxdbUrl: "http://influxdb2", datasourcePrefix: "downsampled-"}
+	sut.SetInfluxdbCredentials("downsamplr", "secret2")
+
+	err := sut.CreateDatasource(getQueryForValidation())
+	if err != nil || len(calls) != 2 || calls[1] != "PUT /api/datasources/uid/downsampled-sca" {
+		t.Error(fmt.Sprintf("Existing datasource was expected to be updated by uid, found %v (%v)", calls, err))
+	}
+	if ds.URL != "http://influxdb2" || ds.SecureJsonData["password"] != "secret2" || ds.IsDefault {
+		t.Error(fmt.Sprintf("Datasource was expected to be updated with the new url and password, not as default, found %v", ds))
+	}
+}
+
+func Test_Grafana_CreateDatasource_Default(t *testing.T) {
+	var ds DataSource
+	sut := &Grafana{grafanaClient: NewGrafanaMockClient(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&ds)
+		w.WriteHeader(200)
+	})}
+	sut.SetDefaultDatasource()
+
+	err := sut.CreateDatasource(getQueryForValidation())
+	if err != nil || !ds.IsDefault {
+		t.Error(fmt.Sprintf("Datasource of a preview Grafana was expected to be the default, found %v (%v)", ds, err))
+	}
+}
+
+func Test_GrafanaUid(t *testing.T) {
+	if uid := GrafanaUid("downsampled-sca.prod/eu"); uid != "downsampled-sca-prod-eu" {
+		t.Error(fmt.Sprintf("Invalid characters were expected to be replaced, found %s", uid))
+	}
+}
+
+func Test_Grafana_SaveDashboardInFolder(t *testing.T) {
+	var calls []string
+	var dashboard map[string]interface{}
+	grafanaSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/folders/downsampled-sca":
+			w.WriteHeader(404)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/folders":
+			w.Write([]byte(`{"id": 7, "uid": "downsampled-sca"}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/datasources/uid/downsampled-sca":
+			w.Write([]byte(`{"message": "Data source deleted"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/dashboards/db":
+			json.NewDecoder(r.Body).Decode(&dashboard)
+			w.Write([]byte(`{"status": "success"}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/dashboards/uid/ds-query1":
+			w.WriteHeader(404)
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer grafanaSpy.Close()
+	sut := &Grafana{grafanaClient: NewGrafanaClient("admin", "admin"), grafanaBaseURL: grafanaSpy.URL, templateParser: NewTemplateParser(), dashboards: NewDashboardRegistryForTest()}
+	query := getQueryForValidation()
+
+	err := sut.CreateFolder(DashboardFolderUid(query), "Downsampled sca")
+	if err != nil {
+		t.Error(fmt.Sprintf("Folder was expected to be created, found %v", err))
+	}
+	_, err = sut.SaveDashboard(query, DashboardUid(query), DashboardFolderUid(query))
+	if err != nil || dashboard["folderUid"] != "downsampled-sca" || dashboard["overwrite"] != true || !strings.HasPrefix(dashboard["message"].(string), "Deployed query1") {
+		t.Error(fmt.Sprintf("Dashboard was expected to be saved in folder downsampled-sca, found %v (%v)", dashboard, err))
+	}
+	if uid := dashboard["dashboard"].(map[string]interface{})["uid"]; uid != "ds-query1" {
+		t.Error(fmt.Sprintf("Dashboard uid was expected to be ds-query1, found %v", uid))
+	}
+	err = sut.DeleteDashboard(DashboardUid(query))
+	if err != nil || len(calls) != 4 {
+		t.Error(fmt.Sprintf("A missing dashboard was expected to be deleted without error, found %v (%v)", calls, err))
+	}
+	err = sut.DeleteDatasource(GrafanaUid("downsampled-sca"))
+	if err != nil || calls[4] != "DELETE /api/datasources/uid/downsampled-sca" {
+		t.Error(fmt.Sprintf("Datasource was expected to be deleted by uid, found %v (%v)", calls, err))
+	}
+}
+
+func Test_Grafana_CreateAnnotation(t *testing.T) {
+	var annotation struct {
+		Time int64    `json:"time"`
+		Text string   `json:"text"`
+		Tags []string `json:"tags"`
+	}
+	grafanaSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/annotations" {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&annotation)
+		w.Write([]byte(`{"message": "Annotation added", "id": 1}`))
+	}))
+	defer grafanaSpy.Close()
+	sut := &Grafana{grafanaClient: NewGrafanaApiKeyClient("key1"), grafanaBaseURL: grafanaSpy.URL}
+
+	err := sut.CreateAnnotation("deployed", []string{"db:sca", "action:deploy"})
+	if err != nil || annotation.Time == 0 || annotation.Text != "deployed" || len(annotation.Tags) != 2 {
+		t.Error(fmt.Sprintf("Annotation was expected with time, text and tags, found %v (%v)", annotation, err))
+	}
+}
@@ -1,23 +1,59 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/influxdata/influxdb/client/v2"
 	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type InfluxdbInterface interface {
-	CreateDatabaseAndRp(db string, rp string) ([]client.Result, error)
+	InfluxdbAdminInterface
+	GetMeasurements(db string, measurement string) ([]string, error)
+	GetFieldKeys(db string, rp string, measurement string) (map[string][]string, error)
+	GetTagKeys(db string, rp string, measurement string) ([]string, error)
+	GetSeriesPoints(db string, rp string, measurement string, fields []string, from time.Time, to time.Time) (map[string]int64, error)
+	CreateContinuousQuery(db string, name string, selectStatement string) error
+	DropContinuousQuery(db string, name string) error
+	GetBuckets(db string, rp string, measurement string, selector string, tags []string, interval time.Duration, from time.Time, to time.Time) (map[string]float64, error)
+	ReadPoints(db string, rp string, measurement string, fieldTypes map[string]string, from time.Time, to time.Time, limit int) ([]InfluxdbPoint, error)
+	WritePoints(db string, rp string, points []InfluxdbPoint) error
 }
 
+// Points are written in batches of this size.
+const INFLUXDB_WRITE_BATCH = 5000
+
+// Points are read in chunks of this size.
+const INFLUXDB_READ_CHUNK = 10000
+
+type RetentionPolicy struct {
+	Name          string
+	Duration      string
+	ShardDuration string
+}
+
+type InfluxdbPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// Timeout bounds each request, none when zero.
 type Influxdb struct {
 	Url            string
 	User           string
 	Password       string
+	Timeout        time.Duration
 	InfluxdbClient client.Client
 }
 
-func NewInfluxdb(url string, user string, password string) (*Influxdb, error) {
+// NewInfluxdb waits up to upTimeout for InfluxDB to answer.
+func NewInfluxdb(url string, user string, password string, upTimeout time.Duration) (*Influxdb, error) {
 	i := Influxdb{Url: url, User: user, Password: password}
 	clnt, err := i.getClient()
 	if err != nil {
@@ -25,8 +61,22 @@ func NewInfluxdb(url string, user string, password string) (*Influxdb, error) {
 	}
 
 	i.InfluxdbClient = clnt
-	i.checkUpStatus()
-	return &i, err
+	if err := i.checkUpStatus(upTimeout); err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+// NewInfluxdbWithTimeout does not wait for InfluxDB to be up, each request fails after timeout instead.
+func NewInfluxdbWithTimeout(url string, user string, password string, timeout time.Duration) (*Influxdb, error) {
+	i := Influxdb{Url: url, User: user, Password: password, Timeout: timeout}
+	clnt, err := i.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	i.InfluxdbClient = clnt
+	return &i, nil
 }
 
 func (i *Influxdb) getClient() (client.Client, error) {
@@ -35,20 +85,15 @@ func (i *Influxdb) getClient() (client.Client, error) {
 		Addr:     i.Url,
 		Username: i.User,
 		Password: i.Password,
+		Timeout:  i.Timeout,
 	})
 }
 
-func (i *Influxdb) checkUpStatus() {
-	for {
-		log.Printf("Checking if InfluxDB is up at %s", i.Url)
-		d, v, err := i.InfluxdbClient.Ping(10 * time.Second)
-		if err == nil {
-			return
-		} else {
-			log.Printf("Got Response: %v, %s, %v Retrying after 5s...", d, v, err)
-			time.Sleep(5 * time.Second)
-		}
-	}
+func (i *Influxdb) checkUpStatus(timeout time.Duration) error {
+	return waitUntilUp("InfluxDB", i.Url, timeout, func() error {
+		_, _, err := i.InfluxdbClient.Ping(10 * time.Second)
+		return err
+	})
 }
 
 func (i *Influxdb) CreateDatabaseAndRp(db string, rp string) error {
@@ -59,9 +104,264 @@ func (i *Influxdb) CreateDatabaseAndRp(db string, rp string) error {
 	return err
 }
 
+// GetMeasurements returns the measurements of db matching measurement exactly, so it is either empty or the measurement itself.
+func (i *Influxdb) GetMeasurements(db string, measurement string) ([]string, error) {
+	var measurements []string
+	res, err := i.queryDb(db, fmt.Sprintf("SHOW MEASUREMENTS WITH MEASUREMENT = %s", quoteIdentifier(measurement)))
+	if err != nil {
+		return measurements, err
+	}
+
+	for _, row := range seriesValues(res) {
+		measurements = append(measurements, fmt.Sprintf("%v", row[0]))
+	}
+	return measurements, nil
+}
+
+// GetFieldKeys maps each field key to its types, a field can have a different type in each shard.
+func (i *Influxdb) GetFieldKeys(db string, rp string, measurement string) (map[string][]string, error) {
+	fields := make(map[string][]string)
+	res, err := i.queryDb(db, "SHOW FIELD KEYS FROM "+qualifiedMeasurement(rp, measurement))
+	if err != nil {
+		return fields, err
+	}
+
+	for _, row := range seriesValues(res) {
+		key := fmt.Sprintf("%v", row[0])
+		fields[key] = append(fields[key], fmt.Sprintf("%v", row[1]))
+	}
+	return fields, nil
+}
+
+func (i *Influxdb) GetTagKeys(db string, rp string, measurement string) ([]string, error) {
+	var tags []string
+	res, err := i.queryDb(db, "SHOW TAG KEYS FROM "+qualifiedMeasurement(rp, measurement))
+	if err != nil {
+		return tags, err
+	}
+
+	for _, row := range seriesValues(res) {
+		tags = append(tags, fmt.Sprintf("%v", row[0]))
+	}
+	return tags, nil
+}
+
+func (i *Influxdb) GetRetentionPolicies(db string) (map[string]RetentionPolicy, error) {
+	rps := make(map[string]RetentionPolicy)
+	res, err := i.query("SHOW RETENTION POLICIES ON " + quoteIdentifier(db))
+	if err != nil {
+		return rps, err
+	}
+
+	for _, row := range seriesValues(res) {
+		rp := RetentionPolicy{fmt.Sprintf("%v", row[0]), fmt.Sprintf("%v", row[1]), fmt.Sprintf("%v", row[2])}
+		rps[rp.Name] = rp
+	}
+	return rps, nil
+}
+
+// EnsureRetentionPolicy creates rp on db, or alters it when it exists with a different duration or shard duration.
+// An empty shardDuration leaves the shard duration to InfluxDB.
+func (i *Influxdb) EnsureRetentionPolicy(db string, rp string, duration string, shardDuration string) error {
+	rps, err := i.GetRetentionPolicies(db)
+	if err != nil {
+		return err
+	}
+
+	cmd := ""
+	existing, ok := rps[rp]
+	if !ok {
+		cmd = fmt.Sprintf("CREATE RETENTION POLICY %s ON %s DURATION %s REPLICATION 1", quoteIdentifier(rp), quoteIdentifier(db), duration)
+	} else if !sameInfluxDuration(existing.Duration, duration) || (shardDuration != "" && !sameInfluxDuration(existing.ShardDuration, shardDuration)) {
+		cmd = fmt.Sprintf("ALTER RETENTION POLICY %s ON %s DURATION %s", quoteIdentifier(rp), quoteIdentifier(db), duration)
+	} else {
+		log.Printf("Retention policy %s on %s is already up to date.", rp, db)
+		return nil
+	}
+	if shardDuration != "" {
+		cmd += " SHARD DURATION " + shardDuration
+	}
+
+	log.Printf("Running %s", cmd)
+	res, err := i.query(cmd)
+	log.Printf("Response: %v", res)
+	return err
+}
+
+// DropSeries drops measurement from every retention policy of db, InfluxQL cannot scope it to rp.
+func (i *Influxdb) DropSeries(db string, rp string, measurement string) error {
+	cmd := "DROP SERIES FROM " + quoteIdentifier(measurement)
+	log.Printf("Running %s on %s", cmd, db)
+	res, err := i.queryDb(db, cmd)
+	log.Printf("Response: %v", res)
+	return err
+}
+
+func (i *Influxdb) CreateContinuousQuery(db string, name string, selectStatement string) error {
+	cmd := fmt.Sprintf("CREATE CONTINUOUS QUERY %s ON %s BEGIN %s END", quoteIdentifier(name), quoteIdentifier(db), selectStatement)
+	log.Printf("Running %s", cmd)
+	res, err := i.query(cmd)
+	log.Printf("Response: %v", res)
+	return err
+}
+
+// DropContinuousQuery ignores a missing continuous query so a failed delete can be retried.
+func (i *Influxdb) DropContinuousQuery(db string, name string) error {
+	cmd := fmt.Sprintf("DROP CONTINUOUS QUERY %s ON %s", quoteIdentifier(name), quoteIdentifier(db))
+	log.Printf("Running %s", cmd)
+	res, err := i.query(cmd)
+	log.Printf("Response: %v", res)
+	if err != nil && strings.Contains(err.Error(), "continuous query not found") {
+		return nil
+	}
+	return err
+}
+
+// GetSeriesPoints counts the points of each series between from and to, summed over fields.
+// Series are keyed by their tag set so the same series can be matched across databases.
+func (i *Influxdb) GetSeriesPoints(db string, rp string, measurement string, fields []string, from time.Time, to time.Time) (map[string]int64, error) {
+	points := make(map[string]int64)
+	var counts []string
+	for _, field := range fields {
+		counts = append(counts, "COUNT("+quoteIdentifier(field)+")")
+	}
+	cmd := fmt.Sprintf("SELECT %s FROM %s WHERE %s GROUP BY *", strings.Join(counts, ", "), qualifiedMeasurement(rp, measurement), timeRange(from, to))
+	log.Printf("Running %s on %s", cmd, db)
+	res, err := i.queryDb(db, cmd)
+	if err != nil {
+		return points, err
+	}
+
+	for _, result := range res.Results {
+		for _, series := range result.Series {
+			key := seriesKey(series.Tags)
+			for _, row := range series.Values {
+				for _, value := range row[1:] {
+					count, err := strconv.ParseInt(fmt.Sprintf("%v", value), 10, 64)
+					if err == nil {
+						points[key] += count
+					}
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+// GetBuckets runs selector (e.g. MEAN("value")) grouped by interval and tags, keyed by tag set and bucket start.
+func (i *Influxdb) GetBuckets(db string, rp string, measurement string, selector string, tags []string, interval time.Duration, from time.Time, to time.Time) (map[string]float64, error) {
+	buckets := make(map[string]float64)
+	groupBy := []string{fmt.Sprintf("time(%ds)", int64(interval.Seconds()))}
+	for _, tag := range tags {
+		groupBy = append(groupBy, quoteIdentifier(tag))
+	}
+	cmd := fmt.Sprintf("SELECT %s FROM %s WHERE %s GROUP BY %s fill(none)", selector, qualifiedMeasurement(rp, measurement), timeRange(from, to), strings.Join(groupBy, ", "))
+	log.Printf("Running %s on %s", cmd, db)
+	res, err := i.queryDb(db, cmd)
+	if err != nil {
+		return buckets, err
+	}
+
+	for _, result := range res.Results {
+		for _, series := range result.Series {
+			key := seriesKey(series.Tags)
+			for _, row := range series.Values {
+				value, err := strconv.ParseFloat(fmt.Sprintf("%v", row[1]), 64)
+				if err != nil {
+					continue
+				}
+				buckets[fmt.Sprintf("%s@%v", key, row[0])] = value
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// ReadPoints returns the most recent raw points of measurement between from and to, at most limit of them, newest first.
+// fieldTypes maps each field to read to its InfluxDB type so values are written back with the same type, every other
+// column is a tag. InfluxDB streams the rows in chunks of INFLUXDB_READ_CHUNK.
+func (i *Influxdb) ReadPoints(db string, rp string, measurement string, fieldTypes map[string]string, from time.Time, to time.Time, limit int) ([]InfluxdbPoint, error) {
+	var points []InfluxdbPoint
+	var fields, selectors []string
+	for field := range fieldTypes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	selectors = append(selectors, "*::tag")
+	for _, field := range fields {
+		selectors = append(selectors, quoteIdentifier(field)+"::field")
+	}
+	cmd := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY time DESC LIMIT %d", strings.Join(selectors, ", "), qualifiedMeasurement(rp, measurement), timeRange(from, to), limit)
+	log.Printf("Running %s on %s", cmd, db)
+	res, err := i.InfluxdbClient.Query(client.Query{Command: cmd, Database: db, Chunked: true, ChunkSize: INFLUXDB_READ_CHUNK})
+	if err == nil {
+		err = res.Error()
+	}
+	if err != nil {
+		return points, err
+	}
+
+	for _, result := range res.Results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				t, err := time.Parse(time.RFC3339Nano, fmt.Sprintf("%v", row[0]))
+				if err != nil {
+					return points, err
+				}
+				point := InfluxdbPoint{Measurement: measurement, Tags: make(map[string]string), Fields: make(map[string]interface{}), Time: t}
+				for c, column := range series.Columns[1:] {
+					value := row[c+1]
+					if fieldType, ok := fieldTypes[column]; ok {
+						if value, ok := fieldValue(value, fieldType); ok {
+							point.Fields[column] = value
+						}
+					} else if value != nil {
+						point.Tags[column] = fmt.Sprintf("%v", value)
+					}
+				}
+				if len(point.Fields) > 0 {
+					points = append(points, point)
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+func (i *Influxdb) WritePoints(db string, rp string, points []InfluxdbPoint) error {
+	for start := 0; start < len(points); start += INFLUXDB_WRITE_BATCH {
+		end := start + INFLUXDB_WRITE_BATCH
+		if end > len(points) {
+			end = len(points)
+		}
+		bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: db, RetentionPolicy: rp, Precision: "ns"})
+		if err != nil {
+			return err
+		}
+		for _, point := range points[start:end] {
+			pt, err := client.NewPoint(point.Measurement, point.Tags, point.Fields, point.Time)
+			if err != nil {
+				return err
+			}
+			bp.AddPoint(pt)
+		}
+		log.Printf("Writing %d points to %s.%s", end-start, db, rp)
+		err = i.InfluxdbClient.Write(bp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (i *Influxdb) query(cmd string) (res *client.Response, err error) {
+	return i.queryDb("", cmd)
+}
+
+func (i *Influxdb) queryDb(db string, cmd string) (res *client.Response, err error) {
 	q := client.Query{
-		Command: cmd,
+		Command:  cmd,
+		Database: db,
 	}
 
 	response, err := i.InfluxdbClient.Query(q)
@@ -75,3 +375,81 @@ func (i *Influxdb) query(cmd string) (res *client.Response, err error) {
 
 	return response, nil
 }
+
+func seriesValues(res *client.Response) [][]interface{} {
+	var values [][]interface{}
+	if res == nil {
+		return values
+	}
+	for _, result := range res.Results {
+		for _, series := range result.Series {
+			values = append(values, series.Values...)
+		}
+	}
+	return values
+}
+
+// fieldValue converts a value read back from InfluxDB to the Go type of fieldType, numbers are decoded as json.Number.
+func fieldValue(value interface{}, fieldType string) (interface{}, bool) {
+	if value == nil {
+		return nil, false
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return value, true
+	}
+	if fieldType == "integer" {
+		n, err := number.Int64()
+		return n, err == nil
+	}
+	f, err := number.Float64()
+	return f, err == nil
+}
+
+func timeRange(from time.Time, to time.Time) string {
+	return fmt.Sprintf("time >= '%s' AND time < '%s'", from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+}
+
+func seriesKey(tags map[string]string) string {
+	var pairs []string
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func quoteIdentifier(identifier string) string {
+	return "\"" + strings.Replace(identifier, "\"", "\\\"", -1) + "\""
+}
+
+func qualifiedMeasurement(rp string, measurement string) string {
+	if rp == "" {
+		return quoteIdentifier(measurement)
+	}
+	return quoteIdentifier(rp) + "." + quoteIdentifier(measurement)
+}
+
+// sameInfluxDuration compares InfluxQL duration literals such as 7d with the normalized form InfluxDB reports (168h0m0s).
+func sameInfluxDuration(a string, b string) bool {
+	da, errA := parseInfluxDuration(a)
+	db, errB := parseInfluxDuration(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return da == db
+}
+
+func parseInfluxDuration(d string) (time.Duration, error) {
+	if strings.ToUpper(d) == "INF" || d == "0" {
+		return 0, nil
+	}
+	units := map[string]time.Duration{"w": 7 * 24 * time.Hour, "d": 24 * time.Hour}
+	for unit, size := range units {
+		if strings.HasSuffix(d, unit) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(d, unit), 10, 64)
+			return time.Duration(n) * size, err
+		}
+	}
+	return time.ParseDuration(d)
+}
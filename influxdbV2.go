@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// InfluxdbAdminInterface is what provisioning needs from an InfluxDB, whatever its version.
+type InfluxdbAdminInterface interface {
+	CreateDatabaseAndRp(db string, rp string) error
+	EnsureRetentionPolicy(db string, rp string, duration string, shardDuration string) error
+	DropSeries(db string, rp string, measurement string) error
+}
+
+type InfluxdbV2Interface interface {
+	InfluxdbAdminInterface
+	EnsureBucket(db string, rp string, duration string, shardDuration string) (string, error)
+	CreateTask(name string, flux string) error
+	DeleteTask(name string) error
+}
+
+type InfluxdbV2Bucket struct {
+	Id             string                    `json:"id,omitempty"`
+	OrgId          string                    `json:"orgID,omitempty"`
+	Name           string                    `json:"name,omitempty"`
+	RetentionRules []InfluxdbV2RetentionRule `json:"retentionRules"`
+}
+
+// An empty list of retention rules keeps data forever.
+type InfluxdbV2RetentionRule struct {
+	Type                      string `json:"type"`
+	EverySeconds              int64  `json:"everySeconds"`
+	ShardGroupDurationSeconds int64  `json:"shardGroupDurationSeconds,omitempty"`
+}
+
+type InfluxdbV2Dbrp struct {
+	Id              string `json:"id,omitempty"`
+	OrgId           string `json:"orgID"`
+	BucketId        string `json:"bucketID"`
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retention_policy"`
+	Default         bool   `json:"default"`
+}
+
+type InfluxdbV2Task struct {
+	Id     string `json:"id,omitempty"`
+	OrgId  string `json:"orgID,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Flux   string `json:"flux,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// InfluxdbV2 talks to the InfluxDB 2.x HTTP API, each v1 database/retention policy maps to a "db/rp" bucket
+// with a DBRP mapping so the v1 compatible /write and /query endpoints keep working.
+type InfluxdbV2 struct {
+	Url        string
+	Token      string
+	Org        string
+	orgId      string
+	httpClient http.Client
+}
+
+// NewInfluxdbV2 waits up to upTimeout for InfluxDB to answer.
+func NewInfluxdbV2(url string, token string, org string, upTimeout time.Duration) (*InfluxdbV2, error) {
+	i := &InfluxdbV2{Url: url, Token: token, Org: org, httpClient: http.Client{Timeout: time.Second * 30}}
+	if err := i.checkUpStatus(upTimeout); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *InfluxdbV2) checkUpStatus(timeout time.Duration) error {
+	return waitUntilUp("InfluxDB", i.Url+"/health", timeout, func() error {
+		code, body, err := i.makeHttpCall(http.MethodGet, "/health", nil, nil)
+		if err == nil && code != http.StatusOK {
+			err = fmt.Errorf("%v %s", code, body)
+		}
+		return err
+	})
+}
+
+func (i *InfluxdbV2) makeHttpCall(method string, path string, params url.Values, body interface{}) (int, []byte, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+	}
+
+	u := i.Url + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewBuffer(data))
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	req.Header.Add("Authorization", "Token "+i.Token)
+	req.Header.Add("Content-Type", "application/json")
+
+	log.Printf("Request: %s %s %s", method, u, data)
+	res, err := i.httpClient.Do(req)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	defer res.Body.Close()
+
+	bodyOutput, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	log.Printf("Response Code : %v \nResponse Body: %s", res.StatusCode, string(bodyOutput))
+	return res.StatusCode, bodyOutput, nil
+}
+
+// call decodes the response into out, any status outside 2xx is an error.
+func (i *InfluxdbV2) call(method string, path string, params url.Values, body interface{}, out interface{}) error {
+	code, response, err := i.makeHttpCall(method, path, params, body)
+	if err != nil {
+		return err
+	}
+	if code < 200 || code > 299 {
+		return errors.New(fmt.Sprintf("%s %s returned %d: %s", method, path, code, string(response)))
+	}
+	if out == nil || len(response) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response, out)
+}
+
+func (i *InfluxdbV2) getOrgId() (string, error) {
+	if i.orgId != "" {
+		return i.orgId, nil
+	}
+
+	var orgs struct {
+		Orgs []struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"orgs"`
+	}
+	err := i.call(http.MethodGet, "/api/v2/orgs", url.Values{"org": {i.Org}}, nil, &orgs)
+	if err != nil {
+		return "", err
+	}
+	if len(orgs.Orgs) == 0 {
+		return "", errors.New("organization " + i.Org + " not found")
+	}
+
+	i.orgId = orgs.Orgs[0].Id
+	return i.orgId, nil
+}
+
+func (i *InfluxdbV2) getBucket(name string) (*InfluxdbV2Bucket, error) {
+	orgId, err := i.getOrgId()
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets struct {
+		Buckets []InfluxdbV2Bucket `json:"buckets"`
+	}
+	// looking a bucket up by name answers 404 rather than an empty list when it does not exist
+	code, response, err := i.makeHttpCall(http.MethodGet, "/api/v2/buckets", url.Values{"orgID": {orgId}, "name": {name}}, nil)
+	if err != nil || code == http.StatusNotFound {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("GET /api/v2/buckets returned %d: %s", code, string(response)))
+	}
+	err = json.Unmarshal(response, &buckets)
+	if err != nil || len(buckets.Buckets) == 0 {
+		return nil, err
+	}
+	return &buckets.Buckets[0], nil
+}
+
+func (i *InfluxdbV2) CreateDatabaseAndRp(db string, rp string) error {
+	_, err := i.EnsureBucket(db, rp, "INF", "")
+	return err
+}
+
+func (i *InfluxdbV2) EnsureRetentionPolicy(db string, rp string, duration string, shardDuration string) error {
+	_, err := i.EnsureBucket(db, rp, duration, shardDuration)
+	return err
+}
+
+// EnsureBucket creates the db/rp bucket or updates its retention, then makes sure the DBRP mapping exists.
+func (i *InfluxdbV2) EnsureBucket(db string, rp string, duration string, shardDuration string) (string, error) {
+	rules, err := retentionRules(duration, shardDuration)
+	if err != nil {
+		return "", err
+	}
+	orgId, err := i.getOrgId()
+	if err != nil {
+		return "", err
+	}
+
+	name := BucketName(db, rp)
+	bucket, err := i.getBucket(name)
+	if err != nil {
+		return "", err
+	}
+	if bucket == nil {
+		log.Printf("Creating bucket %s...", name)
+		bucket = &InfluxdbV2Bucket{}
+		err = i.call(http.MethodPost, "/api/v2/buckets", nil, &InfluxdbV2Bucket{OrgId: orgId, Name: name, RetentionRules: rules}, bucket)
+	} else if !sameRetentionRules(bucket.RetentionRules, rules) {
+		log.Printf("Updating retention of bucket %s...", name)
+		err = i.call(http.MethodPatch, "/api/v2/buckets/"+bucket.Id, nil, &InfluxdbV2Bucket{RetentionRules: rules}, nil)
+	} else {
+		log.Printf("Bucket %s is already up to date.", name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return bucket.Id, i.ensureDbrp(orgId, bucket.Id, db, rp)
+}
+
+func (i *InfluxdbV2) ensureDbrp(orgId string, bucketId string, db string, rp string) error {
+	var dbrps struct {
+		Content []InfluxdbV2Dbrp `json:"content"`
+	}
+	err := i.call(http.MethodGet, "/api/v2/dbrps", url.Values{"orgID": {orgId}, "db": {db}, "rp": {rp}}, nil, &dbrps)
+	if err != nil {
+		return err
+	}
+	if len(dbrps.Content) > 0 {
+		return nil
+	}
+
+	log.Printf("Mapping %s.%s to bucket %s...", db, rp, bucketId)
+	return i.call(http.MethodPost, "/api/v2/dbrps", nil, &InfluxdbV2Dbrp{OrgId: orgId, BucketId: bucketId, Database: db, RetentionPolicy: rp}, nil)
+}
+
+// DropSeries deletes all points of measurement from the db/rp bucket.
+func (i *InfluxdbV2) DropSeries(db string, rp string, measurement string) error {
+	body := map[string]string{
+		"start":     time.Unix(0, 0).UTC().Format(time.RFC3339),
+		"stop":      time.Now().UTC().Format(time.RFC3339),
+		"predicate": fmt.Sprintf("_measurement=%q", measurement),
+	}
+	return i.call(http.MethodPost, "/api/v2/delete", url.Values{"org": {i.Org}, "bucket": {BucketName(db, rp)}}, body, nil)
+}
+
+func (i *InfluxdbV2) getTask(name string) (*InfluxdbV2Task, error) {
+	orgId, err := i.getOrgId()
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks struct {
+		Tasks []InfluxdbV2Task `json:"tasks"`
+	}
+	err = i.call(http.MethodGet, "/api/v2/tasks", url.Values{"orgID": {orgId}, "name": {name}}, nil, &tasks)
+	if err != nil || len(tasks.Tasks) == 0 {
+		return nil, err
+	}
+	return &tasks.Tasks[0], nil
+}
+
+// CreateTask creates the task or replaces the flux of an existing task with the same name.
+func (i *InfluxdbV2) CreateTask(name string, flux string) error {
+	orgId, err := i.getOrgId()
+	if err != nil {
+		return err
+	}
+	task, err := i.getTask(name)
+	if err != nil {
+		return err
+	}
+
+	if task != nil {
+		log.Printf("Updating task %s...", name)
+		return i.call(http.MethodPatch, "/api/v2/tasks/"+task.Id, nil, &InfluxdbV2Task{Flux: flux, Status: "active"}, nil)
+	}
+	log.Printf("Creating task %s...", name)
+	return i.call(http.MethodPost, "/api/v2/tasks", nil, &InfluxdbV2Task{OrgId: orgId, Flux: flux, Status: "active"}, nil)
+}
+
+// DeleteTask ignores a missing task so a failed delete can be retried.
+func (i *InfluxdbV2) DeleteTask(name string) error {
+	task, err := i.getTask(name)
+	if err != nil || task == nil {
+		return err
+	}
+
+	log.Printf("Deleting task %s...", name)
+	return i.call(http.MethodDelete, "/api/v2/tasks/"+task.Id, nil, nil, nil)
+}
+
+func BucketName(db string, rp string) string {
+	return db + "/" + rp
+}
+
+func retentionRules(duration string, shardDuration string) ([]InfluxdbV2RetentionRule, error) {
+	rules := []InfluxdbV2RetentionRule{}
+	every, err := parseInfluxDuration(duration)
+	if err != nil {
+		return rules, err
+	}
+	var shard time.Duration
+	if shardDuration != "" {
+		shard, err = parseInfluxDuration(shardDuration)
+		if err != nil {
+			return rules, err
+		}
+	}
+
+	if every > 0 || shard > 0 {
+		rules = append(rules, InfluxdbV2RetentionRule{"expire", int64(every.Seconds()), int64(shard.Seconds())})
+	}
+	return rules, nil
+}
+
+// sameRetentionRules compares existing with wanted rules, a wanted shard group duration of 0 leaves it to InfluxDB.
+func sameRetentionRules(existing []InfluxdbV2RetentionRule, wanted []InfluxdbV2RetentionRule) bool {
+	var existingRule, wantedRule InfluxdbV2RetentionRule
+	if len(existing) > 0 {
+		existingRule = existing[0]
+	}
+	if len(wanted) > 0 {
+		wantedRule = wanted[0]
+	}
+	return existingRule.EverySeconds == wantedRule.EverySeconds &&
+		(wantedRule.ShardGroupDurationSeconds == 0 || existingRule.ShardGroupDurationSeconds == wantedRule.ShardGroupDurationSeconds)
+}
+
+// BuildFluxTask writes each aggregated field under its alias into the target bucket, keeping the query tags.
+func BuildFluxTask(name string, query DownsamplingObject) string {
+	groupBy := []string{"\"_measurement\"", "\"_field\""}
+	for _, tag := range query.Tags {
+		groupBy = append(groupBy, fmt.Sprintf("%q", tag))
+	}
+
+	flux := fmt.Sprintf("option task = {name: %q, every: %ds}\n", name, query.Interval)
+	for _, field := range query.Fields {
+		flux += fmt.Sprintf(`
+from(bucket: %q)
+    |> range(start: -task.every)
+    |> filter(fn: (r) => r._measurement == %q and r._field == %q)
+    |> group(columns: [%s])
+    |> aggregateWindow(every: task.every, fn: %s)
+    |> set(key: "_measurement", value: %q)
+    |> set(key: "_field", value: %q)
+    |> to(bucket: %q)
+`, BucketName(query.Db, query.Rp), query.Measurement, field.Field, strings.Join(groupBy, ", "), strings.ToLower(field.Function),
+			query.TargetMeasurement, field.Alias, BucketName(query.Db, query.TargetRp))
+	}
+	return flux
+}
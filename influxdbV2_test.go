@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// MockInfluxdbV2Server keeps just enough of the 2.x API state to check what the client asked for.
+type MockInfluxdbV2Server struct {
+	buckets  []InfluxdbV2Bucket
+	dbrps    []InfluxdbV2Dbrp
+	tasks    []InfluxdbV2Task
+	requests []string
+}
+
+func (s *MockInfluxdbV2Server) handler(w http.ResponseWriter, r *http.Request) {
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	if r.Header.Get("Authorization") != "Token secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	query := r.URL.Query()
+
+	switch {
+	case r.URL.Path == "/api/v2/orgs":
+		if query.Get("org") != "ops" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"orgs":[{"id":"org1","name":"ops"}]}`))
+	case r.URL.Path == "/api/v2/buckets" && r.Method == http.MethodGet:
+		for _, bucket := range s.buckets {
+			if bucket.Name == query.Get("name") {
+				json.NewEncoder(w).Encode(map[string][]InfluxdbV2Bucket{"buckets": {bucket}})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.URL.Path == "/api/v2/buckets" && r.Method == http.MethodPost:
+		var bucket InfluxdbV2Bucket
+		json.Unmarshal(body, &bucket)
+		bucket.Id = fmt.Sprintf("bucket%d", len(s.buckets)+1)
+		s.buckets = append(s.buckets, bucket)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(bucket)
+	case strings.HasPrefix(r.URL.Path, "/api/v2/buckets/") && r.Method == http.MethodPatch:
+		var bucket InfluxdbV2Bucket
+		json.Unmarshal(body, &bucket)
+		for b := range s.buckets {
+			if "/api/v2/buckets/"+s.buckets[b].Id == r.URL.Path {
+				s.buckets[b].RetentionRules = bucket.RetentionRules
+			}
+		}
+		w.Write([]byte(`{}`))
+	case r.URL.Path == "/api/v2/dbrps" && r.Method == http.MethodGet:
+		var dbrps []InfluxdbV2Dbrp
+		for _, dbrp := range s.dbrps {
+			if dbrp.Database == query.Get("db") && dbrp.RetentionPolicy == query.Get("rp") {
+				dbrps = append(dbrps, dbrp)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string][]InfluxdbV2Dbrp{"content": dbrps})
+	case r.URL.Path == "/api/v2/dbrps" && r.Method == http.MethodPost:
+		var dbrp InfluxdbV2Dbrp
+		json.Unmarshal(body, &dbrp)
+		s.dbrps = append(s.dbrps, dbrp)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	case r.URL.Path == "/api/v2/tasks" && r.Method == http.MethodGet:
+		var tasks []InfluxdbV2Task
+		for _, task := range s.tasks {
+			if task.Name == query.Get("name") {
+				tasks = append(tasks, task)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string][]InfluxdbV2Task{"tasks": tasks})
+	case r.URL.Path == "/api/v2/tasks" && r.Method == http.MethodPost:
+		var task InfluxdbV2Task
+		json.Unmarshal(body, &task)
+		task.Id = fmt.Sprintf("task%d", len(s.tasks)+1)
+		task.Name = strings.Split(strings.Split(task.Flux, "name: \"")[1], "\"")[0]
+		s.tasks = append(s.tasks, task)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(task)
+	case strings.HasPrefix(r.URL.Path, "/api/v2/tasks/") && r.Method == http.MethodPatch:
+		w.Write(body)
+	case strings.HasPrefix(r.URL.Path, "/api/v2/tasks/") && r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/api/v2/delete":
+		if query.Get("bucket") != "sca/downsampled" || !strings.Contains(string(body), `_measurement=\"request_count_1m\"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func Test_InfluxdbV2_EnsureBucket(t *testing.T) {
+	server := &MockInfluxdbV2Server{}
+	influxSpy := httptest.NewServer(http.HandlerFunc(server.handler))
+	defer influxSpy.Close()
+	i := &InfluxdbV2{Url: influxSpy.URL, Token: "secret", Org: "ops"}
+
+	id, err := i.EnsureBucket("sca", "downsampled", "30d", "1d")
+	if err != nil || id != "bucket1" {
+		t.Error(fmt.Sprintf("Bucket bucket1 was expected to be created, found %s (%v)", id, err))
+	}
+	if len(server.buckets) != 1 || server.buckets[0].Name != "sca/downsampled" || server.buckets[0].OrgId != "org1" || server.buckets[0].RetentionRules[0].EverySeconds != 30*24*3600 {
+		t.Error(fmt.Sprintf("Bucket sca/downsampled was expected with 30d retention, found %v", server.buckets))
+	}
+	if len(server.dbrps) != 1 || server.dbrps[0].BucketId != "bucket1" || server.dbrps[0].Database != "sca" || server.dbrps[0].RetentionPolicy != "downsampled" {
+		t.Error(fmt.Sprintf("DBRP mapping sca.downsampled was expected, found %v", server.dbrps))
+	}
+
+	server.requests = nil
+	_, err = i.EnsureBucket("sca", "downsampled", "30d", "")
+	if err != nil || len(server.buckets) != 1 || len(server.dbrps) != 1 {
+		t.Error(fmt.Sprintf("Bucket was not expected to change, found %v %v (%v)", server.buckets, server.dbrps, err))
+	}
+	for _, request := range server.requests {
+		if request != "GET /api/v2/buckets" && request != "GET /api/v2/dbrps" {
+			t.Error(fmt.Sprintf("Only lookups were expected for an up to date bucket, found %v", server.requests))
+		}
+	}
+
+	_, err = i.EnsureBucket("sca", "downsampled", "INF", "")
+	if err != nil || len(server.buckets[0].RetentionRules) != 0 {
+		t.Error(fmt.Sprintf("Bucket retention was expected to be removed, found %v (%v)", server.buckets[0].RetentionRules, err))
+	}
+}
+
+func Test_InfluxdbV2_EnsureBucket_Error(t *testing.T) {
+	server := &MockInfluxdbV2Server{}
+	influxSpy := httptest.NewServer(http.HandlerFunc(server.handler))
+	defer influxSpy.Close()
+
+	_, err := (&InfluxdbV2{Url: influxSpy.URL, Token: "wrong", Org: "ops"}).EnsureBucket("sca", "downsampled", "INF", "")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Error(fmt.Sprintf("Was expecting an unauthorized error but received %v", err))
+	}
+	_, err = (&InfluxdbV2{Url: influxSpy.URL, Token: "secret", Org: "ops"}).EnsureBucket("sca", "downsampled", "1x", "")
+	if err == nil {
+		t.Error(fmt.Sprintf("Was expecting error for an invalid duration but not received"))
+	}
+}
+
+func Test_InfluxdbV2_Tasks(t *testing.T) {
+	server := &MockInfluxdbV2Server{}
+	influxSpy := httptest.NewServer(http.HandlerFunc(server.handler))
+	defer influxSpy.Close()
+	i := &InfluxdbV2{Url: influxSpy.URL, Token: "secret", Org: "ops"}
+
+	err := i.CreateTask("ds_query1", "option task = {name: \"ds_query1\", every: 60s}")
+	if err != nil || len(server.tasks) != 1 || server.tasks[0].OrgId != "org1" || server.tasks[0].Status != "active" {
+		t.Error(fmt.Sprintf("Task ds_query1 was expected to be created, found %v (%v)", server.tasks, err))
+	}
+	err = i.CreateTask("ds_query1", "option task = {name: \"ds_query1\", every: 300s}")
+	if err != nil || len(server.tasks) != 1 || server.requests[len(server.requests)-1] != "PATCH /api/v2/tasks/task1" {
+		t.Error(fmt.Sprintf("Task ds_query1 was expected to be updated, found %v (%v)", server.requests, err))
+	}
+
+	err = i.DeleteTask("ds_query1")
+	if err != nil || server.requests[len(server.requests)-1] != "DELETE /api/v2/tasks/task1" {
+		t.Error(fmt.Sprintf("Task ds_query1 was expected to be deleted, found %v (%v)", server.requests, err))
+	}
+	err = i.DeleteTask("ds_query2")
+	if err != nil || server.requests[len(server.requests)-1] != "GET /api/v2/tasks" {
+		t.Error(fmt.Sprintf("Deleting a missing task was expected to be skipped, found %v (%v)", server.requests, err))
+	}
+}
+
+func Test_InfluxdbV2_DropSeries(t *testing.T) {
+	server := &MockInfluxdbV2Server{}
+	influxSpy := httptest.NewServer(http.HandlerFunc(server.handler))
+	defer influxSpy.Close()
+
+	err := (&InfluxdbV2{Url: influxSpy.URL, Token: "secret", Org: "ops"}).DropSeries("sca", "downsampled", "request_count_1m")
+	if err != nil {
+		t.Error(fmt.Sprintf("Was not expecting error but received %v", err))
+	}
+}
+
+func Test_BuildFluxTask(t *testing.T) {
+	query := getQueryForValidation()
+	query.Fields = query.Fields[:1]
+	query.TargetRp, query.TargetMeasurement, query.Interval = "downsampled", "request_count_1m", 60
+
+	expected := `option task = {name: "ds_query1", every: 60s}
+
+from(bucket: "sca/autogen")
+    |> range(start: -task.every)
+    |> filter(fn: (r) => r._measurement == "request_count" and r._field == "count")
+    |> group(columns: ["_measurement", "_field", "app_name", "scenario"])
+    |> aggregateWindow(every: task.every, fn: sum)
+    |> set(key: "_measurement", value: "request_count_1m")
+    |> set(key: "_field", value: "sum_count")
+    |> to(bucket: "sca/downsampled")
+`
+	flux := BuildFluxTask(DownsamplingTaskName(query), query)
+	if flux != expected {
+		t.Error(fmt.Sprintf("Flux task was expected\n%s\nfound\n%s", expected, flux))
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type InfluxDbTestSuite struct {
@@ -60,3 +62,144 @@ func Test_Influxdb_CreateDatabaseAndRp_Error(t *testing.T) {
 		t.Error(fmt.Sprintf("Was expecting error but not received"))
 	}
 }
+
+func Test_Influxdb_GetSchema(t *testing.T) {
+	influxSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		if r.URL.Query().Get("db") != "sca" {
+			w.WriteHeader(500)
+			return
+		}
+		switch r.URL.Query().Get("q") {
+		case "SHOW MEASUREMENTS WITH MEASUREMENT = \"request_count\"":
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["request_count"]]}]}]}`))
+		case "SHOW FIELD KEYS FROM \"autogen\".\"request_count\"":
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"request_count","columns":["fieldKey","fieldType"],"values":[["count","integer"],["count","float"],["status","string"]]}]}]}`))
+		case "SHOW TAG KEYS FROM \"autogen\".\"request_count\"":
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"request_count","columns":["tagKey"],"values":[["app_name"],["scenario"]]}]}]}`))
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer influxSpy.Close()
+	i := Influxdb{Url: influxSpy.URL, User: "", Password: ""}
+	clnt, err := i.getClient()
+	i.InfluxdbClient = clnt
+
+	measurements, err := i.GetMeasurements("sca", "request_count")
+	if err != nil || len(measurements) != 1 || measurements[0] != "request_count" {
+		t.Error(fmt.Sprintf("Unexpected measurements %v, error: %v", measurements, err))
+	}
+	fields, err := i.GetFieldKeys("sca", "autogen", "request_count")
+	if err != nil || len(fields["count"]) != 2 || fields["status"][0] != "string" {
+		t.Error(fmt.Sprintf("Unexpected field keys %v, error: %v", fields, err))
+	}
+	tags, err := i.GetTagKeys("sca", "autogen", "request_count")
+	if err != nil || len(tags) != 2 || tags[1] != "scenario" {
+		t.Error(fmt.Sprintf("Unexpected tag keys %v, error: %v", tags, err))
+	}
+}
+
+func Test_Influxdb_EnsureRetentionPolicy(t *testing.T) {
+	var executed []string
+	influxSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query().Get("q")
+		if q == "SHOW RETENTION POLICIES ON \"sca\"" {
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"columns":["name","duration","shardGroupDuration","replicaN","default"],"values":[["autogen","0s","168h0m0s",1,true],["downsampled","168h0m0s","24h0m0s",1,false]]}]}]}`))
+			return
+		}
+		executed = append(executed, q)
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer influxSpy.Close()
+	i := Influxdb{Url: influxSpy.URL, User: "", Password: ""}
+	clnt, err := i.getClient()
+	i.InfluxdbClient = clnt
+
+	err = i.EnsureRetentionPolicy("sca", "downsampled", "7d", "1d")
+	if err != nil || len(executed) != 0 {
+		t.Error(fmt.Sprintf("Was expecting no change for an up to date policy, executed %v, error: %v", executed, err))
+	}
+
+	err = i.EnsureRetentionPolicy("sca", "downsampled", "30d", "")
+	if err != nil || len(executed) != 1 || executed[0] != "ALTER RETENTION POLICY \"downsampled\" ON \"sca\" DURATION 30d" {
+		t.Error(fmt.Sprintf("Was expecting the policy to be altered, executed %v, error: %v", executed, err))
+	}
+
+	err = i.EnsureRetentionPolicy("sca", "yearly", "INF", "1w")
+	if err != nil || len(executed) != 2 || executed[1] != "CREATE RETENTION POLICY \"yearly\" ON \"sca\" DURATION INF REPLICATION 1 SHARD DURATION 1w" {
+		t.Error(fmt.Sprintf("Was expecting the policy to be created, executed %v, error: %v", executed, err))
+	}
+}
+
+func Test_Influxdb_ParseInfluxDuration(t *testing.T) {
+	if !sameInfluxDuration("INF", "0s") || !sameInfluxDuration("2w", "336h0m0s") || sameInfluxDuration("1d", "1h0m0s") {
+		t.Error("Unexpected duration comparison")
+	}
+}
+
+func Test_Influxdb_GetSeriesPointsAndBuckets(t *testing.T) {
+	influxSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		switch r.URL.Query().Get("q") {
+		case "SELECT COUNT(\"count\"), COUNT(\"status\") FROM \"autogen\".\"request_count\" WHERE time >= '1970-01-01T00:00:00Z' AND time < '1970-01-01T01:00:00Z' GROUP BY *":
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"request_count","tags":{"app_name":"a","scenario":"x"},"columns":["time","count","count_1"],"values":[["1970-01-01T00:00:00Z",10,5]]},{"name":"request_count","tags":{"app_name":"b","scenario":"x"},"columns":["time","count","count_1"],"values":[["1970-01-01T00:00:00Z",3,null]]}]}]}`))
+		case "SELECT SUM(\"count\") FROM \"autogen\".\"request_count\" WHERE time >= '1970-01-01T00:00:00Z' AND time < '1970-01-01T01:00:00Z' GROUP BY time(60s), \"app_name\" fill(none)":
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"request_count","tags":{"app_name":"a"},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",1.5],["1970-01-01T00:01:00Z",2]]}]}]}`))
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer influxSpy.Close()
+	i := Influxdb{Url: influxSpy.URL, User: "", Password: ""}
+	clnt, err := i.getClient()
+	i.InfluxdbClient = clnt
+
+	points, err := i.GetSeriesPoints("sca", "autogen", "request_count", []string{"count", "status"}, time.Unix(0, 0), time.Unix(3600, 0))
+	if err != nil || len(points) != 2 || points["app_name=a,scenario=x"] != 15 || points["app_name=b,scenario=x"] != 3 {
+		t.Error(fmt.Sprintf("Unexpected series points %v, error: %v", points, err))
+	}
+	buckets, err := i.GetBuckets("sca", "autogen", "request_count", "SUM(\"count\")", []string{"app_name"}, time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	if err != nil || len(buckets) != 2 || buckets["app_name=a@1970-01-01T00:01:00Z"] != 2 {
+		t.Error(fmt.Sprintf("Unexpected buckets %v, error: %v", buckets, err))
+	}
+}
+
+func Test_Influxdb_ReadAndWritePoints(t *testing.T) {
+	var written string
+	influxSpy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/write" && r.URL.Query().Get("db") == "sca" && r.URL.Query().Get("rp") == "raw" {
+			body, _ := ioutil.ReadAll(r.Body)
+			written += string(body)
+			w.WriteHeader(204)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		switch r.URL.Query().Get("q") {
+		case "SELECT *::tag, \"count\"::field, \"latency\"::field FROM \"autogen\".\"request_count\" WHERE time >= '1970-01-01T00:00:00Z' AND time < '1970-01-01T01:00:00Z' ORDER BY time DESC LIMIT 100":
+			if r.URL.Query().Get("chunked") != "true" {
+				w.WriteHeader(400)
+				return
+			}
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"request_count","columns":["time","app_name","count","latency"],"values":[["1970-01-01T00:02:00Z","a",null,null],["1970-01-01T00:01:00Z",null,null,2],["1970-01-01T00:00:00Z","a",3,1.5]]}]}]}`))
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer influxSpy.Close()
+	i := Influxdb{Url: influxSpy.URL, User: "", Password: ""}
+	clnt, err := i.getClient()
+	i.InfluxdbClient = clnt
+
+	points, err := i.ReadPoints("sca", "autogen", "request_count", map[string]string{"count": "integer", "latency": "float"}, time.Unix(0, 0), time.Unix(3600, 0), 100)
+	if err != nil || len(points) != 2 || points[1].Fields["count"] != int64(3) || points[0].Fields["latency"] != float64(2) || len(points[0].Fields) != 1 || points[1].Tags["app_name"] != "a" || len(points[0].Tags) != 0 {
+		t.Error(fmt.Sprintf("Unexpected points %v, error: %v", points, err))
+	}
+
+	err = i.WritePoints("sca", "raw", points)
+	expected := "request_count latency=2 60000000000\nrequest_count,app_name=a count=3i,latency=1.5 0\n"
+	if err != nil || written != expected {
+		t.Error(fmt.Sprintf("Points were expected to be written as\n%s found\n%s (%v)", expected, written, err))
+	}
+}
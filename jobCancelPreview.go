@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// CancelPreviewJob tears down a preview before it expires, on request of its user.
+// Run from the command line, outside of a controller job, it also cancels a PREVIEW_DEPLOYED preview.
+type CancelPreviewJob struct {
+	flinkJobHandler     FlinkJobHandlerInterface
+	k8DeploymentHandler DeploymentHandlerInterface
+	itemHandler         DownsamplingItemHandlerInterface
+	config              *Config
+	Metrics             *Metrics
+	eventPublisher      EventPublisherInterface
+	events              EventRecorderInterface
+}
+
+func NewCancelPreviewJob(config *Config, metrics *Metrics) (*CancelPreviewJob, error) {
+	k8client, err := NewK8Client(config)
+	if err != nil {
+		return nil, err
+	}
+	k8DeploymentHandler, err := NewDeploymentHandler(k8client, config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	itemHandler, err := NewDownsamplingItemHandler(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	eventPublisher, err := NewEventPublisher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CancelPreviewJob{NewFlinkJobHandler(config, metrics), k8DeploymentHandler, itemHandler, config, metrics, eventPublisher, NewEventRecorder(k8client, config)}, nil
+}
+
+func (d *CancelPreviewJob) Execute(params PARAM) error {
+	defer closeEventPublisher(d.eventPublisher)
+
+	if params.queryId == "" {
+		return errors.New("queryId not received, erroring out")
+	}
+
+	query, err := d.itemHandler.GetDownsamplingItem(params.queryId)
+	if err != nil {
+		return err
+	}
+
+	if query.QueryId == "" {
+		log.Println("No item found. Exiting...")
+		return nil
+	}
+
+	log.Printf("query object: %v", query)
+	direct := d.config.JobName == "" && query.QueryState == "PREVIEW_DEPLOYED"
+	if query.QueryState != "PREVIEW_CANCEL_PENDING" && !direct {
+		log.Printf("Query %s must have status as PREVIEW_CANCEL_PENDING, found %s", query.QueryId, query.QueryState)
+		return nil
+	}
+
+	log.Println("Deleting preview stack...")
+	err = d.k8DeploymentHandler.DeletePreviewStack(NewPreviewStack(query))
+	if err != nil {
+		return err
+	}
+
+	log.Println("Cancelling simulation Flink job...")
+	count, err := d.flinkJobHandler.CancelFlinkJob(query.QueryId, FLINKL_SIMULATION)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d Flink jobs were cancelled.", count)
+
+	err = d.itemHandler.CancelDownsamplingPreviewItem(query)
+	if err != nil {
+		return err
+	}
+
+	// the deployment is gone, the event is only on the job
+	event := NewLifecycleEvent(EVENT_PREVIEW_CANCELLED, d.config.Environment, query)
+	publishLifecycleEvent(d.eventPublisher, event)
+	recordLifecycleEvent(d.events, event, nil)
+	return nil
+}
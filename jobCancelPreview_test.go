@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+type CancelPreviewJobTestSuite struct {
+	CancelPreviewJob CancelPreviewJob
+	EventPublisher   *InMemoryEventPublisher
+}
+
+func NewCancelPreviewJobTestSuite(config *Config, data FakeQueryAssertData) *CancelPreviewJobTestSuite {
+	publisher := &InMemoryEventPublisher{}
+	return &CancelPreviewJobTestSuite{CancelPreviewJob{flinkJobHandler: &FakeFlinkJobHandlerForPreview{}, k8DeploymentHandler: &FakeDeploymentHandler{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, eventPublisher: publisher, events: NewTestEventRecorder()}, publisher}
+}
+
+func Test_CancelPreviewJob_Execute_Success(t *testing.T) {
+	tc := NewCancelPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_CANCEL_PENDING"}}})
+	err := tc.CancelPreviewJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+
+	deleted := tc.CancelPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).deletedStacks
+	cancelled := tc.CancelPreviewJob.flinkJobHandler.(*FakeFlinkJobHandlerForPreview).cancelled
+	if len(deleted) != 1 || deleted[0] != "downsamplr-preview-query1" || len(cancelled) != 1 || cancelled[0] != "query1" {
+		t.Error(fmt.Sprintf("The stack and the simulation job of query1 were expected to be removed, found %v and %v", deleted, cancelled))
+	}
+	updated := tc.CancelPreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "PREVIEW_CANCELLED" {
+		t.Error(fmt.Sprintf("Query was expected PREVIEW_CANCELLED, found %s", updated.QueryState))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_PREVIEW_CANCELLED, "query1", t)
+}
+
+func Test_CancelPreviewJob_Execute_DiffStatus(t *testing.T) {
+	tc := NewCancelPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test", JobName: "downsamplr-test-job"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED"}}})
+	err := tc.CancelPreviewJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if deleted := tc.CancelPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).deletedStacks; len(deleted) != 0 {
+		t.Error(fmt.Sprintf("A preview that was not asked to be cancelled was torn down: %v", deleted))
+	}
+}
+
+func Test_CancelPreviewJob_Execute_FromCommandLine(t *testing.T) {
+	for state, cancelled := range map[string]bool{"PREVIEW_DEPLOYED": true, "PREVIEW_CANCELLED": false} {
+		tc := NewCancelPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: state}}})
+		err := tc.CancelPreviewJob.Execute(PARAM{queryId: "query1"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected here but received - %v", state, err))
+		}
+		if deleted := tc.CancelPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).deletedStacks; (len(deleted) == 1) != cancelled {
+			t.Error(fmt.Sprintf("%s: a preview cancelled from the command line was expected torn down %v, found %v", state, cancelled, deleted))
+		}
+	}
+}
+
+func Test_CancelPreviewJob_Execute_Error_NoQueryId(t *testing.T) {
+	tc := NewCancelPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{})
+	err := tc.CancelPreviewJob.Execute(PARAM{})
+	if err == nil {
+		t.Error("Error was expected without a query id")
+	}
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"strings"
+	"time"
 )
 
 type CoordinatorJob struct {
@@ -30,12 +34,22 @@ func NewCoordinatorJob(config *Config, metrics *Metrics) (*CoordinatorJob, error
 }
 
 func (d *CoordinatorJob) Execute(params PARAM) error {
+	// a failed job is recorded before its item is looked at, the item is not waiting for it anymore
+	if err := d.trackJobs(params); err != nil {
+		log.Printf("Could not track controller jobs: %v", err)
+	}
+
 	dsList, err := d.itemHandler.GetAllDownsamplingItems()
 	if err != nil {
 		return err
 	}
 
 	log.Printf("Received pending items: %v", dsList)
+	admitted, err := d.admitPreviews(dsList)
+	if err != nil {
+		return err
+	}
+
 	operation := ""
 	jobName := ""
 	const CONTROLLER_NAME_PREFIX = "downsample-controller-"
@@ -43,6 +57,10 @@ func (d *CoordinatorJob) Execute(params PARAM) error {
 		log.Printf("Trying query object: %v", query)
 		switch query.QueryState {
 		case "PREVIEW_PENDING":
+			if !admitted[query.QueryId] {
+				log.Printf("Queueing preview of %s, too many previews are active", query.QueryId)
+				continue
+			}
 			jobName = CONTROLLER_NAME_PREFIX + d.config.Environment + "-" + params.OPERATION_SIMULATE + "-" + query.QueryId
 			operation = params.OPERATION_SIMULATE
 		case "PENDING":
@@ -51,12 +69,20 @@ func (d *CoordinatorJob) Execute(params PARAM) error {
 		case "DELETED":
 			jobName = CONTROLLER_NAME_PREFIX + d.config.Environment + "-" + params.OPERATION_DELETE + "-" + query.QueryId
 			operation = params.OPERATION_DELETE
+		case "PREVIEW_CANCEL_PENDING":
+			jobName = CONTROLLER_NAME_PREFIX + d.config.Environment + "-" + params.OPERATION_CANCEL_PREVIEW + "-" + query.QueryId
+			operation = params.OPERATION_CANCEL_PREVIEW
+		case "PREVIEW_EXTEND_PENDING":
+			// each extension moves the expiry, so a preview can be extended again once its last job ran
+			jobName = CONTROLLER_NAME_PREFIX + d.config.Environment + "-" + params.OPERATION_EXTEND_PREVIEW + "-" + query.QueryId + "-" + previewExpiryKey(query)
+			operation = params.OPERATION_EXTEND_PREVIEW
 		default:
 			err = errors.New("Invalid option, must not have reached here!")
 		}
 		if err != nil {
 			return err
 		}
+		jobName = shortJobName(jobName)
 
 		config, err := d.k8JobHandler.GetConfigForJob(operation, jobName, query.QueryId, params)
 		if err != nil {
@@ -75,3 +101,110 @@ func (d *CoordinatorJob) Execute(params PARAM) error {
 
 	return nil
 }
+
+// trackJobs records how the finished controller jobs ended on their items, and deletes those finished for longer than
+// JobRetentionMinute. Jobs created before they were labeled with their query are only deleted.
+func (d *CoordinatorJob) trackJobs(params PARAM) error {
+	jobs, err := d.k8JobHandler.GetAllDeploymentJobs()
+	if err != nil {
+		return err
+	}
+
+	// jobs failed for these operations leave their items waiting
+	failStates := map[string]string{params.OPERATION_SIMULATE: "PREVIEW_PENDING", params.OPERATION_DEPLOY: "PENDING"}
+	for _, job := range jobs.Items {
+		outcome, err := d.k8JobHandler.GetJobOutcome(job)
+		if err != nil {
+			return err
+		}
+		if outcome == nil {
+			continue
+		}
+
+		if queryId := job.Labels["queryId"]; queryId != "" {
+			err = d.itemHandler.RecordJobOutcome(queryId, *outcome, failStates[outcome.Operation])
+			if err != nil {
+				return err
+			}
+		}
+
+		finishedAt, err := time.Parse(time.RFC3339, outcome.FinishedAt)
+		if err == nil && time.Now().Sub(finishedAt).Minutes() > d.config.JobRetentionMinute {
+			err = d.k8JobHandler.DeleteJob(job.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// admitPreviews picks the pending previews that fit in the preview limits, oldest first, the others wait for a later run.
+// Pending previews admitted by an earlier run are older than the rest, so they are admitted again before any new one.
+func (d *CoordinatorJob) admitPreviews(dsList []DownsamplingObject) (map[string]bool, error) {
+	admitted := make(map[string]bool)
+	var pending []DownsamplingObject
+	for _, query := range dsList {
+		if query.QueryState == "PREVIEW_PENDING" {
+			pending = append(pending, query)
+		}
+	}
+	limits := d.config.PreviewLimits
+	if len(pending) == 0 || limits == nil || limits.MaxActive <= 0 && limits.MaxActivePerDb <= 0 {
+		for _, query := range pending {
+			admitted[query.QueryId] = true
+		}
+		return admitted, nil
+	}
+
+	deployed, err := d.itemHandler.GetActivePreviewItems()
+	if err != nil {
+		return admitted, err
+	}
+	active := make(map[string]string)
+	for _, query := range append(deployed, dsList...) {
+		switch query.QueryState {
+		case "PREVIEW_DEPLOYED", "PREVIEW_CANCEL_PENDING", "PREVIEW_EXTEND_PENDING":
+			active[query.QueryId] = query.Db
+		}
+	}
+	activePerDb := make(map[string]int)
+	for _, db := range active {
+		activePerDb[db]++
+	}
+
+	DownsampleObjects(pending).SortByTime()
+	count := len(active)
+	for _, query := range pending {
+		if limits.Admits(count, activePerDb[query.Db]) {
+			admitted[query.QueryId] = true
+			count++
+			activePerDb[query.Db]++
+		}
+	}
+	log.Printf("Admitted %d of %d pending previews, %d previews active", len(admitted), len(pending), len(active))
+	return admitted, nil
+}
+
+// previewExpiryKey tells apart the extensions of a preview in job names.
+func previewExpiryKey(query DownsamplingObject) string {
+	return shortHash(query.PreviewExpiresAt)
+}
+
+// Job names end up in the app label of their pods, whose values are at most this long.
+const MAX_JOB_NAME_LENGTH = 63
+
+// shortJobName keeps a job name within MAX_JOB_NAME_LENGTH, a longer one is cut and ends with a hash of the whole name.
+func shortJobName(name string) string {
+	if len(name) <= MAX_JOB_NAME_LENGTH {
+		return name
+	}
+	suffix := "-" + shortHash(name)
+	return strings.TrimRight(name[:MAX_JOB_NAME_LENGTH-len(suffix)], "-") + suffix
+}
+
+func shortHash(value string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
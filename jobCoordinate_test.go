@@ -6,6 +6,7 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	"strings"
 	"testing"
+	"time"
 )
 
 type CoordinatorJobTestSuite struct {
@@ -43,14 +44,14 @@ func (j *FakeJobHandler) GetJob(jobName string) (*batchv1.Job, error) {
 	return &job, nil
 }
 
-func (j *FakeJobHandler) CreateJob(jobName string, config *DefaultFiller) (bool, error) {
+func (j *FakeJobHandler) CreateJob(jobName string, config *ControllerJobFiller) (bool, error) {
 	if jobName != j.JobName {
 		return false, errors.New("wrong job name")
 	}
 	return true, nil
 }
 
-func (j *FakeJobHandler) GetConfigForJob(operation string, jobName string, queryId string, params PARAM) (*DefaultFiller, error) {
+func (j *FakeJobHandler) GetConfigForJob(operation string, jobName string, queryId string, params PARAM) (*ControllerJobFiller, error) {
 	if jobName != j.JobName {
 		return nil, errors.New("wrong job name")
 	}
@@ -60,6 +61,14 @@ func (j *FakeJobHandler) GetConfigForJob(operation string, jobName string, query
 	return nil, nil
 }
 
+func (j *FakeJobHandler) GetJobOutcome(job batchv1.Job) (*JobOutcome, error) {
+	return nil, nil
+}
+
+func (j *FakeJobHandler) DeleteJob(jobName string) error {
+	return nil
+}
+
 func Test_CoordinatorJob_Execute_PreviewPending(t *testing.T) {
 	tc := NewCoordinatorJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PREVIEW_PENDING"}}}, "downsample-controller-test-simulate-query1", "simulate")
 	err := tc.CoordinatorJob.Execute(PARAM{OPERATION_SIMULATE: "simulate"})
@@ -84,6 +93,55 @@ func Test_CoordinatorJob_Execute_Deleted(t *testing.T) {
 	}
 }
 
+func Test_CoordinatorJob_Execute_PreviewCancelPending(t *testing.T) {
+	tc := NewCoordinatorJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query4", QueryState: "PREVIEW_CANCEL_PENDING"}}}, "downsample-controller-test-cancel-preview-query4", "cancel-preview")
+	err := tc.CoordinatorJob.Execute(PARAM{OPERATION_CANCEL_PREVIEW: "cancel-preview"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+}
+
+func Test_CoordinatorJob_Execute_PreviewExtendPending(t *testing.T) {
+	tc := NewCoordinatorJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query5", QueryState: "PREVIEW_EXTEND_PENDING", PreviewExpiresAt: "2030-01-01T00:00:00Z"}}}, "downsample-controller-test-extend-preview-query5-741d3fb2", "extend-preview")
+	err := tc.CoordinatorJob.Execute(PARAM{OPERATION_EXTEND_PREVIEW: "extend-preview"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+}
+
+func Test_CoordinatorJob_Execute_LongJobNames(t *testing.T) {
+	queryId := "3f2b8c1e-4d5a-4b6c-9e7f-1a2b3c4d5e6f"
+	config := &Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "production-eu-west-1"}
+	var names []string
+	for _, expiresAt := range []string{"2030-01-01T00:00:00Z", "2030-01-01T01:00:00Z", "2030-01-01T01:00:00Z"} {
+		jobHandler := &RecordingJobHandler{}
+		sut := CoordinatorJob{k8JobHandler: jobHandler, itemHandler: &DownsamplingItemHandler{db: NewMockDb(FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: queryId, QueryState: "PREVIEW_EXTEND_PENDING", PreviewExpiresAt: expiresAt}}}), config: config}, config: config}
+		err := sut.Execute(PARAM{OPERATION_EXTEND_PREVIEW: "extend-preview"})
+		if err != nil {
+			t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+		}
+		for _, name := range jobHandler.created {
+			if len(name) > MAX_JOB_NAME_LENGTH || !strings.HasPrefix(name, "downsample-controller-production-eu-west-1-") {
+				t.Error(fmt.Sprintf("The job name was expected to be cut to %d characters, found %s", MAX_JOB_NAME_LENGTH, name))
+			}
+		}
+		names = append(names, jobHandler.created...)
+	}
+	if len(names) != 3 || names[0] == names[1] || names[1] != names[2] {
+		t.Error(fmt.Sprintf("Each extension was expected to get its own job name, found %v", names))
+	}
+}
+
+func Test_ShortJobName(t *testing.T) {
+	if name := shortJobName("downsample-controller-test-deploy-query1"); name != "downsample-controller-test-deploy-query1" {
+		t.Error(fmt.Sprintf("A short job name was expected to be kept, found %s", name))
+	}
+	long := "downsample-controller-production-eu-west-1-deploy-3f2b8c1e-4d5a-4b6c-9e7f-1a2b3c4d5e6f"
+	if name := shortJobName(long); len(name) > MAX_JOB_NAME_LENGTH || name == shortJobName(long+"0") || name != shortJobName(long) {
+		t.Error(fmt.Sprintf("A long job name was expected to be cut with a hash of the whole name, found %s", name))
+	}
+}
+
 func Test_CoordinatorJob_Execute_Error(t *testing.T) {
 	tc := NewCoordinatorJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query3", QueryState: "DEPLOYED"}}}, "", "deploy")
 	err := tc.CoordinatorJob.Execute(PARAM{OPERATION_DEPLOY: "deploy"})
@@ -91,3 +149,126 @@ func Test_CoordinatorJob_Execute_Error(t *testing.T) {
 		t.Error(fmt.Sprintf("Error was expected but not received accordingly - %v", err))
 	}
 }
+
+// RecordingJobHandler creates any job and records their names.
+type RecordingJobHandler struct {
+	FakeJobHandler
+	created []string
+}
+
+func (j *RecordingJobHandler) GetConfigForJob(operation string, jobName string, queryId string, params PARAM) (*ControllerJobFiller, error) {
+	return nil, nil
+}
+
+func (j *RecordingJobHandler) CreateJob(jobName string, config *ControllerJobFiller) (bool, error) {
+	j.created = append(j.created, jobName)
+	return true, nil
+}
+
+func Test_CoordinatorJob_Execute_PreviewLimits(t *testing.T) {
+	dsList := []DownsamplingObject{
+		{QueryId: "query5", Db: "sca", QueryState: "PREVIEW_EXTEND_PENDING", PreviewExpiresAt: "2030-01-01T00:00:00Z", CreatedAt: "2017-11-20T18:00:00Z"},
+		{QueryId: "query8", Db: "omni", QueryState: "PREVIEW_PENDING", CreatedAt: "2017-11-20T18:58:33Z"},
+		{QueryId: "query6", Db: "sca", QueryState: "PREVIEW_PENDING", CreatedAt: "2017-11-20T18:58:31Z"},
+		{QueryId: "query7", Db: "sca", QueryState: "PREVIEW_PENDING", CreatedAt: "2017-11-20T18:58:32Z"},
+		{QueryId: "query9", Db: "omni", QueryState: "PREVIEW_PENDING", CreatedAt: "2017-11-20T18:58:34Z"},
+	}
+	tests := map[string]struct {
+		limits   *PreviewLimitConfig
+		expected []string
+	}{
+		"no limits": {&PreviewLimitConfig{}, []string{"query5", "query8", "query6", "query7", "query9"}},
+		"global":    {&PreviewLimitConfig{MaxActive: 3}, []string{"query5", "query6", "query7"}},
+		"per db":    {&PreviewLimitConfig{MaxActivePerDb: 2}, []string{"query5", "query8", "query6", "query9"}},
+		"both":      {&PreviewLimitConfig{MaxActive: 3, MaxActivePerDb: 2}, []string{"query5", "query8", "query6"}},
+	}
+	for name, test := range tests {
+		config := &Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test", PreviewLimits: test.limits}
+		jobHandler := &RecordingJobHandler{}
+		sut := CoordinatorJob{k8JobHandler: jobHandler, itemHandler: &DownsamplingItemHandler{db: NewMockDb(FakeQueryAssertData{dsList: dsList}), config: config}, config: config}
+		err := sut.Execute(PARAM{OPERATION_SIMULATE: "simulate", OPERATION_EXTEND_PREVIEW: "extend-preview"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected here but received - %v", name, err))
+		}
+		var created []string
+		for _, jobName := range jobHandler.created {
+			created = append(created, jobName[strings.Index(jobName, "query"):][:len("query5")])
+		}
+		if strings.Join(created, ",") != strings.Join(test.expected, ",") {
+			t.Error(fmt.Sprintf("%s: jobs were expected for %v, found %v", name, test.expected, jobHandler.created))
+		}
+	}
+}
+
+// TrackedJobHandler has finished jobs, the outcome of a job is read from its annotations.
+type TrackedJobHandler struct {
+	RecordingJobHandler
+	jobs    []batchv1.Job
+	deleted []string
+}
+
+func (j *TrackedJobHandler) GetAllDeploymentJobs() (*batchv1.JobList, error) {
+	return &batchv1.JobList{Items: j.jobs}, nil
+}
+
+func (j *TrackedJobHandler) GetJobOutcome(job batchv1.Job) (*JobOutcome, error) {
+	if job.Annotations["finishedAt"] == "" {
+		return nil, nil
+	}
+	return &JobOutcome{Name: job.Name, Operation: job.Labels["operation"], Succeeded: job.Annotations["succeeded"] == "true", Message: job.Annotations["message"], FinishedAt: job.Annotations["finishedAt"]}, nil
+}
+
+func (j *TrackedJobHandler) DeleteJob(jobName string) error {
+	j.deleted = append(j.deleted, jobName)
+	return nil
+}
+
+func NewTrackedJob(name string, queryId string, operation string, succeeded string, finishedMinutesAgo int) batchv1.Job {
+	job := batchv1.Job{}
+	job.Name = name
+	job.Labels = map[string]string{"purpose": CONTROLLER_JOB_PURPOSE, "queryId": queryId, "operation": operation}
+	if finishedMinutesAgo >= 0 {
+		job.Annotations = map[string]string{"succeeded": succeeded, "message": "DeadlineExceeded: preview not available", "finishedAt": time.Now().Add(-time.Duration(finishedMinutesAgo) * time.Minute).UTC().Format(time.RFC3339)}
+	}
+	return job
+}
+
+func Test_CoordinatorJob_Execute_TracksJobs(t *testing.T) {
+	tests := map[string]struct {
+		job           batchv1.Job
+		expectedState string
+		deleted       bool
+	}{
+		"running":                   {NewTrackedJob("job1", "query1", "simulate", "", -1), "PREVIEW_PENDING", false},
+		"failed":                    {NewTrackedJob("job1", "query1", "simulate", "false", 5), "FAILED", false},
+		"succeeded":                 {NewTrackedJob("job1", "query1", "simulate", "true", 5), "PREVIEW_PENDING", false},
+		"failed for other state":    {NewTrackedJob("job1", "query1", "deploy", "false", 5), "PREVIEW_PENDING", false},
+		"past retention":            {NewTrackedJob("job1", "query1", "simulate", "true", 61), "PREVIEW_PENDING", true},
+		"past retention, no labels": {batchv1.Job{ObjectMeta: NewTrackedJob("job1", "", "", "true", 61).ObjectMeta}, "PREVIEW_PENDING", true},
+	}
+	for name, test := range tests {
+		config := &Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test", JobRetentionMinute: 60}
+		jobHandler := &TrackedJobHandler{jobs: []batchv1.Job{test.job}}
+		db := NewMockDb(FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_PENDING"}}})
+		sut := CoordinatorJob{k8JobHandler: jobHandler, itemHandler: &DownsamplingItemHandler{db: db, config: config}, config: config}
+		err := sut.trackJobs(PARAM{OPERATION_SIMULATE: "simulate", OPERATION_DEPLOY: "deploy"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected here but received - %v", name, err))
+		}
+
+		updated := db.FakeQueryAssertData.objectToExpect
+		if test.job.Labels["queryId"] != "" && test.job.Annotations["finishedAt"] != "" {
+			if updated.LastJob == nil || updated.LastJob.Name != "job1" || updated.QueryState != test.expectedState {
+				t.Error(fmt.Sprintf("%s: the outcome was expected on the item in state %s, found %v in %s", name, test.expectedState, updated.LastJob, updated.QueryState))
+			}
+			if test.expectedState == "FAILED" && !strings.Contains(updated.StateMessage, "preview not available") {
+				t.Error(fmt.Sprintf("%s: the termination message was expected on the item, found %s", name, updated.StateMessage))
+			}
+		} else if updated.QueryId != "" {
+			t.Error(fmt.Sprintf("%s: the item was not expected to be updated, found %v", name, updated))
+		}
+		if deleted := len(jobHandler.deleted) == 1; deleted != test.deleted {
+			t.Error(fmt.Sprintf("%s: deleted %t was expected, found %v", name, test.deleted, jobHandler.deleted))
+		}
+	}
+}
@@ -6,10 +6,14 @@ import (
 )
 
 type DeleteDownsamplingJob struct {
-	flinkJobHandler FlinkJobHandlerInterface
-	itemHandler     DownsamplingItemHandlerInterface
-	config          *Config
-	Metrics         *Metrics
+	engineSelector       EngineSelectorInterface
+	itemHandler          DownsamplingItemHandlerInterface
+	config               *Config
+	Metrics              *Metrics
+	eventPublisher       EventPublisherInterface
+	dashboardProvisioner DashboardProvisionerInterface
+	annotator            AnnotatorInterface
+	events               EventRecorderInterface
 }
 
 func NewDeleteDownsamplingJob(config *Config, metrics *Metrics) (*DeleteDownsamplingJob, error) {
@@ -18,11 +22,32 @@ func NewDeleteDownsamplingJob(config *Config, metrics *Metrics) (*DeleteDownsamp
 		return nil, err
 	}
 
-	flinkJobHandler := NewFlinkJobHandler(config, metrics)
-	return &DeleteDownsamplingJob{flinkJobHandler, itemHanlder, config, metrics}, nil
+	engineSelector, err := NewEngineSelector(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	eventPublisher, err := NewEventPublisher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboardProvisioner, err := NewDashboardProvisioner(config)
+	if err != nil {
+		return nil, err
+	}
+
+	k8client, err := NewK8Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeleteDownsamplingJob{engineSelector, itemHanlder, config, metrics, eventPublisher, dashboardProvisioner, NewAnnotator(config, metrics), NewEventRecorder(k8client, config)}, nil
 }
 
 func (d *DeleteDownsamplingJob) Execute(params PARAM) error {
+	defer closeEventPublisher(d.eventPublisher)
+
 	if params.queryId == "" {
 		return errors.New("queryId not received, erroring out...")
 	}
@@ -43,18 +68,39 @@ func (d *DeleteDownsamplingJob) Execute(params PARAM) error {
 		return nil
 	}
 
-	log.Println("Cancelling Flink job...")
-	count, err := d.flinkJobHandler.CancelFlinkJob(query.QueryId, FLINK_ALL)
+	err = d.delete(query)
 	if err != nil {
+		event := NewFailedLifecycleEvent(d.config.Environment, query, err)
+		publishLifecycleEvent(d.eventPublisher, event)
+		recordLifecycleEvent(d.events, event, nil)
 		return err
 	}
-	log.Printf("%d jobs were cancel attempted.", count)
 
-	log.Println("Deleting from database...")
-	err = d.itemHandler.DeleteDownsamplingItem(query)
+	event := NewLifecycleEvent(EVENT_DELETED, d.config.Environment, query)
+	publishLifecycleEvent(d.eventPublisher, event)
+	recordLifecycleEvent(d.events, event, nil)
+	annotateLifecycle(d.annotator, query, ANNOTATION_DELETE)
+	return nil
+}
+
+func (d *DeleteDownsamplingJob) delete(query DownsamplingObject) error {
+	engine, err := d.engineSelector.GetEngine(query.Engine)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	log.Printf("Deleting from %s engine...", engine.Name())
+	err = engine.Delete(query)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Removing dashboard...")
+	err = d.dashboardProvisioner.RemoveDashboard(query)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Deleting from database...")
+	return d.itemHandler.DeleteDownsamplingItem(query)
 }
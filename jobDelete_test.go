@@ -10,10 +10,12 @@ import (
 type DeleteDownsamplingJobTestSuite struct {
 	DeleteDownsamplingJob DeleteDownsamplingJob
 	FakeQueryAssertData   FakeQueryAssertData
+	EventPublisher        *InMemoryEventPublisher
 }
 
 func NewDeleteDownsamplingJobTestSuite(config *Config, data FakeQueryAssertData) *DeleteDownsamplingJobTestSuite {
-	return &DeleteDownsamplingJobTestSuite{DeleteDownsamplingJob{flinkJobHandler: &FakeFlinkJobHandler{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config}, data}
+	publisher := &InMemoryEventPublisher{}
+	return &DeleteDownsamplingJobTestSuite{DeleteDownsamplingJob{engineSelector: NewFlinkEngineSelector(&FakeFlinkJobHandler{}), itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, eventPublisher: publisher, dashboardProvisioner: &NoopDashboardProvisioner{}, annotator: &NoopAnnotator{}, events: NewTestEventRecorder()}, data, publisher}
 }
 
 type FakeFlinkJobHandler struct {
@@ -38,12 +40,17 @@ func (f *FakeFlinkJobHandler) HandleOldFlinkJobs() (int, error) {
 	return 0, nil
 }
 
+func (f *FakeFlinkJobHandler) FindFlinkJobId(queryId string, mode string) (string, error) {
+	return "", nil
+}
+
 func Test_DeleteDownsamplingJob_Execute_Success(t *testing.T) {
 	tc := NewDeleteDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "DELETED"}}})
 	err := tc.DeleteDownsamplingJob.Execute(PARAM{queryId: "query1"})
 	if err != nil {
 		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
 	}
+	tc.EventPublisher.AssertPublished(EVENT_DELETED, "query1", t)
 }
 
 func Test_DeleteDownsamplingJob_Execute_NoItem(t *testing.T) {
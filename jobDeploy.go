@@ -3,13 +3,19 @@ package main
 import (
 	"errors"
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 )
 
 type DeployDownsamplingJob struct {
-	flinkJobHandler FlinkJobHandlerInterface
-	itemHandler     DownsamplingItemHandlerInterface
-	config          *Config
-	metrics         *Metrics
+	engineSelector       EngineSelectorInterface
+	itemHandler          DownsamplingItemHandlerInterface
+	config               *Config
+	metrics              *Metrics
+	eventPublisher       EventPublisherInterface
+	queryValidator       QueryValidatorInterface
+	dashboardProvisioner DashboardProvisionerInterface
+	annotator            AnnotatorInterface
+	events               EventRecorderInterface
 }
 
 func NewDeployDownsamplingJob(config *Config, metrics *Metrics) (*DeployDownsamplingJob, error) {
@@ -18,12 +24,37 @@ func NewDeployDownsamplingJob(config *Config, metrics *Metrics) (*DeployDownsamp
 		return nil, err
 	}
 
-	flinkJobHandler := NewFlinkJobHandler(config, metrics)
+	engineSelector, err := NewEngineSelector(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	eventPublisher, err := NewEventPublisher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	queryValidator, err := NewQueryValidator(config)
+	if err != nil {
+		return nil, err
+	}
 
-	return &DeployDownsamplingJob{flinkJobHandler, itemHanlder, config, metrics}, nil
+	dashboardProvisioner, err := NewDashboardProvisioner(config)
+	if err != nil {
+		return nil, err
+	}
+
+	k8client, err := NewK8Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeployDownsamplingJob{engineSelector, itemHanlder, config, metrics, eventPublisher, queryValidator, dashboardProvisioner, NewAnnotator(config, metrics), NewEventRecorder(k8client, config)}, nil
 }
 
 func (d *DeployDownsamplingJob) Execute(params PARAM) error {
+	defer closeEventPublisher(d.eventPublisher)
+
 	if params.queryId == "" {
 		return errors.New("queryId not received, erroring out")
 	}
@@ -44,17 +75,97 @@ func (d *DeployDownsamplingJob) Execute(params PARAM) error {
 		return nil
 	}
 
-	log.Println("Deploying Flink job...")
-	err = d.flinkJobHandler.DeployFlinkJob(query)
-	if err != nil {
+	err = d.queryValidator.Validate(query)
+	if validationErr, ok := err.(*QueryValidationError); ok {
+		event := NewFailedLifecycleEvent(d.config.Environment, query, validationErr)
+		publishLifecycleEvent(d.eventPublisher, event)
+		recordLifecycleEvent(d.events, event, nil)
+		return d.itemHandler.FailDownsamplingItem(query, validationErr.Error())
+	} else if err != nil {
 		return err
 	}
 
-	log.Println("Updating status as deployed...")
-	err = d.itemHandler.DeployDownsamplingItem(query)
+	query, replaced, err := d.deploy(query)
 	if err != nil {
+		event := NewFailedLifecycleEvent(d.config.Environment, query, err)
+		publishLifecycleEvent(d.eventPublisher, event)
+		recordLifecycleEvent(d.events, event, nil)
 		return err
 	}
 
+	event := NewLifecycleEvent(EVENT_DEPLOYED, d.config.Environment, query)
+	publishLifecycleEvent(d.eventPublisher, event)
+	recordLifecycleEvent(d.events, event, nil)
+	action := ANNOTATION_DEPLOY
+	if replaced {
+		action = ANNOTATION_UPDATE
+	}
+	annotateLifecycle(d.annotator, query, action)
 	return nil
 }
+
+// deploy returns the query with the engine it was deployed on, and whether it replaced a previous deployment.
+// A query back to PENDING after a deploy still has the engine it was deployed on.
+func (d *DeployDownsamplingJob) deploy(query DownsamplingObject) (DownsamplingObject, bool, error) {
+	replaced := query.Engine != ""
+	if replaced {
+		var err error
+		query, err = d.undeploy(query)
+		if err != nil {
+			return query, false, err
+		}
+	}
+
+	engine, err := d.engineSelector.SelectEngine(query)
+	if err != nil {
+		return query, false, err
+	}
+	query.Engine = engine.Name()
+
+	// the dashboard goes first, a failure here leaves nothing running to clean up
+	log.Println("Provisioning dashboard...")
+	query.DashboardTemplate, err = d.dashboardProvisioner.ProvisionDashboard(query)
+	if err != nil {
+		return query, false, err
+	}
+	if query.DashboardTemplate != "" {
+		d.events.Eventf(nil, corev1.EventTypeNormal, REASON_GRAFANA_PROVISIONED, "Dashboard %s of query %s provisioned", query.DashboardTemplate, query.QueryId)
+	}
+
+	log.Printf("Deploying on %s engine...", query.Engine)
+	err = engine.Deploy(query)
+	if err != nil {
+		return query, false, err
+	}
+	if jobEngine, ok := engine.(JobEngineInterface); ok {
+		// the job runs already, not knowing its id is no reason to fail the deploy
+		query.FlinkJobId, err = jobEngine.JobId(query)
+		if err != nil {
+			log.Printf("Could not get the job id: %v", err)
+		}
+		d.events.Eventf(nil, corev1.EventTypeNormal, REASON_FLINK_JOB_SUBMITTED, "Flink job %s of query %s submitted", query.FlinkJobId, query.QueryId)
+	} else {
+		d.events.Eventf(nil, corev1.EventTypeNormal, REASON_ENGINE_DEPLOYED, "Query %s deployed on %s engine", query.QueryId, query.Engine)
+	}
+
+	log.Println("Updating status as deployed...")
+	return query, replaced, d.itemHandler.DeployDownsamplingItem(query)
+}
+
+// undeploy removes the deployment of a query whose spec changed, a running job or continuous query does not pick up
+// the new spec. The engine is selected again for the new spec.
+func (d *DeployDownsamplingJob) undeploy(query DownsamplingObject) (DownsamplingObject, error) {
+	engine, err := d.engineSelector.GetEngine(query.Engine)
+	if err != nil {
+		return query, err
+	}
+
+	log.Printf("Removing the previous deployment from %s engine...", engine.Name())
+	err = engine.Delete(query)
+	if err != nil {
+		return query, err
+	}
+	query.Engine = ""
+	query.FlinkJobId = ""
+	return query, nil
+}
@@ -10,13 +10,17 @@ import (
 type DeployDownsamplingJobTestSuite struct {
 	DeployDownsamplingJob DeployDownsamplingJob
 	FakeQueryAssertData   FakeQueryAssertData
+	EventPublisher        *InMemoryEventPublisher
 }
 
 func NewDeployDownsamplingJobTestSuite(config *Config, data FakeQueryAssertData) *DeployDownsamplingJobTestSuite {
-	return &DeployDownsamplingJobTestSuite{DeployDownsamplingJob{flinkJobHandler: &FakeFlinkJobHandlerForDeploy{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config}, data}
+	publisher := &InMemoryEventPublisher{}
+	return &DeployDownsamplingJobTestSuite{DeployDownsamplingJob{engineSelector: NewFlinkEngineSelector(&FakeFlinkJobHandlerForDeploy{}), itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, eventPublisher: publisher, queryValidator: &NoopQueryValidator{}, dashboardProvisioner: &NoopDashboardProvisioner{}, annotator: &NoopAnnotator{}, events: NewTestEventRecorder()}, data, publisher}
 }
 
 type FakeFlinkJobHandlerForDeploy struct {
+	calls     []string
+	cancelErr error
 }
 
 func (f *FakeFlinkJobHandlerForDeploy) DeployFlinkJobForSimulation(query DownsamplingObject, influxdbBaseUrl string, offsets KafkaPartitionOffsets) error {
@@ -24,6 +28,7 @@ func (f *FakeFlinkJobHandlerForDeploy) DeployFlinkJobForSimulation(query Downsam
 }
 
 func (f *FakeFlinkJobHandlerForDeploy) DeployFlinkJob(query DownsamplingObject) error {
+	f.calls = append(f.calls, "deploy "+query.QueryId)
 	return nil
 }
 
@@ -31,19 +36,31 @@ func (f *FakeFlinkJobHandlerForDeploy) CancelFlinkJob(queryId string, mode strin
 	if mode != FLINK_ALL {
 		return 0, errors.New("wrong mode")
 	}
-	return 0, nil
+	if f.cancelErr != nil {
+		return 0, f.cancelErr
+	}
+	f.calls = append(f.calls, "cancel "+queryId)
+	return 1, nil
 }
 
 func (f *FakeFlinkJobHandlerForDeploy) HandleOldFlinkJobs() (int, error) {
 	return 0, nil
 }
 
+func (f *FakeFlinkJobHandlerForDeploy) FindFlinkJobId(queryId string, mode string) (string, error) {
+	return "flinkjob1", nil
+}
+
 func Test_DeployDownsamplingJob_Execute_Success(t *testing.T) {
 	tc := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PENDING"}}})
 	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
 	if err != nil {
 		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
 	}
+	tc.EventPublisher.AssertPublished(EVENT_DEPLOYED, "query1", t)
+	if !tc.EventPublisher.Closed {
+		t.Error("The event publisher was expected to be closed when the job ends")
+	}
 }
 
 func Test_DeployDownsamplingJob_Execute_NoItem(t *testing.T) {
@@ -69,3 +86,159 @@ func Test_DeployDownsamplingJob_Execute_Error_NoQueryId(t *testing.T) {
 		t.Error(fmt.Sprintf("Error was expected but not received accordingly - %v", err))
 	}
 }
+
+func Test_DeployDownsamplingJob_Execute_InvalidQuery(t *testing.T) {
+	tc := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PENDING"}}})
+	tc.DeployDownsamplingJob.queryValidator = &FakeQueryValidator{&QueryValidationError{[]string{"field count not found in request_count"}}}
+	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	updated := tc.DeployDownsamplingJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "FAILED" || !strings.Contains(updated.StateMessage, "field count not found") {
+		t.Error(fmt.Sprintf("Query was expected to be FAILED with a message, found %s: %s", updated.QueryState, updated.StateMessage))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_FAILED, "query1", t)
+}
+
+func Test_DeployDownsamplingJob_Execute_ValidationError(t *testing.T) {
+	tc := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PENDING"}}})
+	tc.DeployDownsamplingJob.queryValidator = &FakeQueryValidator{errors.New("connection refused")}
+	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Error(fmt.Sprintf("Error was expected but not received accordingly - %v", err))
+	}
+}
+
+func Test_DeployDownsamplingJob_Execute_RecordsEngine(t *testing.T) {
+	tc := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PENDING"}}})
+	tc.DeployDownsamplingJob.engineSelector = NewEngineSelectorForTest(3)
+	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	updated := tc.DeployDownsamplingJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "DEPLOYED" || updated.Engine != ENGINE_CONTINUOUS_QUERY {
+		t.Error(fmt.Sprintf("Query was expected DEPLOYED on %s, found %s on %s", ENGINE_CONTINUOUS_QUERY, updated.QueryState, updated.Engine))
+	}
+	if len(tc.EventPublisher.Events) != 1 || tc.EventPublisher.Events[0].Engine != ENGINE_CONTINUOUS_QUERY {
+		t.Error(fmt.Sprintf("Deployed event was expected with engine %s, found %v", ENGINE_CONTINUOUS_QUERY, tc.EventPublisher.Events))
+	}
+}
+
+func Test_DeployDownsamplingJob_Execute_Annotates(t *testing.T) {
+	tc := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PENDING", Engine: ENGINE_FLINK}}})
+	annotator := &FakeAnnotator{err: errors.New("grafana down")}
+	tc.DeployDownsamplingJob.annotator = annotator
+	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("A failed annotation was not expected to fail the deploy - %v", err))
+	}
+	if fmt.Sprint(annotator.actions) != "[update query1]" {
+		t.Error(fmt.Sprintf("A redeployed query was expected to be annotated as an update, found %v", annotator.actions))
+	}
+}
+
+func Test_DeployDownsamplingJob_Execute_AnnotatesOnlyReplaced(t *testing.T) {
+	testCases := map[string]struct {
+		engine    string
+		cancelErr error
+		expected  string
+	}{
+		"new":               {"", nil, "[deploy query1]"},
+		"replaced":          {ENGINE_FLINK, nil, "[update query1]"},
+		"not torn down yet": {ENGINE_FLINK, errors.New("flink down"), "[]"},
+	}
+
+	for name, tc := range testCases {
+		suite := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PENDING", Engine: tc.engine}}})
+		flinkJobHandler := &FakeFlinkJobHandlerForDeploy{cancelErr: tc.cancelErr}
+		suite.DeployDownsamplingJob.engineSelector = NewFlinkEngineSelector(flinkJobHandler)
+		annotator := &FakeAnnotator{}
+		suite.DeployDownsamplingJob.annotator = annotator
+		err := suite.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+		if (err != nil) != (tc.cancelErr != nil) {
+			t.Error(fmt.Sprintf("%s: error was not expected accordingly - %v", name, err))
+		}
+		if fmt.Sprint(annotator.actions) != tc.expected {
+			t.Error(fmt.Sprintf("%s: annotations were expected %s, found %v", name, tc.expected, annotator.actions))
+		}
+		if tc.cancelErr != nil && len(flinkJobHandler.calls) != 0 {
+			t.Error(fmt.Sprintf("%s: nothing was expected to be deployed while the previous job runs, found %v", name, flinkJobHandler.calls))
+		}
+	}
+}
+
+func Test_DeployDownsamplingJob_Execute_RecordsDashboardTemplate(t *testing.T) {
+	config := &Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}
+	tc := NewDeployDownsamplingJobTestSuite(config, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PENDING"}}})
+	tc.DeployDownsamplingJob.dashboardProvisioner = &DashboardProvisioner{grafana: &FakeGrafana{}, config: config}
+	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	updated := tc.DeployDownsamplingJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "DEPLOYED" || updated.DashboardTemplate != "counter" {
+		t.Error(fmt.Sprintf("Query was expected DEPLOYED with dashboard template counter, found %s with %s", updated.QueryState, updated.DashboardTemplate))
+	}
+}
+
+func Test_DeployDownsamplingJob_Execute_RecordsFlinkJobId(t *testing.T) {
+	tc := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PENDING"}}})
+	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	updated := tc.DeployDownsamplingJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.FlinkJobId != "flinkjob1" {
+		t.Error(fmt.Sprintf("Flink job id was expected flinkjob1, found %s", updated.FlinkJobId))
+	}
+}
+
+func Test_DeployDownsamplingJob_Execute_RecordsEvents(t *testing.T) {
+	testCases := map[string]struct {
+		engineSelector EngineSelectorInterface
+		expected       string
+	}{
+		"flink":            {NewFlinkEngineSelector(&FakeFlinkJobHandlerForDeploy{}), "[Normal FlinkJobSubmitted Flink job flinkjob1 of query query1 submitted Normal Deployed Query query1 deployed]"},
+		"continuous query": {NewEngineSelectorForTest(3), "[Normal EngineDeployed Query query1 deployed on continuous_query engine Normal Deployed Query query1 deployed]"},
+	}
+
+	for name, tc := range testCases {
+		suite := NewDeployDownsamplingJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PENDING"}}})
+		suite.DeployDownsamplingJob.engineSelector = tc.engineSelector
+		err := suite.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected here but received - %v", name, err))
+		}
+		recorded := fmt.Sprint(recordedEvents(suite.DeployDownsamplingJob.events))
+		if recorded != tc.expected {
+			t.Error(fmt.Sprintf("%s: events %s were expected, found %s", name, tc.expected, recorded))
+		}
+	}
+}
+
+func Test_DeployDownsamplingJob_Execute_SpecChanged(t *testing.T) {
+	spec := map[string]interface{}{"db": "sca", "rp": "autogen", "measurement": "request_count", "interval": int64(60),
+		"fields": []interface{}{map[string]interface{}{"alias": "sum_count", "field": "count", "func": "SUM"}}}
+	object := NewDownsamplingQuery("query1", spec, map[string]interface{}{"observedGeneration": int64(1), "queryState": "DEPLOYED", "engine": ENGINE_FLINK, "flinkJobId": "flinkjob0"})
+	object.SetGeneration(2)
+	db := NewCrdDbForTest(object)
+	flinkJobHandler := &FakeFlinkJobHandlerForDeploy{}
+	config := &Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}
+	tc := NewDeployDownsamplingJobTestSuite(config, FakeQueryAssertData{})
+	tc.DeployDownsamplingJob.engineSelector = NewFlinkEngineSelector(flinkJobHandler)
+	tc.DeployDownsamplingJob.itemHandler = &DownsamplingItemHandler{db: db, config: config}
+
+	err := tc.DeployDownsamplingJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if fmt.Sprint(flinkJobHandler.calls) != "[cancel query1 deploy query1]" {
+		t.Error(fmt.Sprintf("The previous job was expected to be cancelled before the new one is submitted, found %v", flinkJobHandler.calls))
+	}
+	updated, _ := db.GetDownsamplingItem("query1")
+	if updated.QueryState != "DEPLOYED" || updated.FlinkJobId != "flinkjob1" {
+		t.Error(fmt.Sprintf("Query was expected DEPLOYED with the new job flinkjob1, found %s with %s", updated.QueryState, updated.FlinkJobId))
+	}
+}
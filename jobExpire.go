@@ -9,9 +9,13 @@ type DeletePreviewJob struct {
 	k8DeploymentHandler DeploymentHandlerInterface
 	k8ServiceHandler    ServiceHandlerInterface
 	k8IngressHandler    IngressHandlerInterface
+	k8SecretHandler     SecretHandlerInterface
 	itemHandler         DownsamplingItemHandlerInterface
 	config              *Config
 	Metrics             *Metrics
+	eventPublisher      EventPublisherInterface
+	previewExporter     PreviewExporterInterface
+	events              EventRecorderInterface
 }
 
 func NewDeletePreviewJob(config *Config, metrics *Metrics) (*DeletePreviewJob, error) {
@@ -31,6 +35,10 @@ func NewDeletePreviewJob(config *Config, metrics *Metrics) (*DeletePreviewJob, e
 	if err != nil {
 		return nil, err
 	}
+	k8SecretHandler, err := NewSecretHandler(k8client, config, metrics)
+	if err != nil {
+		return nil, err
+	}
 	previewHandler, err := NewDownsamplingItemHandler(config, metrics)
 	if err != nil {
 		return nil, err
@@ -39,11 +47,41 @@ func NewDeletePreviewJob(config *Config, metrics *Metrics) (*DeletePreviewJob, e
 	if err != nil {
 		return nil, err
 	}
+	eventPublisher, err := NewEventPublisher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	previewExporter, err := NewPreviewExporter(config)
+	if err != nil {
+		return nil, err
+	}
 
-	return &DeletePreviewJob{flinkJobHandler, k8DeploymentHandler, k8ServiceHandler, k8IngressHandler, previewHandler, config, metrics}, nil
+	return &DeletePreviewJob{flinkJobHandler, k8DeploymentHandler, k8ServiceHandler, k8IngressHandler, k8SecretHandler, previewHandler, config, metrics, eventPublisher, previewExporter, NewEventRecorder(k8client, config)}, nil
 }
 
 func (d *DeletePreviewJob) Execute(params PARAM) error {
+	defer closeEventPublisher(d.eventPublisher)
+
+	expired, err := d.itemHandler.GetExpiredItems()
+	if err != nil {
+		return err
+	}
+
+	// each preview is exported while it still runs and torn down right after, whether it could be exported or not,
+	// so a preview that does not answer neither keeps its resources nor holds back the others
+	log.Println("Exporting and deleting expired preview stacks...")
+	for _, query := range expired {
+		d.exportExpiredPreview(query)
+		if err := d.k8DeploymentHandler.DeletePreviewStack(NewPreviewStack(query)); err != nil {
+			return err
+		}
+		if _, err := d.flinkJobHandler.CancelFlinkJob(query.QueryId, FLINKL_SIMULATION); err != nil {
+			return err
+		}
+	}
+
+	// stacks left behind by items that are gone
 	log.Println("Cancelling old deployments...")
 	countDeps, err := d.k8DeploymentHandler.HandleOldDeployments()
 	if err != nil {
@@ -64,6 +102,13 @@ func (d *DeletePreviewJob) Execute(params PARAM) error {
 	}
 	log.Printf("%d k8 ingresses were cancelled.", countIngress)
 
+	log.Println("Deleting old secrets...")
+	countSecrets, err := d.k8SecretHandler.HandleOldSecrets()
+	if err != nil {
+		return err
+	}
+	log.Printf("%d k8 secrets were deleted.", countSecrets)
+
 	log.Println("Cancelling old Flink jobs...")
 	countFlinkJobs, err := d.flinkJobHandler.HandleOldFlinkJobs()
 	if err != nil {
@@ -72,11 +117,41 @@ func (d *DeletePreviewJob) Execute(params PARAM) error {
 	log.Printf("%d Flink jobs were cancelled.", countFlinkJobs)
 
 	log.Println("Deleting expired simulation queries...")
-	countQueries, err := d.itemHandler.HandleExpiredSimulations()
+	deleted, kept, err := d.itemHandler.HandleExpiredSimulations()
 	if err != nil {
 		return err
 	}
-	log.Printf("%d queries were deleted.", countQueries)
+	log.Printf("%d queries were deleted, %d were kept as PREVIEW_EXPIRED.", len(deleted), len(kept))
+
+	for _, query := range append(deleted, kept...) {
+		event := NewLifecycleEvent(EVENT_EXPIRED, d.config.Environment, query)
+		publishLifecycleEvent(d.eventPublisher, event)
+		recordLifecycleEvent(d.events, event, nil)
+	}
 
 	return nil
 }
+
+// exportExpiredPreview moves an exported preview to PREVIEW_EXPIRED, the others are left to HandleExpiredSimulations.
+// A preview that cannot be exported must not keep its resources, so failures are only logged.
+func (d *DeletePreviewJob) exportExpiredPreview(query DownsamplingObject) {
+	location, err := d.previewExporter.Export(query)
+	if err != nil {
+		log.Printf("Could not export preview %s: %v", query.QueryId, err)
+		return
+	}
+	if location == "" {
+		return
+	}
+
+	log.Printf("Preview %s exported to %s", query.QueryId, location)
+	err = d.itemHandler.ExpireDownsamplingPreviewItem(query, location)
+	if err != nil {
+		log.Printf("Could not expire preview %s: %v", query.QueryId, err)
+		return
+	}
+	event := NewLifecycleEvent(EVENT_EXPIRED, d.config.Environment, query)
+	event.Urls = map[string]string{"artifacts": location}
+	publishLifecycleEvent(d.eventPublisher, event)
+	recordLifecycleEvent(d.events, event, nil)
+}
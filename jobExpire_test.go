@@ -1,16 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 )
 
 type DeletePreviewJobTestSuite struct {
 	DeletePreviewJob DeletePreviewJob
+	EventPublisher   *InMemoryEventPublisher
 }
 
 func NewDeletePreviewJobTestSuite(config *Config, data FakeQueryAssertData) *DeletePreviewJobTestSuite {
-	return &DeletePreviewJobTestSuite{DeletePreviewJob{flinkJobHandler: &FakeFlinkJobHandler{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, k8DeploymentHandler: &FakeDeploymentHandler{}, k8IngressHandler: &FakeIngressHandler{}, k8ServiceHandler: &FakeServiceHandler{}}}
+	publisher := &InMemoryEventPublisher{}
+	return &DeletePreviewJobTestSuite{DeletePreviewJob{flinkJobHandler: &FakeFlinkJobHandlerForPreview{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, k8DeploymentHandler: &FakeDeploymentHandler{}, k8IngressHandler: &FakeIngressHandler{}, k8ServiceHandler: &FakeServiceHandler{}, k8SecretHandler: &FakeSecretHandler{}, eventPublisher: publisher, previewExporter: &NoopPreviewExporter{}, events: NewTestEventRecorder()}, publisher}
 }
 
 func Test_DeletePreviewJob_Execute_Success(t *testing.T) {
@@ -20,3 +24,66 @@ func Test_DeletePreviewJob_Execute_Success(t *testing.T) {
 		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
 	}
 }
+
+func Test_DeletePreviewJob_Execute_DeletesExpiredStacks(t *testing.T) {
+	tc := NewDeletePreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED", PreviewExpiresAt: time.Now().Add(-1 * time.Minute).Format(time.RFC3339)}}})
+	err := tc.DeletePreviewJob.Execute(PARAM{})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	deleted := tc.DeletePreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).deletedStacks
+	if len(deleted) != 1 || deleted[0] != "downsamplr-preview-query1" {
+		t.Error(fmt.Sprintf("The stack of query1 was expected to be deleted, found %v", deleted))
+	}
+	cancelled := tc.DeletePreviewJob.flinkJobHandler.(*FakeFlinkJobHandlerForPreview).cancelled
+	if len(cancelled) != 1 || cancelled[0] != "query1" {
+		t.Error(fmt.Sprintf("The simulation job of query1 was expected to be cancelled, found %v", cancelled))
+	}
+}
+
+func Test_DeletePreviewJob_Execute_PublishesExpired(t *testing.T) {
+	tc := NewDeletePreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED", PreviewExpiresAt: time.Now().Add(-1 * time.Minute).Format(time.RFC3339)}}})
+	err := tc.DeletePreviewJob.Execute(PARAM{})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_EXPIRED, "query1", t)
+}
+
+type FakePreviewExporter struct {
+	location string
+	err      error
+}
+
+func (e *FakePreviewExporter) Export(query DownsamplingObject) (string, error) {
+	return e.location, e.err
+}
+
+func Test_DeletePreviewJob_Execute_Exports(t *testing.T) {
+	tc := NewDeletePreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED", PreviewExpiresAt: time.Now().Add(-1 * time.Minute).Format(time.RFC3339)}}})
+	tc.DeletePreviewJob.previewExporter = &FakePreviewExporter{location: "s3://previews/query1"}
+	err := tc.DeletePreviewJob.Execute(PARAM{})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	updated := tc.DeletePreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "PREVIEW_EXPIRED" || updated.ArtifactLocation != "s3://previews/query1" {
+		t.Error(fmt.Sprintf("Query was expected PREVIEW_EXPIRED with its artifacts, found %s at %s", updated.QueryState, updated.ArtifactLocation))
+	}
+	if len(tc.EventPublisher.Events) == 0 || tc.EventPublisher.Events[0].Urls["artifacts"] != "s3://previews/query1" {
+		t.Error(fmt.Sprintf("Expired event was expected with the artifact location, found %v", tc.EventPublisher.Events))
+	}
+}
+
+func Test_DeletePreviewJob_Execute_ExportError(t *testing.T) {
+	tc := NewDeletePreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED", PreviewExpiresAt: time.Now().Add(-1 * time.Minute).Format(time.RFC3339)}}})
+	tc.DeletePreviewJob.previewExporter = &FakePreviewExporter{err: errors.New("grafana is gone")}
+	err := tc.DeletePreviewJob.Execute(PARAM{})
+	if err != nil {
+		t.Error(fmt.Sprintf("A failed export was not expected to fail the job - %v", err))
+	}
+	if deleted := tc.DeletePreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).deletedStacks; fmt.Sprint(deleted) != "[downsamplr-preview-query1]" {
+		t.Error(fmt.Sprintf("The stack of a preview that could not be exported was expected to be deleted, found %v", deleted))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_EXPIRED, "query1", t)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// ExtendPreviewJob keeps a preview running longer than ExpireAfterMinute, up to PreviewLifetimeMinute after it was deployed.
+// The minutes come from the command line, or from the item when the coordinator runs the job.
+// Run from the command line, outside of a controller job, it also extends a PREVIEW_DEPLOYED preview nobody asked to extend.
+type ExtendPreviewJob struct {
+	k8DeploymentHandler DeploymentHandlerInterface
+	itemHandler         DownsamplingItemHandlerInterface
+	config              *Config
+	Metrics             *Metrics
+	eventPublisher      EventPublisherInterface
+	events              EventRecorderInterface
+}
+
+func NewExtendPreviewJob(config *Config, metrics *Metrics) (*ExtendPreviewJob, error) {
+	k8client, err := NewK8Client(config)
+	if err != nil {
+		return nil, err
+	}
+	k8DeploymentHandler, err := NewDeploymentHandler(k8client, config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	itemHandler, err := NewDownsamplingItemHandler(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	eventPublisher, err := NewEventPublisher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExtendPreviewJob{k8DeploymentHandler, itemHandler, config, metrics, eventPublisher, NewEventRecorder(k8client, config)}, nil
+}
+
+func (d *ExtendPreviewJob) Execute(params PARAM) error {
+	defer closeEventPublisher(d.eventPublisher)
+
+	if params.queryId == "" {
+		return errors.New("queryId not received, erroring out")
+	}
+
+	query, err := d.itemHandler.GetDownsamplingItem(params.queryId)
+	if err != nil {
+		return err
+	}
+
+	if query.QueryId == "" {
+		log.Println("No item found. Exiting...")
+		return nil
+	}
+
+	log.Printf("query object: %v", query)
+	direct := d.config.JobName == "" && query.QueryState == "PREVIEW_DEPLOYED"
+	if query.QueryState != "PREVIEW_EXTEND_PENDING" && !direct {
+		log.Printf("Query %s must have status as PREVIEW_EXTEND_PENDING, found %s", query.QueryId, query.QueryState)
+		return nil
+	}
+
+	minutes := query.PreviewExtendMinutes
+	if params.minutes != "" {
+		minutes, err = strconv.Atoi(params.minutes)
+		if err != nil {
+			return errors.New("invalid minutes " + params.minutes + ", must be a number")
+		}
+	}
+
+	expiresAt, message := d.extendedExpiry(query, minutes)
+	log.Printf("Extending preview %s from %s to %s", query.QueryId, query.PreviewExpiresAt, expiresAt)
+	query.PreviewExpiresAt = expiresAt
+	err = d.k8DeploymentHandler.ExtendPreviewStack(NewPreviewStack(query))
+	if err != nil {
+		return err
+	}
+
+	err = d.itemHandler.ExtendDownsamplingPreviewItem(query, expiresAt, message)
+	if err != nil {
+		return err
+	}
+
+	event := NewLifecycleEvent(EVENT_PREVIEW_EXTENDED, d.config.Environment, query)
+	event.Message = message
+	publishLifecycleEvent(d.eventPublisher, event)
+	recordLifecycleEvent(d.events, event, NewPreviewStack(query))
+	return nil
+}
+
+// extendedExpiry adds the minutes to the expiry of the preview, or to now if it is already past,
+// without going beyond PreviewLifetimeMinute after it was deployed.
+func (d *ExtendPreviewJob) extendedExpiry(query DownsamplingObject, minutes int) (string, string) {
+	if minutes <= 0 {
+		return query.PreviewExpiresAt, fmt.Sprintf("extension of %d minutes ignored, must be positive", minutes)
+	}
+
+	from := time.Now()
+	if expiresAt, err := time.Parse(time.RFC3339, query.PreviewExpiresAt); err == nil && expiresAt.After(from) {
+		from = expiresAt
+	}
+	extended := from.Add(time.Duration(minutes) * time.Minute)
+
+	message := ""
+	if deployedAt, err := time.Parse(time.RFC3339, query.PreviewDeployedAt); err == nil {
+		limit := deployedAt.Add(time.Duration(d.config.PreviewLifetimeMinute()) * time.Minute)
+		if extended.After(limit) {
+			extended = limit
+			message = fmt.Sprintf("extension cut to %s, previews run for at most %.0f minutes", limit.UTC().Format(time.RFC3339), d.config.PreviewLifetimeMinute())
+		}
+	}
+	return extended.UTC().Format(time.RFC3339), message
+}
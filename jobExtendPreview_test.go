@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type ExtendPreviewJobTestSuite struct {
+	ExtendPreviewJob ExtendPreviewJob
+	EventPublisher   *InMemoryEventPublisher
+}
+
+func NewExtendPreviewJobTestSuite(config *Config, data FakeQueryAssertData) *ExtendPreviewJobTestSuite {
+	publisher := &InMemoryEventPublisher{}
+	return &ExtendPreviewJobTestSuite{ExtendPreviewJob{k8DeploymentHandler: &FakeDeploymentHandler{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, eventPublisher: publisher, events: NewTestEventRecorder()}, publisher}
+}
+
+func NewPreviewToExtend(deployedMinutesAgo int, expiresInMinutes int, extendMinutes int) DownsamplingObject {
+	return DownsamplingObject{QueryId: "query1", QueryState: "PREVIEW_EXTEND_PENDING", PreviewExtendMinutes: extendMinutes,
+		PreviewDeployedAt: time.Now().Add(-time.Duration(deployedMinutesAgo) * time.Minute).UTC().Format(time.RFC3339),
+		PreviewExpiresAt:  time.Now().Add(time.Duration(expiresInMinutes) * time.Minute).UTC().Format(time.RFC3339)}
+}
+
+func Test_ExtendPreviewJob_Execute(t *testing.T) {
+	for name, test := range map[string]struct {
+		query     DownsamplingObject
+		minutes   string
+		expiresIn float64
+		cut       bool
+	}{
+		"from the item":        {NewPreviewToExtend(30, 15, 60), "", 75, false},
+		"from the params":      {NewPreviewToExtend(30, 15, 60), "30", 45, false},
+		"already expired":      {NewPreviewToExtend(50, -5, 60), "", 60, false},
+		"beyond the max":       {NewPreviewToExtend(30, 15, 600), "", 90, true},
+		"not positive ignored": {NewPreviewToExtend(30, 15, 0), "", 15, true},
+	} {
+		tc := NewExtendPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, PreviewMaxMinute: 120, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{test.query}})
+		err := tc.ExtendPreviewJob.Execute(PARAM{queryId: "query1", minutes: test.minutes})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected here but received - %v", name, err))
+			continue
+		}
+
+		updated := tc.ExtendPreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+		expiresAt, _ := time.Parse(time.RFC3339, updated.PreviewExpiresAt)
+		if updated.QueryState != "PREVIEW_DEPLOYED" || time.Until(expiresAt).Minutes() < test.expiresIn-1 || time.Until(expiresAt).Minutes() > test.expiresIn+1 {
+			t.Error(fmt.Sprintf("%s: query was expected PREVIEW_DEPLOYED expiring in %.0f minutes, found %s at %s", name, test.expiresIn, updated.QueryState, updated.PreviewExpiresAt))
+		}
+		if (updated.StateMessage != "") != test.cut {
+			t.Error(fmt.Sprintf("%s: unexpected message %q", name, updated.StateMessage))
+		}
+		extended := tc.ExtendPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).extendedStacks
+		if len(extended) != 1 || extended[0].ExpiresAt != updated.PreviewExpiresAt {
+			t.Error(fmt.Sprintf("%s: the stack was expected to expire with the item, found %v", name, extended))
+		}
+		tc.EventPublisher.AssertPublished(EVENT_PREVIEW_EXTENDED, "query1", t)
+	}
+}
+
+func Test_ExtendPreviewJob_Execute_InvalidMinutes(t *testing.T) {
+	tc := NewExtendPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{NewPreviewToExtend(30, 15, 0)}})
+	err := tc.ExtendPreviewJob.Execute(PARAM{queryId: "query1", minutes: "an hour"})
+	if err == nil {
+		t.Error("Error was expected for minutes that are not a number")
+	}
+}
+
+func Test_ExtendPreviewJob_Execute_DiffStatus(t *testing.T) {
+	tc := NewExtendPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test", JobName: "downsamplr-test-job"}, FakeQueryAssertData{dsList: []DownsamplingObject{{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED"}}})
+	err := tc.ExtendPreviewJob.Execute(PARAM{queryId: "query1", minutes: "30"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if extended := tc.ExtendPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).extendedStacks; len(extended) != 0 {
+		t.Error(fmt.Sprintf("A preview that was not asked to be extended was extended: %v", extended))
+	}
+}
+
+func Test_ExtendPreviewJob_Execute_FromCommandLine(t *testing.T) {
+	query := NewPreviewToExtend(30, 15, 0)
+	query.QueryState = "PREVIEW_DEPLOYED"
+	tc := NewExtendPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, PreviewMaxMinute: 120, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{query}})
+	err := tc.ExtendPreviewJob.Execute(PARAM{queryId: "query1", minutes: "30"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+
+	updated := tc.ExtendPreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	expiresAt, _ := time.Parse(time.RFC3339, updated.PreviewExpiresAt)
+	if updated.QueryState != "PREVIEW_DEPLOYED" || time.Until(expiresAt).Minutes() < 44 || time.Until(expiresAt).Minutes() > 46 {
+		t.Error(fmt.Sprintf("A deployed preview was expected to be extended from the command line, found %s at %s", updated.QueryState, updated.PreviewExpiresAt))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_PREVIEW_EXTENDED, "query1", t)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+type PreviewReportJob struct {
+	itemHandler   DownsamplingItemHandlerInterface
+	sourceInflux  InfluxdbInterface
+	previewInflux func(query DownsamplingObject, url string) (InfluxdbInterface, error)
+	config        *Config
+	Metrics       *Metrics
+}
+
+func NewPreviewReportJob(config *Config, metrics *Metrics) (*PreviewReportJob, error) {
+	if config.SourceInfluxdb == nil || config.SourceInfluxdb.Url == "" {
+		return nil, errors.New("source InfluxDB is not configured, previews cannot be reported")
+	}
+
+	itemHandler, err := NewDownsamplingItemHandler(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceInflux, err := NewInfluxdb(config.SourceInfluxdb.Url, config.SourceInfluxdb.Username, config.SourceInfluxdb.Password, config.ReadyTimeout())
+	if err != nil {
+		return nil, err
+	}
+
+	previewInflux := func(query DownsamplingObject, url string) (InfluxdbInterface, error) {
+		user, password := PreviewInfluxdbCredentials(config, query)
+		return NewInfluxdb(url, user, password, config.ReadyTimeout())
+	}
+
+	return &PreviewReportJob{itemHandler, sourceInflux, previewInflux, config, metrics}, nil
+}
+
+func (d *PreviewReportJob) Execute(params PARAM) error {
+	dsList, err := d.itemHandler.GetPreviewItemsDueForReport()
+	if err != nil {
+		return err
+	}
+	log.Printf("%d previews are due for a report.", len(dsList))
+
+	// a preview that cannot be reported must not hold back the others, it is retried on the next run
+	var lastErr error
+	for _, query := range dsList {
+		err = d.report(query)
+		if err != nil {
+			log.Printf("Could not report preview %s: %v", query.QueryId, err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+func (d *PreviewReportJob) report(query DownsamplingObject) error {
+	from, err := time.Parse(time.RFC3339, query.PreviewDeployedAt)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(query.Interval) * time.Second
+	if interval <= 0 {
+		return errors.New("query interval must be positive")
+	}
+	from, to := from.Truncate(interval).Add(interval), time.Now().Truncate(interval)
+
+	preview, err := d.previewInflux(query, query.PreviewInfluxdbUrl)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Building report for preview %s from %v to %v...", query.QueryId, from, to)
+	report, err := BuildPreviewReport(d.sourceInflux, preview, query, from, to)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Report for preview %s: compression ratio %.2f, %d/%d points", query.QueryId, report.CompressionRatio, report.PreviewPoints, report.SourcePoints)
+	return d.itemHandler.SavePreviewReport(query, report)
+}
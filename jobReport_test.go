@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type PreviewReportJobTestSuite struct {
+	PreviewReportJob PreviewReportJob
+	PreviewUrls      []string
+}
+
+func NewPreviewReportJobTestSuite(config *Config, data FakeQueryAssertData, previewErr error) *PreviewReportJobTestSuite {
+	tc := &PreviewReportJobTestSuite{}
+	previewInflux := func(query DownsamplingObject, url string) (InfluxdbInterface, error) {
+		tc.PreviewUrls = append(tc.PreviewUrls, url)
+		return NewFakePreviewInfluxdb(), previewErr
+	}
+	tc.PreviewReportJob = PreviewReportJob{itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, sourceInflux: NewFakeSourceInfluxdb(), previewInflux: previewInflux, config: config}
+	return tc
+}
+
+func getPreviewForReport(deployedAt time.Time) DownsamplingObject {
+	query := getQueryForValidation()
+	query.QueryState = "PREVIEW_DEPLOYED"
+	query.Interval = 60
+	query.PreviewDeployedAt = deployedAt.UTC().Format(time.RFC3339)
+	query.PreviewInfluxdbUrl = "http://preview-influxdb"
+	return query
+}
+
+func Test_PreviewReportJob_Execute_Success(t *testing.T) {
+	tc := NewPreviewReportJobTestSuite(&Config{ReportAfterMinute: 60}, FakeQueryAssertData{dsList: []DownsamplingObject{getPreviewForReport(time.Now().Add(-2 * time.Hour))}}, nil)
+	err := tc.PreviewReportJob.Execute(PARAM{})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if len(tc.PreviewUrls) != 1 || tc.PreviewUrls[0] != "http://preview-influxdb" {
+		t.Error(fmt.Sprintf("Preview InfluxDB was expected to be queried once, found %v", tc.PreviewUrls))
+	}
+	updated := tc.PreviewReportJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.PreviewReport == nil || updated.PreviewReport.CompressionRatio != 30 {
+		t.Error(fmt.Sprintf("Report was expected to be saved on the item, found %v", updated.PreviewReport))
+	}
+}
+
+func Test_PreviewReportJob_Execute_NotDue(t *testing.T) {
+	reported := getPreviewForReport(time.Now().Add(-2 * time.Hour))
+	reported.PreviewReport = &PreviewReport{}
+	tc := NewPreviewReportJobTestSuite(&Config{ReportAfterMinute: 60}, FakeQueryAssertData{dsList: []DownsamplingObject{getPreviewForReport(time.Now().Add(-10 * time.Minute)), reported}}, nil)
+	err := tc.PreviewReportJob.Execute(PARAM{})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if len(tc.PreviewUrls) != 0 {
+		t.Error(fmt.Sprintf("No preview was expected to be reported, found %v", tc.PreviewUrls))
+	}
+}
+
+func Test_PreviewReportJob_Execute_Error(t *testing.T) {
+	tc := NewPreviewReportJobTestSuite(&Config{ReportAfterMinute: 60}, FakeQueryAssertData{dsList: []DownsamplingObject{getPreviewForReport(time.Now().Add(-2 * time.Hour))}}, errors.New("preview unreachable"))
+	err := tc.PreviewReportJob.Execute(PARAM{})
+	if err == nil {
+		t.Error(fmt.Sprintf("Was expecting error but not received"))
+	}
+}
@@ -2,20 +2,45 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"time"
 )
 
 const SIMULATION_STACK_PREFIX = "downsamplr-preview"
 
+// Preview stacks of InfluxDB 2.x databases are set up with this organization, see templates/simulation-deployment.json.
+const PREVIEW_INFLUXDB_V2_ORG = "downsampling"
+
+// PreviewInfluxdbCredentials are used with the v1 compatible API of the preview InfluxDB, InfluxDB 2.x takes the token as password.
+// Previews deployed before credentials were generated run with admin/admin.
+func PreviewInfluxdbCredentials(config *Config, query DownsamplingObject) (string, string) {
+	credentials := query.PreviewCredentials
+	if credentials == nil {
+		return "admin", "admin"
+	}
+	if config.IsInfluxdbV2(query.Db) {
+		return credentials.InfluxdbUser, credentials.InfluxdbToken
+	}
+	return credentials.InfluxdbUser, credentials.InfluxdbPassword
+}
+
 type DeployPreviewJob struct {
-	flinkJobHandler     FlinkJobHandlerInterface
-	k8DeploymentHandler DeploymentHandlerInterface
-	k8ServiceHandler    ServiceHandlerInterface
-	k8IngressHandler    IngressHandlerInterface
-	itemHandler         DownsamplingItemHandlerInterface
-	config              *Config
-	metrics             *Metrics
-	kafkaClient         KafkaClientInterface
+	flinkJobHandler      FlinkJobHandlerInterface
+	k8DeploymentHandler  DeploymentHandlerInterface
+	k8ServiceHandler     ServiceHandlerInterface
+	k8IngressHandler     IngressHandlerInterface
+	k8SecretHandler      SecretHandlerInterface
+	k8VolumeClaimHandler VolumeClaimHandlerInterface
+	itemHandler          DownsamplingItemHandlerInterface
+	config               *Config
+	metrics              *Metrics
+	kafkaClient          KafkaClientInterface
+	eventPublisher       EventPublisherInterface
+	queryValidator       QueryValidatorInterface
+	previewSeeder        PreviewSeederInterface
+	events               EventRecorderInterface
 }
 
 func NewDeployPreviewJob(config *Config, metrics *Metrics) (*DeployPreviewJob, error) {
@@ -35,6 +60,14 @@ func NewDeployPreviewJob(config *Config, metrics *Metrics) (*DeployPreviewJob, e
 	if err != nil {
 		return nil, err
 	}
+	k8SecretHandler, err := NewSecretHandler(k8client, config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	k8VolumeClaimHandler, err := NewVolumeClaimHandler(k8client, config, metrics)
+	if err != nil {
+		return nil, err
+	}
 	previewHandler, err := NewDownsamplingItemHandler(config, metrics)
 	if err != nil {
 		return nil, err
@@ -49,11 +82,28 @@ func NewDeployPreviewJob(config *Config, metrics *Metrics) (*DeployPreviewJob, e
 		return nil, err
 	}
 
-	return &DeployPreviewJob{flinkJobHandler, k8DeploymentHandler, k8ServiceHandler, k8IngressHandler,
-		previewHandler, config, metrics, kafkaClient}, nil
+	eventPublisher, err := NewEventPublisher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	queryValidator, err := NewQueryValidator(config)
+	if err != nil {
+		return nil, err
+	}
+
+	previewSeeder, err := NewPreviewSeeder(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeployPreviewJob{flinkJobHandler, k8DeploymentHandler, k8ServiceHandler, k8IngressHandler, k8SecretHandler,
+		k8VolumeClaimHandler, previewHandler, config, metrics, kafkaClient, eventPublisher, queryValidator, previewSeeder, NewEventRecorder(k8client, config)}, nil
 }
 
 func (d *DeployPreviewJob) Execute(params PARAM) error {
+	defer closeEventPublisher(d.eventPublisher)
+
 	if params.queryId == "" {
 		return errors.New("queryId not received, erroring out")
 	}
@@ -74,59 +124,153 @@ func (d *DeployPreviewJob) Execute(params PARAM) error {
 		return nil
 	}
 
-	err = d.k8DeploymentHandler.CreateDeployment(params)
-	if err != nil {
+	err = d.queryValidator.Validate(query)
+	if validationErr, ok := err.(*QueryValidationError); ok {
+		event := NewFailedLifecycleEvent(d.config.Environment, query, validationErr)
+		publishLifecycleEvent(d.eventPublisher, event)
+		recordLifecycleEvent(d.events, event, nil)
+		return d.itemHandler.FailDownsamplingItem(query, validationErr.Error())
+	} else if err != nil {
 		return err
 	}
 
-	err = d.k8ServiceHandler.CreateService(params)
-	if err != nil {
+	influxdbIngressUrl, grafanaIngressUrl, err := d.deployPreview(query, params)
+	if notReadyErr, ok := err.(*PreviewNotReadyError); ok {
+		event := NewFailedLifecycleEvent(d.config.Environment, query, notReadyErr)
+		publishLifecycleEvent(d.eventPublisher, event)
+		recordLifecycleEvent(d.events, event, NewPreviewStack(query))
+		// the reason is kept on the item, the stack would only run until it expires
+		if err := d.k8DeploymentHandler.DeletePreviewStack(NewPreviewStack(query)); err != nil {
+			log.Printf("Could not delete preview stack of %s: %v", query.QueryId, err)
+		}
+		return d.itemHandler.FailDownsamplingItem(query, notReadyErr.Error())
+	} else if err != nil {
+		event := NewFailedLifecycleEvent(d.config.Environment, query, err)
+		publishLifecycleEvent(d.eventPublisher, event)
+		recordLifecycleEvent(d.events, event, NewPreviewStack(query))
 		return err
 	}
 
-	influxdbIngressUrl, grafanaIngressUrl, err := d.k8IngressHandler.CreateIngress(params)
-	if err != nil {
+	event := NewLifecycleEvent(EVENT_PREVIEW_READY, d.config.Environment, query)
+	event.Urls = map[string]string{"influxdb": influxdbIngressUrl, "grafana": grafanaIngressUrl}
+	publishLifecycleEvent(d.eventPublisher, event)
+	recordLifecycleEvent(d.events, event, NewPreviewStack(query))
+
+	return nil
+}
+
+// notReady makes InfluxDB or Grafana not answering in time a PreviewNotReadyError, with what the pods of the stack were doing.
+func (d *DeployPreviewJob) notReady(stack *PreviewStack, err error) error {
+	notUpErr, ok := err.(*NotUpError)
+	if !ok {
 		return err
 	}
+	reason := fmt.Sprintf("%s at %s did not answer: %v; %s", notUpErr.Name, notUpErr.Url, notUpErr.Err, d.k8DeploymentHandler.DescribePreviewStack(stack))
+	return &PreviewNotReadyError{Name: stack.Name, Timeout: notUpErr.Timeout, Reason: reason}
+}
 
-	influx, err := NewInfluxdb(influxdbIngressUrl, "admin", "admin")
+// deployPreview creates the deployment before the rest of the stack, which it owns.
+func (d *DeployPreviewJob) deployPreview(query DownsamplingObject, params PARAM) (string, string, error) {
+	credentials, err := NewPreviewCredentials(query.QueryId)
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	query.PreviewExpiresAt = time.Now().Add(time.Duration(d.config.ExpireAfterMinute) * time.Minute).Format(time.RFC3339)
+	stack := NewPreviewStack(query)
 
-	err = influx.CreateDatabaseAndRp(query.Db, "downsample")
+	err = d.k8DeploymentHandler.CreateDeployment(query, stack)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	grafana, err := NewGrafanaApiClient(influxdbIngressUrl, grafanaIngressUrl, "admin", "admin")
+	// a retried preview runs with the credentials of its first try
+	credentials, err = d.k8SecretHandler.CreateSecret(stack, credentials)
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	query.PreviewCredentials = credentials
 
-	err = grafana.CreateDatasource(query)
+	err = d.k8VolumeClaimHandler.CreateVolumeClaim(stack)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	err = grafana.CreateDashboard(query)
+	err = d.k8ServiceHandler.CreateService(stack)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	offsets, err := d.kafkaClient.GetDesiredOffsets(d.config.GetSourceKafkaTopic(query))
+	influxdbIngressUrl, grafanaIngressUrl, err := d.k8IngressHandler.CreateIngress(stack)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	err = d.flinkJobHandler.DeployFlinkJobForSimulation(query, influxdbIngressUrl, offsets)
+
+	err = d.k8DeploymentHandler.WaitForPreviewStack(stack)
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	d.events.Eventf(stack, corev1.EventTypeNormal, REASON_PREVIEW_AVAILABLE, "Preview stack %s is available at %s", stack.Name, influxdbIngressUrl)
 
-	err = d.itemHandler.DeployDownsamplingPendingSimulationItem(query.QueryId)
+	var influx InfluxdbAdminInterface
+	if d.config.IsInfluxdbV2(query.Db) {
+		influx, err = NewInfluxdbV2(influxdbIngressUrl, credentials.InfluxdbToken, PREVIEW_INFLUXDB_V2_ORG, d.config.ReadyTimeout())
+	} else {
+		influx, err = NewInfluxdb(influxdbIngressUrl, credentials.InfluxdbUser, credentials.InfluxdbPassword, d.config.ReadyTimeout())
+	}
 	if err != nil {
-		return err
+		return "", "", d.notReady(stack, err)
 	}
 
-	return nil
+	err = influx.CreateDatabaseAndRp(query.Db, PREVIEW_RP)
+	if err != nil {
+		return "", "", err
+	}
+	err = influx.EnsureRetentionPolicy(query.Db, PREVIEW_RAW_RP, "INF", "")
+	if err != nil {
+		return "", "", err
+	}
+
+	// the preview is still useful without raw data, so a failed copy is not fatal
+	seeded, err := d.previewSeeder.SeedPreview(query, influxdbIngressUrl)
+	if err != nil {
+		log.Printf("Could not seed preview %s with raw data: %v", query.QueryId, err)
+	}
+
+	grafana, err := NewGrafanaApiClient(influxdbIngressUrl, grafanaIngressUrl, credentials.GrafanaUser, credentials.GrafanaPassword, d.config.ReadyTimeout())
+	if err != nil {
+		return "", "", d.notReady(stack, err)
+	}
+	grafana.SetInfluxdbCredentials(PreviewInfluxdbCredentials(d.config, query))
+	grafana.SetDefaultDatasource()
+	if seeded > 0 {
+		grafana.SetRawPolicy(PREVIEW_RAW_RP)
+	}
+
+	err = grafana.CreateDatasource(query)
+	if err != nil {
+		return "", "", err
+	}
+
+	dashboardTemplate, err := grafana.CreateDashboard(query)
+	if err != nil {
+		return "", "", err
+	}
+	d.events.Eventf(stack, corev1.EventTypeNormal, REASON_GRAFANA_PROVISIONED, "Grafana datasource and dashboard created at %s", grafanaIngressUrl)
+
+	sourceTopic, err := d.config.GetSourceKafkaTopic(query)
+	if err != nil {
+		return "", "", err
+	}
+	offsets, err := d.kafkaClient.GetDesiredOffsets(sourceTopic)
+	if err != nil {
+		return "", "", err
+	}
+	err = d.flinkJobHandler.DeployFlinkJobForSimulation(query, influxdbIngressUrl, offsets)
+	if err != nil {
+		return "", "", err
+	}
+	d.events.Eventf(stack, corev1.EventTypeNormal, REASON_FLINK_JOB_SUBMITTED, "Simulation Flink job of query %s submitted", query.QueryId)
+
+	err = d.itemHandler.DeployDownsamplingPendingSimulationItem(query.QueryId, influxdbIngressUrl, grafanaIngressUrl, credentials, dashboardTemplate, query.PreviewExpiresAt)
+	return influxdbIngressUrl, grafanaIngressUrl, err
 }
@@ -2,23 +2,29 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 type DeployPreviewJobTestSuite struct {
 	DeployPreviewJob    DeployPreviewJob
 	FakeQueryAssertData FakeQueryAssertData
+	EventPublisher      *InMemoryEventPublisher
 }
 
 func NewDeployPreviewJobTestSuite(config *Config, data FakeQueryAssertData) *DeployPreviewJobTestSuite {
-	return &DeployPreviewJobTestSuite{DeployPreviewJob{flinkJobHandler: &FakeFlinkJobHandlerForPreview{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, k8DeploymentHandler: &FakeDeploymentHandler{}, k8IngressHandler: &FakeIngressHandler{}, k8ServiceHandler: &FakeServiceHandler{}, kafkaClient: &FakeKafkaClient{}}, data}
+	publisher := &InMemoryEventPublisher{}
+	return &DeployPreviewJobTestSuite{DeployPreviewJob{flinkJobHandler: &FakeFlinkJobHandlerForPreview{}, itemHandler: &DownsamplingItemHandler{db: NewMockDb(data), config: config}, config: config, k8DeploymentHandler: &FakeDeploymentHandler{}, k8IngressHandler: &FakeIngressHandler{}, k8ServiceHandler: &FakeServiceHandler{}, k8SecretHandler: &FakeSecretHandler{}, k8VolumeClaimHandler: &FakeVolumeClaimHandler{}, kafkaClient: &FakeKafkaClient{}, eventPublisher: publisher, queryValidator: &NoopQueryValidator{}, previewSeeder: &NoopPreviewSeeder{}, events: NewTestEventRecorder()}, data, publisher}
 }
 
 type FakeFlinkJobHandlerForPreview struct {
+	cancelled []string
 }
 
 func (f *FakeFlinkJobHandlerForPreview) DeployFlinkJobForSimulation(query DownsamplingObject, influxdbBaseUrl string, offsets KafkaPartitionOffsets) error {
@@ -30,28 +36,73 @@ func (f *FakeFlinkJobHandlerForPreview) DeployFlinkJob(query DownsamplingObject)
 }
 
 func (f *FakeFlinkJobHandlerForPreview) CancelFlinkJob(queryId string, mode string) (int, error) {
-	return 0, nil
+	if mode != FLINKL_SIMULATION {
+		return 0, errors.New("wrong mode")
+	}
+	f.cancelled = append(f.cancelled, queryId)
+	return 1, nil
 }
 
 func (f *FakeFlinkJobHandlerForPreview) HandleOldFlinkJobs() (int, error) {
 	return 0, nil
 }
 
+func (f *FakeFlinkJobHandlerForPreview) FindFlinkJobId(queryId string, mode string) (string, error) {
+	return "", nil
+}
+
+type FakeVolumeClaimHandler struct {
+	stacks []PreviewStack
+}
+
+func (v *FakeVolumeClaimHandler) CreateVolumeClaim(stack *PreviewStack) error {
+	v.stacks = append(v.stacks, *stack)
+	return nil
+}
+
 type FakeDeploymentHandler struct {
+	deletedStacks  []string
+	extendedStacks []PreviewStack
+	notReady       string
+	pods           string
+}
+
+func (d *FakeDeploymentHandler) CreateDeployment(query DownsamplingObject, stack *PreviewStack) error {
+	stack.Owner = &metav1.OwnerReference{APIVersion: DEPLOYMENT_API_APPS_V1, Kind: "Deployment", Name: stack.Name, UID: "uid1"}
+	return nil
+}
+
+func (d *FakeDeploymentHandler) DeletePreviewStack(stack *PreviewStack) error {
+	d.deletedStacks = append(d.deletedStacks, stack.Name)
+	return nil
 }
 
-func (d *FakeDeploymentHandler) CreateDeployment(params PARAM) error {
+func (d *FakeDeploymentHandler) ExtendPreviewStack(stack *PreviewStack) error {
+	d.extendedStacks = append(d.extendedStacks, *stack)
 	return nil
 }
 
+func (d *FakeDeploymentHandler) WaitForPreviewStack(stack *PreviewStack) error {
+	if d.notReady != "" {
+		return &PreviewNotReadyError{Name: stack.Name, Timeout: time.Minute, Reason: d.notReady}
+	}
+	return nil
+}
+
+func (d *FakeDeploymentHandler) DescribePreviewStack(stack *PreviewStack) string {
+	return d.pods
+}
+
 func (d *FakeDeploymentHandler) HandleOldDeployments() (int, error) {
 	return 0, nil
 }
 
+// FakeIngressHandler serves the preview InfluxDB and Grafana, down makes them not answer.
 type FakeIngressHandler struct {
+	down bool
 }
 
-func (d *FakeIngressHandler) CreateIngress(params PARAM) (string, string, error) {
+func (d *FakeIngressHandler) CreateIngress(stack *PreviewStack) (string, string, error) {
 	h := http.NewServeMux()
 	h.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(204)
@@ -62,6 +113,9 @@ func (d *FakeIngressHandler) CreateIngress(params PARAM) (string, string, error)
 	})
 	ispy := httptest.NewServer(h)
 	//defer ispy.Close()
+	if d.down {
+		ispy.Close()
+	}
 	return ispy.URL, ispy.URL, nil
 }
 
@@ -72,7 +126,7 @@ func (d *FakeIngressHandler) HandleOldIngresses() (int, error) {
 type FakeServiceHandler struct {
 }
 
-func (d *FakeServiceHandler) CreateService(params PARAM) error {
+func (d *FakeServiceHandler) CreateService(stack *PreviewStack) error {
 	return nil
 }
 
@@ -80,6 +134,21 @@ func (d *FakeServiceHandler) HandleOldServices() error {
 	return nil
 }
 
+type FakeSecretHandler struct {
+	secrets []string
+	stacks  []PreviewStack
+}
+
+func (d *FakeSecretHandler) CreateSecret(stack *PreviewStack, credentials *PreviewCredentials) (*PreviewCredentials, error) {
+	d.secrets = append(d.secrets, credentials.SecretName)
+	d.stacks = append(d.stacks, *stack)
+	return credentials, nil
+}
+
+func (d *FakeSecretHandler) HandleOldSecrets() (int, error) {
+	return 0, nil
+}
+
 type FakeKafkaClient struct {
 }
 
@@ -122,6 +191,124 @@ func Test_DeployPreviewJob_Execute_Success(t *testing.T) {
 	if err != nil {
 		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
 	}
+	tc.EventPublisher.AssertPublished(EVENT_PREVIEW_READY, "query1", t)
+
+	credentials := tc.DeployPreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect.PreviewCredentials
+	secrets := tc.DeployPreviewJob.k8SecretHandler.(*FakeSecretHandler).secrets
+	if credentials == nil || credentials.InfluxdbPassword == "" || len(secrets) != 1 || secrets[0] != credentials.SecretName {
+		t.Error(fmt.Sprintf("Credentials were expected on the item and in secret %v, found %v", secrets, credentials))
+	}
+}
+
+func Test_DeployPreviewJob_Execute_OwnsStackByDeployment(t *testing.T) {
+	var ds DownsamplingObject
+	json.Unmarshal([]byte(`{"queryId": "query1", "queryState": "PREVIEW_PENDING", "db": "sca", "rp": "autogen", "measurement": "request_count",
+	  "fields": [{"alias": "sum_count", "field": "count", "func": "SUM"}], "interval": 60, "targetRp": "downsample", "targetMeasurement": "request_count"}`), &ds)
+
+	tc := NewDeployPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{ds}})
+	err := tc.DeployPreviewJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+
+	updated := tc.DeployPreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	stacks := tc.DeployPreviewJob.k8SecretHandler.(*FakeSecretHandler).stacks
+	if len(stacks) != 1 || stacks[0].Owner == nil || stacks[0].Owner.Name != "downsamplr-preview-query1" {
+		t.Error(fmt.Sprintf("The secret was expected to be owned by the deployment, found %v", stacks))
+		return
+	}
+	if updated.PreviewExpiresAt == "" || stacks[0].ExpiresAt != updated.PreviewExpiresAt {
+		t.Error(fmt.Sprintf("The stack was expected to expire with the item at %s, found %s", updated.PreviewExpiresAt, stacks[0].ExpiresAt))
+	}
+}
+
+func Test_DeployPreviewJob_Execute_NotReady(t *testing.T) {
+	var ds DownsamplingObject
+	json.Unmarshal([]byte(`{"queryId": "query1", "queryState": "PREVIEW_PENDING", "db": "sca", "rp": "autogen", "measurement": "request_count",
+	  "fields": [{"alias": "sum_count", "field": "count", "func": "SUM"}], "interval": 60, "targetRp": "downsample", "targetMeasurement": "request_count"}`), &ds)
+
+	tc := NewDeployPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{ds}})
+	deployments := tc.DeployPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler)
+	deployments.notReady = "pod downsamplr-preview-query1-abc Pending, container influxdb waiting: ImagePullBackOff"
+	err := tc.DeployPreviewJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_FAILED, "query1", t)
+
+	updated := tc.DeployPreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "FAILED" || !strings.Contains(updated.StateMessage, "ImagePullBackOff") {
+		t.Error(fmt.Sprintf("The item was expected FAILED with the reason of the pod, found %s: %s", updated.QueryState, updated.StateMessage))
+	}
+	if len(deployments.deletedStacks) != 1 || deployments.deletedStacks[0] != "downsamplr-preview-query1" {
+		t.Error(fmt.Sprintf("The stack was expected to be deleted, found %v", deployments.deletedStacks))
+	}
+}
+
+func Test_DeployPreviewJob_Execute_NotUp(t *testing.T) {
+	defer func(interval time.Duration) {
+		upStatusInterval = interval
+	}(upStatusInterval)
+	upStatusInterval = 10 * time.Millisecond
+
+	var ds DownsamplingObject
+	json.Unmarshal([]byte(`{"queryId": "query1", "queryState": "PREVIEW_PENDING", "db": "sca", "rp": "autogen", "measurement": "request_count",
+	  "fields": [{"alias": "sum_count", "field": "count", "func": "SUM"}], "interval": 60, "targetRp": "downsample", "targetMeasurement": "request_count"}`), &ds)
+
+	tc := NewDeployPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test", ReadyTimeoutMinute: 0.001}, FakeQueryAssertData{dsList: []DownsamplingObject{ds}})
+	tc.DeployPreviewJob.k8IngressHandler.(*FakeIngressHandler).down = true
+	deployments := tc.DeployPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler)
+	deployments.pods = "pod downsamplr-preview-query1-abc Running, container influxdb last terminated: OOMKilled (exit code 137)"
+	err := tc.DeployPreviewJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+
+	updated := tc.DeployPreviewJob.itemHandler.(*DownsamplingItemHandler).db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "FAILED" || !strings.Contains(updated.StateMessage, "InfluxDB") || !strings.Contains(updated.StateMessage, "OOMKilled") {
+		t.Error(fmt.Sprintf("The item was expected FAILED with InfluxDB not answering and the reason of the pod, found %s: %s", updated.QueryState, updated.StateMessage))
+	}
+	if len(deployments.deletedStacks) != 1 {
+		t.Error(fmt.Sprintf("The stack was expected to be deleted, found %v", deployments.deletedStacks))
+	}
+}
+
+func Test_DeployPreviewJob_Execute_RecordsEvents(t *testing.T) {
+	var ds DownsamplingObject
+	json.Unmarshal([]byte(`{"queryId": "query1", "queryState": "PREVIEW_PENDING", "db": "sca", "rp": "autogen", "measurement": "request_count",
+	  "fields": [{"alias": "sum_count", "field": "count", "func": "SUM"}], "interval": 60, "targetRp": "downsample", "targetMeasurement": "request_count"}`), &ds)
+
+	testCases := map[string]struct {
+		notReady string
+		expected []string
+	}{
+		"ready":     {"", []string{REASON_PREVIEW_AVAILABLE, REASON_GRAFANA_PROVISIONED, REASON_FLINK_JOB_SUBMITTED, "PreviewReady"}},
+		"not ready": {"no pod was created", []string{"Failed"}},
+	}
+
+	for name, tc := range testCases {
+		suite := NewDeployPreviewJobTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45, Environment: "test"}, FakeQueryAssertData{dsList: []DownsamplingObject{ds}})
+		suite.DeployPreviewJob.k8DeploymentHandler.(*FakeDeploymentHandler).notReady = tc.notReady
+		err := suite.DeployPreviewJob.Execute(PARAM{queryId: "query1"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected here but received - %v", name, err))
+		}
+
+		// every step is recorded on the job and on the deployment
+		recorded := recordedEvents(suite.DeployPreviewJob.events)
+		if len(recorded) != 2*len(tc.expected) {
+			t.Error(fmt.Sprintf("%s: events %v were expected on the job and the deployment, found %v", name, tc.expected, recorded))
+			continue
+		}
+		for i, reason := range tc.expected {
+			if !strings.Contains(recorded[2*i], " "+reason+" ") || recorded[2*i] != recorded[2*i+1] {
+				t.Error(fmt.Sprintf("%s: event %s was expected, found %v", name, reason, recorded))
+			}
+		}
+		if name == "not ready" && !strings.HasPrefix(recorded[0], "Warning Failed") {
+			t.Error(fmt.Sprintf("%s: a warning was expected, found %v", name, recorded))
+		}
+	}
 }
 
 func Test_DeployPreviewJob_Execute_NoItem(t *testing.T) {
@@ -147,3 +334,18 @@ func Test_DeployPreviewJob_Execute_Error_NoQueryId(t *testing.T) {
 		t.Error(fmt.Sprintf("Error was expected but not received accordingly - %v", err))
 	}
 }
+
+func Test_PreviewInfluxdbCredentials(t *testing.T) {
+	config := &Config{TargetInfluxdbV2: &InfluxdbV2Config{Databases: []string{"omni"}}}
+	credentials := &PreviewCredentials{InfluxdbUser: "downsamplr", InfluxdbPassword: "secret", InfluxdbToken: "token"}
+
+	if user, password := PreviewInfluxdbCredentials(config, DownsamplingObject{Db: "sca"}); user != "admin" || password != "admin" {
+		t.Error(fmt.Sprintf("Previews without credentials were expected on admin/admin, found %s/%s", user, password))
+	}
+	if user, password := PreviewInfluxdbCredentials(config, DownsamplingObject{Db: "sca", PreviewCredentials: credentials}); user != "downsamplr" || password != "secret" {
+		t.Error(fmt.Sprintf("InfluxDB 1.x previews were expected on the password, found %s/%s", user, password))
+	}
+	if user, password := PreviewInfluxdbCredentials(config, DownsamplingObject{Db: "omni", PreviewCredentials: credentials}); user != "downsamplr" || password != "token" {
+		t.Error(fmt.Sprintf("InfluxDB 2.x previews were expected on the token, found %s/%s", user, password))
+	}
+}
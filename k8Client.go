@@ -2,50 +2,79 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// K8ClientInterface hands out the clients by interface, so handlers can be built on the fakes of client-go in tests.
 type K8ClientInterface interface {
-	GetClientSet() *kubernetes.Clientset
+	GetClientSet() kubernetes.Interface
+	GetDynamicClient() dynamic.Interface
 }
 
 type K8Client struct {
-	clientset *kubernetes.Clientset
-	config    *Config
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	config        *Config
 }
 
 func NewK8Client(config *Config) (*K8Client, error) {
 	k8client := &K8Client{}
-	var clientset *kubernetes.Clientset
+	var restConfig *rest.Config
 	var err error
 
 	if config.Mode == "in-cluster" {
-		clientset, err = k8client.createInClusterClientSet()
+		restConfig, err = k8client.createInClusterConfig()
 	} else {
-		clientset, err = k8client.createLocalClientSet()
+		restConfig, err = k8client.createLocalConfig()
 	}
 	if err != nil {
 		return k8client, err
 	}
 
+	// create the clientset
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return k8client, err
+	}
+	// the dynamic client serves custom resources, see crdDb.go
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return k8client, err
+	}
+
 	k8client.clientset = clientset
+	k8client.dynamicClient = dynamicClient
 	k8client.config = config
 
 	return k8client, nil
 }
 
-func (k8 K8Client) GetClientSet() *kubernetes.Clientset {
+func (k8 K8Client) GetClientSet() kubernetes.Interface {
 	return k8.clientset
 }
 
-func (k8 K8Client) createLocalClientSet() (*kubernetes.Clientset, error) {
+func (k8 K8Client) GetDynamicClient() dynamic.Interface {
+	return k8.dynamicClient
+}
+
+func (k8 K8Client) createLocalConfig() (*rest.Config, error) {
 	log.Println("Getting local k8 client...")
 
+	// a job may need more than one client, the flag can only be defined once
+	if kubeconfigFlag := flag.Lookup("kubeconfig"); kubeconfigFlag != nil {
+		return clientcmd.BuildConfigFromFlags("", kubeconfigFlag.Value.String())
+	}
+
 	var kubeconfig *string
 	homeDir := os.Getenv("HOME")
 
@@ -62,13 +91,10 @@ func (k8 K8Client) createLocalClientSet() (*kubernetes.Clientset, error) {
 		panic(err.Error())
 	}
 
-	// create the clientset
-	clientset, err := kubernetes.NewForConfig(currentconfig)
-
-	return clientset, err
+	return currentconfig, nil
 }
 
-func (k8 K8Client) createInClusterClientSet() (*kubernetes.Clientset, error) {
+func (k8 K8Client) createInClusterConfig() (*rest.Config, error) {
 	log.Println("Getting in-cluster k8 client...")
 
 	// creates the in-cluster config
@@ -76,8 +102,26 @@ func (k8 K8Client) createInClusterClientSet() (*kubernetes.Clientset, error) {
 	if err != nil {
 		panic(err.Error())
 	}
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
 
-	return clientset, err
+	return config, nil
+}
+
+// ServedGroupVersion returns the first of the group versions the cluster serves the resource in,
+// so handlers keep working on clusters that only serve an older API.
+func ServedGroupVersion(client discovery.DiscoveryInterface, resource string, groupVersions ...string) (string, error) {
+	for _, groupVersion := range groupVersions {
+		resources, err := client.ServerResourcesForGroupVersion(groupVersion)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return "", err
+		}
+		for _, apiResource := range resources.APIResources {
+			if apiResource.Name == resource {
+				return groupVersion, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("the cluster serves %s in none of %s", resource, strings.Join(groupVersions, ", "))
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_ServedGroupVersion(t *testing.T) {
+	for _, served := range DeploymentApiVersions {
+		clientset := NewFakeClientset(served, "deployments")
+		apiVersion, err := ServedGroupVersion(clientset.Discovery(), "deployments", DeploymentApiVersions...)
+		if err != nil || apiVersion != served {
+			t.Error(fmt.Sprintf("%s was expected, found %s (%v)", served, apiVersion, err))
+		}
+	}
+}
+
+func Test_ServedGroupVersion_NotServed(t *testing.T) {
+	clientset := NewFakeClientset(INGRESS_API_NETWORKING_V1, "ingresses")
+	_, err := ServedGroupVersion(clientset.Discovery(), "deployments", DeploymentApiVersions...)
+	if err == nil {
+		t.Error("Error was expected when no version serves the resource")
+	}
+}
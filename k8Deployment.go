@@ -1,88 +1,401 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"k8s.io/api/apps/v1beta1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	clientv1beta1 "k8s.io/client-go/kubernetes/typed/apps/v1beta1"
-	//"gopkg.in/yaml.v2"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"strings"
 	"time"
 )
 
+const DEPLOYMENT_API_APPS_V1 = "apps/v1"
+const DEPLOYMENT_API_APPS_V1BETA1 = "apps/v1beta1"
+
 type DeploymentHandlerInterface interface {
 	HandleOldDeployments() (int, error)
-	CreateDeployment(params PARAM) error
+	CreateDeployment(query DownsamplingObject, stack *PreviewStack) error
+	DeletePreviewStack(stack *PreviewStack) error
+	ExtendPreviewStack(stack *PreviewStack) error
+	WaitForPreviewStack(stack *PreviewStack) error
+	DescribePreviewStack(stack *PreviewStack) string
+}
+
+// PreviewNotReadyError tells the deployment of a preview did not become Available in time, or its InfluxDB or Grafana
+// did not answer, Reason sums up what its pods were doing.
+type PreviewNotReadyError struct {
+	Name    string
+	Timeout time.Duration
+	Reason  string
+}
+
+func (e *PreviewNotReadyError) Error() string {
+	return fmt.Sprintf("preview %s not available after %v: %s", e.Name, e.Timeout, e.Reason)
+}
+
+// PreviewDeploymentFiller sets up the preview InfluxDB as 2.x for databases migrated to it.
+// Credentials come from the secret named after the stack, see SecretHandler, and so does the
+// volume claim InfluxDB keeps its data in when StorageClaim is set, see VolumeClaimHandler.
+type PreviewDeploymentFiller struct {
+	DefaultFiller
+	InfluxdbV2        bool
+	InfluxdbV2Org     string
+	InfluxdbV2Bucket  string
+	InfluxdbResources string
+	GrafanaResources  string
+	StorageClaim      string
+	InfluxdbDataPath  string
+}
+
+// Validate parses every quantity of the profiles and the storage size.
+func (c *PreviewResourceConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, profile := range []*ResourceProfile{c.Influxdb, c.Grafana} {
+		if _, err := profile.Requirements(); err != nil {
+			return err
+		}
+	}
+	if c.StorageSize != "" {
+		if _, err := resource.ParseQuantity(c.StorageSize); err != nil {
+			return fmt.Errorf("invalid preview storage size %q: %v", c.StorageSize, err)
+		}
+	}
+	return nil
+}
+
+// Requirements sets the quantities of the profile as both requests and limits.
+func (p *ResourceProfile) Requirements() (corev1.ResourceRequirements, error) {
+	requirements := corev1.ResourceRequirements{}
+	if p == nil {
+		return requirements, nil
+	}
+	list := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{corev1.ResourceCPU: p.Cpu, corev1.ResourceMemory: p.Memory, corev1.ResourceEphemeralStorage: p.EphemeralStorage} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return requirements, fmt.Errorf("invalid preview %s %q: %v", name, value, err)
+		}
+		list[name] = quantity
+	}
+	if len(list) > 0 {
+		requirements.Requests = list
+		requirements.Limits = list.DeepCopy()
+	}
+	return requirements, nil
 }
 
+// resourcesJson renders the requirements of the profile for the deployment template.
+func resourcesJson(profile *ResourceProfile) (string, error) {
+	requirements, err := profile.Requirements()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(requirements)
+	return string(data), err
+}
+
+// DeploymentHandler uses apps/v1 deployments, apps/v1beta1 on clusters that do not serve them yet.
+// The template is the same for both, apps/v1beta1 reads the apps/v1 spec.
+// The deployment of a preview owns the rest of its stack, see PreviewStack.
 type DeploymentHandler struct {
-	deploymentClient clientv1beta1.DeploymentInterface
-	templateParser   TemplateParserInterface
-	config           *Config
-	Metrics          *Metrics
+	clientset      kubernetes.Interface
+	apiVersion     string
+	templateParser TemplateParserInterface
+	config         *Config
+	Metrics        *Metrics
 }
 
 func NewDeploymentHandler(k8client K8ClientInterface, config *Config, metrics *Metrics) (*DeploymentHandler, error) {
-	deploymentsClient := k8client.GetClientSet().AppsV1beta1().Deployments(config.Namespace)
-	return &DeploymentHandler{deploymentsClient, NewTemplateParser(), config, metrics}, nil
+	clientset := k8client.GetClientSet()
+	apiVersion, err := ServedGroupVersion(clientset.Discovery(), "deployments", DEPLOYMENT_API_APPS_V1, DEPLOYMENT_API_APPS_V1BETA1)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using %s deployments.", apiVersion)
+	return &DeploymentHandler{clientset, apiVersion, NewTemplateParser(), config, metrics}, nil
 }
 
-func (d *DeploymentHandler) CreateDeployment(params PARAM) error {
-	yamlStr, err := d.templateParser.LoadTemplate("templates/simulation-deployment.json", &DefaultFiller{StackName: SIMULATION_STACK_PREFIX + "-" + params.queryId})
-	if err != nil {
+// CreateDeployment creates the deployment first in the stack, the stack gets it as owner of the other objects.
+func (d *DeploymentHandler) CreateDeployment(query DownsamplingObject, stack *PreviewStack) error {
+	filler := &PreviewDeploymentFiller{
+		DefaultFiller:    DefaultFiller{StackName: stack.Name},
+		InfluxdbV2:       d.config.IsInfluxdbV2(query.Db),
+		InfluxdbV2Org:    PREVIEW_INFLUXDB_V2_ORG,
+		InfluxdbV2Bucket: BucketName(query.Db, PREVIEW_RP),
+		InfluxdbDataPath: "/var/lib/influxdb",
+	}
+	if filler.InfluxdbV2 {
+		filler.InfluxdbDataPath = "/var/lib/influxdb2"
+	}
+	var influxdbProfile, grafanaProfile *ResourceProfile
+	if resources := d.config.PreviewResources; resources != nil {
+		influxdbProfile, grafanaProfile = resources.Influxdb, resources.Grafana
+		if resources.StorageSize != "" {
+			filler.StorageClaim = stack.Name
+		}
+	}
+	var err error
+	if filler.InfluxdbResources, err = resourcesJson(influxdbProfile); err != nil {
 		return err
 	}
-
-	log.Printf("Deployment spec: %s", yamlStr)
-	var spec *v1beta1.Deployment
-	err = json.Unmarshal([]byte(yamlStr), &spec)
+	if filler.GrafanaResources, err = resourcesJson(grafanaProfile); err != nil {
+		return err
+	}
+	yamlStr, err := d.templateParser.LoadTemplate("templates/simulation-deployment.json", filler)
 	if err != nil {
 		return err
 	}
 
+	log.Printf("Deployment spec: %s", yamlStr)
+
 	// Create Deployment
-	created, err := d.CreateK8Deployment(spec)
+	created, err := d.CreateK8Deployment([]byte(yamlStr), stack)
 	log.Printf("Deployment created: %t", created)
 	return err
 }
 
-func (d *DeploymentHandler) CreateK8Deployment(spec *v1beta1.Deployment) (bool, error) {
+// CreateK8Deployment sets the deployment, created or already there, as owner of the stack.
+func (d *DeploymentHandler) CreateK8Deployment(spec []byte, stack *PreviewStack) (bool, error) {
 	created := false
-	// Create Deployment
-	log.Printf("Creating deployment %s", spec.Name)
-	result, err := d.deploymentClient.Create(spec)
-	log.Printf("Response: %v", result)
-	if err != nil {
+	var name string
+	var result metav1.Object
+	var err error
+	switch d.apiVersion {
+	case DEPLOYMENT_API_APPS_V1BETA1:
+		var deployment *appsv1beta1.Deployment
+		if err = json.Unmarshal(spec, &deployment); err != nil {
+			return created, err
+		}
+		deployment.APIVersion = d.apiVersion
+		stack.Apply(&deployment.ObjectMeta)
+		stack.Apply(&deployment.Spec.Template.ObjectMeta)
+		name = deployment.Name
+		log.Printf("Creating deployment %s", name)
+		result, err = d.clientset.AppsV1beta1().Deployments(d.config.Namespace).Create(context.TODO(), deployment, metav1.CreateOptions{})
 		if errors.IsAlreadyExists(err) {
 			log.Println("Deployment already exists. Skipping...")
-			return created, nil
+			result, err = d.clientset.AppsV1beta1().Deployments(d.config.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
 		} else {
+			created = err == nil
+		}
+	default:
+		var deployment *appsv1.Deployment
+		if err = json.Unmarshal(spec, &deployment); err != nil {
 			return created, err
 		}
+		deployment.APIVersion = d.apiVersion
+		stack.Apply(&deployment.ObjectMeta)
+		stack.Apply(&deployment.Spec.Template.ObjectMeta)
+		name = deployment.Name
+		log.Printf("Creating deployment %s", name)
+		result, err = d.clientset.AppsV1().Deployments(d.config.Namespace).Create(context.TODO(), deployment, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			log.Println("Deployment already exists. Skipping...")
+			result, err = d.clientset.AppsV1().Deployments(d.config.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		} else {
+			created = err == nil
+		}
+	}
+	if err != nil {
+		return false, err
 	}
 
-	created = true
+	stack.Owner = &metav1.OwnerReference{APIVersion: d.apiVersion, Kind: "Deployment", Name: name, UID: result.GetUID()}
 	return created, nil
 }
 
+// DeletePreviewStack deletes the deployment of the stack, the garbage collector deletes the objects it owns.
+func (d *DeploymentHandler) DeletePreviewStack(stack *PreviewStack) error {
+	log.Printf("Deleting preview stack %s", stack.Name)
+	deletePolicy := metav1.DeletePropagationForeground
+	err := d.deleteDeployment(stack.Name, metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ExtendPreviewStack moves the expiry annotation of the deployment to that of the stack,
+// the objects it owns are not swept on their own so they keep theirs.
+func (d *DeploymentHandler) ExtendPreviewStack(stack *PreviewStack) error {
+	log.Printf("Extending preview stack %s to %s", stack.Name, stack.ExpiresAt)
+	switch d.apiVersion {
+	case DEPLOYMENT_API_APPS_V1BETA1:
+		deployment, err := d.clientset.AppsV1beta1().Deployments(d.config.Namespace).Get(context.TODO(), stack.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		stack.Apply(&deployment.ObjectMeta)
+		_, err = d.clientset.AppsV1beta1().Deployments(d.config.Namespace).Update(context.TODO(), deployment, metav1.UpdateOptions{})
+		return err
+	default:
+		deployment, err := d.clientset.AppsV1().Deployments(d.config.Namespace).Get(context.TODO(), stack.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		stack.Apply(&deployment.ObjectMeta)
+		_, err = d.clientset.AppsV1().Deployments(d.config.Namespace).Update(context.TODO(), deployment, metav1.UpdateOptions{})
+		return err
+	}
+}
+
+// WaitForPreviewStack watches the deployment of the stack until it is Available, for at most the ready timeout.
+// When it is not, the error is a PreviewNotReadyError with the container statuses and warning events of its pods.
+func (d *DeploymentHandler) WaitForPreviewStack(stack *PreviewStack) error {
+	timeout := d.config.ReadyTimeout()
+	log.Printf("Waiting up to %v for deployment %s to be available", timeout, stack.Name)
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+	err := d.waitAvailable(ctx, stack.Name)
+	if err == nil {
+		log.Printf("Deployment %s is available", stack.Name)
+		return nil
+	}
+	if ctx.Err() == nil {
+		return err
+	}
+	return &PreviewNotReadyError{Name: stack.Name, Timeout: timeout, Reason: d.describePods(stack)}
+}
+
+// waitAvailable starts watching before it reads the deployment, so no change in between is missed.
+func (d *DeploymentHandler) waitAvailable(ctx context.Context, name string) error {
+	opts := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()}
+	var w watch.Interface
+	var err error
+	if d.apiVersion == DEPLOYMENT_API_APPS_V1BETA1 {
+		w, err = d.clientset.AppsV1beta1().Deployments(d.config.Namespace).Watch(ctx, opts)
+	} else {
+		w, err = d.clientset.AppsV1().Deployments(d.config.Namespace).Watch(ctx, opts)
+	}
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	var deployment runtime.Object
+	if d.apiVersion == DEPLOYMENT_API_APPS_V1BETA1 {
+		deployment, err = d.clientset.AppsV1beta1().Deployments(d.config.Namespace).Get(ctx, name, metav1.GetOptions{})
+	} else {
+		deployment, err = d.clientset.AppsV1().Deployments(d.config.Namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if deploymentAvailable(deployment) {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return fmt.Errorf("watch of deployment %s closed", name)
+			}
+			if event.Type == watch.Deleted {
+				return fmt.Errorf("deployment %s was deleted", name)
+			}
+			if deploymentAvailable(event.Object) {
+				return nil
+			}
+		}
+	}
+}
+
+func deploymentAvailable(object runtime.Object) bool {
+	switch deployment := object.(type) {
+	case *appsv1.Deployment:
+		for _, condition := range deployment.Status.Conditions {
+			if condition.Type == appsv1.DeploymentAvailable && condition.Status == corev1.ConditionTrue {
+				return true
+			}
+		}
+	case *appsv1beta1.Deployment:
+		for _, condition := range deployment.Status.Conditions {
+			if condition.Type == appsv1beta1.DeploymentAvailable && condition.Status == corev1.ConditionTrue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DescribePreviewStack tells what the pods of the stack are doing, for a stack that does not answer.
+func (d *DeploymentHandler) DescribePreviewStack(stack *PreviewStack) string {
+	return d.describePods(stack)
+}
+
+// describePods sums up the container statuses and the warning events of the pods of the stack.
+func (d *DeploymentHandler) describePods(stack *PreviewStack) string {
+	pods, err := d.clientset.CoreV1().Pods(d.config.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: "queryId=" + stack.QueryId})
+	if err != nil {
+		return fmt.Sprintf("could not list pods: %v", err)
+	}
+	if len(pods.Items) == 0 {
+		return "no pod was created"
+	}
+
+	var reasons []string
+	for _, pod := range pods.Items {
+		var details []string
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			if status.State.Waiting != nil && status.State.Waiting.Reason != "" {
+				details = append(details, fmt.Sprintf("container %s waiting: %s %s", status.Name, status.State.Waiting.Reason, status.State.Waiting.Message))
+			}
+			if status.State.Terminated != nil {
+				details = append(details, fmt.Sprintf("container %s terminated: %s (exit code %d) %s", status.Name, status.State.Terminated.Reason, status.State.Terminated.ExitCode, status.State.Terminated.Message))
+			} else if status.LastTerminationState.Terminated != nil {
+				details = append(details, fmt.Sprintf("container %s last terminated: %s (exit code %d) %s", status.Name, status.LastTerminationState.Terminated.Reason, status.LastTerminationState.Terminated.ExitCode, status.LastTerminationState.Terminated.Message))
+			}
+		}
+		events, err := d.clientset.CoreV1().Events(d.config.Namespace).List(context.TODO(), metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("involvedObject.name", pod.Name).String()})
+		if err != nil {
+			details = append(details, fmt.Sprintf("could not list events: %v", err))
+		} else {
+			for _, event := range events.Items {
+				if event.Type == corev1.EventTypeWarning {
+					details = append(details, fmt.Sprintf("event %s: %s", event.Reason, event.Message))
+				}
+			}
+		}
+		if len(details) == 0 {
+			details = append(details, "no container status or warning event")
+		}
+		reasons = append(reasons, fmt.Sprintf("pod %s %s, %s", pod.Name, pod.Status.Phase, strings.Join(details, "; ")))
+	}
+	return strings.Join(reasons, "; ")
+}
+
 func (d *DeploymentHandler) HandleOldDeployments() (int, error) {
 	count := 0
 	log.Println("Getting old k8 deployments...")
-	deps, err := d.deploymentClient.List(metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
+	deps, err := d.listDeployments(metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
 	if err != nil {
 		return count, err
 	}
 
-	log.Printf("Got k8 deployments with tag purpose=%s: %v", SIMULATION_STACK_PREFIX, deps)
+	log.Printf("Got %d k8 deployments with tag purpose=%s", len(deps), SIMULATION_STACK_PREFIX)
 	deletePolicy := metav1.DeletePropagationForeground
-	for _, item := range deps.Items {
-		ts := item.GetCreationTimestamp()
-		now := time.Now()
-		diff := now.Sub(ts.Time).Minutes()
-		if diff > d.config.ExpireAfterMinute {
+	for _, item := range deps {
+		if PreviewExpired(item, d.config.ExpireAfterMinute) {
 			log.Printf("Deleting k8 deployment: %s", item.Name)
-			if err := d.deploymentClient.Delete(item.Name, &metav1.DeleteOptions{
+			if err := d.deleteDeployment(item.Name, metav1.DeleteOptions{
 				PropagationPolicy: &deletePolicy,
 			}); err != nil {
 				return count, err
@@ -94,3 +407,34 @@ func (d *DeploymentHandler) HandleOldDeployments() (int, error) {
 
 	return count, nil
 }
+
+// listDeployments returns the metadata of the deployments, whichever API version they are read from.
+func (d *DeploymentHandler) listDeployments(opts metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+	var deps []metav1.ObjectMeta
+	switch d.apiVersion {
+	case DEPLOYMENT_API_APPS_V1BETA1:
+		list, err := d.clientset.AppsV1beta1().Deployments(d.config.Namespace).List(context.TODO(), opts)
+		if err != nil {
+			return deps, err
+		}
+		for _, item := range list.Items {
+			deps = append(deps, item.ObjectMeta)
+		}
+	default:
+		list, err := d.clientset.AppsV1().Deployments(d.config.Namespace).List(context.TODO(), opts)
+		if err != nil {
+			return deps, err
+		}
+		for _, item := range list.Items {
+			deps = append(deps, item.ObjectMeta)
+		}
+	}
+	return deps, nil
+}
+
+func (d *DeploymentHandler) deleteDeployment(name string, opts metav1.DeleteOptions) error {
+	if d.apiVersion == DEPLOYMENT_API_APPS_V1BETA1 {
+		return d.clientset.AppsV1beta1().Deployments(d.config.Namespace).Delete(context.TODO(), name, opts)
+	}
+	return d.clientset.AppsV1().Deployments(d.config.Namespace).Delete(context.TODO(), name, opts)
+}
@@ -1,132 +1,295 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"k8s.io/api/apps/v1beta1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	types "k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
 	"testing"
 	"time"
 )
 
-type DeploymentHandlerTestSuite struct {
-	DeploymentHandler DeploymentHandler
-}
+var DeploymentApiVersions = []string{DEPLOYMENT_API_APPS_V1, DEPLOYMENT_API_APPS_V1BETA1}
 
-func NewDeploymentHandlerTestSuite(config *Config, data FakeDeploymentAssertData) *DeploymentHandler {
-	return &DeploymentHandler{deploymentClient: &FakeDeployments{data}, templateParser: &MockTemplateParserK8DepTest{}, config: config, Metrics: NewMetrics(*config, PARAM{})}
+// NewFakeClientset returns a clientset of a cluster serving the resource in the group version only.
+func NewFakeClientset(groupVersion string, resource string, objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*v1.APIResourceList{
+		{GroupVersion: groupVersion, APIResources: []v1.APIResource{{Name: resource}}},
+	}
+	return clientset
 }
 
-type FakeDeploymentAssertData struct {
-	errorToExpect error
+// NewPreviewObjectMeta is the metadata of a preview resource created minutes ago.
+func NewPreviewObjectMeta(name string, minutes int) v1.ObjectMeta {
+	return v1.ObjectMeta{Name: name, Namespace: "testns", Labels: map[string]string{"purpose": SIMULATION_STACK_PREFIX},
+		CreationTimestamp: v1.NewTime(time.Now().Add(-time.Duration(minutes) * time.Minute))}
 }
 
-type FakeDeployments struct {
-	FakeDeploymentAssertData FakeDeploymentAssertData
+func NewDeploymentHandlerTestSuite(config *Config, apiVersion string) *DeploymentHandler {
+	config.Namespace = "testns"
+	objects := []runtime.Object{&appsv1.Deployment{ObjectMeta: NewPreviewObjectMeta("test-deployment", 46)}, &appsv1.Deployment{ObjectMeta: NewPreviewObjectMeta("test-deployment2", 40)}}
+	if apiVersion == DEPLOYMENT_API_APPS_V1BETA1 {
+		objects = []runtime.Object{&appsv1beta1.Deployment{ObjectMeta: NewPreviewObjectMeta("test-deployment", 46)}, &appsv1beta1.Deployment{ObjectMeta: NewPreviewObjectMeta("test-deployment2", 40)}}
+	}
+	clientset := NewFakeClientset(apiVersion, "deployments", objects...)
+	served, _ := ServedGroupVersion(clientset.Discovery(), "deployments", DeploymentApiVersions...)
+	return &DeploymentHandler{clientset: clientset, apiVersion: served, templateParser: &MockTemplateParserK8DepTest{}, config: config, Metrics: NewMetrics(*config, PARAM{})}
 }
 
-func (c *FakeDeployments) Get(name string, options v1.GetOptions) (result *v1beta1.Deployment, err error) {
-	return nil, err
+type MockTemplateParserK8DepTest struct {
 }
 
-func (c *FakeDeployments) List(opts v1.ListOptions) (result *v1beta1.DeploymentList, err error) {
-	list := &v1beta1.DeploymentList{}
-	if opts.LabelSelector != "purpose="+SIMULATION_STACK_PREFIX {
-		err = errors.NewBadRequest("wrong label selector")
-		return list, err
-	}
-	i := v1beta1.Deployment{}
-	i.Name = "test-deployment"
-	i.CreationTimestamp.Time = time.Now().Add(-46 * time.Minute)
-	list.Items = append(list.Items, i)
-	i2 := v1beta1.Deployment{}
-	i2.Name = "test-deployment2"
-	i2.CreationTimestamp.Time = time.Now().Add(-40 * time.Minute)
-	list.Items = append(list.Items, i2)
-	return list, nil
+func (t *MockTemplateParserK8DepTest) LoadTemplate(path string, filler interface{}) (string, error) {
+	return `{"metadata": {"name": "downsamplr-preview-qwertyu"}}`, nil
 }
 
-func (c *FakeDeployments) Watch(opts v1.ListOptions) (watch.Interface, error) {
-	return nil, nil
-
-}
+func Test_DeploymentHandler_CreateDeployment(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}}, apiVersion)
+		stack := NewPreviewStack(DownsamplingObject{QueryId: "qwertyu", PreviewExpiresAt: "2030-01-01T00:00:00Z"})
+		err := tc.CreateDeployment(DownsamplingObject{Db: "sca"}, stack)
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
 
-func (c *FakeDeployments) Create(deployment *v1beta1.Deployment) (result *v1beta1.Deployment, err error) {
-	return nil, c.FakeDeploymentAssertData.errorToExpect
+		var meta v1.ObjectMeta
+		if apiVersion == DEPLOYMENT_API_APPS_V1BETA1 {
+			deployment, e := tc.clientset.AppsV1beta1().Deployments("testns").Get(context.TODO(), "downsamplr-preview-qwertyu", v1.GetOptions{})
+			if e == nil {
+				meta = deployment.ObjectMeta
+			}
+			err = e
+		} else {
+			deployment, e := tc.clientset.AppsV1().Deployments("testns").Get(context.TODO(), "downsamplr-preview-qwertyu", v1.GetOptions{})
+			if e == nil {
+				meta = deployment.ObjectMeta
+			}
+			err = e
+		}
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: deployment was expected to be created in its api version. %v", apiVersion, err))
+		}
+		if meta.Labels["queryId"] != "qwertyu" || meta.Annotations[PREVIEW_EXPIRES_AT_ANNOTATION] != "2030-01-01T00:00:00Z" {
+			t.Error(fmt.Sprintf("%s: deployment was expected with the query id and expiry, found %v and %v", apiVersion, meta.Labels, meta.Annotations))
+		}
+		if stack.Owner == nil || stack.Owner.Kind != "Deployment" || stack.Owner.Name != "downsamplr-preview-qwertyu" || stack.Owner.APIVersion != apiVersion {
+			t.Error(fmt.Sprintf("%s: deployment was expected as owner of the stack, found %v", apiVersion, stack.Owner))
+		}
+	}
 }
 
-func (c *FakeDeployments) Update(deployment *v1beta1.Deployment) (result *v1beta1.Deployment, err error) {
-	return nil, err
+func Test_DeploymentHandler_CreateK8Deployment_Success(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}}, apiVersion)
+		bool, err := tc.CreateK8Deployment([]byte(`{"metadata": {"name": "test-deployment3"}}`), &PreviewStack{})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		if !bool {
+			t.Error(fmt.Sprintf("%s: deployment not present, was expecting true (created), but got false.", apiVersion))
+		}
+	}
 }
 
-func (c *FakeDeployments) UpdateStatus(deployment *v1beta1.Deployment) (*v1beta1.Deployment, error) {
-	return nil, nil
+func Test_DeploymentHandler_CreateK8Deployment_AlreadyExists(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}}, apiVersion)
+		stack := &PreviewStack{}
+		bool, err := tc.CreateK8Deployment([]byte(`{"metadata": {"name": "test-deployment"}}`), stack)
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		if bool {
+			t.Error(fmt.Sprintf("%s: deployment already present, was expecting false, but got true.", apiVersion))
+		}
+		if stack.Owner == nil || stack.Owner.Name != "test-deployment" {
+			t.Error(fmt.Sprintf("%s: the existing deployment was expected as owner of the stack, found %v", apiVersion, stack.Owner))
+		}
+	}
 }
 
-func (c *FakeDeployments) Delete(name string, options *v1.DeleteOptions) error {
-	return nil
+func Test_DeploymentHandler_HandleOldDeployments_Success(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{ExpireAfterMinute: 45, MetricsConfig: &MetricsConfig{}}, apiVersion)
+		count, err := tc.HandleOldDeployments()
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		if count != 1 {
+			t.Error(fmt.Sprintf("%s: only one expired deployment was expected.", apiVersion))
+		}
+		deps, _ := tc.listDeployments(v1.ListOptions{})
+		if len(deps) != 1 || deps[0].Name != "test-deployment2" {
+			t.Error(fmt.Sprintf("%s: only test-deployment2 was expected to be left, found %v", apiVersion, deps))
+		}
+	}
 }
 
-func (c *FakeDeployments) DeleteCollection(options *v1.DeleteOptions, listOptions v1.ListOptions) error {
-	return nil
-}
+func Test_DeploymentHandler_HandleOldDeployments_ByExpiryAnnotation(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{ExpireAfterMinute: 45, MetricsConfig: &MetricsConfig{}}, apiVersion)
+		// extended past its age, and expired before it
+		old := NewPreviewObjectMeta("test-deployment", 46)
+		old.Annotations = map[string]string{PREVIEW_EXPIRES_AT_ANNOTATION: time.Now().Add(time.Hour).Format(time.RFC3339)}
+		young := NewPreviewObjectMeta("test-deployment2", 5)
+		young.Annotations = map[string]string{PREVIEW_EXPIRES_AT_ANNOTATION: time.Now().Add(-time.Minute).Format(time.RFC3339)}
+		if apiVersion == DEPLOYMENT_API_APPS_V1BETA1 {
+			tc.clientset = NewFakeClientset(apiVersion, "deployments", &appsv1beta1.Deployment{ObjectMeta: old}, &appsv1beta1.Deployment{ObjectMeta: young})
+		} else {
+			tc.clientset = NewFakeClientset(apiVersion, "deployments", &appsv1.Deployment{ObjectMeta: old}, &appsv1.Deployment{ObjectMeta: young})
+		}
 
-func (c *FakeDeployments) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (result *v1beta1.Deployment, err error) {
-	return nil, err
+		count, err := tc.HandleOldDeployments()
+		deps, _ := tc.listDeployments(v1.ListOptions{})
+		if err != nil || count != 1 || len(deps) != 1 || deps[0].Name != "test-deployment" {
+			t.Error(fmt.Sprintf("%s: only test-deployment2 was expected to expire, found %v left (%v)", apiVersion, deps, err))
+		}
+	}
 }
 
-type MockTemplateParserK8DepTest struct {
-}
+func Test_DeploymentHandler_DeletePreviewStack(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}}, apiVersion)
+		err := tc.DeletePreviewStack(&PreviewStack{Name: "test-deployment2"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		deps, _ := tc.listDeployments(v1.ListOptions{})
+		if len(deps) != 1 || deps[0].Name != "test-deployment" {
+			t.Error(fmt.Sprintf("%s: test-deployment2 was expected to be deleted, found %v", apiVersion, deps))
+		}
 
-func (t *MockTemplateParserK8DepTest) LoadTemplate(path string, filler interface{}) (string, error) {
-	return "{}", nil
+		err = tc.DeletePreviewStack(&PreviewStack{Name: "test-deployment2"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected for a deleted stack but received. %v", apiVersion, err))
+		}
+	}
 }
 
-func Test_DeploymentHandler_CreateDeployment(t *testing.T) {
-	tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}}, FakeDeploymentAssertData{})
-	err := tc.CreateDeployment(PARAM{queryId: "qwertyu"})
+// setAvailable marks the deployment Available, whichever API version it is served in.
+func setAvailable(tc *DeploymentHandler, name string) error {
+	if tc.apiVersion == DEPLOYMENT_API_APPS_V1BETA1 {
+		deployment, err := tc.clientset.AppsV1beta1().Deployments("testns").Get(context.TODO(), name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		deployment.Status.Conditions = []appsv1beta1.DeploymentCondition{{Type: appsv1beta1.DeploymentAvailable, Status: corev1.ConditionTrue}}
+		_, err = tc.clientset.AppsV1beta1().Deployments("testns").Update(context.TODO(), deployment, v1.UpdateOptions{})
+		return err
+	}
+	deployment, err := tc.clientset.AppsV1().Deployments("testns").Get(context.TODO(), name, v1.GetOptions{})
 	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+		return err
 	}
+	deployment.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue}}
+	_, err = tc.clientset.AppsV1().Deployments("testns").Update(context.TODO(), deployment, v1.UpdateOptions{})
+	return err
 }
 
-func Test_DeploymentHandler_CreateK8Deployment_Success(t *testing.T) {
-	tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}}, FakeDeploymentAssertData{})
-	var spec *v1beta1.Deployment
-	json.Unmarshal([]byte("{}"), &spec)
-	bool, err := tc.CreateK8Deployment(spec)
-	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+func Test_DeploymentHandler_WaitForPreviewStack_Available(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ReadyTimeoutMinute: 0.05}, apiVersion)
+		setAvailable(tc, "test-deployment")
+		err := tc.WaitForPreviewStack(&PreviewStack{Name: "test-deployment", QueryId: "qwertyu"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
 	}
-	if !bool {
-		t.Error(fmt.Sprintf("Deployment not present, was expecting true (created), but got false."))
+}
+
+func Test_DeploymentHandler_WaitForPreviewStack_BecomesAvailable(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ReadyTimeoutMinute: 0.05}, apiVersion)
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			setAvailable(tc, "test-deployment")
+		}()
+		err := tc.WaitForPreviewStack(&PreviewStack{Name: "test-deployment", QueryId: "qwertyu"})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
 	}
 }
 
-func Test_DeploymentHandler_CreateK8Deployment_AlreadyExists(t *testing.T) {
-	tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}}, FakeDeploymentAssertData{errors.NewAlreadyExists(schema.GroupResource{}, "")})
-	var spec *v1beta1.Deployment
-	json.Unmarshal([]byte("{}"), &spec)
-	bool, err := tc.CreateK8Deployment(spec)
-	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+func Test_DeploymentHandler_WaitForPreviewStack_NotReady(t *testing.T) {
+	for _, apiVersion := range DeploymentApiVersions {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ReadyTimeoutMinute: 0.01}, apiVersion)
+		pod := &corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: "test-deployment-abc", Namespace: "testns", Labels: map[string]string{"queryId": "qwertyu"}},
+			Status: corev1.PodStatus{Phase: corev1.PodPending, ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "influxdb", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}}},
+			}},
+		}
+		event := &corev1.Event{
+			ObjectMeta:     v1.ObjectMeta{Name: "test-deployment-abc.1", Namespace: "testns"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "test-deployment-abc"},
+			Type:           corev1.EventTypeWarning, Reason: "Failed", Message: "ErrImagePull",
+		}
+		tc.clientset.CoreV1().Pods("testns").Create(context.TODO(), pod, v1.CreateOptions{})
+		tc.clientset.CoreV1().Events("testns").Create(context.TODO(), event, v1.CreateOptions{})
+
+		err := tc.WaitForPreviewStack(&PreviewStack{Name: "test-deployment", QueryId: "qwertyu"})
+		notReadyErr, ok := err.(*PreviewNotReadyError)
+		if !ok {
+			t.Error(fmt.Sprintf("%s: PreviewNotReadyError was expected, received %v", apiVersion, err))
+			continue
+		}
+		for _, expected := range []string{"Pending", "influxdb waiting: ImagePullBackOff", "event Failed: ErrImagePull"} {
+			if !strings.Contains(notReadyErr.Reason, expected) {
+				t.Error(fmt.Sprintf("%s: the reason was expected to contain %q, found %s", apiVersion, expected, notReadyErr.Reason))
+			}
+		}
 	}
-	if bool {
-		t.Error(fmt.Sprintf("Deployment already present, was expecting false, but got true."))
+}
+
+func Test_DeploymentHandler_WaitForPreviewStack_NoPod(t *testing.T) {
+	tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ReadyTimeoutMinute: 0.01}, DEPLOYMENT_API_APPS_V1)
+	err := tc.WaitForPreviewStack(&PreviewStack{Name: "test-deployment", QueryId: "qwertyu"})
+	if notReadyErr, ok := err.(*PreviewNotReadyError); !ok || notReadyErr.Reason != "no pod was created" {
+		t.Error(fmt.Sprintf("PreviewNotReadyError without pods was expected, received %v", err))
 	}
 }
 
-func Test_DeploymentHandler_HandleOldDeployments_Success(t *testing.T) {
-	tc := NewDeploymentHandlerTestSuite(&Config{ExpireAfterMinute: 45, MetricsConfig: &MetricsConfig{}}, FakeDeploymentAssertData{})
-	count, err := tc.HandleOldDeployments()
-	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+func Test_DeploymentHandler_CreateDeployment_Resources(t *testing.T) {
+	resources := &PreviewResourceConfig{Influxdb: &ResourceProfile{Cpu: "500m", Memory: "1Gi", EphemeralStorage: "2Gi"}, Grafana: &ResourceProfile{Memory: "256Mi"}, StorageSize: "10Gi"}
+	tests := map[string]struct {
+		resources *PreviewResourceConfig
+		claim     string
+	}{
+		"no resources": {nil, ""},
+		"profiles":     {resources, "downsamplr-preview-qwertyu"},
 	}
-	if count != 1 {
-		t.Error(fmt.Sprintf("Only one expired deployment was expected."))
+	for name, test := range tests {
+		tc := NewDeploymentHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, PreviewResources: test.resources}, DEPLOYMENT_API_APPS_V1)
+		tc.templateParser = NewTemplateParser()
+		err := tc.CreateDeployment(DownsamplingObject{Db: "sca"}, NewPreviewStack(DownsamplingObject{QueryId: "qwertyu"}))
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", name, err))
+			continue
+		}
+
+		deployment, _ := tc.clientset.AppsV1().Deployments("testns").Get(context.TODO(), "downsamplr-preview-qwertyu", v1.GetOptions{})
+		spec := deployment.Spec.Template.Spec
+		influxdb, grafana := spec.Containers[0].Resources, spec.Containers[1].Resources
+		if test.resources == nil {
+			if len(influxdb.Limits) != 0 || len(grafana.Requests) != 0 || len(spec.Volumes) != 0 {
+				t.Error(fmt.Sprintf("%s: no resources nor volumes were expected, found %v %v %v", name, influxdb, grafana, spec.Volumes))
+			}
+			continue
+		}
+		if influxdb.Limits.Cpu().String() != "500m" || influxdb.Requests.Memory().String() != "1Gi" || influxdb.Limits.StorageEphemeral().String() != "2Gi" || grafana.Limits.Memory().String() != "256Mi" || !grafana.Requests.Cpu().IsZero() {
+			t.Error(fmt.Sprintf("%s: the profiles were expected as requests and limits, found %v and %v", name, influxdb, grafana))
+		}
+		if len(spec.Volumes) != 1 || spec.Volumes[0].PersistentVolumeClaim == nil || spec.Volumes[0].PersistentVolumeClaim.ClaimName != test.claim ||
+			len(spec.Containers[0].VolumeMounts) != 1 || spec.Containers[0].VolumeMounts[0].MountPath != "/var/lib/influxdb" {
+			t.Error(fmt.Sprintf("%s: InfluxDB was expected to keep its data in claim %s, found %v", name, test.claim, spec.Volumes))
+		}
 	}
 }
@@ -1,58 +1,99 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
-	"k8s.io/api/extensions/v1beta1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	clientv1betaextn "k8s.io/client-go/kubernetes/typed/extensions/v1beta1"
-	"time"
+	"k8s.io/client-go/kubernetes"
 )
 
+const INGRESS_API_NETWORKING_V1 = "networking.k8s.io/v1"
+const INGRESS_API_EXTENSIONS_V1BETA1 = "extensions/v1beta1"
+
 type IngressHandlerInterface interface {
 	HandleOldIngresses() (int, error)
-	CreateIngress(params PARAM) (string, string, error)
+	CreateIngress(stack *PreviewStack) (string, string, error)
+}
+
+// PreviewIngressFiller has the hosts of a preview stack, the URLs returned by CreateIngress are made from the same.
+type PreviewIngressFiller struct {
+	DefaultFiller
+	InfluxdbHost string
+	GrafanaHost  string
 }
 
+// IngressHandler uses networking.k8s.io/v1 ingresses, extensions/v1beta1 on clusters that do not serve them yet.
+// The backends are written differently in both, so each has its template.
 type IngressHandler struct {
-	ingressesClient clientv1betaextn.IngressInterface
-	templateParser  TemplateParserInterface
-	config          *Config
-	Metrics         *Metrics
+	clientset      kubernetes.Interface
+	apiVersion     string
+	templateParser TemplateParserInterface
+	config         *Config
+	Metrics        *Metrics
 }
 
 func NewIngressHandler(k8client K8ClientInterface, config *Config, metrics *Metrics) (*IngressHandler, error) {
-	ingressesClient := k8client.GetClientSet().ExtensionsV1beta1().Ingresses(config.Namespace)
-	return &IngressHandler{ingressesClient, NewTemplateParser(), config, metrics}, nil
+	clientset := k8client.GetClientSet()
+	apiVersion, err := ServedGroupVersion(clientset.Discovery(), "ingresses", INGRESS_API_NETWORKING_V1, INGRESS_API_EXTENSIONS_V1BETA1)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using %s ingresses.", apiVersion)
+	return &IngressHandler{clientset, apiVersion, NewTemplateParser(), config, metrics}, nil
 }
 
-func (s *IngressHandler) CreateIngress(params PARAM) (string, string, error) {
-	influxdbIngressUrl := "http://" + SIMULATION_STACK_PREFIX + "-" + params.queryId + ".influx.platform.r53.arghanil.net"
-	grafanaIngressUrl := "http://" + SIMULATION_STACK_PREFIX + "-" + params.queryId + ".grafana.platform.r53.arghanil.net"
-	yamlStr, err := s.templateParser.LoadTemplate("templates/simulation-ingress.json", &DefaultFiller{StackName: SIMULATION_STACK_PREFIX + "-" + params.queryId})
+func (s *IngressHandler) CreateIngress(stack *PreviewStack) (string, string, error) {
+	ingress := s.config.PreviewIngress
+	filler := &PreviewIngressFiller{
+		DefaultFiller: DefaultFiller{StackName: stack.Name, Config: *s.config},
+		InfluxdbHost:  ingress.Host(stack.Name, "influx"),
+		GrafanaHost:   ingress.Host(stack.Name, "grafana"),
+	}
+	influxdbIngressUrl := ingress.Url(filler.InfluxdbHost)
+	grafanaIngressUrl := ingress.Url(filler.GrafanaHost)
+	template := "templates/simulation-ingress.json"
+	if s.apiVersion == INGRESS_API_EXTENSIONS_V1BETA1 {
+		template = "templates/simulation-ingress-v1beta1.json"
+	}
+	yamlStr, err := s.templateParser.LoadTemplate(template, filler)
 	if err != nil {
 		return influxdbIngressUrl, grafanaIngressUrl, err
 	}
 
 	log.Printf("Ingress spec: %s", yamlStr)
-	var spec *v1beta1.Ingress
-	err = json.Unmarshal([]byte(yamlStr), &spec)
-	if err != nil {
-		return influxdbIngressUrl, grafanaIngressUrl, err
-	}
 
 	// Create ingress
-	ingressCreated, err := s.CreateK8Ingress(spec)
+	ingressCreated, err := s.CreateK8Ingress([]byte(yamlStr), stack)
 	log.Printf("Ingress created: %t", ingressCreated)
 	return influxdbIngressUrl, grafanaIngressUrl, err
 }
 
-func (s *IngressHandler) CreateK8Ingress(spec *v1beta1.Ingress) (bool, error) {
+func (s *IngressHandler) CreateK8Ingress(spec []byte, stack *PreviewStack) (bool, error) {
 	ingressCreated := false
-	// Create ingress
-	log.Printf("Creating ingress %s", spec.Name)
-	result, err := s.ingressesClient.Create(spec)
+	var result interface{}
+	var err error
+	switch s.apiVersion {
+	case INGRESS_API_EXTENSIONS_V1BETA1:
+		var ingress *extensionsv1beta1.Ingress
+		if err = json.Unmarshal(spec, &ingress); err != nil {
+			return ingressCreated, err
+		}
+		stack.Apply(&ingress.ObjectMeta)
+		log.Printf("Creating ingress %s", ingress.Name)
+		result, err = s.clientset.ExtensionsV1beta1().Ingresses(s.config.Namespace).Create(context.TODO(), ingress, metav1.CreateOptions{})
+	default:
+		var ingress *networkingv1.Ingress
+		if err = json.Unmarshal(spec, &ingress); err != nil {
+			return ingressCreated, err
+		}
+		stack.Apply(&ingress.ObjectMeta)
+		log.Printf("Creating ingress %s", ingress.Name)
+		result, err = s.clientset.NetworkingV1().Ingresses(s.config.Namespace).Create(context.TODO(), ingress, metav1.CreateOptions{})
+	}
 	log.Printf("Response: %v", result)
 	if err != nil {
 		if errors.IsAlreadyExists(err) {
@@ -70,20 +111,18 @@ func (s *IngressHandler) CreateK8Ingress(spec *v1beta1.Ingress) (bool, error) {
 func (h *IngressHandler) HandleOldIngresses() (int, error) {
 	count := 0
 	log.Println("Getting old k8 ingresses...")
-	deps, err := h.ingressesClient.List(metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
+	deps, err := h.listIngresses(metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
 	if err != nil {
 		return count, err
 	}
 
-	log.Printf("Got k8 ingresses with tag purpose=%s: %v", SIMULATION_STACK_PREFIX, deps)
+	log.Printf("Got %d k8 ingresses with tag purpose=%s", len(deps), SIMULATION_STACK_PREFIX)
 	deletePolicy := metav1.DeletePropagationForeground
-	for _, item := range deps.Items {
-		ts := item.GetCreationTimestamp()
-		now := time.Now()
-		diff := now.Sub(ts.Time).Minutes()
-		if diff > h.config.ExpireAfterMinute {
+	for _, item := range deps {
+		// owned ingresses go with their deployment
+		if !ownedByStack(item) && PreviewExpired(item, h.config.ExpireAfterMinute) {
 			log.Printf("Deleting k8 ingress: %s", item.Name)
-			if err := h.ingressesClient.Delete(item.Name, &metav1.DeleteOptions{
+			if err := h.deleteIngress(item.Name, metav1.DeleteOptions{
 				PropagationPolicy: &deletePolicy,
 			}); err != nil {
 				return count, err
@@ -94,3 +133,34 @@ func (h *IngressHandler) HandleOldIngresses() (int, error) {
 
 	return count, nil
 }
+
+// listIngresses returns the metadata of the ingresses, whichever API version they are read from.
+func (h *IngressHandler) listIngresses(opts metav1.ListOptions) ([]metav1.ObjectMeta, error) {
+	var ingresses []metav1.ObjectMeta
+	switch h.apiVersion {
+	case INGRESS_API_EXTENSIONS_V1BETA1:
+		list, err := h.clientset.ExtensionsV1beta1().Ingresses(h.config.Namespace).List(context.TODO(), opts)
+		if err != nil {
+			return ingresses, err
+		}
+		for _, item := range list.Items {
+			ingresses = append(ingresses, item.ObjectMeta)
+		}
+	default:
+		list, err := h.clientset.NetworkingV1().Ingresses(h.config.Namespace).List(context.TODO(), opts)
+		if err != nil {
+			return ingresses, err
+		}
+		for _, item := range list.Items {
+			ingresses = append(ingresses, item.ObjectMeta)
+		}
+	}
+	return ingresses, nil
+}
+
+func (h *IngressHandler) deleteIngress(name string, opts metav1.DeleteOptions) error {
+	if h.apiVersion == INGRESS_API_EXTENSIONS_V1BETA1 {
+		return h.clientset.ExtensionsV1beta1().Ingresses(h.config.Namespace).Delete(context.TODO(), name, opts)
+	}
+	return h.clientset.NetworkingV1().Ingresses(h.config.Namespace).Delete(context.TODO(), name, opts)
+}
@@ -1,132 +1,166 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	v1beta1 "k8s.io/api/extensions/v1beta1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	types "k8s.io/apimachinery/pkg/types"
-	watch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/runtime"
 	"testing"
-	"time"
 )
 
-type IngressHandlerTestSuite struct {
-	IngressHandler IngressHandler
-}
-
-func NewIngressHandlerTestSuite(config *Config, data FakeIngressAssertData) *IngressHandler {
-	return &IngressHandler{ingressesClient: &FakeIngresses{data}, templateParser: &MockTemplateParser3{}, config: config}
-}
-
-type FakeIngressAssertData struct {
-	errorToExpect error
-}
-
-type FakeIngresses struct {
-	FakeIngressAssertData FakeIngressAssertData
-}
-
-func (c *FakeIngresses) Get(name string, options v1.GetOptions) (result *v1beta1.Ingress, err error) {
-	return nil, err
-}
+var IngressApiVersions = []string{INGRESS_API_NETWORKING_V1, INGRESS_API_EXTENSIONS_V1BETA1}
 
-func (c *FakeIngresses) List(opts v1.ListOptions) (result *v1beta1.IngressList, err error) {
-	list := &v1beta1.IngressList{}
-	if opts.LabelSelector != "purpose="+SIMULATION_STACK_PREFIX {
-		err = errors.NewBadRequest("wrong label selector")
-		return list, err
+func NewIngressHandlerTestSuite(config *Config, apiVersion string) *IngressHandler {
+	config.Namespace = "testns"
+	if config.PreviewIngress == nil {
+		config.PreviewIngress = &IngressConfig{Domain: "platform.test", Scheme: "http"}
 	}
-	i := v1beta1.Ingress{}
-	i.Name = "test-ingress"
-	i.CreationTimestamp.Time = time.Now().Add(-46 * time.Minute)
-	list.Items = append(list.Items, i)
-	i2 := v1beta1.Ingress{}
-	i2.Name = "test-ingress2"
-	i2.CreationTimestamp.Time = time.Now().Add(-40 * time.Minute)
-	list.Items = append(list.Items, i2)
-	return list, nil
-}
-
-func (c *FakeIngresses) Watch(opts v1.ListOptions) (watch.Interface, error) {
-	return nil, nil
-
-}
-
-func (c *FakeIngresses) Create(ingress *v1beta1.Ingress) (result *v1beta1.Ingress, err error) {
-	return nil, c.FakeIngressAssertData.errorToExpect
-}
-
-func (c *FakeIngresses) Update(ingress *v1beta1.Ingress) (result *v1beta1.Ingress, err error) {
-	return nil, err
-}
-
-func (c *FakeIngresses) UpdateStatus(ingress *v1beta1.Ingress) (*v1beta1.Ingress, error) {
-	return nil, nil
-}
-
-func (c *FakeIngresses) Delete(name string, options *v1.DeleteOptions) error {
-	return nil
-}
-
-func (c *FakeIngresses) DeleteCollection(options *v1.DeleteOptions, listOptions v1.ListOptions) error {
-	return nil
-}
-
-func (c *FakeIngresses) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (result *v1beta1.Ingress, err error) {
-	return nil, err
+	objects := []runtime.Object{&networkingv1.Ingress{ObjectMeta: NewPreviewObjectMeta("test-ingress", 46)}, &networkingv1.Ingress{ObjectMeta: NewPreviewObjectMeta("test-ingress2", 40)}}
+	if apiVersion == INGRESS_API_EXTENSIONS_V1BETA1 {
+		objects = []runtime.Object{&extensionsv1beta1.Ingress{ObjectMeta: NewPreviewObjectMeta("test-ingress", 46)}, &extensionsv1beta1.Ingress{ObjectMeta: NewPreviewObjectMeta("test-ingress2", 40)}}
+	}
+	clientset := NewFakeClientset(apiVersion, "ingresses", objects...)
+	served, _ := ServedGroupVersion(clientset.Discovery(), "ingresses", IngressApiVersions...)
+	return &IngressHandler{clientset: clientset, apiVersion: served, templateParser: &MockTemplateParser3{}, config: config}
 }
 
+// MockTemplateParser3 records the template asked for, each api version has its own.
 type MockTemplateParser3 struct {
+	path string
 }
 
 func (t *MockTemplateParser3) LoadTemplate(path string, filler interface{}) (string, error) {
-	return "{}", nil
+	t.path = path
+	return `{"metadata": {"name": "downsamplr-preview-qwertyu"}}`, nil
 }
 
 func Test_IngressHandler_CreateIngress(t *testing.T) {
-	tc := NewIngressHandlerTestSuite(&Config{}, FakeIngressAssertData{})
-	_, _, err := tc.CreateIngress(PARAM{queryId: "qwertyu"})
-	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+	for apiVersion, template := range map[string]string{
+		INGRESS_API_NETWORKING_V1:      "templates/simulation-ingress.json",
+		INGRESS_API_EXTENSIONS_V1BETA1: "templates/simulation-ingress-v1beta1.json",
+	} {
+		tc := NewIngressHandlerTestSuite(&Config{}, apiVersion)
+		owner := &v1.OwnerReference{APIVersion: DEPLOYMENT_API_APPS_V1, Kind: "Deployment", Name: "downsamplr-preview-qwertyu", UID: "uid1"}
+		_, _, err := tc.CreateIngress(&PreviewStack{Name: "downsamplr-preview-qwertyu", QueryId: "qwertyu", Owner: owner})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		if path := tc.templateParser.(*MockTemplateParser3).path; path != template {
+			t.Error(fmt.Sprintf("%s: template %s was expected, found %s", apiVersion, template, path))
+		}
+
+		ingresses, err := tc.listIngresses(v1.ListOptions{LabelSelector: "queryId=qwertyu"})
+		if err != nil || len(ingresses) != 1 || ingresses[0].Name != "downsamplr-preview-qwertyu" {
+			t.Error(fmt.Sprintf("%s: ingress was expected to be created in its api version, found %v (%v)", apiVersion, ingresses, err))
+			continue
+		}
+		if len(ingresses[0].OwnerReferences) != 1 || ingresses[0].OwnerReferences[0].UID != "uid1" {
+			t.Error(fmt.Sprintf("%s: ingress was expected to be owned by the deployment, found %v", apiVersion, ingresses[0].OwnerReferences))
+		}
 	}
 }
 
 func Test_IngressHandler_CreateK8Ingress_Success(t *testing.T) {
-	tc := NewIngressHandlerTestSuite(&Config{}, FakeIngressAssertData{})
-	var spec *v1beta1.Ingress
-	json.Unmarshal([]byte("{}"), &spec)
-	bool, err := tc.CreateK8Ingress(spec)
-	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
-	}
-	if !bool {
-		t.Error(fmt.Sprintf("Ingress not present, was expecting true (created), but got false."))
+	for _, apiVersion := range IngressApiVersions {
+		tc := NewIngressHandlerTestSuite(&Config{}, apiVersion)
+		bool, err := tc.CreateK8Ingress([]byte(`{"metadata": {"name": "test-ingress3"}}`), &PreviewStack{})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		if !bool {
+			t.Error(fmt.Sprintf("%s: ingress not present, was expecting true (created), but got false.", apiVersion))
+		}
 	}
 }
 
 func Test_IngressHandler_CreateK8Ingress_AlreadyExists(t *testing.T) {
-	tc := NewIngressHandlerTestSuite(&Config{}, FakeIngressAssertData{errors.NewAlreadyExists(schema.GroupResource{}, "")})
-	var spec *v1beta1.Ingress
-	json.Unmarshal([]byte("{}"), &spec)
-	bool, err := tc.CreateK8Ingress(spec)
-	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
-	}
-	if bool {
-		t.Error(fmt.Sprintf("Ingress already present, was expecting false, but got true."))
+	for _, apiVersion := range IngressApiVersions {
+		tc := NewIngressHandlerTestSuite(&Config{}, apiVersion)
+		bool, err := tc.CreateK8Ingress([]byte(`{"metadata": {"name": "test-ingress"}}`), &PreviewStack{})
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		if bool {
+			t.Error(fmt.Sprintf("%s: ingress already present, was expecting false, but got true.", apiVersion))
+		}
 	}
 }
 
 func Test_IngressHandler_HandleOldIngresses_Success(t *testing.T) {
-	tc := NewIngressHandlerTestSuite(&Config{ExpireAfterMinute: 45}, FakeIngressAssertData{})
-	count, err := tc.HandleOldIngresses()
-	if err != nil {
-		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+	for _, apiVersion := range IngressApiVersions {
+		tc := NewIngressHandlerTestSuite(&Config{ExpireAfterMinute: 45}, apiVersion)
+		count, err := tc.HandleOldIngresses()
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+		}
+		if count != 1 {
+			t.Error(fmt.Sprintf("%s: only one expired ingress was expected, found %d.", apiVersion, count))
+		}
+	}
+}
+
+func Test_IngressHandler_HandleOldIngresses_SkipsOwned(t *testing.T) {
+	for _, apiVersion := range IngressApiVersions {
+		tc := NewIngressHandlerTestSuite(&Config{ExpireAfterMinute: 45}, apiVersion)
+		owned := NewPreviewObjectMeta("test-ingress", 46)
+		owned.OwnerReferences = []v1.OwnerReference{{Kind: "Deployment", Name: "test-deployment"}}
+		if apiVersion == INGRESS_API_EXTENSIONS_V1BETA1 {
+			tc.clientset = NewFakeClientset(apiVersion, "ingresses", &extensionsv1beta1.Ingress{ObjectMeta: owned})
+		} else {
+			tc.clientset = NewFakeClientset(apiVersion, "ingresses", &networkingv1.Ingress{ObjectMeta: owned})
+		}
+
+		count, err := tc.HandleOldIngresses()
+		if err != nil || count != 0 {
+			t.Error(fmt.Sprintf("%s: an ingress owned by its deployment was not expected to be deleted, found %d deleted (%v)", apiVersion, count, err))
+		}
 	}
-	if count != 1 {
-		t.Error(fmt.Sprintf("Ingress already present, was expecting false, but got true."))
+}
+
+func Test_IngressHandler_CreateIngress_UrlsMatchHosts(t *testing.T) {
+	for _, apiVersion := range IngressApiVersions {
+		tc := NewIngressHandlerTestSuite(&Config{PreviewIngress: &IngressConfig{Domain: "previews.test", Scheme: "https", Class: "nginx", TlsSecret: "previews-tls"}}, apiVersion)
+		tc.templateParser = NewTemplateParser()
+		influxdbUrl, grafanaUrl, err := tc.CreateIngress(NewPreviewStack(DownsamplingObject{QueryId: "qwertyu"}))
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", apiVersion, err))
+			continue
+		}
+		if influxdbUrl != "https://downsamplr-preview-qwertyu.influx.previews.test" || grafanaUrl != "https://downsamplr-preview-qwertyu.grafana.previews.test" {
+			t.Error(fmt.Sprintf("%s: unexpected urls %s and %s", apiVersion, influxdbUrl, grafanaUrl))
+		}
+
+		var hosts, tlsHosts []string
+		var class, tlsSecret string
+		if apiVersion == INGRESS_API_EXTENSIONS_V1BETA1 {
+			ingress, _ := tc.clientset.ExtensionsV1beta1().Ingresses("testns").Get(context.TODO(), "downsamplr-preview-qwertyu", v1.GetOptions{})
+			for _, rule := range ingress.Spec.Rules {
+				hosts = append(hosts, rule.Host)
+			}
+			if len(ingress.Spec.TLS) == 1 {
+				tlsHosts, tlsSecret = ingress.Spec.TLS[0].Hosts, ingress.Spec.TLS[0].SecretName
+			}
+			class = ingress.Annotations["kubernetes.io/ingress.class"]
+		} else {
+			ingress, _ := tc.clientset.NetworkingV1().Ingresses("testns").Get(context.TODO(), "downsamplr-preview-qwertyu", v1.GetOptions{})
+			for _, rule := range ingress.Spec.Rules {
+				hosts = append(hosts, rule.Host)
+			}
+			if len(ingress.Spec.TLS) == 1 {
+				tlsHosts, tlsSecret = ingress.Spec.TLS[0].Hosts, ingress.Spec.TLS[0].SecretName
+			}
+			if ingress.Spec.IngressClassName != nil {
+				class = *ingress.Spec.IngressClassName
+			}
+		}
+		// the urls handed to the clients must point at what was created
+		if len(hosts) != 2 || influxdbUrl != "https://"+hosts[0] || grafanaUrl != "https://"+hosts[1] {
+			t.Error(fmt.Sprintf("%s: urls %s and %s were expected to match the hosts %v", apiVersion, influxdbUrl, grafanaUrl, hosts))
+		}
+		if len(tlsHosts) != 2 || tlsHosts[0] != hosts[0] || tlsHosts[1] != hosts[1] || tlsSecret != "previews-tls" || class != "nginx" {
+			t.Error(fmt.Sprintf("%s: tls for %v with previews-tls and class nginx were expected, found %v with %s and class %s", apiVersion, hosts, tlsHosts, tlsSecret, class))
+		}
 	}
 }
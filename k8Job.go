@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	//"gopkg.in/yaml.v2"
 	"encoding/json"
@@ -9,18 +11,43 @@ import (
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/kubernetes/typed/batch/v1"
+	clientv1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"time"
 )
 
+// The jobs the coordinator spawns are labeled with this purpose, the query id and the operation, see templates/controller-job.json.
+const CONTROLLER_JOB_PURPOSE = "downsample-deployment-controller"
+
 type JobHandlerInterface interface {
 	GetAllDeploymentJobs() (*batchv1.JobList, error)
 	CheckIfJobExists(jobName string) (bool, error)
 	GetJob(jobName string) (*batchv1.Job, error)
-	CreateJob(jobName string, config *DefaultFiller) (bool, error)
-	GetConfigForJob(operation string, jobName string, queryId string, params PARAM) (*DefaultFiller, error)
+	CreateJob(jobName string, config *ControllerJobFiller) (bool, error)
+	GetConfigForJob(operation string, jobName string, queryId string, params PARAM) (*ControllerJobFiller, error)
+	GetJobOutcome(job batchv1.Job) (*JobOutcome, error)
+	DeleteJob(jobName string) error
+}
+
+// ControllerJobFiller labels a job with the query and the operation it runs.
+type ControllerJobFiller struct {
+	DefaultFiller
+	QueryId   string
+	Operation string
+}
+
+// JobOutcome is how the last controller job of an item ended, Message is the termination message of its pod
+// or, for a job failed without one, why it failed.
+type JobOutcome struct {
+	Name       string `json:"name"`
+	Operation  string `json:"operation"`
+	Succeeded  bool   `json:"succeeded"`
+	Message    string `json:"message,omitempty"`
+	FinishedAt string `json:"finishedAt"`
 }
 
 type JobHandler struct {
 	jobClient      v1.JobInterface
+	podsClient     clientv1core.PodInterface
 	templateParser TemplateParserInterface
 	config         *Config
 	Metrics        *Metrics
@@ -45,21 +72,84 @@ func (j *JobHandler) CheckIfJobExists(jobName string) (bool, error) {
 }
 
 func NewJobHandler(k8client K8ClientInterface, config *Config, metrics *Metrics) (*JobHandler, error) {
-	jobClient := k8client.GetClientSet().BatchV1().Jobs(config.Namespace)
-	return &JobHandler{jobClient, NewTemplateParser(), config, metrics}, nil
+	clientset := k8client.GetClientSet()
+	return &JobHandler{clientset.BatchV1().Jobs(config.Namespace), clientset.CoreV1().Pods(config.Namespace), NewTemplateParser(), config, metrics}, nil
 }
 
 func (j *JobHandler) GetAllDeploymentJobs() (*batchv1.JobList, error) {
-	jobs, err := j.jobClient.List(metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
+	jobs, err := j.jobClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "purpose=" + CONTROLLER_JOB_PURPOSE})
 	return jobs, err
 }
 
+// GetJobOutcome tells how a finished job ended, it is nil for a job still running.
+func (j *JobHandler) GetJobOutcome(job batchv1.Job) (*JobOutcome, error) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue || condition.Type != batchv1.JobComplete && condition.Type != batchv1.JobFailed {
+			continue
+		}
+
+		message, err := j.terminationMessage(job.Name)
+		if err != nil {
+			return nil, err
+		}
+		succeeded := condition.Type == batchv1.JobComplete
+		if !succeeded {
+			if message == "" {
+				message = condition.Message
+			}
+			message = condition.Reason + ": " + message
+		}
+		return &JobOutcome{
+			Name:       job.Name,
+			Operation:  job.Labels["operation"],
+			Succeeded:  succeeded,
+			Message:    message,
+			FinishedAt: condition.LastTransitionTime.UTC().Format(time.RFC3339),
+		}, nil
+	}
+	return nil, nil
+}
+
+// terminationMessage is the message of the container of the job that terminated last, if any.
+func (j *JobHandler) terminationMessage(jobName string) (string, error) {
+	pods, err := j.podsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "job-name=" + jobName})
+	if err != nil {
+		return "", err
+	}
+
+	var last *corev1.ContainerStateTerminated
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			for _, terminated := range []*corev1.ContainerStateTerminated{status.State.Terminated, status.LastTerminationState.Terminated} {
+				if terminated != nil && terminated.Message != "" && (last == nil || last.FinishedAt.Before(&terminated.FinishedAt)) {
+					last = terminated
+				}
+			}
+		}
+	}
+	if last == nil {
+		return "", nil
+	}
+	return last.Message, nil
+}
+
+// DeleteJob deletes the job with its pods.
+func (j *JobHandler) DeleteJob(jobName string) error {
+	log.Printf("Deleting job %s", jobName)
+	deletePolicy := metav1.DeletePropagationBackground
+	err := j.jobClient.Delete(context.TODO(), jobName, metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 func (j *JobHandler) GetJob(jobName string) (*batchv1.Job, error) {
-	job, err := j.jobClient.Get(jobName, metav1.GetOptions{})
+	job, err := j.jobClient.Get(context.TODO(), jobName, metav1.GetOptions{})
 	return job, err
 }
 
-func (j *JobHandler) CreateJob(jobName string, config *DefaultFiller) (bool, error) {
+func (j *JobHandler) CreateJob(jobName string, config *ControllerJobFiller) (bool, error) {
 	jobCreated := false
 	log.Printf("Checking if a job already exists with name %s", jobName)
 	present, err := j.CheckIfJobExists(jobName)
@@ -86,7 +176,7 @@ func (j *JobHandler) CreateJob(jobName string, config *DefaultFiller) (bool, err
 
 	// Create Job
 	log.Println("Creating job...")
-	result, err := j.jobClient.Create(spec)
+	result, err := j.jobClient.Create(context.TODO(), spec, metav1.CreateOptions{})
 	log.Printf("Output: %v", result)
 	if err != nil {
 		return jobCreated, err
@@ -96,7 +186,7 @@ func (j *JobHandler) CreateJob(jobName string, config *DefaultFiller) (bool, err
 	return jobCreated, nil
 }
 
-func (j *JobHandler) GetConfigForJob(operation string, jobName string, queryId string, params PARAM) (*DefaultFiller, error) {
+func (j *JobHandler) GetConfigForJob(operation string, jobName string, queryId string, params PARAM) (*ControllerJobFiller, error) {
 	var f *DefaultFiller
 	switch operation {
 	case params.OPERATION_DEPLOY:
@@ -105,11 +195,16 @@ func (j *JobHandler) GetConfigForJob(operation string, jobName string, queryId s
 		f = j.getFiller(jobName, "./main", "\"in-cluster\",\"delete\",\""+queryId+"\"")
 	case params.OPERATION_SIMULATE:
 		f = j.getFiller(jobName, "./main", "\"in-cluster\",\"simulate\",\""+queryId+"\"")
+	case params.OPERATION_CANCEL_PREVIEW:
+		f = j.getFiller(jobName, "./main", "\"in-cluster\",\"cancel-preview\",\""+queryId+"\"")
+	case params.OPERATION_EXTEND_PREVIEW:
+		// the minutes are read from the item
+		f = j.getFiller(jobName, "./main", "\"in-cluster\",\"extend-preview\",\""+queryId+"\"")
 	default:
-		return f, errors2.New("wrong case option " + operation)
+		return nil, errors2.New("wrong case option " + operation)
 	}
 	//f = j.getFiller(jobName, "sleep", "\"900\"")
-	return f, nil
+	return &ControllerJobFiller{*f, queryId, operation}, nil
 }
 
 func (j *JobHandler) getFiller(stackName string, Command string, Argument string) *DefaultFiller {
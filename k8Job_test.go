@@ -1,35 +1,41 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	batch_v1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	types "k8s.io/apimachinery/pkg/types"
-	watch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	batchclientv1 "k8s.io/client-go/kubernetes/typed/batch/v1"
 	"testing"
+	"time"
 )
 
 type JobHandlerTestSuite struct {
 	JobHandler JobHandler
 }
 
-func NewJobHandlerTestSuite(config *Config, jobs FakeJobNames) *JobHandler {
-	return &JobHandler{jobClient: &FakeJobClient{jobs}, templateParser: &MockTemplateParser{}, config: config}
+func NewJobHandlerTestSuite(config *Config, jobs FakeJobNames, pods ...runtime.Object) *JobHandler {
+	return &JobHandler{jobClient: &FakeJobClient{jobNames: jobs}, podsClient: fake.NewSimpleClientset(pods...).CoreV1().Pods("testns"), templateParser: &MockTemplateParser{}, config: config}
 }
 
 type FakeJobNames struct {
-	job_get_name    string
-	job_list_name   string
-	job_create_name string
+	job_get_name     string
+	job_list_name    string
+	job_create_name  string
+	job_deleted_name string
 }
 
 // FakeJobs implements JobInterface
 type FakeJobClient struct {
+	batchclientv1.JobInterface
 	jobNames FakeJobNames
 }
 
-func (c *FakeJobClient) Get(name string, options v1.GetOptions) (result *batch_v1.Job, err error) {
+func (c *FakeJobClient) Get(ctx context.Context, name string, options v1.GetOptions) (result *batch_v1.Job, err error) {
 	j := &batch_v1.Job{}
 	if name == c.jobNames.job_get_name {
 		j.Name = c.jobNames.job_get_name
@@ -38,9 +44,9 @@ func (c *FakeJobClient) Get(name string, options v1.GetOptions) (result *batch_v
 	return j, err
 }
 
-func (c *FakeJobClient) List(opts v1.ListOptions) (result *batch_v1.JobList, err error) {
+func (c *FakeJobClient) List(ctx context.Context, opts v1.ListOptions) (result *batch_v1.JobList, err error) {
 	list := &batch_v1.JobList{}
-	if opts.LabelSelector != "purpose="+SIMULATION_STACK_PREFIX {
+	if opts.LabelSelector != "purpose="+CONTROLLER_JOB_PURPOSE {
 		return list, errors.New("Wrong label selector")
 	}
 	j := batch_v1.Job{}
@@ -49,31 +55,12 @@ func (c *FakeJobClient) List(opts v1.ListOptions) (result *batch_v1.JobList, err
 	return list, nil
 }
 
-func (c *FakeJobClient) Watch(opts v1.ListOptions) (watch.Interface, error) {
-	return nil, nil
-}
-
-func (c *FakeJobClient) Create(job *batch_v1.Job) (result *batch_v1.Job, err error) {
-	return nil, err
-}
-
-func (c *FakeJobClient) Update(job *batch_v1.Job) (result *batch_v1.Job, err error) {
-	return nil, err
-}
-
-func (c *FakeJobClient) UpdateStatus(job *batch_v1.Job) (*batch_v1.Job, error) {
-	return nil, nil
-}
-
-func (c *FakeJobClient) Delete(name string, options *v1.DeleteOptions) error {
+func (c *FakeJobClient) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
+	c.jobNames.job_deleted_name = name
 	return nil
 }
 
-func (c *FakeJobClient) DeleteCollection(options *v1.DeleteOptions, listOptions v1.ListOptions) error {
-	return nil
-}
-
-func (c *FakeJobClient) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (result *batch_v1.Job, err error) {
+func (c *FakeJobClient) Create(ctx context.Context, job *batch_v1.Job, opts v1.CreateOptions) (result *batch_v1.Job, err error) {
 	return nil, err
 }
 
@@ -102,7 +89,7 @@ func Test_JobHandler_CheckIfJobExists_False(t *testing.T) {
 
 func Test_JobHandler_CreateJob(t *testing.T) {
 	tc := NewJobHandlerTestSuite(&Config{}, FakeJobNames{job_get_name: "job-to-exist"})
-	ind, err := tc.CreateJob("job-new", &DefaultFiller{})
+	ind, err := tc.CreateJob("job-new", &ControllerJobFiller{})
 	if err != nil {
 		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
 	}
@@ -113,7 +100,7 @@ func Test_JobHandler_CreateJob(t *testing.T) {
 
 func Test_JobHandler_CreateJob_AlreadyExists(t *testing.T) {
 	tc := NewJobHandlerTestSuite(&Config{}, FakeJobNames{job_get_name: "job-to-exist"})
-	ind, err := tc.CreateJob("job-to-exist", &DefaultFiller{})
+	ind, err := tc.CreateJob("job-to-exist", &ControllerJobFiller{})
 	if err != nil {
 		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
 	}
@@ -132,3 +119,62 @@ func Test_JobHandler_GetAllDeploymentJobs(t *testing.T) {
 		t.Error(fmt.Sprintf("Job %s should be returned but wasn't.", "job-1"))
 	}
 }
+
+func NewJobPod(name string, jobName string, terminated corev1.ContainerStateTerminated) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.Name, pod.Namespace = name, "testns"
+	pod.Labels = map[string]string{"job-name": jobName}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "controller", State: corev1.ContainerState{Terminated: &terminated}}}
+	return pod
+}
+
+func Test_JobHandler_GetJobOutcome(t *testing.T) {
+	finished := v1.NewTime(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	pods := []runtime.Object{
+		NewJobPod("job-1-a", "job-1", corev1.ContainerStateTerminated{ExitCode: 1, Message: "first attempt", FinishedAt: v1.NewTime(finished.Add(-time.Minute))}),
+		NewJobPod("job-1-b", "job-1", corev1.ContainerStateTerminated{ExitCode: 1, Message: "preview not available", FinishedAt: finished}),
+		NewJobPod("job-2-a", "job-2", corev1.ContainerStateTerminated{ExitCode: 1, Message: "other job", FinishedAt: finished}),
+	}
+	tests := map[string]struct {
+		job      batch_v1.Job
+		expected *JobOutcome
+	}{
+		"running": {batch_v1.Job{}, nil},
+		"failed": {
+			batch_v1.Job{ObjectMeta: v1.ObjectMeta{Name: "job-1", Labels: map[string]string{"operation": "simulate"}}, Status: batch_v1.JobStatus{Conditions: []batch_v1.JobCondition{
+				{Type: batch_v1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", LastTransitionTime: finished},
+			}}},
+			&JobOutcome{Name: "job-1", Operation: "simulate", Succeeded: false, Message: "BackoffLimitExceeded: preview not available", FinishedAt: "2030-01-01T00:00:00Z"},
+		},
+		"failed without message": {
+			batch_v1.Job{ObjectMeta: v1.ObjectMeta{Name: "job-3"}, Status: batch_v1.JobStatus{Conditions: []batch_v1.JobCondition{
+				{Type: batch_v1.JobFailed, Status: corev1.ConditionTrue, Reason: "DeadlineExceeded", Message: "Job was active longer than specified deadline", LastTransitionTime: finished},
+			}}},
+			&JobOutcome{Name: "job-3", Succeeded: false, Message: "DeadlineExceeded: Job was active longer than specified deadline", FinishedAt: "2030-01-01T00:00:00Z"},
+		},
+		"succeeded": {
+			batch_v1.Job{ObjectMeta: v1.ObjectMeta{Name: "job-3", Labels: map[string]string{"operation": "deploy"}}, Status: batch_v1.JobStatus{Conditions: []batch_v1.JobCondition{
+				{Type: batch_v1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: finished},
+			}}},
+			&JobOutcome{Name: "job-3", Operation: "deploy", Succeeded: true, FinishedAt: "2030-01-01T00:00:00Z"},
+		},
+	}
+	for name, test := range tests {
+		tc := NewJobHandlerTestSuite(&Config{}, FakeJobNames{}, pods...)
+		outcome, err := tc.GetJobOutcome(test.job)
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: error was not expected but received. %v", name, err))
+		}
+		if (outcome == nil) != (test.expected == nil) || outcome != nil && *outcome != *test.expected {
+			t.Error(fmt.Sprintf("%s: %v was expected, found %v", name, test.expected, outcome))
+		}
+	}
+}
+
+func Test_JobHandler_DeleteJob(t *testing.T) {
+	tc := NewJobHandlerTestSuite(&Config{}, FakeJobNames{})
+	err := tc.DeleteJob("job-1")
+	if err != nil || tc.jobClient.(*FakeJobClient).jobNames.job_deleted_name != "job-1" {
+		t.Error(fmt.Sprintf("Job job-1 was expected to be deleted, received %v", err))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientv1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"regexp"
+)
+
+// PreviewCredentials are generated for each preview and kept in a k8s secret named after the preview stack,
+// the deployment reads them from there, see templates/simulation-secret.json.
+type PreviewCredentials struct {
+	SecretName       string `json:"secretName"`
+	InfluxdbUser     string `json:"influxdbUser"`
+	InfluxdbPassword string `json:"influxdbPassword"`
+	InfluxdbToken    string `json:"influxdbToken,omitempty"`
+	GrafanaUser      string `json:"grafanaUser"`
+	GrafanaPassword  string `json:"grafanaPassword"`
+}
+
+func NewPreviewCredentials(queryId string) (*PreviewCredentials, error) {
+	credentials := &PreviewCredentials{SecretName: SIMULATION_STACK_PREFIX + "-" + queryId, InfluxdbUser: "downsamplr", GrafanaUser: "downsamplr"}
+	for _, secret := range []*string{&credentials.InfluxdbPassword, &credentials.InfluxdbToken, &credentials.GrafanaPassword} {
+		value, err := randomSecret(24)
+		if err != nil {
+			return nil, err
+		}
+		*secret = value
+	}
+	return credentials, nil
+}
+
+// REDACTED replaces secrets in what is logged.
+const REDACTED = "<redacted>"
+
+var passwordJsonValue = regexp.MustCompile(`("[A-Za-z]*(?i:password|token)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactPasswords hides the password and token values of a JSON document, like the secure data of a Grafana datasource.
+func redactPasswords(text string) string {
+	return passwordJsonValue.ReplaceAllString(text, `${1}"`+REDACTED+`"`)
+}
+
+func randomSecret(size int) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type PreviewSecretFiller struct {
+	DefaultFiller
+	QueryId     string
+	Credentials *PreviewCredentials
+}
+
+type SecretHandlerInterface interface {
+	HandleOldSecrets() (int, error)
+	CreateSecret(stack *PreviewStack, credentials *PreviewCredentials) (*PreviewCredentials, error)
+}
+
+type SecretHandler struct {
+	secretsClient  clientv1core.SecretInterface
+	templateParser TemplateParserInterface
+	config         *Config
+	Metrics        *Metrics
+}
+
+func NewSecretHandler(k8client K8ClientInterface, config *Config, metrics *Metrics) (*SecretHandler, error) {
+	secretsClient := k8client.GetClientSet().CoreV1().Secrets(config.Namespace)
+	return &SecretHandler{secretsClient, NewTemplateParser(), config, metrics}, nil
+}
+
+// CreateSecret returns the credentials the preview runs with. A retried preview keeps those of the secret already there,
+// InfluxDB and Grafana only take their admin credentials when their data is initialized.
+func (s *SecretHandler) CreateSecret(stack *PreviewStack, credentials *PreviewCredentials) (*PreviewCredentials, error) {
+	filler := &PreviewSecretFiller{DefaultFiller{StackName: credentials.SecretName}, stack.QueryId, credentials}
+	yamlStr, err := s.templateParser.LoadTemplate("templates/simulation-secret.json", filler)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec *v1.Secret
+	err = json.Unmarshal([]byte(yamlStr), &spec)
+	if err != nil {
+		return nil, err
+	}
+	stack.Apply(&spec.ObjectMeta)
+
+	// the spec is not logged, it holds the credentials
+	log.Printf("Creating secret %s", spec.Name)
+	_, err = s.secretsClient.Create(context.TODO(), spec, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		log.Printf("Secret already exists. Using its credentials...")
+		existing, err := s.secretsClient.Get(context.TODO(), spec.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return credentialsFromSecret(existing), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// credentialsFromSecret reads the keys of templates/simulation-secret.json, the API server moves stringData to data.
+func credentialsFromSecret(secret *v1.Secret) *PreviewCredentials {
+	value := func(key string) string {
+		if data, ok := secret.Data[key]; ok {
+			return string(data)
+		}
+		return secret.StringData[key]
+	}
+	return &PreviewCredentials{SecretName: secret.Name, InfluxdbUser: value("influxdb-user"), InfluxdbPassword: value("influxdb-password"),
+		InfluxdbToken: value("influxdb-token"), GrafanaUser: value("grafana-user"), GrafanaPassword: value("grafana-password")}
+}
+
+func (s *SecretHandler) HandleOldSecrets() (int, error) {
+	count := 0
+	log.Println("Getting old k8 secrets...")
+	secrets, err := s.secretsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
+	if err != nil {
+		return count, err
+	}
+
+	log.Printf("Got %d k8 secrets with tag purpose=%s", len(secrets.Items), SIMULATION_STACK_PREFIX)
+	for _, item := range secrets.Items {
+		// owned secrets go with their deployment
+		if !ownedByStack(item.ObjectMeta) && PreviewExpired(item.ObjectMeta, s.config.ExpireAfterMinute) {
+			log.Printf("Deleting k8 secret: %s", item.Name)
+			if err := s.secretsClient.Delete(context.TODO(), item.Name, metav1.DeleteOptions{}); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
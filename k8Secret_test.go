@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientv1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"testing"
+	"time"
+)
+
+// FakeSecrets implements SecretInterface
+type FakeSecrets struct {
+	clientv1core.SecretInterface
+	existing map[string]*v1.Secret
+	deleted  []string
+}
+
+func (c *FakeSecrets) Get(ctx context.Context, name string, options metav1.GetOptions) (result *v1.Secret, err error) {
+	return c.existing[name], nil
+}
+
+func (c *FakeSecrets) List(ctx context.Context, opts metav1.ListOptions) (result *v1.SecretList, err error) {
+	list := &v1.SecretList{}
+	if opts.LabelSelector != "purpose="+SIMULATION_STACK_PREFIX {
+		return list, errors.NewBadRequest("wrong label selector")
+	}
+	for _, age := range []int{46, 40} {
+		s := v1.Secret{}
+		s.Name = fmt.Sprintf("test-secret-%d", age)
+		s.CreationTimestamp.Time = time.Now().Add(-time.Duration(age) * time.Minute)
+		list.Items = append(list.Items, s)
+	}
+	return list, nil
+}
+
+func (c *FakeSecrets) Create(ctx context.Context, secret *v1.Secret, opts metav1.CreateOptions) (result *v1.Secret, err error) {
+	if _, ok := c.existing[secret.Name]; ok {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, secret.Name)
+	}
+	c.existing[secret.Name] = secret
+	return secret, nil
+}
+
+func (c *FakeSecrets) Update(ctx context.Context, secret *v1.Secret, opts metav1.UpdateOptions) (result *v1.Secret, err error) {
+	c.existing[secret.Name] = secret
+	return secret, nil
+}
+
+func (c *FakeSecrets) Delete(ctx context.Context, name string, options metav1.DeleteOptions) error {
+	c.deleted = append(c.deleted, name)
+	return nil
+}
+
+func Test_NewPreviewCredentials(t *testing.T) {
+	c1, err := NewPreviewCredentials("query1")
+	c2, _ := NewPreviewCredentials("query1")
+	if err != nil || c1.SecretName != "downsamplr-preview-query1" || len(c1.InfluxdbPassword) != 48 || c1.InfluxdbPassword == c2.InfluxdbPassword || c1.GrafanaPassword == c1.InfluxdbPassword {
+		t.Error(fmt.Sprintf("Random credentials were expected, found %v and %v (%v)", c1, c2, err))
+	}
+}
+
+func Test_SecretHandler_CreateSecret(t *testing.T) {
+	secrets := &FakeSecrets{existing: map[string]*v1.Secret{}}
+	handler := &SecretHandler{secretsClient: secrets, templateParser: NewTemplateParser(), config: &Config{}}
+	credentials, _ := NewPreviewCredentials("query1")
+
+	stack := NewPreviewStack(DownsamplingObject{QueryId: "query1"})
+	stack.Owner = &metav1.OwnerReference{Kind: "Deployment", Name: stack.Name, UID: "uid1"}
+	created, err := handler.CreateSecret(stack, credentials)
+	secret := secrets.existing["downsamplr-preview-query1"]
+	if err != nil || created != credentials || secret == nil || secret.Labels["queryId"] != "query1" || secret.StringData["influxdb-password"] != credentials.InfluxdbPassword {
+		t.Error(fmt.Sprintf("Secret downsamplr-preview-query1 was expected with the credentials, found %v (%v)", secret, err))
+		return
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != "uid1" {
+		t.Error(fmt.Sprintf("Secret was expected to be owned by the deployment, found %v", secret.OwnerReferences))
+	}
+
+	retried, _ := NewPreviewCredentials("query1")
+	kept, err := handler.CreateSecret(stack, retried)
+	secret = secrets.existing["downsamplr-preview-query1"]
+	if err != nil || secret.StringData["grafana-password"] != credentials.GrafanaPassword || kept == nil || *kept != *credentials {
+		t.Error(fmt.Sprintf("The credentials of the secret were expected to be kept on a retry, found %v in %v (%v)", kept, secret, err))
+	}
+}
+
+func Test_SecretHandler_HandleOldSecrets(t *testing.T) {
+	secrets := &FakeSecrets{existing: map[string]*v1.Secret{}}
+	handler := &SecretHandler{secretsClient: secrets, templateParser: NewTemplateParser(), config: &Config{ExpireAfterMinute: 45}}
+
+	count, err := handler.HandleOldSecrets()
+	if err != nil || count != 1 || len(secrets.deleted) != 1 || secrets.deleted[0] != "test-secret-46" {
+		t.Error(fmt.Sprintf("Only test-secret-46 was expected to be deleted, found %v (%v)", secrets.deleted, err))
+	}
+}
+
+func Test_RedactPasswords(t *testing.T) {
+	redacted := redactPasswords(`{"user":"downsamplr","basicAuthPassword":"p\"1","secureJsonData":{"password":"p2"},"token": "t1"}`)
+	if redacted != `{"user":"downsamplr","basicAuthPassword":"<redacted>","secureJsonData":{"password":"<redacted>"},"token": "<redacted>"}` {
+		t.Error(fmt.Sprintf("Passwords and tokens were expected to be redacted, found %s", redacted))
+	}
+}
@@ -1,18 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientv1core "k8s.io/client-go/kubernetes/typed/core/v1"
-	"time"
 )
 
 type ServiceHandlerInterface interface {
 	HandleOldServices() error
-	CreateService(params PARAM) error
+	CreateService(stack *PreviewStack) error
 }
 
 type ServiceHandler struct {
@@ -27,8 +27,8 @@ func NewServiceHandler(k8client K8ClientInterface, config *Config, metrics *Metr
 	return &ServiceHandler{ServicesClient, NewTemplateParser(), config, metrics}, nil
 }
 
-func (s *ServiceHandler) CreateService(params PARAM) error {
-	yamlStr, err := s.templateParser.LoadTemplate("templates/simulation-service.json", &DefaultFiller{StackName: SIMULATION_STACK_PREFIX + "-" + params.queryId})
+func (s *ServiceHandler) CreateService(stack *PreviewStack) error {
+	yamlStr, err := s.templateParser.LoadTemplate("templates/simulation-service.json", &DefaultFiller{StackName: stack.Name})
 	if err != nil {
 		return err
 	}
@@ -39,10 +39,11 @@ func (s *ServiceHandler) CreateService(params PARAM) error {
 	if err != nil {
 		return err
 	}
+	stack.Apply(&spec.ObjectMeta)
 
 	// Create service
 	log.Printf("Creating service %s", spec.Name)
-	result, err := s.servicesClient.Create(spec)
+	result, err := s.servicesClient.Create(context.TODO(), spec, metav1.CreateOptions{})
 	log.Printf("Response: %v", result)
 	if err != nil {
 		if errors.IsAlreadyExists(err) {
@@ -58,7 +59,7 @@ func (s *ServiceHandler) CreateService(params PARAM) error {
 
 func (h *ServiceHandler) HandleOldServices() error {
 	log.Println("Getting old k8 services...")
-	deps, err := h.servicesClient.List(metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
+	deps, err := h.servicesClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "purpose=" + SIMULATION_STACK_PREFIX})
 	if err != nil {
 		return err
 	}
@@ -66,12 +67,10 @@ func (h *ServiceHandler) HandleOldServices() error {
 	log.Printf("Got k8 services with tag purpose=%s: %v", SIMULATION_STACK_PREFIX, deps)
 	deletePolicy := metav1.DeletePropagationForeground
 	for _, item := range deps.Items {
-		ts := item.GetCreationTimestamp()
-		now := time.Now()
-		diff := now.Sub(ts.Time).Minutes()
-		if diff > h.config.ExpireAfterMinute {
+		// owned services go with their deployment
+		if !ownedByStack(item.ObjectMeta) && PreviewExpired(item.ObjectMeta, h.config.ExpireAfterMinute) {
 			log.Printf("Deleting k8 service: %s", item.Name)
-			if err := h.servicesClient.Delete(item.Name, &metav1.DeleteOptions{
+			if err := h.servicesClient.Delete(context.TODO(), item.Name, metav1.DeleteOptions{
 				PropagationPolicy: &deletePolicy,
 			}); err != nil {
 				return err
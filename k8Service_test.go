@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	types "k8s.io/apimachinery/pkg/types"
-	watch "k8s.io/apimachinery/pkg/watch"
+	clientv1core "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 type ServiceHandlerTestSuite struct {
@@ -17,45 +17,29 @@ func NewServiceHandlerTestSuite(config *Config, jobs FakeJobNames) *ServiceHandl
 
 // FakeServices implements ServiceInterface
 type FakeService struct {
+	clientv1core.ServiceInterface
 }
 
-func (c *FakeService) Get(name string, options metav1.GetOptions) (result *v1.Service, err error) {
+func (c *FakeService) Get(ctx context.Context, name string, options metav1.GetOptions) (result *v1.Service, err error) {
 	return nil, nil
 }
 
-func (c *FakeService) List(opts metav1.ListOptions) (result *v1.ServiceList, err error) {
+func (c *FakeService) List(ctx context.Context, opts metav1.ListOptions) (result *v1.ServiceList, err error) {
 	return nil, nil
 }
 
-func (c *FakeService) Watch(opts metav1.ListOptions) (watch.Interface, error) {
-	return nil, nil
-
-}
-
-func (c *FakeService) Create(service *v1.Service) (result *v1.Service, err error) {
-	return nil, nil
-}
-
-func (c *FakeService) Update(service *v1.Service) (result *v1.Service, err error) {
+func (c *FakeService) Create(ctx context.Context, service *v1.Service, opts metav1.CreateOptions) (result *v1.Service, err error) {
 	return nil, nil
 }
 
-func (c *FakeService) UpdateStatus(service *v1.Service) (result *v1.Service, err error) {
+func (c *FakeService) Update(ctx context.Context, service *v1.Service, opts metav1.UpdateOptions) (result *v1.Service, err error) {
 	return nil, nil
 }
 
-func (c *FakeService) Delete(name string, options *metav1.DeleteOptions) error {
-	return nil
-}
-
-func (c *FakeService) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+func (c *FakeService) Delete(ctx context.Context, name string, options metav1.DeleteOptions) error {
 	return nil
 }
 
-func (c *FakeService) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (result *v1.Service, err error) {
-	return nil, err
-}
-
 type MockTemplateParser2 struct {
 }
 
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientv1core "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+type VolumeClaimHandlerInterface interface {
+	CreateVolumeClaim(stack *PreviewStack) error
+}
+
+// VolumeClaimHandler creates the claim InfluxDB of a preview keeps its data in, when a storage size is configured.
+// The claim is owned by the deployment so it is only deleted with the stack.
+type VolumeClaimHandler struct {
+	claimsClient   clientv1core.PersistentVolumeClaimInterface
+	templateParser TemplateParserInterface
+	config         *Config
+	Metrics        *Metrics
+}
+
+func NewVolumeClaimHandler(k8client K8ClientInterface, config *Config, metrics *Metrics) (*VolumeClaimHandler, error) {
+	claimsClient := k8client.GetClientSet().CoreV1().PersistentVolumeClaims(config.Namespace)
+	return &VolumeClaimHandler{claimsClient, NewTemplateParser(), config, metrics}, nil
+}
+
+func (v *VolumeClaimHandler) CreateVolumeClaim(stack *PreviewStack) error {
+	if v.config.PreviewResources == nil || v.config.PreviewResources.StorageSize == "" {
+		return nil
+	}
+
+	filler := &DefaultFiller{StackName: stack.Name, Config: *v.config}
+	yamlStr, err := v.templateParser.LoadTemplate("templates/simulation-volume-claim.json", filler)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Volume claim spec: %s", yamlStr)
+	var spec *v1.PersistentVolumeClaim
+	err = json.Unmarshal([]byte(yamlStr), &spec)
+	if err != nil {
+		return err
+	}
+	stack.Apply(&spec.ObjectMeta)
+
+	_, err = v.claimsClient.Create(context.TODO(), spec, metav1.CreateOptions{})
+	if err != nil {
+		if errors.IsAlreadyExists(err) {
+			// the claim of a retried preview keeps its data
+			log.Printf("Volume claim already exists. Skipping...")
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
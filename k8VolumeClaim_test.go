@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func NewVolumeClaimHandlerTestSuite(resources *PreviewResourceConfig) *VolumeClaimHandler {
+	config := &Config{Namespace: "testns", MetricsConfig: &MetricsConfig{}, PreviewResources: resources}
+	claimsClient := fake.NewSimpleClientset().CoreV1().PersistentVolumeClaims("testns")
+	return &VolumeClaimHandler{claimsClient, NewTemplateParser(), config, NewMetrics(*config, PARAM{})}
+}
+
+func Test_VolumeClaimHandler_CreateVolumeClaim(t *testing.T) {
+	tc := NewVolumeClaimHandlerTestSuite(&PreviewResourceConfig{StorageSize: "10Gi", StorageClass: "gp3"})
+	stack := NewPreviewStack(DownsamplingObject{QueryId: "qwertyu", PreviewExpiresAt: "2030-01-01T00:00:00Z"})
+	stack.Owner = &metav1.OwnerReference{APIVersion: DEPLOYMENT_API_APPS_V1, Kind: "Deployment", Name: stack.Name, UID: "uid1"}
+	err := tc.CreateVolumeClaim(stack)
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+	}
+
+	claim, err := tc.claimsClient.Get(context.TODO(), "downsamplr-preview-qwertyu", metav1.GetOptions{})
+	if err != nil {
+		t.Error(fmt.Sprintf("The claim was expected but received. %v", err))
+		return
+	}
+	storage := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	if storage.String() != "10Gi" || claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName != "gp3" {
+		t.Error(fmt.Sprintf("A claim of 10Gi of gp3 was expected, found %v", claim.Spec))
+	}
+	if len(claim.OwnerReferences) != 1 || claim.OwnerReferences[0].UID != "uid1" || claim.Labels["queryId"] != "qwertyu" {
+		t.Error(fmt.Sprintf("The claim was expected to be owned by the deployment, found %v %v", claim.OwnerReferences, claim.Labels))
+	}
+
+	err = tc.CreateVolumeClaim(stack)
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected for an existing claim but received. %v", err))
+	}
+}
+
+func Test_VolumeClaimHandler_CreateVolumeClaim_NoStorage(t *testing.T) {
+	tc := NewVolumeClaimHandlerTestSuite(&PreviewResourceConfig{})
+	err := tc.CreateVolumeClaim(NewPreviewStack(DownsamplingObject{QueryId: "qwertyu"}))
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected but received. %v", err))
+	}
+	claims, _ := tc.claimsClient.List(context.TODO(), metav1.ListOptions{})
+	if len(claims.Items) != 0 {
+		t.Error(fmt.Sprintf("No claim was expected without a storage size, found %v", claims.Items))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/Shopify/sarama.v1"
+	"time"
+)
+
+// Bump LIFECYCLE_EVENT_VERSION on any change to LifecycleEvent that is not backward compatible for consumers.
+const LIFECYCLE_EVENT_VERSION = 1
+
+const EVENT_PREVIEW_READY = "preview_ready"
+const EVENT_DEPLOYED = "deployed"
+const EVENT_DELETED = "deleted"
+const EVENT_FAILED = "failed"
+const EVENT_EXPIRED = "expired"
+const EVENT_PREVIEW_CANCELLED = "preview_cancelled"
+const EVENT_PREVIEW_EXTENDED = "preview_extended"
+
+type LifecycleEvent struct {
+	Version           int               `json:"version"`
+	Type              string            `json:"type"`
+	Timestamp         string            `json:"timestamp"`
+	Environment       string            `json:"environment"`
+	QueryId           string            `json:"queryId"`
+	Nickname          string            `json:"nickname"`
+	Db                string            `json:"db"`
+	Rp                string            `json:"rp"`
+	Measurement       string            `json:"measurement"`
+	TargetRp          string            `json:"targetRp"`
+	TargetMeasurement string            `json:"targetMeasurement"`
+	Engine            string            `json:"engine,omitempty"`
+	Urls              map[string]string `json:"urls,omitempty"`
+	Message           string            `json:"message,omitempty"`
+}
+
+func NewLifecycleEvent(eventType string, environment string, query DownsamplingObject) LifecycleEvent {
+	return LifecycleEvent{
+		Version:           LIFECYCLE_EVENT_VERSION,
+		Type:              eventType,
+		Timestamp:         time.Now().UTC().Format(time.RFC3339),
+		Environment:       environment,
+		QueryId:           query.QueryId,
+		Nickname:          query.Nickname,
+		Db:                query.Db,
+		Rp:                query.Rp,
+		Measurement:       query.Measurement,
+		TargetRp:          query.TargetRp,
+		TargetMeasurement: query.TargetMeasurement,
+		Engine:            query.Engine,
+	}
+}
+
+func NewFailedLifecycleEvent(environment string, query DownsamplingObject, err error) LifecycleEvent {
+	event := NewLifecycleEvent(EVENT_FAILED, environment, query)
+	event.Message = err.Error()
+	return event
+}
+
+type EventPublisherInterface interface {
+	Publish(event LifecycleEvent) error
+	Close() error
+}
+
+func NewEventPublisher(config *Config) (EventPublisherInterface, error) {
+	if config.KafkaConfig.AuditTopic == "" {
+		log.Println("No audit topic configured, lifecycle events will not be published.")
+		return &NoopEventPublisher{}, nil
+	}
+	return NewKafkaEventPublisher(config)
+}
+
+type NoopEventPublisher struct {
+}
+
+func (p *NoopEventPublisher) Publish(event LifecycleEvent) error {
+	return nil
+}
+
+func (p *NoopEventPublisher) Close() error {
+	return nil
+}
+
+type KafkaEventPublisher struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewKafkaEventPublisher(config *Config) (*KafkaEventPublisher, error) {
+	cluster := config.KafkaConfig.AuditCluster
+	if cluster == "" {
+		cluster = config.KafkaConfig.Sink
+	}
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = sarama.V0_11_0_0
+	saramaConfig.Producer.Return.Successes = true
+	saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	producer, err := sarama.NewSyncProducer([]string{cluster}, saramaConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaEventPublisher{producer: producer, topic: config.KafkaConfig.AuditTopic}, nil
+}
+
+func (p *KafkaEventPublisher) Publish(event LifecycleEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	partition, offset, err := p.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: p.topic,
+		Key:   sarama.StringEncoder(event.QueryId),
+		Value: sarama.ByteEncoder(data),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Lifecycle event %s for query %s published to %s/%d at offset %d", event.Type, event.QueryId, p.topic, partition, offset)
+	return nil
+}
+
+// Close flushes and closes the producer, the publisher cannot be used afterwards.
+func (p *KafkaEventPublisher) Close() error {
+	return p.producer.Close()
+}
+
+// publishLifecycleEvent never fails the calling job, a lost audit event is only logged.
+func publishLifecycleEvent(publisher EventPublisherInterface, event LifecycleEvent) {
+	log.Printf("Publishing %s event for query %s...", event.Type, event.QueryId)
+	if err := publisher.Publish(event); err != nil {
+		log.Printf("Could not publish lifecycle event: %v", err)
+	}
+}
+
+// closeEventPublisher is deferred by the jobs publishing events, like a lost event a failed close is only logged.
+func closeEventPublisher(publisher EventPublisherInterface) {
+	if err := publisher.Close(); err != nil {
+		log.Printf("Could not close the lifecycle event publisher: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/Shopify/sarama.v1"
+	"gopkg.in/Shopify/sarama.v1/mocks"
+	"testing"
+)
+
+type InMemoryEventPublisher struct {
+	Events []LifecycleEvent
+	Closed bool
+}
+
+func (p *InMemoryEventPublisher) Publish(event LifecycleEvent) error {
+	p.Events = append(p.Events, event)
+	return nil
+}
+
+func (p *InMemoryEventPublisher) Close() error {
+	p.Closed = true
+	return nil
+}
+
+func (p *InMemoryEventPublisher) AssertPublished(eventType string, queryId string, t *testing.T) {
+	for _, e := range p.Events {
+		if e.Type == eventType && e.QueryId == queryId {
+			return
+		}
+	}
+	t.Error(fmt.Sprintf("Event %s for query %s was expected but not published, found %v", eventType, queryId, p.Events))
+}
+
+func Test_LifecycleEvent_NewFailedLifecycleEvent(t *testing.T) {
+	event := NewFailedLifecycleEvent("test", DownsamplingObject{QueryId: "query1", Db: "sca", Measurement: "request_count"}, errors.New("flink is down"))
+	if event.Version != LIFECYCLE_EVENT_VERSION || event.Type != EVENT_FAILED || event.Environment != "test" {
+		t.Error(fmt.Sprintf("Unexpected event header: %v", event))
+	}
+	if event.QueryId != "query1" || event.Db != "sca" || event.Measurement != "request_count" || event.Message != "flink is down" {
+		t.Error(fmt.Sprintf("Unexpected event body: %v", event))
+	}
+}
+
+func Test_KafkaEventPublisher_Publish(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		var event LifecycleEvent
+		if err := json.Unmarshal(val, &event); err != nil {
+			return err
+		}
+		if event.Type != EVENT_PREVIEW_READY || event.Urls["grafana"] != "http://grafana" {
+			return errors.New(fmt.Sprintf("unexpected event %s", string(val)))
+		}
+		return nil
+	})
+	sut := &KafkaEventPublisher{producer: producer, topic: "audit"}
+	event := NewLifecycleEvent(EVENT_PREVIEW_READY, "test", DownsamplingObject{QueryId: "query1"})
+	event.Urls = map[string]string{"grafana": "http://grafana"}
+	err := sut.Publish(event)
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected but received - %v", err))
+	}
+	err = sut.Close()
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected when closing but received - %v", err))
+	}
+}
+
+func Test_KafkaEventPublisher_Publish_Error(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	sut := &KafkaEventPublisher{producer: producer, topic: "audit"}
+	err := sut.Publish(NewLifecycleEvent(EVENT_DEPLOYED, "test", DownsamplingObject{QueryId: "query1"}))
+	if err == nil {
+		t.Error(fmt.Sprintf("Was expecting error but not received"))
+	}
+	producer.Close()
+}
+
+func Test_NewEventPublisher_NoTopic(t *testing.T) {
+	publisher, err := NewEventPublisher(&Config{KafkaConfig: &KafkaConfig{}})
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected but received - %v", err))
+	}
+	if _, ok := publisher.(*NoopEventPublisher); !ok {
+		t.Error(fmt.Sprintf("A no-op publisher was expected when no audit topic is configured"))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
 	"os"
 	"time"
 )
@@ -11,16 +12,20 @@ import (
 var PARAMS = GetParams()
 
 type PARAM struct {
-	mode                 string
-	operation            string
-	queryId              string
-	MODE_LOCAL           string
-	MODE_IN_CLUSTER      string
-	OPERATION_COORDINATE string
-	OPERATION_SIMULATE   string
-	OPERATION_DEPLOY     string
-	OPERATION_DELETE     string
-	OPERATION_EXPIRE     string
+	mode                     string
+	operation                string
+	queryId                  string
+	minutes                  string
+	MODE_LOCAL               string
+	MODE_IN_CLUSTER          string
+	OPERATION_COORDINATE     string
+	OPERATION_SIMULATE       string
+	OPERATION_DEPLOY         string
+	OPERATION_DELETE         string
+	OPERATION_EXPIRE         string
+	OPERATION_REPORT         string
+	OPERATION_CANCEL_PREVIEW string
+	OPERATION_EXTEND_PREVIEW string
 }
 
 func GetParams() *PARAM {
@@ -33,6 +38,8 @@ func GetParams() *PARAM {
 			params.operation = p
 		case 3:
 			params.queryId = p
+		case 4:
+			params.minutes = p
 		}
 	}
 	params.MODE_IN_CLUSTER = "in-cluster"
@@ -42,6 +49,9 @@ func GetParams() *PARAM {
 	params.OPERATION_DEPLOY = "deploy"
 	params.OPERATION_DELETE = "delete"
 	params.OPERATION_EXPIRE = "expire"
+	params.OPERATION_REPORT = "report"
+	params.OPERATION_CANCEL_PREVIEW = "cancel-preview"
+	params.OPERATION_EXTEND_PREVIEW = "extend-preview"
 	return &params
 }
 
@@ -54,7 +64,7 @@ func main() {
 	var CONFIG *Config
 	var METRICS *Metrics
 
-	log.Printf("Received Params – mode: %s, operation: %s, queryId: %s", PARAMS.mode, PARAMS.operation, PARAMS.queryId)
+	log.Printf("Received Params – mode: %s, operation: %s, queryId: %s, minutes: %s", PARAMS.mode, PARAMS.operation, PARAMS.queryId, PARAMS.minutes)
 	Error(ValidateParams())
 
 	CONFIG, err1 := NewConfig(PARAMS.mode)
@@ -82,8 +92,8 @@ func ValidateParams() error {
 	if PARAMS.mode != PARAMS.MODE_LOCAL && PARAMS.mode != PARAMS.MODE_IN_CLUSTER {
 		return errors.New(fmt.Sprintf("invalid mode, must be - %s, %s", PARAMS.MODE_LOCAL, PARAMS.MODE_IN_CLUSTER))
 	}
-	if PARAMS.operation != PARAMS.OPERATION_COORDINATE && PARAMS.operation != PARAMS.OPERATION_SIMULATE && PARAMS.operation != PARAMS.OPERATION_DEPLOY && PARAMS.operation != PARAMS.OPERATION_DELETE && PARAMS.operation != PARAMS.OPERATION_EXPIRE {
-		return errors.New(fmt.Sprintf("invalid operation, must be - $s/%s/%s/%s/%s", PARAMS.OPERATION_COORDINATE, PARAMS.OPERATION_SIMULATE, PARAMS.OPERATION_DEPLOY, PARAMS.OPERATION_DELETE, PARAMS.OPERATION_EXPIRE))
+	if PARAMS.operation != PARAMS.OPERATION_COORDINATE && PARAMS.operation != PARAMS.OPERATION_SIMULATE && PARAMS.operation != PARAMS.OPERATION_DEPLOY && PARAMS.operation != PARAMS.OPERATION_DELETE && PARAMS.operation != PARAMS.OPERATION_EXPIRE && PARAMS.operation != PARAMS.OPERATION_REPORT && PARAMS.operation != PARAMS.OPERATION_CANCEL_PREVIEW && PARAMS.operation != PARAMS.OPERATION_EXTEND_PREVIEW {
+		return errors.New(fmt.Sprintf("invalid operation, must be - %s/%s/%s/%s/%s/%s/%s/%s", PARAMS.OPERATION_COORDINATE, PARAMS.OPERATION_SIMULATE, PARAMS.OPERATION_DEPLOY, PARAMS.OPERATION_DELETE, PARAMS.OPERATION_EXPIRE, PARAMS.OPERATION_REPORT, PARAMS.OPERATION_CANCEL_PREVIEW, PARAMS.OPERATION_EXTEND_PREVIEW))
 	}
 	return nil
 }
@@ -102,6 +112,12 @@ func DefineJob(CONFIG *Config, METRICS *Metrics) (DownsampleJobInterface, error)
 		job, err = NewDeployPreviewJob(CONFIG, METRICS)
 	case PARAMS.OPERATION_EXPIRE:
 		job, err = NewDeletePreviewJob(CONFIG, METRICS)
+	case PARAMS.OPERATION_REPORT:
+		job, err = NewPreviewReportJob(CONFIG, METRICS)
+	case PARAMS.OPERATION_CANCEL_PREVIEW:
+		job, err = NewCancelPreviewJob(CONFIG, METRICS)
+	case PARAMS.OPERATION_EXTEND_PREVIEW:
+		job, err = NewExtendPreviewJob(CONFIG, METRICS)
 	default:
 		err = errors.New("Invalid option " + PARAMS.operation + ", must not reach here!")
 	}
@@ -115,9 +131,15 @@ func handleError(err error, metrics *Metrics) {
 	}
 }
 
+// The coordinator records what is written here on the item of the job, see JobHandler.GetJobOutcome.
+const TERMINATION_MESSAGE_PATH = "/dev/termination-log"
+
 func Error(err error) {
 	if err != nil {
 		log.Printf("An error has occurred. Details as follows – %v", err)
+		if PARAMS != nil && PARAMS.mode == PARAMS.MODE_IN_CLUSTER {
+			ioutil.WriteFile(TERMINATION_MESSAGE_PATH, []byte(err.Error()), 0644)
+		}
 		time.Sleep(7 * time.Second)
 		log.Println("Exiting...")
 		os.Exit(1)
@@ -62,6 +62,24 @@ var MainTestCases = []MainTestSuite{
 		"operation:expire",
 		"",
 	},
+	{
+		"local",
+		"report",
+		"operation:report",
+		"",
+	},
+	{
+		"local",
+		"cancel-preview",
+		"operation:cancel-preview",
+		"",
+	},
+	{
+		"local",
+		"extend-preview",
+		"operation:extend-preview",
+		"",
+	},
 	{
 		"local",
 		"crap",
@@ -73,7 +91,7 @@ var MainTestCases = []MainTestSuite{
 func Test_Main_ValidateParams(t *testing.T) {
 	for _, testCase := range MainTestCases {
 		t.Run(testCase.label, func(t *testing.T) {
-			PARAMS = &PARAM{MODE_IN_CLUSTER: "in-cluster", MODE_LOCAL: "local", OPERATION_COORDINATE: "coordinate", OPERATION_SIMULATE: "simulate", OPERATION_DEPLOY: "deploy", OPERATION_DELETE: "delete", OPERATION_EXPIRE: "expire", mode: testCase.mode, operation: testCase.operation}
+			PARAMS = &PARAM{MODE_IN_CLUSTER: "in-cluster", MODE_LOCAL: "local", OPERATION_COORDINATE: "coordinate", OPERATION_SIMULATE: "simulate", OPERATION_DEPLOY: "deploy", OPERATION_DELETE: "delete", OPERATION_EXPIRE: "expire", OPERATION_REPORT: "report", OPERATION_CANCEL_PREVIEW: "cancel-preview", OPERATION_EXTEND_PREVIEW: "extend-preview", mode: testCase.mode, operation: testCase.operation}
 			err := ValidateParams()
 			testCase.AssertErrorNotExpected(err, t)
 			testCase.AssertError(err, t)
@@ -12,6 +12,8 @@ type Metrics struct {
 	Error       metrics.Gauge
 	ExpireCount metrics.Counter
 	Duration    metrics.Gauge
+	// AnnotationErrors counts Grafana annotations that could not be added, they do not fail the job
+	AnnotationErrors metrics.Counter
 }
 
 func (m *Metrics) startMetrics(r metrics.Registry, config Config, params PARAM) {
@@ -35,6 +37,8 @@ func NewMetrics(config Config, param PARAM) *Metrics {
 	r.Register("downsampling.controller.error", m.Error)
 	m.ExpireCount = metrics.NewCounter()
 	r.Register("downsampling.controller.expiredCount", m.ExpireCount)
+	m.AnnotationErrors = metrics.NewCounter()
+	r.Register("downsampling.controller.annotationErrors", m.AnnotationErrors)
 
 	metrics.RegisterDebugGCStats(r)
 	go metrics.CaptureDebugGCStats(r, 5e9)
@@ -54,6 +58,10 @@ func (m *Metrics) IncrementExpiredCount() {
 	m.ExpireCount.Inc(1)
 }
 
+func (m *Metrics) IncrementAnnotationErrors() {
+	m.AnnotationErrors.Inc(1)
+}
+
 func (m *Metrics) ReportError() {
 	m.Error.Update(1)
 }
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The end to end tests run the preview jobs with their real handlers, against the fake clientset of client-go
+// and httptest servers standing in for Flink, Grafana and the InfluxDB of the preview.
+
+type FakeK8Client struct {
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+}
+
+func (k8 *FakeK8Client) GetClientSet() kubernetes.Interface {
+	return k8.clientset
+}
+
+func (k8 *FakeK8Client) GetDynamicClient() dynamic.Interface {
+	return k8.dynamicClient
+}
+
+// NewEndToEndClientset serves apps/v1 deployments and networking.k8s.io/v1 ingresses,
+// deployments are available as soon as they are created since there is no controller to roll them out.
+func NewEndToEndClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: DEPLOYMENT_API_APPS_V1, APIResources: []metav1.APIResource{{Name: "deployments"}}},
+		{GroupVersion: INGRESS_API_NETWORKING_V1, APIResources: []metav1.APIResource{{Name: "ingresses"}}},
+	}
+	clientset.PrependReactor("create", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		deployment := action.(k8stesting.CreateAction).GetObject().(*appsv1.Deployment)
+		deployment.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue}}
+		return false, nil, nil
+	})
+	return clientset
+}
+
+// InMemoryDb keeps the items by query id, unlike MockDb it answers each query with the items in its states.
+type InMemoryDb struct {
+	mutex sync.Mutex
+	items map[string]DownsamplingObject
+}
+
+func NewInMemoryDb(items ...DownsamplingObject) *InMemoryDb {
+	db := &InMemoryDb{items: map[string]DownsamplingObject{}}
+	for _, item := range items {
+		db.items[item.QueryId] = item
+	}
+	return db
+}
+
+func (d *InMemoryDb) itemsInStates(states ...string) ([]DownsamplingObject, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var items []DownsamplingObject
+	for _, item := range d.items {
+		for _, state := range states {
+			if item.QueryState == state {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, nil
+}
+
+func (d *InMemoryDb) GetAllToDoItems() ([]DownsamplingObject, error) {
+	return d.itemsInStates("PENDING", "PREVIEW_PENDING", "DELETED", "PREVIEW_CANCEL_PENDING", "PREVIEW_EXTEND_PENDING")
+}
+
+func (d *InMemoryDb) GetPendingDownsamplePreviewItems() ([]DownsamplingObject, error) {
+	return d.itemsInStates("PREVIEW_PENDING")
+}
+
+func (d *InMemoryDb) GetPendingDownsampleItems() ([]DownsamplingObject, error) {
+	return d.itemsInStates("PENDING")
+}
+
+func (d *InMemoryDb) GetDeployedDownsamplePreviewItems() ([]DownsamplingObject, error) {
+	return d.itemsInStates("PREVIEW_DEPLOYED")
+}
+
+func (d *InMemoryDb) GetDeletedDownsampleItems() ([]DownsamplingObject, error) {
+	return d.itemsInStates("DELETED")
+}
+
+func (d *InMemoryDb) DeleteDownsamplingItem(queryId string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.items, queryId)
+	return nil
+}
+
+func (d *InMemoryDb) GetDownsamplingItem(queryId string) (DownsamplingObject, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.items[queryId], nil
+}
+
+func (d *InMemoryDb) UpdateDownsamplingItem(DownsampleObject DownsamplingObject) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.items[DownsampleObject.QueryId] = DownsampleObject
+	return "success", nil
+}
+
+// FakeFlink runs the jobs submitted with the jar of the downsampler until they are cancelled.
+type FakeFlink struct {
+	server    *httptest.Server
+	mutex     sync.Mutex
+	jobs      map[string]string
+	cancelled []string
+}
+
+func NewFakeFlink() *FakeFlink {
+	f := &FakeFlink{jobs: map[string]string{}}
+	h := http.NewServeMux()
+	h.HandleFunc("/jars/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"files": [{"id": "jar1", "name": "flink-line-protocol-downsampler.jar"}]}`))
+			return
+		}
+		args := strings.Fields(r.URL.Query().Get("program-args"))
+		for i, arg := range args {
+			if arg == "--jobName" && i+1 < len(args) {
+				f.mutex.Lock()
+				f.jobs[fmt.Sprintf("flinkjob%d", len(f.jobs)+len(f.cancelled)+1)] = args[i+1]
+				f.mutex.Unlock()
+			}
+		}
+		w.Write([]byte(`{"jobid": "flinkjob"}`))
+	})
+	h.HandleFunc("/joboverview/running", func(w http.ResponseWriter, r *http.Request) {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		jobs := []map[string]interface{}{}
+		for id, name := range f.jobs {
+			jobs = append(jobs, map[string]interface{}{"jid": id, "name": name, "start-time": time.Now().Unix() * 1000})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobs})
+	})
+	h.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/cancel")
+		f.mutex.Lock()
+		delete(f.jobs, id)
+		f.cancelled = append(f.cancelled, id)
+		f.mutex.Unlock()
+		w.Write([]byte(`{}`))
+	})
+	f.server = httptest.NewServer(h)
+	return f
+}
+
+func (f *FakeFlink) Config() *FlinkConfig {
+	return &FlinkConfig{FlinkJarsUrl: f.server.URL + "/jars/", FlinkJobsUrl: f.server.URL + "/joboverview/running", FlinkJobDeleteUrl: f.server.URL + "/jobs"}
+}
+
+func (f *FakeFlink) JobNames() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var names []string
+	for _, name := range f.jobs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// FakeHttpServer answers every request with the body of its path, or with the default body, and keeps the requests it got.
+type FakeHttpServer struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	requests []string
+}
+
+func NewFakeHttpServer(bodies map[string]string, defaultBody string) *FakeHttpServer {
+	s := &FakeHttpServer{}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("q"))
+		s.mutex.Unlock()
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if body, ok := bodies[r.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.Write([]byte(defaultBody))
+	}))
+	return s
+}
+
+func (s *FakeHttpServer) Received(request string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, r := range s.requests {
+		if strings.HasPrefix(r, request) {
+			return true
+		}
+	}
+	return false
+}
+
+// EndToEndIngressHandler creates the ingresses, but hands out the urls of the fakes since the ingress hosts do not resolve here.
+type EndToEndIngressHandler struct {
+	*IngressHandler
+	influxdbUrl string
+	grafanaUrl  string
+}
+
+func (s *EndToEndIngressHandler) CreateIngress(stack *PreviewStack) (string, string, error) {
+	if _, _, err := s.IngressHandler.CreateIngress(stack); err != nil {
+		return "", "", err
+	}
+	return s.influxdbUrl, s.grafanaUrl, nil
+}
+
+type PreviewEndToEndTestSuite struct {
+	DeployPreviewJob *DeployPreviewJob
+	DeletePreviewJob *DeletePreviewJob
+	Clientset        *fake.Clientset
+	Db               *InMemoryDb
+	Flink            *FakeFlink
+	Influxdb         *FakeHttpServer
+	Grafana          *FakeHttpServer
+	EventPublisher   *InMemoryEventPublisher
+}
+
+func NewPreviewEndToEndTestSuite(t *testing.T, items ...DownsamplingObject) *PreviewEndToEndTestSuite {
+	tc := &PreviewEndToEndTestSuite{
+		Clientset:      NewEndToEndClientset(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "downsamplr-controller-test", Namespace: "testns", UID: "jobuid"}}),
+		Db:             NewInMemoryDb(items...),
+		Flink:          NewFakeFlink(),
+		Influxdb:       NewFakeHttpServer(map[string]string{}, `{"results": [{"statement_id": 0}]}`),
+		Grafana:        NewFakeHttpServer(map[string]string{"/api/health": `{"database": "ok"}`}, `{"status": "success"}`),
+		EventPublisher: &InMemoryEventPublisher{},
+	}
+	config := &Config{Environment: "test", Namespace: "testns", ExpireAfterMinute: 45, ReadyTimeoutMinute: 1, MetricsConfig: &MetricsConfig{}, FlinkConfig: tc.Flink.Config(),
+		KafkaConfig: &KafkaConfig{Source: "source"}, PreviewIngress: &IngressConfig{Domain: "preview.test", Scheme: "http"}, JobName: "downsamplr-controller-test"}
+	metrics := NewMetrics(*config, PARAM{})
+	k8client := &FakeK8Client{clientset: tc.Clientset}
+	itemHandler := &DownsamplingItemHandler{db: tc.Db, config: config, Metrics: metrics}
+
+	deployments, err := NewDeploymentHandler(k8client, config, metrics)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Deployment handler could not be created - %v", err))
+	}
+	ingresses, err := NewIngressHandler(k8client, config, metrics)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Ingress handler could not be created - %v", err))
+	}
+	services, _ := NewServiceHandler(k8client, config, metrics)
+	secrets, _ := NewSecretHandler(k8client, config, metrics)
+	claims, _ := NewVolumeClaimHandler(k8client, config, metrics)
+	flinkJobHandler := NewFlinkJobHandler(config, metrics)
+	events := NewEventRecorder(k8client, config)
+
+	tc.DeployPreviewJob = &DeployPreviewJob{flinkJobHandler: flinkJobHandler, k8DeploymentHandler: deployments, k8ServiceHandler: services,
+		k8IngressHandler: &EndToEndIngressHandler{ingresses, tc.Influxdb.server.URL, tc.Grafana.server.URL}, k8SecretHandler: secrets, k8VolumeClaimHandler: claims,
+		itemHandler: itemHandler, config: config, metrics: metrics, kafkaClient: &FakeKafkaClient{}, eventPublisher: tc.EventPublisher,
+		queryValidator: &NoopQueryValidator{}, previewSeeder: &NoopPreviewSeeder{}, events: events}
+	tc.DeletePreviewJob = &DeletePreviewJob{flinkJobHandler: flinkJobHandler, k8DeploymentHandler: deployments, k8ServiceHandler: services, k8IngressHandler: ingresses,
+		k8SecretHandler: secrets, itemHandler: itemHandler, config: config, Metrics: metrics, eventPublisher: tc.EventPublisher, previewExporter: &NoopPreviewExporter{}, events: events}
+	return tc
+}
+
+func (tc *PreviewEndToEndTestSuite) Close() {
+	tc.Flink.server.Close()
+	tc.Influxdb.server.Close()
+	tc.Grafana.server.Close()
+}
+
+// AssertOwnedByStack checks the object is there and goes with the deployment of the stack.
+func AssertOwnedByStack(kind string, meta metav1.ObjectMeta, err error, t *testing.T) {
+	if err != nil {
+		t.Error(fmt.Sprintf("The %s of the stack was expected to be created - %v", kind, err))
+	} else if len(meta.OwnerReferences) != 1 || meta.OwnerReferences[0].Name != "downsamplr-preview-query1" {
+		t.Error(fmt.Sprintf("The %s was expected to be owned by the deployment, found %v", kind, meta.OwnerReferences))
+	}
+}
+
+func Test_PreviewEndToEnd_DeployAndExpire(t *testing.T) {
+	var query DownsamplingObject
+	json.Unmarshal([]byte(`{"queryId": "query1", "queryState": "PREVIEW_PENDING", "db": "sca", "rp": "autogen", "measurement": "request_count", "tags": ["app_name"],
+	  "fields": [{"alias": "sum_count", "field": "count", "func": "SUM"}], "interval": 60, "targetRp": "downsample", "targetMeasurement": "request_count_by_scenario"}`), &query)
+	tc := NewPreviewEndToEndTestSuite(t, query)
+	defer tc.Close()
+	ctx := context.TODO()
+
+	err := tc.DeployPreviewJob.Execute(PARAM{queryId: "query1"})
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+
+	deployed, _ := tc.Db.GetDownsamplingItem("query1")
+	if deployed.QueryState != "PREVIEW_DEPLOYED" || deployed.PreviewInfluxdbUrl != tc.Influxdb.server.URL || deployed.PreviewGrafanaUrl != tc.Grafana.server.URL {
+		t.Error(fmt.Sprintf("Query was expected PREVIEW_DEPLOYED with the urls of the stack, found %s with %s and %s", deployed.QueryState, deployed.PreviewInfluxdbUrl, deployed.PreviewGrafanaUrl))
+	}
+	if _, err := tc.Clientset.AppsV1().Deployments("testns").Get(ctx, "downsamplr-preview-query1", metav1.GetOptions{}); err != nil {
+		t.Error(fmt.Sprintf("The deployment of the stack was expected to be created - %v", err))
+	}
+	service, err := tc.Clientset.CoreV1().Services("testns").Get(ctx, "downsamplr-preview-query1", metav1.GetOptions{})
+	AssertOwnedByStack("service", service.ObjectMeta, err, t)
+	ingress, err := tc.Clientset.NetworkingV1().Ingresses("testns").Get(ctx, "downsamplr-preview-query1", metav1.GetOptions{})
+	AssertOwnedByStack("ingress", ingress.ObjectMeta, err, t)
+	if err == nil && (len(ingress.Spec.Rules) == 0 || ingress.Spec.Rules[0].Host != "downsamplr-preview-query1.influx.preview.test") {
+		t.Error(fmt.Sprintf("The ingress was expected to expose influx on the preview domain, found %v", ingress.Spec.Rules))
+	}
+	if deployed.PreviewCredentials == nil {
+		t.Error("The deployed preview was expected to keep its credentials")
+	} else {
+		secret, err := tc.Clientset.CoreV1().Secrets("testns").Get(ctx, deployed.PreviewCredentials.SecretName, metav1.GetOptions{})
+		AssertOwnedByStack("secret", secret.ObjectMeta, err, t)
+	}
+
+	if !tc.Influxdb.Received(`GET /query CREATE DATABASE "sca"`) && !tc.Influxdb.Received(`POST /query CREATE DATABASE "sca"`) {
+		t.Error(fmt.Sprintf("The preview database was expected to be created, InfluxDB received %v", tc.Influxdb.requests))
+	}
+	if !tc.Grafana.Received("POST /api/datasources") || !tc.Grafana.Received("POST /api/dashboards/db") {
+		t.Error(fmt.Sprintf("The datasource and the dashboard were expected to be created, Grafana received %v", tc.Grafana.requests))
+	}
+	if names := tc.Flink.JobNames(); len(names) != 1 || !strings.HasPrefix(names[0], "simulate:query1:") {
+		t.Error(fmt.Sprintf("The simulation Flink job was expected to run, found %v", names))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_PREVIEW_READY, "query1", t)
+
+	// the recorder writes the events in the background
+	expected := []string{REASON_PREVIEW_AVAILABLE, REASON_GRAFANA_PROVISIONED, REASON_FLINK_JOB_SUBMITTED, "PreviewReady"}
+	reasons := map[string]bool{}
+	for i := 0; i < 50 && len(reasons) < len(expected); i++ {
+		time.Sleep(100 * time.Millisecond)
+		events, _ := tc.Clientset.CoreV1().Events("testns").List(ctx, metav1.ListOptions{})
+		for _, event := range events.Items {
+			if event.InvolvedObject.Kind == "Job" && event.InvolvedObject.UID == "jobuid" {
+				reasons[event.Reason] = true
+			}
+		}
+	}
+	for _, reason := range expected {
+		if !reasons[reason] {
+			t.Error(fmt.Sprintf("Event %s was expected on the job, found %v", reason, reasons))
+		}
+	}
+
+	deployed.PreviewExpiresAt = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	tc.Db.UpdateDownsamplingItem(deployed)
+	err = tc.DeletePreviewJob.Execute(PARAM{})
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+
+	if _, err := tc.Clientset.AppsV1().Deployments("testns").Get(ctx, "downsamplr-preview-query1", metav1.GetOptions{}); err == nil {
+		t.Error("The deployment of the expired stack was expected to be deleted")
+	}
+	if names := tc.Flink.JobNames(); len(names) != 0 || len(tc.Flink.cancelled) != 1 {
+		t.Error(fmt.Sprintf("The simulation Flink job was expected to be cancelled, found %v running", names))
+	}
+	if expired, _ := tc.Db.GetDownsamplingItem("query1"); expired.QueryId != "" {
+		t.Error(fmt.Sprintf("The expired query was expected to be deleted, found %s", expired.QueryState))
+	}
+	tc.EventPublisher.AssertPublished(EVENT_EXPIRED, "query1", t)
+}
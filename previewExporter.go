@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+type PreviewExporterInterface interface {
+	Export(query DownsamplingObject) (string, error)
+}
+
+func NewPreviewExporter(config *Config) (PreviewExporterInterface, error) {
+	if config.Artifacts == nil || config.Artifacts.Store == "" {
+		log.Println("No artifact store configured, previews will not be exported.")
+		return &NoopPreviewExporter{}, nil
+	}
+
+	store, err := NewArtifactStore(config.Artifacts)
+	if err != nil {
+		return nil, err
+	}
+	// no up check, an expiring preview that does not answer is not waited for
+	timeout := config.Artifacts.ExportTimeout()
+	previewInflux := func(query DownsamplingObject) (InfluxdbInterface, error) {
+		user, password := PreviewInfluxdbCredentials(config, query)
+		return NewInfluxdbWithTimeout(query.PreviewInfluxdbUrl, user, password, timeout)
+	}
+	previewGrafana := func(query DownsamplingObject) GrafanaInterface {
+		user, password := "admin", "admin"
+		if query.PreviewCredentials != nil {
+			user, password = query.PreviewCredentials.GrafanaUser, query.PreviewCredentials.GrafanaPassword
+		}
+		grafanaClient := NewGrafanaClient(user, password)
+		grafanaClient.grafanaClient.Timeout = timeout
+		return &Grafana{grafanaBaseURL: query.PreviewGrafanaUrl, grafanaClient: grafanaClient}
+	}
+
+	return &PreviewExporter{store, previewInflux, previewGrafana, config.Artifacts.MaxRows, timeout}, nil
+}
+
+type NoopPreviewExporter struct {
+}
+
+func (e *NoopPreviewExporter) Export(query DownsamplingObject) (string, error) {
+	return "", nil
+}
+
+type PreviewExporter struct {
+	store          ArtifactStoreInterface
+	previewInflux  func(query DownsamplingObject) (InfluxdbInterface, error)
+	previewGrafana func(query DownsamplingObject) GrafanaInterface
+	maxRows        int
+	timeout        time.Duration
+}
+
+type exportResult struct {
+	location string
+	err      error
+}
+
+// Export keeps the preview dashboard and the downsampled data under the query id, it returns where they were stored.
+// It gives up after the export timeout, leaving what was already stored behind.
+func (e *PreviewExporter) Export(query DownsamplingObject) (string, error) {
+	if e.timeout <= 0 {
+		return e.export(query)
+	}
+
+	result := make(chan exportResult, 1)
+	go func() {
+		location, err := e.export(query)
+		result <- exportResult{location, err}
+	}()
+	select {
+	case r := <-result:
+		return r.location, r.err
+	case <-time.After(e.timeout):
+		return "", fmt.Errorf("export of preview %s did not complete in %v", query.QueryId, e.timeout)
+	}
+}
+
+func (e *PreviewExporter) export(query DownsamplingObject) (string, error) {
+	log.Printf("Exporting dashboard of preview %s...", query.QueryId)
+	dashboard, err := e.previewGrafana(query).GetDashboard(PreviewDashboardUid(query))
+	if err != nil {
+		return "", err
+	}
+	err = e.store.Put(query.QueryId+"/dashboard.json", dashboard, "application/json")
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Exporting data of preview %s...", query.QueryId)
+	data, err := e.exportData(query)
+	if err != nil {
+		return "", err
+	}
+	err = e.store.Put(query.QueryId+"/"+query.TargetMeasurement+".csv", data, "text/csv")
+	if err != nil {
+		return "", err
+	}
+
+	return e.store.Location(query.QueryId), nil
+}
+
+// exportData returns the most recent maxRows downsampled points of the preview as CSV, a column per tag then
+// a column per field, oldest first.
+func (e *PreviewExporter) exportData(query DownsamplingObject) ([]byte, error) {
+	preview, err := e.previewInflux(query)
+	if err != nil {
+		return nil, err
+	}
+
+	to := time.Now()
+	from, err := time.Parse(time.RFC3339, query.PreviewDeployedAt)
+	if err != nil {
+		from = to.Add(-24 * time.Hour)
+	}
+	fieldTypes := make(map[string]string)
+	var fields []string
+	for _, field := range query.Fields {
+		fieldTypes[field.Alias] = "float"
+		fields = append(fields, field.Alias)
+	}
+	sort.Strings(fields)
+
+	points, err := preview.ReadPoints(query.Db, PREVIEW_RP, query.TargetMeasurement, fieldTypes, from, to, e.maxRows)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == e.maxRows {
+		log.Printf("Export of %s cut to the %d most recent rows.", query.QueryId, e.maxRows)
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+
+	tags := append([]string{}, query.Tags...)
+	sort.Strings(tags)
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Write(append(append([]string{"time"}, tags...), fields...))
+	for _, point := range points {
+		row := []string{point.Time.UTC().Format(time.RFC3339Nano)}
+		for _, tag := range tags {
+			row = append(row, point.Tags[tag])
+		}
+		for _, field := range fields {
+			value, ok := point.Fields[field]
+			if !ok {
+				row = append(row, "")
+				continue
+			}
+			row = append(row, fmt.Sprint(value))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+type FakeExportInfluxdb struct {
+	*FakeSchemaInfluxdb
+	points []InfluxdbPoint
+	reads  []string
+}
+
+func (i *FakeExportInfluxdb) ReadPoints(db string, rp string, measurement string, fieldTypes map[string]string, from time.Time, to time.Time, limit int) ([]InfluxdbPoint, error) {
+	i.reads = append(i.reads, fmt.Sprintf("%s.%s.%s %d", db, rp, measurement, limit))
+	points := append([]InfluxdbPoint{}, i.points...)
+	sort.SliceStable(points, func(a, b int) bool {
+		return points[a].Time.After(points[b].Time)
+	})
+	if len(points) > limit {
+		points = points[:limit]
+	}
+	return points, i.err
+}
+
+func NewPreviewExporterForTest(maxRows int, points []InfluxdbPoint) (*PreviewExporter, *FakeArtifactStore, *FakeGrafana, *FakeExportInfluxdb) {
+	store, grafana := &FakeArtifactStore{}, &FakeGrafana{}
+	preview := &FakeExportInfluxdb{FakeSchemaInfluxdb: &FakeSchemaInfluxdb{}, points: points}
+	previewInflux := func(query DownsamplingObject) (InfluxdbInterface, error) {
+		return preview, nil
+	}
+	previewGrafana := func(query DownsamplingObject) GrafanaInterface {
+		return grafana
+	}
+	return &PreviewExporter{store, previewInflux, previewGrafana, maxRows, 0}, store, grafana, preview
+}
+
+func getPointsForExport() []InfluxdbPoint {
+	t := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	return []InfluxdbPoint{
+		{Measurement: "request_count_1m", Tags: map[string]string{"app_name": "api", "scenario": "b"}, Fields: map[string]interface{}{"sum_count": 3.0}, Time: t.Add(time.Minute)},
+		{Measurement: "request_count_1m", Tags: map[string]string{"app_name": "api", "scenario": "a"}, Fields: map[string]interface{}{"sum_count": 5.0, "last_status": 200.0}, Time: t},
+	}
+}
+
+func Test_PreviewExporter_Export(t *testing.T) {
+	sut, store, grafana, preview := NewPreviewExporterForTest(100, getPointsForExport())
+	query := getQueryForValidation()
+	query.TargetMeasurement = "request_count_1m"
+
+	location, err := sut.Export(query)
+	if err != nil || location != "fake://query1" {
+		t.Error(fmt.Sprintf("Preview was expected to be exported to fake://query1, found %s (%v)", location, err))
+	}
+	if grafana.calls[0] != "get preview-query1" || store.files["query1/dashboard.json"] == "" {
+		t.Error(fmt.Sprintf("Preview dashboard was expected to be exported, found %v %v", grafana.calls, store.files))
+	}
+	if preview.reads[0] != "sca.downsample.request_count_1m 100" {
+		t.Error(fmt.Sprintf("Preview data was expected to be read from the preview policy, found %v", preview.reads))
+	}
+	expected := "time,app_name,scenario,last_status,sum_count\n" +
+		"2026-10-19T12:00:00Z,api,a,200,5\n" +
+		"2026-10-19T12:01:00Z,api,b,,3\n"
+	if csv := store.files["query1/request_count_1m.csv"]; csv != expected {
+		t.Error(fmt.Sprintf("CSV was expected to be\n%s\nfound\n%s", expected, csv))
+	}
+}
+
+func Test_PreviewExporter_Export_MaxRows(t *testing.T) {
+	sut, store, _, _ := NewPreviewExporterForTest(1, getPointsForExport())
+	query := getQueryForValidation()
+	query.TargetMeasurement = "request_count_1m"
+
+	_, err := sut.Export(query)
+	if csv := store.files["query1/request_count_1m.csv"]; err != nil || csv != "time,app_name,scenario,last_status,sum_count\n2026-10-19T12:01:00Z,api,b,,3\n" {
+		t.Error(fmt.Sprintf("CSV was expected to be cut to the most recent row, found %s (%v)", csv, err))
+	}
+}
+
+func Test_PreviewExporter_Export_Error(t *testing.T) {
+	sut, store, grafana, _ := NewPreviewExporterForTest(100, nil)
+	grafana.err = errors.New("dashboard not found")
+
+	location, err := sut.Export(getQueryForValidation())
+	if err == nil || location != "" || len(store.files) != 0 {
+		t.Error(fmt.Sprintf("Export was expected to fail without a location, found %s %v (%v)", location, store.files, err))
+	}
+}
+
+func Test_PreviewExporter_Export_Timeout(t *testing.T) {
+	sut, store, _, _ := NewPreviewExporterForTest(100, getPointsForExport())
+	sut.timeout = 50 * time.Millisecond
+	sut.previewInflux = func(query DownsamplingObject) (InfluxdbInterface, error) {
+		time.Sleep(time.Second)
+		return nil, errors.New("preview is gone")
+	}
+
+	start := time.Now()
+	location, err := sut.Export(getQueryForValidation())
+	if err == nil || location != "" || time.Since(start) > 500*time.Millisecond {
+		t.Error(fmt.Sprintf("Export was expected to give up after its timeout, found %s after %v (%v)", location, time.Since(start), err))
+	}
+	if store.files["query1/request_count_1m.csv"] != "" {
+		t.Error(fmt.Sprintf("No data was expected to be exported, found %v", store.files))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strings"
+	"time"
+)
+
+// The Flink job writes previews to this retention policy, see CreateSimulationJobConfig.
+const PREVIEW_RP = "downsample"
+
+type PreviewReport struct {
+	GeneratedAt      string          `json:"generatedAt"`
+	From             string          `json:"from"`
+	To               string          `json:"to"`
+	SourceSeries     int             `json:"sourceSeries"`
+	SourcePoints     int64           `json:"sourcePoints"`
+	PreviewSeries    int             `json:"previewSeries"`
+	PreviewPoints    int64           `json:"previewPoints"`
+	CompressionRatio float64         `json:"compressionRatio"`
+	Fields           []FieldAccuracy `json:"fields"`
+}
+
+// FieldAccuracy compares the downsampled values of one field with the same aggregation run by InfluxDB on the raw data.
+// MeanAbsolutePercentageError skips buckets where the expected value is 0.
+type FieldAccuracy struct {
+	Alias                       string  `json:"alias"`
+	Field                       string  `json:"field"`
+	Function                    string  `json:"func"`
+	ComparedBuckets             int     `json:"comparedBuckets"`
+	MissingBuckets              int     `json:"missingBuckets"`
+	MeanAbsoluteError           float64 `json:"meanAbsoluteError"`
+	MaxAbsoluteError            float64 `json:"maxAbsoluteError"`
+	MeanAbsolutePercentageError float64 `json:"meanAbsolutePercentageError"`
+}
+
+// BuildPreviewReport compares the raw data in source with the preview between from and to, both should be aligned on the query interval.
+func BuildPreviewReport(source InfluxdbInterface, preview InfluxdbInterface, query DownsamplingObject, from time.Time, to time.Time) (PreviewReport, error) {
+	report := PreviewReport{
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		From:        from.UTC().Format(time.RFC3339),
+		To:          to.UTC().Format(time.RFC3339),
+	}
+
+	var sourceFields, previewFields []string
+	for _, field := range query.Fields {
+		sourceFields = append(sourceFields, field.Field)
+		previewFields = append(previewFields, field.Alias)
+	}
+
+	log.Printf("Counting source series and points for %s...", query.QueryId)
+	sourcePoints, err := source.GetSeriesPoints(query.Db, query.Rp, query.Measurement, sourceFields, from, to)
+	if err != nil {
+		return report, err
+	}
+	log.Printf("Counting preview series and points for %s...", query.QueryId)
+	previewPoints, err := preview.GetSeriesPoints(query.Db, PREVIEW_RP, query.TargetMeasurement, previewFields, from, to)
+	if err != nil {
+		return report, err
+	}
+
+	report.SourceSeries, report.SourcePoints = len(sourcePoints), sumPoints(sourcePoints)
+	report.PreviewSeries, report.PreviewPoints = len(previewPoints), sumPoints(previewPoints)
+	if report.PreviewPoints > 0 {
+		report.CompressionRatio = float64(report.SourcePoints) / float64(report.PreviewPoints)
+	}
+
+	interval := time.Duration(query.Interval) * time.Second
+	for _, field := range query.Fields {
+		log.Printf("Comparing %s(%s) with %s...", field.Function, field.Field, field.Alias)
+		expected, err := source.GetBuckets(query.Db, query.Rp, query.Measurement,
+			fmt.Sprintf("%s(%s)", strings.ToUpper(field.Function), quoteIdentifier(field.Field)), query.Tags, interval, from, to)
+		if err != nil {
+			return report, err
+		}
+		actual, err := preview.GetBuckets(query.Db, PREVIEW_RP, query.TargetMeasurement,
+			fmt.Sprintf("LAST(%s)", quoteIdentifier(field.Alias)), query.Tags, interval, from, to)
+		if err != nil {
+			return report, err
+		}
+
+		accuracy := CompareBuckets(expected, actual)
+		accuracy.Alias, accuracy.Field, accuracy.Function = field.Alias, field.Field, field.Function
+		report.Fields = append(report.Fields, accuracy)
+	}
+
+	return report, nil
+}
+
+func CompareBuckets(expected map[string]float64, actual map[string]float64) FieldAccuracy {
+	var accuracy FieldAccuracy
+	var sumError, sumPercentageError float64
+	percentageBuckets := 0
+	for bucket, want := range expected {
+		got, ok := actual[bucket]
+		if !ok {
+			accuracy.MissingBuckets++
+			continue
+		}
+
+		absError := math.Abs(got - want)
+		accuracy.ComparedBuckets++
+		sumError += absError
+		accuracy.MaxAbsoluteError = math.Max(accuracy.MaxAbsoluteError, absError)
+		if want != 0 {
+			sumPercentageError += absError / math.Abs(want) * 100
+			percentageBuckets++
+		}
+	}
+
+	if accuracy.ComparedBuckets > 0 {
+		accuracy.MeanAbsoluteError = sumError / float64(accuracy.ComparedBuckets)
+	}
+	if percentageBuckets > 0 {
+		accuracy.MeanAbsolutePercentageError = sumPercentageError / float64(percentageBuckets)
+	}
+	return accuracy
+}
+
+func sumPoints(points map[string]int64) int64 {
+	var sum int64
+	for _, count := range points {
+		sum += count
+	}
+	return sum
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+type FakeReportInfluxdb struct {
+	*FakeSchemaInfluxdb
+	seriesPoints map[string]int64
+	buckets      map[string]map[string]float64
+	selectors    []string
+}
+
+func (i *FakeReportInfluxdb) GetSeriesPoints(db string, rp string, measurement string, fields []string, from time.Time, to time.Time) (map[string]int64, error) {
+	return i.seriesPoints, i.err
+}
+
+func (i *FakeReportInfluxdb) GetBuckets(db string, rp string, measurement string, selector string, tags []string, interval time.Duration, from time.Time, to time.Time) (map[string]float64, error) {
+	i.selectors = append(i.selectors, selector)
+	return i.buckets[selector], i.err
+}
+
+func NewFakeSourceInfluxdb() *FakeReportInfluxdb {
+	return &FakeReportInfluxdb{
+		FakeSchemaInfluxdb: &FakeSchemaInfluxdb{},
+		seriesPoints:       map[string]int64{"app_name=a": 600, "app_name=b": 600},
+		buckets: map[string]map[string]float64{
+			"SUM(\"count\")":   {"app_name=a@t1": 100, "app_name=a@t2": 200, "app_name=b@t1": 0},
+			"LAST(\"status\")": {"app_name=a@t1": 1},
+		},
+	}
+}
+
+func NewFakePreviewInfluxdb() *FakeReportInfluxdb {
+	return &FakeReportInfluxdb{
+		FakeSchemaInfluxdb: &FakeSchemaInfluxdb{},
+		seriesPoints:       map[string]int64{"app_name=a": 20, "app_name=b": 20},
+		buckets: map[string]map[string]float64{
+			"LAST(\"sum_count\")":   {"app_name=a@t1": 110, "app_name=a@t2": 200, "app_name=b@t1": 4},
+			"LAST(\"last_status\")": {"app_name=a@t1": 1},
+		},
+	}
+}
+
+func Test_PreviewReport_CompareBuckets(t *testing.T) {
+	accuracy := CompareBuckets(map[string]float64{"a@t1": 100, "a@t2": 200, "a@t3": 50, "b@t1": 0}, map[string]float64{"a@t1": 110, "a@t2": 190, "b@t1": 3})
+	if accuracy.ComparedBuckets != 3 || accuracy.MissingBuckets != 1 {
+		t.Error(fmt.Sprintf("Was expecting 3 compared and 1 missing bucket, found %d and %d", accuracy.ComparedBuckets, accuracy.MissingBuckets))
+	}
+	if math.Abs(accuracy.MeanAbsoluteError-23.0/3) > 1e-9 || accuracy.MaxAbsoluteError != 10 {
+		t.Error(fmt.Sprintf("Unexpected absolute errors %v", accuracy))
+	}
+	if math.Abs(accuracy.MeanAbsolutePercentageError-7.5) > 1e-9 {
+		t.Error(fmt.Sprintf("MAPE was expected %v found %v", 7.5, accuracy.MeanAbsolutePercentageError))
+	}
+}
+
+func Test_PreviewReport_BuildPreviewReport(t *testing.T) {
+	source, preview := NewFakeSourceInfluxdb(), NewFakePreviewInfluxdb()
+	report, err := BuildPreviewReport(source, preview, getQueryForValidation(), time.Unix(0, 0), time.Unix(3600, 0))
+	if err != nil {
+		t.Error(fmt.Sprintf("Error was not expected here but received - %v", err))
+	}
+	if report.SourceSeries != 2 || report.SourcePoints != 1200 || report.PreviewSeries != 2 || report.PreviewPoints != 40 || report.CompressionRatio != 30 {
+		t.Error(fmt.Sprintf("Unexpected counts in report %v", report))
+	}
+	if len(report.Fields) != 2 || report.Fields[0].Alias != "sum_count" || report.Fields[0].MaxAbsoluteError != 10 || report.Fields[1].MeanAbsoluteError != 0 {
+		t.Error(fmt.Sprintf("Unexpected field accuracy in report %v", report.Fields))
+	}
+	if report.From != "1970-01-01T00:00:00Z" || report.To != "1970-01-01T01:00:00Z" {
+		t.Error(fmt.Sprintf("Unexpected report window %s - %s", report.From, report.To))
+	}
+}
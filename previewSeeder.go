@@ -0,0 +1,105 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Raw data copied from the source is kept next to PREVIEW_RP so dashboards can overlay both.
+const PREVIEW_RAW_RP = "raw"
+
+type PreviewSeederInterface interface {
+	SeedPreview(query DownsamplingObject, previewUrl string) (int, error)
+}
+
+func NewPreviewSeeder(config *Config) (PreviewSeederInterface, error) {
+	if config.PreviewSeed == nil || config.PreviewSeed.Hours <= 0 {
+		log.Println("Preview seeding is disabled.")
+		return &NoopPreviewSeeder{}, nil
+	}
+	if config.SourceInfluxdb == nil || config.SourceInfluxdb.Url == "" {
+		log.Println("No source InfluxDB configured, previews will not be seeded with raw data.")
+		return &NoopPreviewSeeder{}, nil
+	}
+
+	source, err := NewInfluxdb(config.SourceInfluxdb.Url, config.SourceInfluxdb.Username, config.SourceInfluxdb.Password, config.ReadyTimeout())
+	if err != nil {
+		return nil, err
+	}
+	previewInflux := func(query DownsamplingObject, url string) (InfluxdbInterface, error) {
+		user, password := PreviewInfluxdbCredentials(config, query)
+		return NewInfluxdb(url, user, password, config.ReadyTimeout())
+	}
+
+	return &PreviewSeeder{source, previewInflux, config.PreviewSeed}, nil
+}
+
+type NoopPreviewSeeder struct {
+}
+
+func (s *NoopPreviewSeeder) SeedPreview(query DownsamplingObject, previewUrl string) (int, error) {
+	return 0, nil
+}
+
+type PreviewSeeder struct {
+	source        InfluxdbInterface
+	previewInflux func(query DownsamplingObject, url string) (InfluxdbInterface, error)
+	seed          *PreviewSeedConfig
+}
+
+// SeedPreview copies the query fields of the last Hours of the raw measurement into PREVIEW_RAW_RP, one chunk at a time.
+// Chunks are copied newest first, so once MaxPoints is reached the preview keeps the most recent data.
+func (s *PreviewSeeder) SeedPreview(query DownsamplingObject, previewUrl string) (int, error) {
+	fieldKeys, err := s.source.GetFieldKeys(query.Db, query.Rp, query.Measurement)
+	if err != nil {
+		return 0, err
+	}
+	fieldTypes := make(map[string]string)
+	for _, field := range query.Fields {
+		if types := fieldKeys[field.Field]; len(types) > 0 {
+			fieldTypes[field.Field] = types[0]
+		}
+	}
+	if len(fieldTypes) == 0 {
+		log.Printf("None of the fields of %s found in the source, nothing to seed.", query.QueryId)
+		return 0, nil
+	}
+
+	preview, err := s.previewInflux(query, previewUrl)
+	if err != nil {
+		return 0, err
+	}
+
+	chunk := time.Duration(s.seed.ChunkMinutes) * time.Minute
+	if chunk <= 0 {
+		chunk = time.Hour
+	}
+	to := time.Now()
+	from := to.Add(-time.Duration(s.seed.Hours) * time.Hour)
+
+	copied := 0
+	for end := to; end.After(from) && copied < s.seed.MaxPoints; end = end.Add(-chunk) {
+		start := end.Add(-chunk)
+		if start.Before(from) {
+			start = from
+		}
+
+		remaining := s.seed.MaxPoints - copied
+		points, err := s.source.ReadPoints(query.Db, query.Rp, query.Measurement, fieldTypes, start, end, remaining)
+		if err != nil {
+			return copied, err
+		}
+
+		err = preview.WritePoints(query.Db, PREVIEW_RAW_RP, points)
+		if err != nil {
+			return copied, err
+		}
+		copied += len(points)
+	}
+
+	if copied >= s.seed.MaxPoints {
+		log.Printf("Seeding of %s stopped at the cap of %d points.", query.QueryId, s.seed.MaxPoints)
+	}
+	log.Printf("Seeded preview %s with %d raw points.", query.QueryId, copied)
+	return copied, nil
+}
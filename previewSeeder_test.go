@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type FakeSeedInfluxdb struct {
+	*FakeSchemaInfluxdb
+	pointsPerChunk int
+	reads          []string
+	written        map[string]int
+}
+
+func (i *FakeSeedInfluxdb) ReadPoints(db string, rp string, measurement string, fieldTypes map[string]string, from time.Time, to time.Time, limit int) ([]InfluxdbPoint, error) {
+	i.reads = append(i.reads, fmt.Sprintf("%s.%s.%s %v %d", db, rp, measurement, to.Sub(from), limit))
+	var points []InfluxdbPoint
+	for p := 0; p < i.pointsPerChunk && p < limit; p++ {
+		points = append(points, InfluxdbPoint{Measurement: measurement, Fields: map[string]interface{}{"count": int64(p)}, Time: from})
+	}
+	return points, i.err
+}
+
+func (i *FakeSeedInfluxdb) WritePoints(db string, rp string, points []InfluxdbPoint) error {
+	if i.written == nil {
+		i.written = make(map[string]int)
+	}
+	i.written[db+"."+rp] += len(points)
+	return i.err
+}
+
+func NewPreviewSeederForTest(pointsPerChunk int, seed *PreviewSeedConfig) (*PreviewSeeder, *FakeSeedInfluxdb, *FakeSeedInfluxdb) {
+	source := &FakeSeedInfluxdb{FakeSchemaInfluxdb: &FakeSchemaInfluxdb{fieldKeys: map[string][]string{"count": {"integer"}}}, pointsPerChunk: pointsPerChunk}
+	preview := &FakeSeedInfluxdb{FakeSchemaInfluxdb: &FakeSchemaInfluxdb{}}
+	previewInflux := func(query DownsamplingObject, url string) (InfluxdbInterface, error) {
+		return preview, nil
+	}
+	return &PreviewSeeder{source, previewInflux, seed}, source, preview
+}
+
+func Test_PreviewSeeder_SeedPreview(t *testing.T) {
+	seeder, source, preview := NewPreviewSeederForTest(10, &PreviewSeedConfig{Hours: 2, ChunkMinutes: 30, MaxPoints: 1000})
+
+	copied, err := seeder.SeedPreview(getQueryForValidation(), "http://preview")
+	if err != nil || copied != 40 || preview.written["sca.raw"] != 40 {
+		t.Error(fmt.Sprintf("40 points were expected in sca.raw, found %d %v (%v)", copied, preview.written, err))
+	}
+	if len(source.reads) != 4 || source.reads[0] != "sca.autogen.request_count 30m0s 1000" || source.reads[3] != "sca.autogen.request_count 30m0s 970" {
+		t.Error(fmt.Sprintf("4 chunks of 30m were expected to be read, found %v", source.reads))
+	}
+}
+
+func Test_PreviewSeeder_SeedPreview_Cap(t *testing.T) {
+	seeder, source, preview := NewPreviewSeederForTest(10, &PreviewSeedConfig{Hours: 6, ChunkMinutes: 60, MaxPoints: 25})
+
+	copied, err := seeder.SeedPreview(getQueryForValidation(), "http://preview")
+	if err != nil || copied != 25 || preview.written["sca.raw"] != 25 {
+		t.Error(fmt.Sprintf("Seeding was expected to stop at 25 points, found %d %v (%v)", copied, preview.written, err))
+	}
+	if len(source.reads) != 3 {
+		t.Error(fmt.Sprintf("Reading was expected to stop once the cap was reached, found %v", source.reads))
+	}
+}
+
+func Test_PreviewSeeder_SeedPreview_NoFields(t *testing.T) {
+	seeder, source, _ := NewPreviewSeederForTest(10, &PreviewSeedConfig{Hours: 2, ChunkMinutes: 30, MaxPoints: 1000})
+	source.fieldKeys = map[string][]string{"latency": {"float"}}
+
+	copied, err := seeder.SeedPreview(getQueryForValidation(), "http://preview")
+	if err != nil || copied != 0 || len(source.reads) != 0 {
+		t.Error(fmt.Sprintf("Nothing was expected to be seeded, found %d %v (%v)", copied, source.reads, err))
+	}
+}
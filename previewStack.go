@@ -0,0 +1,54 @@
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+)
+
+// The annotation telling when a preview object expires, the same as PreviewExpiresAt of its item when it was created.
+const PREVIEW_EXPIRES_AT_ANNOTATION = "downsamplr.io/expires-at"
+
+// PreviewStack names the objects of the preview of a query. They are labeled with the query id and annotated with
+// when the preview expires, and all but the deployment are owned by it: deleting the deployment removes the stack.
+type PreviewStack struct {
+	Name      string
+	QueryId   string
+	ExpiresAt string
+	Owner     *metav1.OwnerReference
+}
+
+func NewPreviewStack(query DownsamplingObject) *PreviewStack {
+	return &PreviewStack{Name: SIMULATION_STACK_PREFIX + "-" + query.QueryId, QueryId: query.QueryId, ExpiresAt: query.PreviewExpiresAt}
+}
+
+// Apply sets the labels, the expiry annotation and the owner of the stack on an object of it.
+func (s *PreviewStack) Apply(meta *metav1.ObjectMeta) {
+	if meta.Labels == nil {
+		meta.Labels = make(map[string]string)
+	}
+	meta.Labels["purpose"] = SIMULATION_STACK_PREFIX
+	meta.Labels["queryId"] = s.QueryId
+	if s.ExpiresAt != "" {
+		if meta.Annotations == nil {
+			meta.Annotations = make(map[string]string)
+		}
+		meta.Annotations[PREVIEW_EXPIRES_AT_ANNOTATION] = s.ExpiresAt
+	}
+	if s.Owner != nil {
+		meta.OwnerReferences = []metav1.OwnerReference{*s.Owner}
+	}
+}
+
+// PreviewExpired tells whether a preview object is past its expiry annotation,
+// objects created before the annotation expire by their age.
+func PreviewExpired(meta metav1.ObjectMeta, expireAfterMinute float64) bool {
+	if expiresAt, err := time.Parse(time.RFC3339, meta.Annotations[PREVIEW_EXPIRES_AT_ANNOTATION]); err == nil {
+		return time.Now().After(expiresAt)
+	}
+	return time.Now().Sub(meta.CreationTimestamp.Time).Minutes() > expireAfterMinute
+}
+
+// ownedByStack tells whether the garbage collector removes the object with the deployment of its stack.
+func ownedByStack(meta metav1.ObjectMeta) bool {
+	return len(meta.OwnerReferences) > 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func Test_PreviewStack_Apply(t *testing.T) {
+	stack := NewPreviewStack(DownsamplingObject{QueryId: "query1", PreviewExpiresAt: "2030-01-01T00:00:00Z"})
+	stack.Owner = &metav1.OwnerReference{Kind: "Deployment", Name: stack.Name, UID: "uid1"}
+	meta := metav1.ObjectMeta{Labels: map[string]string{"app": "influxdb"}}
+	stack.Apply(&meta)
+	if stack.Name != "downsamplr-preview-query1" || meta.Labels["app"] != "influxdb" || meta.Labels["purpose"] != SIMULATION_STACK_PREFIX || meta.Labels["queryId"] != "query1" {
+		t.Error(fmt.Sprintf("Labels of the stack were expected, found %v", meta.Labels))
+	}
+	if meta.Annotations[PREVIEW_EXPIRES_AT_ANNOTATION] != "2030-01-01T00:00:00Z" || !ownedByStack(meta) {
+		t.Error(fmt.Sprintf("The expiry and the owner were expected, found %v and %v", meta.Annotations, meta.OwnerReferences))
+	}
+}
+
+func Test_PreviewExpired(t *testing.T) {
+	for name, test := range map[string]struct {
+		minutes   int
+		expiresAt string
+		expected  bool
+	}{
+		"old":                {46, "", true},
+		"young":              {40, "", false},
+		"old but extended":   {46, time.Now().Add(time.Hour).Format(time.RFC3339), false},
+		"young but expired":  {5, time.Now().Add(-time.Minute).Format(time.RFC3339), true},
+		"invalid annotation": {46, "tomorrow", true},
+	} {
+		meta := NewPreviewObjectMeta("test", test.minutes)
+		if test.expiresAt != "" {
+			meta.Annotations = map[string]string{PREVIEW_EXPIRES_AT_ANNOTATION: test.expiresAt}
+		}
+		if PreviewExpired(meta, 45) != test.expected {
+			t.Error(fmt.Sprintf("%s: expired %t was expected", name, test.expected))
+		}
+	}
+}
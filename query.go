@@ -11,10 +11,19 @@ type DownsamplingItemHandlerInterface interface {
 	GetDownsamplingItem(queryId string) (DownsamplingObject, error)
 	GetNextPendingDownsamplingItem() (DownsamplingObject, error)
 	GetDeletedDownsamplingItems() ([]DownsamplingObject, error)
-	DeployDownsamplingPendingSimulationItem(id string) error
+	DeployDownsamplingPendingSimulationItem(id string, influxdbUrl string, grafanaUrl string, credentials *PreviewCredentials, dashboardTemplate string, expiresAt string) error
 	DeployDownsamplingItem(query DownsamplingObject) error
 	DeleteDownsamplingItem(query DownsamplingObject) error
-	HandleExpiredSimulations() (int, error)
+	FailDownsamplingItem(query DownsamplingObject, message string) error
+	HandleExpiredSimulations() ([]DownsamplingObject, []DownsamplingObject, error)
+	GetExpiredItems() ([]DownsamplingObject, error)
+	ExpireDownsamplingPreviewItem(query DownsamplingObject, artifactLocation string) error
+	CancelDownsamplingPreviewItem(query DownsamplingObject) error
+	ExtendDownsamplingPreviewItem(query DownsamplingObject, expiresAt string, message string) error
+	GetPreviewItemsDueForReport() ([]DownsamplingObject, error)
+	GetActivePreviewItems() ([]DownsamplingObject, error)
+	RecordJobOutcome(queryId string, outcome JobOutcome, failState string) error
+	SavePreviewReport(query DownsamplingObject, report PreviewReport) error
 }
 
 type DownsamplingItemHandler struct {
@@ -24,7 +33,7 @@ type DownsamplingItemHandler struct {
 }
 
 func NewDownsamplingItemHandler(config *Config, metrics *Metrics) (*DownsamplingItemHandler, error) {
-	db, err := NewDynamodb(config)
+	db, err := NewDb(config)
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +74,9 @@ func (u *DownsamplingItemHandler) GetDeletedDownsamplingItems() ([]DownsamplingO
 	return dsList, err
 }
 
-func (u *DownsamplingItemHandler) DeployDownsamplingPendingSimulationItem(id string) error {
+// DeployDownsamplingPendingSimulationItem saves where the preview runs and the credentials to access it, for the requesting user.
+// The preview expires when its stack does, see PreviewStack.
+func (u *DownsamplingItemHandler) DeployDownsamplingPendingSimulationItem(id string, influxdbUrl string, grafanaUrl string, credentials *PreviewCredentials, dashboardTemplate string, expiresAt string) error {
 	var ds DownsamplingObject
 	ds, err := u.db.GetDownsamplingItem(id)
 	if err != nil {
@@ -82,7 +93,12 @@ func (u *DownsamplingItemHandler) DeployDownsamplingPendingSimulationItem(id str
 
 	ds.QueryState = "PREVIEW_DEPLOYED"
 	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	ds.PreviewExpiresAt = time.Now().Add(time.Duration(u.config.ExpireAfterMinute) * time.Minute).Format(time.RFC3339)
+	ds.PreviewDeployedAt = ds.UpdatedAt
+	ds.PreviewInfluxdbUrl = influxdbUrl
+	ds.PreviewGrafanaUrl = grafanaUrl
+	ds.PreviewCredentials = credentials
+	ds.DashboardTemplate = dashboardTemplate
+	ds.PreviewExpiresAt = expiresAt
 
 	_, err = u.db.UpdateDownsamplingItem(ds)
 	return err
@@ -102,6 +118,9 @@ func (u *DownsamplingItemHandler) DeployDownsamplingItem(query DownsamplingObjec
 	}
 
 	ds.QueryState = "DEPLOYED"
+	ds.Engine = query.Engine
+	ds.DashboardTemplate = query.DashboardTemplate
+	ds.FlinkJobId = query.FlinkJobId
 	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 
 	_, err = u.db.UpdateDownsamplingItem(ds)
@@ -112,23 +131,208 @@ func (u *DownsamplingItemHandler) DeleteDownsamplingItem(query DownsamplingObjec
 	return u.db.DeleteDownsamplingItem(query.QueryId)
 }
 
-func (d *DownsamplingItemHandler) HandleExpiredSimulations() (int, error) {
-	count := 0
+func (u *DownsamplingItemHandler) FailDownsamplingItem(query DownsamplingObject, message string) error {
+	ds, err := u.db.GetDownsamplingItem(query.QueryId)
+	if err != nil {
+		return err
+	}
+
+	if ds.QueryId == "" {
+		return errors.New("object not found")
+	}
+
+	log.Printf("Moving query %s from %s to FAILED: %s", ds.QueryId, ds.QueryState, message)
+	ds.QueryState = "FAILED"
+	ds.StateMessage = message
+	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = u.db.UpdateDownsamplingItem(ds)
+	return err
+}
+
+// GetPreviewItemsDueForReport returns deployed previews without a report that have been running for ReportAfterMinute.
+func (u *DownsamplingItemHandler) GetPreviewItemsDueForReport() ([]DownsamplingObject, error) {
+	var dsListNew []DownsamplingObject
+	log.Println("Getting deployed simulations due for a report...")
+	dsList, err := u.db.GetDeployedDownsamplePreviewItems()
+	if err != nil {
+		return dsListNew, err
+	}
+
+	for _, d := range dsList {
+		if d.PreviewReport != nil || d.PreviewInfluxdbUrl == "" {
+			continue
+		}
+		deployed, err := time.Parse(time.RFC3339, d.PreviewDeployedAt)
+		if err != nil {
+			log.Printf("Query %s has no valid previewDeployedAt, skipping: %v", d.QueryId, err)
+			continue
+		}
+
+		if time.Now().Sub(deployed).Minutes() >= u.config.ReportAfterMinute {
+			dsListNew = append(dsListNew, d)
+		}
+	}
+
+	return dsListNew, nil
+}
+
+// GetActivePreviewItems returns the deployed previews, previews being extended or cancelled are among the to-do items.
+func (u *DownsamplingItemHandler) GetActivePreviewItems() ([]DownsamplingObject, error) {
+	return u.db.GetDeployedDownsamplePreviewItems()
+}
+
+// RecordJobOutcome keeps how the last job of the item ended. A failed job moves the item to FAILED
+// when it is still in failState, waiting for what the job did not do.
+func (u *DownsamplingItemHandler) RecordJobOutcome(queryId string, outcome JobOutcome, failState string) error {
+	ds, err := u.db.GetDownsamplingItem(queryId)
+	if err != nil {
+		return err
+	}
+
+	if ds.QueryId == "" {
+		log.Printf("Object for queryId %s not found, ignoring outcome of job %s...", queryId, outcome.Name)
+		return nil
+	} else if ds.LastJob != nil && *ds.LastJob == outcome {
+		return nil
+	}
+
+	log.Printf("Recording outcome of job %s on query %s: succeeded %t, %s", outcome.Name, ds.QueryId, outcome.Succeeded, outcome.Message)
+	ds.LastJob = &outcome
+	if !outcome.Succeeded && failState != "" && ds.QueryState == failState {
+		log.Printf("Moving query %s from %s to FAILED", ds.QueryId, ds.QueryState)
+		ds.QueryState = "FAILED"
+		ds.StateMessage = "Job " + outcome.Name + " failed: " + outcome.Message
+	}
+	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = u.db.UpdateDownsamplingItem(ds)
+	return err
+}
+
+func (u *DownsamplingItemHandler) SavePreviewReport(query DownsamplingObject, report PreviewReport) error {
+	ds, err := u.db.GetDownsamplingItem(query.QueryId)
+	if err != nil {
+		return err
+	}
+
+	if ds.QueryId == "" {
+		log.Printf("Object for queryId %s not found, ignoring...", query.QueryId)
+		return nil
+	} else if ds.QueryState != "PREVIEW_DEPLOYED" {
+		log.Printf("Object was supposed to have status PREVIEW_DEPLOYED, but found it changed to %s, ignoring...", ds.QueryState)
+		return nil
+	}
+
+	ds.PreviewReport = &report
+	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = u.db.UpdateDownsamplingItem(ds)
+	return err
+}
+
+// HandleExpiredSimulations deletes the expired previews, or keeps them as PREVIEW_EXPIRED on a backend whose items
+// are declared by their owner. The deleted ones are returned first, then the kept ones.
+func (d *DownsamplingItemHandler) HandleExpiredSimulations() ([]DownsamplingObject, []DownsamplingObject, error) {
+	var deleted, kept []DownsamplingObject
 	dsList, err := d.GetExpiredItems()
 	if err != nil {
-		return count, err
+		return deleted, kept, err
 	}
 
+	expiring, ok := d.db.(ExpiringDbInterface)
+	keep := ok && expiring.KeepsExpiredItems()
 	for _, ds := range dsList {
+		if keep {
+			log.Printf("Expiring preview for queryId: %s", ds.QueryId)
+			err := d.ExpireDownsamplingPreviewItem(ds, "")
+			if err != nil {
+				return deleted, kept, err
+			}
+			kept = append(kept, ds)
+			continue
+		}
+
 		log.Printf("Deleting preview for queryId: %s", ds.QueryId)
 		err := d.db.DeleteDownsamplingItem(ds.QueryId)
 		if err != nil {
-			return count, err
+			return deleted, kept, err
 		}
-		count++
+		deleted = append(deleted, ds)
+	}
+
+	return deleted, kept, nil
+}
+
+// ExpireDownsamplingPreviewItem keeps an expired preview whose results were exported, with where they can be found.
+func (u *DownsamplingItemHandler) ExpireDownsamplingPreviewItem(query DownsamplingObject, artifactLocation string) error {
+	ds, err := u.db.GetDownsamplingItem(query.QueryId)
+	if err != nil {
+		return err
+	}
+
+	if ds.QueryId == "" {
+		log.Printf("Object for queryId %s not found, ignoring...", query.QueryId)
+		return nil
+	} else if ds.QueryState != "PREVIEW_DEPLOYED" {
+		log.Printf("Object was supposed to have status PREVIEW_DEPLOYED, but found it changed to %s, ignoring...", ds.QueryState)
+		return nil
+	}
+
+	ds.QueryState = "PREVIEW_EXPIRED"
+	ds.ArtifactLocation = artifactLocation
+	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = u.db.UpdateDownsamplingItem(ds)
+	return err
+}
+
+// CancelDownsamplingPreviewItem keeps a preview torn down on request, so it is not confused with an expired one.
+func (u *DownsamplingItemHandler) CancelDownsamplingPreviewItem(query DownsamplingObject) error {
+	ds, err := u.db.GetDownsamplingItem(query.QueryId)
+	if err != nil {
+		return err
+	}
+
+	if ds.QueryId == "" {
+		log.Printf("Object for queryId %s not found, ignoring...", query.QueryId)
+		return nil
+	} else if ds.QueryState != "PREVIEW_CANCEL_PENDING" && ds.QueryState != "PREVIEW_DEPLOYED" {
+		log.Printf("Object was supposed to have status PREVIEW_CANCEL_PENDING or PREVIEW_DEPLOYED, but found it changed to %s, ignoring...", ds.QueryState)
+		return nil
 	}
 
-	return count, nil
+	ds.QueryState = "PREVIEW_CANCELLED"
+	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = u.db.UpdateDownsamplingItem(ds)
+	return err
+}
+
+// ExtendDownsamplingPreviewItem puts an extended preview back to PREVIEW_DEPLOYED with its new expiry,
+// the message tells when the extension was cut short.
+func (u *DownsamplingItemHandler) ExtendDownsamplingPreviewItem(query DownsamplingObject, expiresAt string, message string) error {
+	ds, err := u.db.GetDownsamplingItem(query.QueryId)
+	if err != nil {
+		return err
+	}
+
+	if ds.QueryId == "" {
+		log.Printf("Object for queryId %s not found, ignoring...", query.QueryId)
+		return nil
+	} else if ds.QueryState != "PREVIEW_EXTEND_PENDING" && ds.QueryState != "PREVIEW_DEPLOYED" {
+		log.Printf("Object was supposed to have status PREVIEW_EXTEND_PENDING or PREVIEW_DEPLOYED, but found it changed to %s, ignoring...", ds.QueryState)
+		return nil
+	}
+
+	ds.QueryState = "PREVIEW_DEPLOYED"
+	ds.PreviewExpiresAt = expiresAt
+	ds.PreviewExtendMinutes = 0
+	ds.StateMessage = message
+	ds.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = u.db.UpdateDownsamplingItem(ds)
+	return err
 }
 
 func (u *DownsamplingItemHandler) GetExpiredItems() ([]DownsamplingObject, error) {
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// Aggregations InfluxQL and the Flink job only support on float/integer fields.
+var NUMERIC_ONLY_FUNCTIONS = map[string]bool{
+	"MEAN":       true,
+	"MEDIAN":     true,
+	"SUM":        true,
+	"MIN":        true,
+	"MAX":        true,
+	"STDDEV":     true,
+	"SPREAD":     true,
+	"INTEGRAL":   true,
+	"PERCENTILE": true,
+}
+
+var NUMERIC_FIELD_TYPES = map[string]bool{
+	"float":    true,
+	"integer":  true,
+	"unsigned": true,
+}
+
+type QueryValidationError struct {
+	Problems []string
+}
+
+func (e *QueryValidationError) Error() string {
+	return "invalid query: " + strings.Join(e.Problems, "; ")
+}
+
+type QueryValidatorInterface interface {
+	Validate(query DownsamplingObject) error
+}
+
+func NewQueryValidator(config *Config) (QueryValidatorInterface, error) {
+	if config.SourceInfluxdb == nil || config.SourceInfluxdb.Url == "" {
+		log.Println("No source InfluxDB configured, queries will not be validated.")
+		return &NoopQueryValidator{}, nil
+	}
+	influx, err := NewInfluxdb(config.SourceInfluxdb.Url, config.SourceInfluxdb.Username, config.SourceInfluxdb.Password, config.ReadyTimeout())
+	if err != nil {
+		return nil, err
+	}
+	return &QueryValidator{influx: influx}, nil
+}
+
+type NoopQueryValidator struct {
+}
+
+func (v *NoopQueryValidator) Validate(query DownsamplingObject) error {
+	return nil
+}
+
+type QueryValidator struct {
+	influx InfluxdbInterface
+}
+
+// Validate returns a *QueryValidationError when the query does not match the source schema,
+// any other error means the schema could not be read.
+func (v *QueryValidator) Validate(query DownsamplingObject) error {
+	log.Printf("Validating query %s against %s.%s.%s...", query.QueryId, query.Db, query.Rp, query.Measurement)
+	measurements, err := v.influx.GetMeasurements(query.Db, query.Measurement)
+	if err != nil {
+		return err
+	}
+	if len(measurements) == 0 {
+		return &QueryValidationError{[]string{fmt.Sprintf("measurement %s not found in database %s", query.Measurement, query.Db)}}
+	}
+
+	fieldKeys, err := v.influx.GetFieldKeys(query.Db, query.Rp, query.Measurement)
+	if err != nil {
+		return err
+	}
+	tagKeys, err := v.influx.GetTagKeys(query.Db, query.Rp, query.Measurement)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, field := range query.Fields {
+		types, ok := fieldKeys[field.Field]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("field %s not found in %s", field.Field, query.Measurement))
+			continue
+		}
+		function := strings.ToUpper(field.Function)
+		if NUMERIC_ONLY_FUNCTIONS[function] && !isNumericField(types) {
+			problems = append(problems, fmt.Sprintf("function %s cannot be applied to field %s of type %s", function, field.Field, strings.Join(types, "/")))
+		}
+	}
+
+	tags := make(map[string]bool)
+	for _, tag := range tagKeys {
+		tags[tag] = true
+	}
+	for _, tag := range query.Tags {
+		if !tags[tag] {
+			problems = append(problems, fmt.Sprintf("tag %s not found in %s", tag, query.Measurement))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &QueryValidationError{problems}
+	}
+	return nil
+}
+
+// isNumericField requires every type of the field to be numeric, a field can have another type in other shards
+// and those points would fail the aggregation.
+func isNumericField(types []string) bool {
+	for _, t := range types {
+		if !NUMERIC_FIELD_TYPES[t] {
+			return false
+		}
+	}
+	return len(types) > 0
+}
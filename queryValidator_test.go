@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type FakeSchemaInfluxdb struct {
+	measurements []string
+	fieldKeys    map[string][]string
+	tagKeys      []string
+	err          error
+	// recorded calls, used by the target provisioner and engine tests
+	retentionPolicies        []string
+	droppedSeries            []string
+	continuousQueries        []string
+	droppedContinuousQueries []string
+}
+
+func (i *FakeSchemaInfluxdb) CreateDatabaseAndRp(db string, rp string) error {
+	return nil
+}
+
+func (i *FakeSchemaInfluxdb) GetMeasurements(db string, measurement string) ([]string, error) {
+	return i.measurements, i.err
+}
+
+func (i *FakeSchemaInfluxdb) GetFieldKeys(db string, rp string, measurement string) (map[string][]string, error) {
+	return i.fieldKeys, i.err
+}
+
+func (i *FakeSchemaInfluxdb) GetTagKeys(db string, rp string, measurement string) ([]string, error) {
+	return i.tagKeys, i.err
+}
+
+func (i *FakeSchemaInfluxdb) EnsureRetentionPolicy(db string, rp string, duration string, shardDuration string) error {
+	i.retentionPolicies = append(i.retentionPolicies, fmt.Sprintf("%s.%s %s %s", db, rp, duration, shardDuration))
+	return i.err
+}
+
+func (i *FakeSchemaInfluxdb) DropSeries(db string, rp string, measurement string) error {
+	i.droppedSeries = append(i.droppedSeries, db+"."+measurement)
+	return i.err
+}
+
+func (i *FakeSchemaInfluxdb) CreateContinuousQuery(db string, name string, selectStatement string) error {
+	i.continuousQueries = append(i.continuousQueries, fmt.Sprintf("%s.%s %s", db, name, selectStatement))
+	return i.err
+}
+
+func (i *FakeSchemaInfluxdb) DropContinuousQuery(db string, name string) error {
+	i.droppedContinuousQueries = append(i.droppedContinuousQueries, db+"."+name)
+	return i.err
+}
+
+func (i *FakeSchemaInfluxdb) GetSeriesPoints(db string, rp string, measurement string, fields []string, from time.Time, to time.Time) (map[string]int64, error) {
+	return map[string]int64{}, i.err
+}
+
+func (i *FakeSchemaInfluxdb) GetBuckets(db string, rp string, measurement string, selector string, tags []string, interval time.Duration, from time.Time, to time.Time) (map[string]float64, error) {
+	return map[string]float64{}, i.err
+}
+
+func (i *FakeSchemaInfluxdb) ReadPoints(db string, rp string, measurement string, fieldTypes map[string]string, from time.Time, to time.Time, limit int) ([]InfluxdbPoint, error) {
+	return []InfluxdbPoint{}, i.err
+}
+
+func (i *FakeSchemaInfluxdb) WritePoints(db string, rp string, points []InfluxdbPoint) error {
+	return i.err
+}
+
+type FakeQueryValidator struct {
+	err error
+}
+
+func (v *FakeQueryValidator) Validate(query DownsamplingObject) error {
+	return v.err
+}
+
+type QueryValidatorTestSuite struct {
+	label            string
+	influx           *FakeSchemaInfluxdb
+	expectValidation bool
+	expectedMessage  string
+}
+
+var QueryValidatorTestCases = []QueryValidatorTestSuite{
+	{
+		"Valid query",
+		&FakeSchemaInfluxdb{measurements: []string{"request_count"}, fieldKeys: map[string][]string{"count": {"integer"}, "status": {"string"}}, tagKeys: []string{"app_name", "scenario"}},
+		false,
+		"",
+	},
+	{
+		"Missing measurement",
+		&FakeSchemaInfluxdb{fieldKeys: map[string][]string{"count": {"integer"}}, tagKeys: []string{"app_name", "scenario"}},
+		true,
+		"measurement request_count not found",
+	},
+	{
+		"Missing field",
+		&FakeSchemaInfluxdb{measurements: []string{"request_count"}, fieldKeys: map[string][]string{"status": {"string"}}, tagKeys: []string{"app_name", "scenario"}},
+		true,
+		"field count not found",
+	},
+	{
+		"Wrong field type",
+		&FakeSchemaInfluxdb{measurements: []string{"request_count"}, fieldKeys: map[string][]string{"count": {"string"}, "status": {"string"}}, tagKeys: []string{"app_name", "scenario"}},
+		true,
+		"function SUM cannot be applied to field count",
+	},
+	{
+		"Mixed field types",
+		&FakeSchemaInfluxdb{measurements: []string{"request_count"}, fieldKeys: map[string][]string{"count": {"integer", "string"}, "status": {"string"}}, tagKeys: []string{"app_name", "scenario"}},
+		true,
+		"function SUM cannot be applied to field count of type integer/string",
+	},
+	{
+		"Mixed numeric field types",
+		&FakeSchemaInfluxdb{measurements: []string{"request_count"}, fieldKeys: map[string][]string{"count": {"float", "integer"}, "status": {"string"}}, tagKeys: []string{"app_name", "scenario"}},
+		false,
+		"",
+	},
+	{
+		"Missing tag",
+		&FakeSchemaInfluxdb{measurements: []string{"request_count"}, fieldKeys: map[string][]string{"count": {"float"}, "status": {"string"}}, tagKeys: []string{"app_name"}},
+		true,
+		"tag scenario not found",
+	},
+}
+
+func getQueryForValidation() DownsamplingObject {
+	query := DownsamplingObject{QueryId: "query1", Db: "sca", Rp: "autogen", Measurement: "request_count", Tags: []string{"app_name", "scenario"}}
+	query.Fields = append(query.Fields, struct {
+		Alias    string `json:"alias"`
+		Field    string `json:"field"`
+		Function string `json:"func"`
+	}{"sum_count", "count", "sum"}, struct {
+		Alias    string `json:"alias"`
+		Field    string `json:"field"`
+		Function string `json:"func"`
+	}{"last_status", "status", "LAST"})
+	return query
+}
+
+func Test_QueryValidator_Validate(t *testing.T) {
+	for _, testCase := range QueryValidatorTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			sut := &QueryValidator{influx: testCase.influx}
+			err := sut.Validate(getQueryForValidation())
+			_, isValidationErr := err.(*QueryValidationError)
+			if !testCase.expectValidation && err != nil {
+				t.Error(fmt.Sprintf("%s: Error was not expected but received - %v", testCase.label, err))
+			}
+			if testCase.expectValidation && (!isValidationErr || !strings.Contains(err.Error(), testCase.expectedMessage)) {
+				t.Error(fmt.Sprintf("%s: Validation error containing %s was expected but received - %v", testCase.label, testCase.expectedMessage, err))
+			}
+		})
+	}
+}
+
+func Test_QueryValidator_Validate_InfluxError(t *testing.T) {
+	sut := &QueryValidator{influx: &FakeSchemaInfluxdb{err: errors.New("connection refused")}}
+	err := sut.Validate(getQueryForValidation())
+	if _, ok := err.(*QueryValidationError); ok || err == nil {
+		t.Error(fmt.Sprintf("A plain error was expected but received - %v", err))
+	}
+}
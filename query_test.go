@@ -20,6 +20,7 @@ type FakeQueryAssertData struct {
 	dsList         []DownsamplingObject
 	objectToExpect DownsamplingObject
 	errorToExpect  error
+	keepsExpired   bool
 }
 
 type MockDb struct {
@@ -58,6 +59,10 @@ func (d *MockDb) DeleteDownsamplingItem(queryId string) error {
 	return nil
 }
 
+func (d *MockDb) KeepsExpiredItems() bool {
+	return d.FakeQueryAssertData.keepsExpired
+}
+
 func (d *MockDb) GetDownsamplingItem(queryId string) (DownsamplingObject, error) {
 	return d.FakeQueryAssertData.dsList[0], nil
 }
@@ -87,7 +92,7 @@ func Test_DownsamplingItemHandler_GetNextPendingDownsamplingItem(t *testing.T) {
 
 func Test_DownsamplingItemHandler_DeployDownsamplingPendingSimulationItem(t *testing.T) {
 	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PREVIEW_PENDING"}}, objectToExpect: DownsamplingObject{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED"}})
-	err := tc.DownsamplingItemHandler.DeployDownsamplingPendingSimulationItem("query1")
+	err := tc.DownsamplingItemHandler.DeployDownsamplingPendingSimulationItem("query1", "http://influxdb", "http://grafana", &PreviewCredentials{SecretName: "downsamplr-preview-query1"}, "default", "2030-01-01T00:00:00Z")
 	if err != nil {
 		t.Error(fmt.Sprintf("Error wasn't expected here - %v", err))
 	}
@@ -95,7 +100,7 @@ func Test_DownsamplingItemHandler_DeployDownsamplingPendingSimulationItem(t *tes
 
 func Test_DownsamplingItemHandler_DeployDownsamplingPendingSimulationItem_Deployed(t *testing.T) {
 	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED"}}, errorToExpect: errors.New("No update should have happened")})
-	err := tc.DownsamplingItemHandler.DeployDownsamplingPendingSimulationItem("query1")
+	err := tc.DownsamplingItemHandler.DeployDownsamplingPendingSimulationItem("query1", "http://influxdb", "http://grafana", &PreviewCredentials{SecretName: "downsamplr-preview-query1"}, "default", "2030-01-01T00:00:00Z")
 	if err != nil {
 		t.Error(fmt.Sprintf("Error wasn't expected here - %v", err))
 	}
@@ -103,7 +108,7 @@ func Test_DownsamplingItemHandler_DeployDownsamplingPendingSimulationItem_Deploy
 
 func Test_DownsamplingItemHandler_DeployDownsamplingPendingSimulationItem_NotFound(t *testing.T) {
 	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "", CreatedAt: "2017-12-08T21:00:00Z", QueryState: "PREVIEW_DEPLOYED"}}, errorToExpect: errors.New("No update should have happened")})
-	err := tc.DownsamplingItemHandler.DeployDownsamplingPendingSimulationItem("query1")
+	err := tc.DownsamplingItemHandler.DeployDownsamplingPendingSimulationItem("query1", "http://influxdb", "http://grafana", &PreviewCredentials{SecretName: "downsamplr-preview-query1"}, "default", "2030-01-01T00:00:00Z")
 	if err != nil {
 		t.Error(fmt.Sprintf("Error wasn't expected here - %v", err))
 	}
@@ -136,11 +141,62 @@ func Test_DownsamplingItemHandler_DeployDownsamplingItem_NotFound(t *testing.T)
 
 func Test_DownsamplingItemHandler_HandleExpiredSimulations(t *testing.T) {
 	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", PreviewExpiresAt: time.Now().Add(-1 * time.Minute).Format(time.RFC3339), QueryState: "PREVIEW_DEPLOYED"}, DownsamplingObject{QueryId: "query2", PreviewExpiresAt: time.Now().Add(1 * time.Minute).Format(time.RFC3339), QueryState: "PREVIEW_DEPLOYED"}}})
-	count, err := tc.DownsamplingItemHandler.HandleExpiredSimulations()
+	expired, kept, err := tc.DownsamplingItemHandler.HandleExpiredSimulations()
 	if err != nil {
 		t.Error(fmt.Sprintf("Error wasn't expected here - %v", err))
 	}
-	if count != 1 {
+	if len(expired) != 1 || expired[0].QueryId != "query1" || len(kept) != 0 {
 		t.Error(fmt.Sprintf("Only one expired query was expected."))
 	}
 }
+
+func Test_DownsamplingItemHandler_HandleExpiredSimulations_KeepsExpired(t *testing.T) {
+	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", PreviewExpiresAt: time.Now().Add(-1 * time.Minute).Format(time.RFC3339), QueryState: "PREVIEW_DEPLOYED"}}, keepsExpired: true})
+	deleted, kept, err := tc.DownsamplingItemHandler.HandleExpiredSimulations()
+	if err != nil {
+		t.Error(fmt.Sprintf("Error wasn't expected here - %v", err))
+	}
+	if len(deleted) != 0 || len(kept) != 1 || kept[0].QueryId != "query1" {
+		t.Error(fmt.Sprintf("The expired query was expected to be kept, found deleted %v and kept %v", deleted, kept))
+	}
+	updated := tc.DownsamplingItemHandler.db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "PREVIEW_EXPIRED" {
+		t.Error(fmt.Sprintf("The kept query was expected to be PREVIEW_EXPIRED, found %s", updated.QueryState))
+	}
+}
+
+func Test_DownsamplingItemHandler_FailDownsamplingItem(t *testing.T) {
+	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PENDING"}}})
+	err := tc.DownsamplingItemHandler.FailDownsamplingItem(DownsamplingObject{QueryId: "query1"}, "tag scenario not found")
+	if err != nil {
+		t.Error(fmt.Sprintf("Error wasn't expected here - %v", err))
+	}
+	updated := tc.DownsamplingItemHandler.db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.QueryState != "FAILED" || updated.StateMessage != "tag scenario not found" {
+		t.Error(fmt.Sprintf("Query was expected to be FAILED with a message, found %s: %s", updated.QueryState, updated.StateMessage))
+	}
+}
+
+func Test_DownsamplingItemHandler_GetPreviewItemsDueForReport(t *testing.T) {
+	due := DownsamplingObject{QueryId: "query1", QueryState: "PREVIEW_DEPLOYED", PreviewInfluxdbUrl: "http://influxdb", PreviewDeployedAt: time.Now().Add(-90 * time.Minute).Format(time.RFC3339)}
+	recent := DownsamplingObject{QueryId: "query2", QueryState: "PREVIEW_DEPLOYED", PreviewInfluxdbUrl: "http://influxdb", PreviewDeployedAt: time.Now().Add(-30 * time.Minute).Format(time.RFC3339)}
+	reported := DownsamplingObject{QueryId: "query3", QueryState: "PREVIEW_DEPLOYED", PreviewInfluxdbUrl: "http://influxdb", PreviewDeployedAt: due.PreviewDeployedAt, PreviewReport: &PreviewReport{}}
+	legacy := DownsamplingObject{QueryId: "query4", QueryState: "PREVIEW_DEPLOYED"}
+	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ReportAfterMinute: 60}, FakeQueryAssertData{dsList: []DownsamplingObject{due, recent, reported, legacy}})
+	dsList, err := tc.DownsamplingItemHandler.GetPreviewItemsDueForReport()
+	if err != nil {
+		t.Error(fmt.Sprintf("Error wasn't expected here - %v", err))
+	}
+	if len(dsList) != 1 || dsList[0].QueryId != "query1" {
+		t.Error(fmt.Sprintf("Only query1 was expected to be due, found %v", dsList))
+	}
+}
+
+func Test_DownsamplingItemHandler_DeployDownsamplingPendingSimulationItem_SavesUrls(t *testing.T) {
+	tc := NewDownsamplingItemHandlerTestSuite(&Config{MetricsConfig: &MetricsConfig{}, ExpireAfterMinute: 45}, FakeQueryAssertData{dsList: []DownsamplingObject{DownsamplingObject{QueryId: "query1", QueryState: "PREVIEW_PENDING"}}})
+	tc.DownsamplingItemHandler.DeployDownsamplingPendingSimulationItem("query1", "http://influxdb", "http://grafana", &PreviewCredentials{SecretName: "downsamplr-preview-query1"}, "default", "2030-01-01T00:00:00Z")
+	updated := tc.DownsamplingItemHandler.db.(*MockDb).FakeQueryAssertData.objectToExpect
+	if updated.PreviewInfluxdbUrl != "http://influxdb" || updated.PreviewGrafanaUrl != "http://grafana" || updated.PreviewDeployedAt == "" || updated.PreviewCredentials == nil || updated.DashboardTemplate != "default" {
+		t.Error(fmt.Sprintf("Preview urls, credentials, dashboard template and deploy time were expected to be saved, found %v", updated))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+type TargetProvisionerInterface interface {
+	ProvisionTarget(query DownsamplingObject) error
+	PurgeTarget(query DownsamplingObject) error
+}
+
+func NewTargetProvisioner(config *Config) (TargetProvisionerInterface, error) {
+	provisioner := &TargetProvisioner{retention: config.TargetRetention, config: config}
+	if config.TargetInfluxdb != nil && config.TargetInfluxdb.Url != "" {
+		influx, err := NewInfluxdb(config.TargetInfluxdb.Url, config.TargetInfluxdb.Username, config.TargetInfluxdb.Password, config.ReadyTimeout())
+		if err != nil {
+			return nil, err
+		}
+		provisioner.influx = influx
+	}
+	if config.TargetInfluxdbV2 != nil && config.TargetInfluxdbV2.Url != "" {
+		influxV2, err := NewInfluxdbV2(config.TargetInfluxdbV2.Url, config.TargetInfluxdbV2.Token, config.TargetInfluxdbV2.Org, config.ReadyTimeout())
+		if err != nil {
+			return nil, err
+		}
+		provisioner.influxV2 = influxV2
+	}
+
+	if provisioner.influx == nil && provisioner.influxV2 == nil {
+		log.Println("No target InfluxDB configured, retention policies will not be provisioned.")
+		return &NoopTargetProvisioner{}, nil
+	}
+	return provisioner, nil
+}
+
+type NoopTargetProvisioner struct {
+}
+
+func (p *NoopTargetProvisioner) ProvisionTarget(query DownsamplingObject) error {
+	return nil
+}
+
+func (p *NoopTargetProvisioner) PurgeTarget(query DownsamplingObject) error {
+	return nil
+}
+
+type TargetProvisioner struct {
+	influx    InfluxdbAdminInterface
+	influxV2  InfluxdbAdminInterface
+	retention *RetentionConfig
+	config    *Config
+}
+
+// adminFor returns the InfluxDB db lives on, nil when that version is not configured.
+func (p *TargetProvisioner) adminFor(db string) InfluxdbAdminInterface {
+	if p.config.IsInfluxdbV2(db) {
+		return p.influxV2
+	}
+	return p.influx
+}
+
+// ProvisionTarget makes sure the target retention policy exists with the query's durations, falling back to the configured defaults.
+// The measurement itself is created by the first point the Flink job writes.
+func (p *TargetProvisioner) ProvisionTarget(query DownsamplingObject) error {
+	duration, shardDuration := query.TargetRpDuration, query.TargetRpShardDuration
+	if p.retention != nil {
+		if duration == "" {
+			duration = p.retention.Duration
+		}
+		if shardDuration == "" {
+			shardDuration = p.retention.ShardDuration
+		}
+	}
+	if duration == "" {
+		duration = "INF"
+	}
+
+	influx := p.adminFor(query.Db)
+	if influx == nil {
+		log.Printf("No target InfluxDB configured for %s, skipping provisioning.", query.Db)
+		return nil
+	}
+
+	log.Printf("Provisioning retention policy %s on %s with duration %s...", query.TargetRp, query.Db, duration)
+	return influx.EnsureRetentionPolicy(query.Db, query.TargetRp, duration, shardDuration)
+}
+
+// PurgeTarget drops the downsampled series when purging is enabled globally or on the query, the retention policy is kept.
+// DROP SERIES is not scoped to a retention policy, so a target measurement sharing the source name is never purged.
+func (p *TargetProvisioner) PurgeTarget(query DownsamplingObject) error {
+	if !query.PurgeOnDelete && (p.retention == nil || !p.retention.PurgeOnDelete) {
+		log.Printf("Keeping downsampled data in %s.%s.%s", query.Db, query.TargetRp, query.TargetMeasurement)
+		return nil
+	}
+	if query.TargetMeasurement == query.Measurement {
+		log.Printf("Target measurement %s is also the source measurement, not purging.", query.TargetMeasurement)
+		return nil
+	}
+
+	influx := p.adminFor(query.Db)
+	if influx == nil {
+		log.Printf("No target InfluxDB configured for %s, skipping purge.", query.Db)
+		return nil
+	}
+
+	log.Printf("Purging downsampled data in %s.%s.%s...", query.Db, query.TargetRp, query.TargetMeasurement)
+	return influx.DropSeries(query.Db, query.TargetRp, query.TargetMeasurement)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_TargetProvisioner_ProvisionTarget(t *testing.T) {
+	influx := &FakeSchemaInfluxdb{}
+	provisioner := &TargetProvisioner{influx: influx, retention: &RetentionConfig{Duration: "INF", ShardDuration: "1w"}}
+
+	err := provisioner.ProvisionTarget(DownsamplingObject{Db: "sca", TargetRp: "downsampled"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Was not expecting error but received %v", err))
+	}
+	err = provisioner.ProvisionTarget(DownsamplingObject{Db: "sca", TargetRp: "monthly", TargetRpDuration: "30d"})
+	if err != nil {
+		t.Error(fmt.Sprintf("Was not expecting error but received %v", err))
+	}
+
+	expected := []string{"sca.downsampled INF 1w", "sca.monthly 30d 1w"}
+	if fmt.Sprint(influx.retentionPolicies) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Retention policies were expected %v found %v", expected, influx.retentionPolicies))
+	}
+}
+
+func Test_TargetProvisioner_PurgeTarget(t *testing.T) {
+	influx := &FakeSchemaInfluxdb{}
+	provisioner := &TargetProvisioner{influx: influx, retention: &RetentionConfig{PurgeOnDelete: false}}
+
+	provisioner.PurgeTarget(DownsamplingObject{Db: "sca", Measurement: "request_count", TargetMeasurement: "request_count_1m"})
+	if len(influx.droppedSeries) != 0 {
+		t.Error(fmt.Sprintf("Was not expecting a purge but found %v", influx.droppedSeries))
+	}
+
+	provisioner.PurgeTarget(DownsamplingObject{Db: "sca", Measurement: "request_count", TargetMeasurement: "request_count", PurgeOnDelete: true})
+	if len(influx.droppedSeries) != 0 {
+		t.Error(fmt.Sprintf("Was not expecting the source measurement to be purged but found %v", influx.droppedSeries))
+	}
+
+	provisioner.PurgeTarget(DownsamplingObject{Db: "sca", Measurement: "request_count", TargetMeasurement: "request_count_1m", PurgeOnDelete: true})
+	if len(influx.droppedSeries) != 1 || influx.droppedSeries[0] != "sca.request_count_1m" {
+		t.Error(fmt.Sprintf("Was expecting sca.request_count_1m to be purged but found %v", influx.droppedSeries))
+	}
+}
+
+func Test_TargetProvisioner_InfluxdbV2(t *testing.T) {
+	influx, influxV2 := &FakeSchemaInfluxdb{}, &FakeInfluxdbV2{}
+	config := &Config{TargetInfluxdbV2: &InfluxdbV2Config{Databases: []string{"sca"}}}
+	provisioner := &TargetProvisioner{influx: influx, influxV2: influxV2, retention: &RetentionConfig{Duration: "INF"}, config: config}
+
+	provisioner.ProvisionTarget(DownsamplingObject{Db: "sca", TargetRp: "downsampled"})
+	provisioner.ProvisionTarget(DownsamplingObject{Db: "omni", TargetRp: "downsampled"})
+	if fmt.Sprint(influxV2.retentionPolicies) != "[sca.downsampled INF ]" || fmt.Sprint(influx.retentionPolicies) != "[omni.downsampled INF ]" {
+		t.Error(fmt.Sprintf("Each database was expected on its own InfluxDB, found v2 %v v1 %v", influxV2.retentionPolicies, influx.retentionPolicies))
+	}
+
+	provisioner.influxV2 = nil
+	err := provisioner.ProvisionTarget(DownsamplingObject{Db: "sca", TargetRp: "monthly"})
+	if err != nil || len(influx.retentionPolicies) != 1 {
+		t.Error(fmt.Sprintf("Provisioning was expected to be skipped without InfluxDB 2.x, found %v (%v)", influx.retentionPolicies, err))
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import "fmt"
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -12,14 +13,15 @@ type TemplateParserTestSuite struct {
 }
 
 func NewTemplateParserTestSuite() *TemplateParserTestSuite {
-	filler := &DashboardTemplateFiller{"db-test123", "tm-test123", "tag-test123", "field-test123"}
+	filler := &DashboardTemplateFiller{Database: "db-test123", Datasource: "db-test123", DatasourceUid: "db-test123", Title: "Downsample Preview", Measurement: "m-test123", TargetMeasurement: "tm-test123", Policy: PREVIEW_RP, Tags: []string{"tag-test123"},
+		Fields: []DashboardField{{PanelId: 1, Alias: "field-test123", Field: "f-test123", Function: "sum"}}}
 
 	return &TemplateParserTestSuite{TemplateParser{}, *filler}
 }
 
 func Test_TemplateParser_LoadTemplate(t *testing.T) {
 	tc := NewTemplateParserTestSuite()
-	str, err := tc.TemplateParser.LoadTemplate("templates/dashboard.json", tc.Filler)
+	str, err := tc.TemplateParser.LoadTemplate(DASHBOARD_TEMPLATES_DIR+"/default.json", tc.Filler)
 	if err != nil {
 		t.Error(fmt.Sprintf("Error wasn't expected but received. %v", err))
 	}
@@ -27,3 +29,88 @@ func Test_TemplateParser_LoadTemplate(t *testing.T) {
 		t.Error(fmt.Sprintf("Expected filling values are not present in the parser output"))
 	}
 }
+
+type DashboardTemplateTestSuite struct {
+	label             string
+	tags              []string
+	rawPolicy         string
+	expectedVariables int
+	expectedTargets   int
+}
+
+var DashboardTemplateTestCases = []DashboardTemplateTestSuite{
+	{"Tags with raw data", []string{"app_name", "scenario"}, PREVIEW_RAW_RP, 2, 2},
+	{"Tags without raw data", []string{"app_name", "scenario"}, "", 2, 1},
+	{"No tags", nil, PREVIEW_RAW_RP, 0, 2},
+}
+
+// Dashboard is the part of the rendered dashboard the tests look at.
+type Dashboard struct {
+	Dashboard struct {
+		SchemaVersion int `json:"schemaVersion"`
+		Rows          []struct {
+			Panels []struct {
+				Id         int `json:"id"`
+				Datasource struct {
+					Type string `json:"type"`
+					Uid  string `json:"uid"`
+				} `json:"datasource"`
+				Targets []struct {
+					Policy  string `json:"policy"`
+					GroupBy []struct {
+						Params []string `json:"params"`
+					} `json:"groupBy"`
+				} `json:"targets"`
+			} `json:"panels"`
+		} `json:"rows"`
+		Templating struct {
+			List []struct {
+				Name  string `json:"name"`
+				Query string `json:"query"`
+			} `json:"list"`
+		} `json:"templating"`
+	} `json:"dashboard"`
+}
+
+// Test_TemplateParser_LoadTemplate_Dashboard renders every template of the registry.
+func Test_TemplateParser_LoadTemplate_Dashboard(t *testing.T) {
+	for _, template := range NewDashboardRegistryForTest().templates {
+		for _, testCase := range DashboardTemplateTestCases {
+			label := template.Name + " - " + testCase.label
+			t.Run(label, func(t *testing.T) {
+				query := getQueryForValidation()
+				query.TargetMeasurement, query.Tags = "request_count_1m", testCase.tags
+				str, err := NewTemplateParser().LoadTemplate(template.Path, NewDashboardTemplateFiller(query, "sca", PREVIEW_RP, testCase.rawPolicy))
+
+				var dashboard Dashboard
+				if err == nil {
+					err = json.Unmarshal([]byte(str), &dashboard)
+				}
+				if err != nil {
+					t.Error(fmt.Sprintf("%s: a valid dashboard was expected but received %v\n%s", label, err, str))
+					return
+				}
+
+				panels := dashboard.Dashboard.Rows[0].Panels
+				if len(panels) != 2 || panels[1].Id != 2 {
+					t.Error(fmt.Sprintf("%s: a panel per field was expected, found %v", label, panels))
+				}
+				if dashboard.Dashboard.SchemaVersion != 14 {
+					t.Error(fmt.Sprintf("%s: the schema version of the rows layout was expected, found %d", label, dashboard.Dashboard.SchemaVersion))
+				}
+				for _, panel := range panels {
+					if panel.Datasource.Type != "influxdb" || panel.Datasource.Uid != "sca" {
+						t.Error(fmt.Sprintf("%s: the datasource was expected to be referred by uid, found %v", label, panel.Datasource))
+					}
+					if len(panel.Targets) != testCase.expectedTargets || panel.Targets[0].Policy != PREVIEW_RP || len(panel.Targets[0].GroupBy) != len(testCase.tags)+2 {
+						t.Error(fmt.Sprintf("%s: %d targets grouped by every tag were expected, found %v", label, testCase.expectedTargets, panel.Targets))
+					}
+				}
+				variables := dashboard.Dashboard.Templating.List
+				if len(variables) != testCase.expectedVariables || (len(variables) > 0 && variables[0].Query != "SHOW TAG VALUES FROM \"downsample\".\"request_count_1m\" WITH KEY = \"app_name\"") {
+					t.Error(fmt.Sprintf("%s: a variable per tag was expected, found %v", label, variables))
+				}
+			})
+		}
+	}
+}
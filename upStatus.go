@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var upStatusInterval = 5 * time.Second
+
+// NotUpError tells InfluxDB or Grafana did not answer in time, Err is the last error of its up check.
+type NotUpError struct {
+	Name    string
+	Url     string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *NotUpError) Error() string {
+	return fmt.Sprintf("%s at %s is not up after %v: %v", e.Name, e.Url, e.Timeout, e.Err)
+}
+
+// waitUntilUp retries check every upStatusInterval until it passes, giving up with a NotUpError after timeout.
+// The clients are given Config.ReadyTimeout.
+func waitUntilUp(name string, url string, timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		log.Printf("Checking if %s is up at %s", name, url)
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(upStatusInterval).After(deadline) {
+			return &NotUpError{Name: name, Url: url, Timeout: timeout, Err: err}
+		}
+		log.Printf("Got %v, retrying after %v...", err, upStatusInterval)
+		time.Sleep(upStatusInterval)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_WaitUntilUp(t *testing.T) {
+	defer func(interval time.Duration) {
+		upStatusInterval = interval
+	}(upStatusInterval)
+	upStatusInterval = 10 * time.Millisecond
+
+	calls := 0
+	err := waitUntilUp("InfluxDB", "http://localhost", 50*time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Error(fmt.Sprintf("Up on the third call was expected, received %v after %d calls", err, calls))
+	}
+
+	err = waitUntilUp("InfluxDB", "http://localhost", 50*time.Millisecond, func() error {
+		return errors.New("connection refused")
+	})
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Error(fmt.Sprintf("A timeout with the last error was expected, received %v", err))
+	}
+}